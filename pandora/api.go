@@ -29,6 +29,8 @@ import (
 	"io"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -58,6 +60,22 @@ const (
 	// ErrNilBody the body passed is nil
 	ErrNilBody = ApiError("body is nil")
 
+	// ErrPayloadTooBig the payload is larger than MaxPayloadSize
+	ErrPayloadTooBig = ApiError("payload is too big")
+
+	// MaxPayloadSize define the max size of the opaque payload of a message
+	MaxPayloadSize = 1 << 20
+
+	// Body field used to store the content type of the payload
+	KeyContentType = "contentType"
+
+	// Key used by form requests and responses to send the payload,
+	// encoded as base64
+	KeyPayload = "payload"
+
+	// DefaultContentType is used when a payload is sent without a content type
+	DefaultContentType = "application/octet-stream"
+
 	// ErrInvalidHeaderEncoding means that a mailbox (sender or receiver) is invalid
 	ErrInvalidMailBox = ApiError("invalid mailbox")
 
@@ -73,6 +91,32 @@ const (
 	// No messages that match the criteria at this moment
 	ErrNoMessages = ApiError("no messages at this moment")
 
+	// The lock id isn't valid or the lease already expired
+	ErrInvalidLease = ApiError("invalid or expired lease")
+
+	// A message with the same mid is already stored
+	ErrDuplicateMessage = ApiError("duplicate message")
+
+	// The batch has more than MaxBatchSize items
+	ErrBatchTooLarge = ApiError("batch is too large")
+
+	// The topic name is empty or the inbox can't subscribe to topics
+	ErrInvalidTopic = ApiError("invalid topic")
+
+	// The key wasn't found on the store
+	ErrKeyNotFound = ApiError("key not found")
+
+	// TopicPrefix is used to send a message to all subscribers of a topic,
+	// ie, sending a message to "topic:news" will deliver one copy to each
+	// inbox subscribed to "news".
+	TopicPrefix = "topic:"
+
+	// Key used to inform the topic name
+	KeyTopic = "topic"
+
+	// MaxBatchSize is the max number of items processed by a batch operation
+	MaxBatchSize = 500
+
 	// Body field used to store the sender
 	KeySender = "sender"
 
@@ -86,9 +130,99 @@ const (
 	// want to keep the message locked
 	KeyLeaseTime = "leaseTime"
 
+	// Key used to inform the max number of deliveries of a inbox
+	KeyMaxDelivery = "maxDelivery"
+
+	// Key used to inform the priority of a message, messages with
+	// higher priority are delivered first
+	KeyPriority = "priority"
+
+	// Key used to inform the group of a message, inside a fifo inbox
+	// only one message of each group can be leased at any given time
+	KeyGroup = "group"
+
+	// Key used to enable the strict fifo mode of a inbox
+	KeyFifo = "fifo"
+
+	// Key used by the client to identify a message, sending a message
+	// with the same key to the same receiver inside the dedup window
+	// returns the mid of the first message instead of sending it again
+	KeyDedupKey = "dedupKey"
+
+	// DefaultDedupWindow is 5 minutes
+	DefaultDedupWindow = time.Minute * 5
+
+	// Key used to inform for how long a message can be delivered,
+	// counting from the time it was received by the server
+	KeyTTL = "ttl"
+
+	// Key used to inform when a message expires, a message that
+	// isn't delivered until then is never delivered
+	KeyExpiresAt = "expiresAt"
+
+	// Key used to drop the expired messages of a inbox instead of
+	// moving them to the dead inbox
+	KeyDropExpired = "dropExpired"
+
+	// ExpireInterval is how often pandorad removes the expired messages
+	ExpireInterval = time.Second * 30
+
+	// Body field used to inform the inbox that should receive the reply of a message
+	KeyReplyTo = "replyTo"
+
+	// Body field used to match a reply with its request
+	KeyCorrelationId = "correlationId"
+
+	// ReplyInboxPrefix is used by the name of the ephemeral inboxes that receive replies,
+	// those inboxes are removed after ReplyInboxTTL
+	ReplyInboxPrefix = "reply."
+
+	// DefaultReplyInboxTTL is 1 hour
+	DefaultReplyInboxTTL = time.Hour
+
+	// ReplyPurgeInterval is how often pandorad removes the expired reply inboxes
+	ReplyPurgeInterval = time.Minute
+
+	// DeadInboxSuffix is appended to the name of a inbox to build the
+	// name of the inbox that receives the messages that exceeded the
+	// max delivery count
+	DeadInboxSuffix = ".dead"
+
+	// Key used by the client to inform how many messages
+	// it want to fetch at once
+	KeyMax = "max"
+
+	// Key used by the client to ask for a new lock id when
+	// extending a lease
+	KeyRotate = "rotate"
+
+	// Key used by the client to inform for how long it
+	// want to wait for a message when the inbox is empty
+	KeyWait = "wait"
+
 	// DefaultLeaseTime is 5 minutes
 
 	DefaultLeaseTime = time.Minute * 5
+
+	// MaxWaitTime is the longest time a client can wait for a message
+	MaxWaitTime = time.Minute * 2
+
+	// Key used to ask for a report of the blobs that would be collected,
+	// without removing them
+	KeyDryRun = "dryRun"
+
+	// GCBatchSize is the default number of blobs removed by a single collection
+	GCBatchSize = 100
+
+	// GCGracePeriod is how long a unreferenced blob is kept before
+	// being collected. This prevents the collector from removing a blob that
+	// was just written but isn't referenced by its message yet.
+	GCGracePeriod = time.Minute * 5
+
+	// WaitRecheckTime is how often a waiting fetch checks the MessageStore
+	// even if no notification was received. This allow delayed messages and
+	// expired leases to be delivered to waiting clients.
+	WaitRecheckTime = time.Second * 10
 )
 
 // KeyPrinter is used to print any key to a human readable format,
@@ -212,6 +346,22 @@ type BlobStore interface {
 	// delta can be positive or negative. If the ref-count becomes 0
 	// or less, then the key SHOULD BE collected.
 	UpdateRefCount(key Key, delta int) error
+
+	// UnreferencedKeys return at most max keys with a ref-count of 0 or less,
+	// that didn't change after olderThan.
+	UnreferencedKeys(max int, olderThan time.Time) ([]Key, error)
+
+	// DeleteData remove the data of keys, keys that are referenced
+	// again or changed after olderThan are ignored.
+	//
+	// Returns the number of keys removed
+	DeleteData(keys []Key, olderThan time.Time) (int, error)
+
+	// Usage return how many blobs are saved and their total size
+	Usage() (BlobUsage, error)
+
+	// Ping check if the store is available
+	Ping() error
 }
 
 // Message is the header used to index the message
@@ -219,6 +369,9 @@ type Message struct {
 	// Mid is the id of the message, calculated based on the
 	// body of the message
 	Mid Key
+	// Bid is the key of the body inside the BlobStore,
+	// when nil Mid is used. Messages sent to a topic share the same Bid.
+	Bid Key
 	// Lid is the id of the current associated lock
 	Lid Key
 	// Status holds the ack status of this message
@@ -238,8 +391,28 @@ type Message struct {
 	// Only one client can access the message at any given time, but when the client crashes
 	// or don't complete the message, then another client might access the message.
 	DeliveryCount int
-	// Body is a list of urlencoded data
+	// Reason holds why the message was moved to a dead inbox
+	Reason string
+	// Priority of the message, messages with higher priority are delivered first.
+	// Messages with the same priority are delivered by SendWhen
+	Priority int
+	// Group is used by fifo inboxes, a message is delivered only after all
+	// earlier messages of the same group were confirmed or moved to the dead inbox.
+	Group string
+	// DedupKey is informed by the client to avoid sending the same message twice,
+	// it is also used to calculate the Mid.
+	DedupKey string
+	// DedupUntil holds until when DedupKey is considered by the server
+	DedupUntil time.Time
+	// ExpiresAt holds when the message expires, expired messages aren't delivered
+	// and are moved to the dead inbox or dropped. A zero value never expires.
+	ExpiresAt time.Time
+	// Body is a list of urlencoded data, used to store the routing headers
+	// and the contents of messages without a payload
 	Body url.Values
+	// Payload is the opaque body of the message, the content type is
+	// available from ContentType.
+	Payload []byte
 
 	invalidBody bool
 }
@@ -285,6 +458,17 @@ func (m *Message) ClientTime() time.Time {
 	return t
 }
 
+// ContentType return the content type of the payload
+func (m *Message) ContentType() string {
+	m.ensureBody()
+	return m.Body.Get(KeyContentType)
+}
+
+func (m *Message) SetContentType(ct string) {
+	m.ensureBody()
+	m.Body.Set(KeyContentType, ct)
+}
+
 func (m *Message) Set(key, value string) {
 	m.ensureBody()
 	m.Body.Set(key, value)
@@ -299,6 +483,10 @@ func (m *Message) CalcualteLeaseFor(now time.Time, lease time.Duration) {
 	var kw SHA1KeyWriter
 	m.LeasedUntil = now.Add(lease)
 	io.WriteString(&kw, m.LeasedUntil.Format(time.RFC3339Nano))
+	if m.Mid != nil {
+		// messages locked at the same time must have different lids
+		kw.Write(m.Mid.Bytes())
+	}
 	m.Lid = kw.Key()
 }
 
@@ -313,6 +501,23 @@ func (m *Message) WriteTo(out url.Values) {
 	out.Set("deliveryCount", strconv.FormatInt(int64(m.DeliveryCount), 10))
 	out.Set("sendWhen", m.SendWhen.Format(time.RFC3339Nano))
 	out.Set("validBody", fmt.Sprintf("%v", m.ValidBody()))
+	if len(m.Reason) > 0 {
+		out.Set("reason", m.Reason)
+	}
+	if m.Priority != 0 {
+		out.Set(KeyPriority, strconv.Itoa(m.Priority))
+	}
+	if len(m.Group) > 0 {
+		out.Set(KeyGroup, m.Group)
+	}
+	if !m.ExpiresAt.IsZero() {
+		out.Set(KeyExpiresAt, m.ExpiresAt.Format(time.RFC3339Nano))
+	}
+}
+
+// Expired check if the message expired at now
+func (m *Message) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !m.ExpiresAt.After(now)
 }
 
 // Empty will clean all fields of this message and mark the message as
@@ -332,13 +537,58 @@ func (m *Message) Empty(body url.Values) *Message {
 	m.Lid = nil
 	m.Status = StatusNotDelivered
 	m.LeasedUntil = time.Time{}
+	m.Reason = ""
+	m.Priority = 0
+	m.Group = ""
+	m.DedupKey = ""
+	m.DedupUntil = time.Time{}
+	m.ExpiresAt = time.Time{}
+	m.Payload = nil
 	return m
 }
 
+// BodyKey return the key used to store the body in the BlobStore
+func (m *Message) BodyKey() Key {
+	if m.Bid != nil {
+		return m.Bid
+	}
+	return m.Mid
+}
+
+// EncodeBlob return the data saved in the BlobStore, ie, the urlencoded Body
+// followed by a new line and the Payload. The new line is omitted if there is no payload.
+func (m *Message) EncodeBlob() []byte {
+	buf := bytes.Buffer{}
+	io.WriteString(&buf, m.Body.Encode())
+	if m.Payload != nil {
+		// urlencoded data never holds a new line
+		buf.WriteByte('\n')
+		buf.Write(m.Payload)
+	}
+	return buf.Bytes()
+}
+
+// DecodeBlob read the Body and the Payload from data, see EncodeBlob
+func (m *Message) DecodeBlob(data []byte) error {
+	m.Payload = nil
+	if idx := bytes.IndexByte(data, '\n'); idx >= 0 {
+		m.Payload = data[idx+1:]
+		data = data[:idx]
+	}
+	var err error
+	m.Body, err = url.ParseQuery(string(data))
+	return err
+}
+
 func (m *Message) CalculateMid() {
 	var kw SHA1KeyWriter
 	buf := bytes.Buffer{}
-	io.WriteString(&buf, m.Body.Encode())
+	buf.Write(m.EncodeBlob())
+	if len(m.DedupKey) > 0 {
+		// identical bodies sent with different keys are different messages
+		io.WriteString(&buf, "\x00")
+		io.WriteString(&buf, m.DedupKey)
+	}
 	kw.Write(buf.Bytes())
 	m.Mid = kw.Key()
 }
@@ -405,6 +655,8 @@ const (
 	StatusTimeout = AckStatus(4)
 	// StatusNotDelivered means that a message is waiting for delivery on the queue
 	StatusNotDelivered = AckStatus(8)
+	// StatusExpired means that a message wasn't delivered before it expired
+	StatusExpired = AckStatus(16)
 )
 
 func (a AckStatus) String() string {
@@ -417,16 +669,26 @@ var (
 		StatusRejected:     "rejected",
 		StatusTimeout:      "timeout",
 		StatusNotDelivered: "notDelivered",
+		StatusExpired:      "expired",
 	}
 )
 
 // MessageStore defines the required interface to allow the system to work
 type MessageStore interface {
-	// Enqueue will put msg in the outputbox of the receiver
+	// Enqueue will put msg in the outputbox of the receiver.
+	//
+	// ErrDuplicateMessage is returned if a message with the same Mid exists. If msg.DedupKey
+	// isn't empty and a message with the same receiver and DedupKey was sent before its DedupUntil,
+	// msg.Mid is changed to the Mid of that message and ErrDuplicateMessage is returned.
+	//
+	// ErrInboxFull is returned if the receiver reached its MaxSize.
 	Enqueue(msg *Message) error
 
 	// FetchAndLockLatest will fetch the next pending queue that is available for delivery, ie,
 	// messages that aren't locked and the SendWhen is less than the current time.
+	// Expired messages are never fetched and paused inboxes return ErrNoMessages.
+	//
+	// If leaseTime is 0, the LeaseTime of the inbox is used.
 	//
 	// This also returns the Lid to be used with the message
 	FetchAndLockLatest(receiver string, leaseTime time.Duration) (*Message, error)
@@ -434,6 +696,37 @@ type MessageStore interface {
 	// Ack will change the status of the given mid message, only if lid is still valid
 	Ack(mid, lid Key, status AckStatus) error
 
+	// BodyKey return the key used to save the body of mid in the BlobStore,
+	// if the message isn't found nil, nil is returned.
+	BodyKey(mid Key) (Key, error)
+
+	// Receiver return the name of the inbox that holds mid, for the copies
+	// of a topic this is the subscriber and not the receiver in the body.
+	// If the message isn't found "", nil is returned.
+	Receiver(mid Key) (string, error)
+
+	// EnqueueBatch works like Enqueue for every message in msgs, inside a single transaction.
+	//
+	// Errors related to a message (invalid mailbox, duplicated mid) are returned in the slice
+	// and the message is skipped. Any other error aborts the whole batch.
+	EnqueueBatch(msgs []*Message) ([]error, error)
+
+	// FetchAndLockBatch works like FetchAndLockLatest but locks up to max messages at once.
+	//
+	// ErrNoMessages is returned if no message is available.
+	FetchAndLockBatch(receiver string, leaseTime time.Duration, max int) ([]*Message, error)
+
+	// AckBatch works like Ack for every item of acks, inside a single transaction.
+	//
+	// Errors related to an item (invalid lid, invalid status) are returned in the slice.
+	// Any other error aborts the whole batch.
+	AckBatch(acks []AckRequest) ([]error, error)
+
+	// ExtendLease keeps the message locked for dur, starting now, only if lid is still valid.
+	//
+	// If rotate is true, a new Lid is returned and the old one becomes invalid.
+	ExtendLease(mid, lid Key, dur time.Duration, rotate bool) (*Message, error)
+
 	// FetchHeaders fetch at least len(out) messages that have the given receiver
 	// and were received after serverTime.
 	//
@@ -441,21 +734,219 @@ type MessageStore interface {
 	FetchHeaders(out []Message, receiver string, serverTime time.Time) (int, error)
 
 	// Reenqueue messages considering now
+	//
+	// Messages that reached the max delivery count of their inbox
+	// are moved to the dead inbox instead.
 	Reenqueue(now time.Time) error
+
+	// ExpireMessages move the messages that expired until now to the dead inbox of their receiver,
+	// or remove them if the receiver drops expired messages. Leased messages aren't touched.
+	//
+	// Returns the number of expired messages and the body key of each message removed
+	ExpireMessages(now time.Time) (int, []Key, error)
+
+	// The Set* methods change the policies of an inbox,
+	// ErrInboxNotFound is returned if the inbox doesn't exist.
+
+	// SetMaxDelivery change how many times a message from inbox can be delivered
+	// before being moved to the dead inbox. A max of 0 means no limit.
+	SetMaxDelivery(inbox string, max int) error
+
+	// SetFifo enable or disable the strict fifo mode of inbox. When enabled,
+	// a message is leased only if it is the oldest pending message of its group.
+	SetFifo(inbox string, fifo bool) error
+
+	// SetDropExpired change what happens with the expired messages of inbox,
+	// if drop is true they are removed, otherwise they are moved to the dead inbox.
+	SetDropExpired(inbox string, drop bool) error
+
+	// SetPaused pause or resume the delivery of the messages of inbox
+	SetPaused(inbox string, paused bool) error
+
+	// SetLeaseTime change the lease used when the client doesn't inform one,
+	// a lease of 0 means DefaultLeaseTime.
+	SetLeaseTime(inbox string, lease time.Duration) error
+
+	// SetMaxSize change the max number of pending messages of inbox, a max of 0 means no limit.
+	SetMaxSize(inbox string, max int) error
+
+	// Inboxes return the policies of every inbox ordered by name, dead inboxes aren't returned.
+	// Inbox.Stats isn't filled.
+	Inboxes() ([]Inbox, error)
+
+	// PurgeMessages remove every pending message of inbox, ErrInboxNotFound is returned
+	// if the inbox doesn't exist.
+	//
+	// Returns the body key of each message removed
+	PurgeMessages(inbox string) ([]Key, error)
+
+	// DeleteInbox remove inbox and its dead inbox, with all their messages and subscriptions.
+	// ErrInboxNotFound is returned if the inbox doesn't exist.
+	//
+	// Returns the body key of each message removed
+	DeleteInbox(inbox string) ([]Key, error)
+
+	// FetchDeadLetters fetch at least len(out) messages from the dead inbox
+	// of the given inbox.
+	FetchDeadLetters(out []Message, inbox string) (int, error)
+
+	// ReplayDeadLetters move the messages from the dead inbox back to inbox,
+	// if mid is nil all messages are moved.
+	//
+	// Returns the number of messages moved
+	ReplayDeadLetters(inbox string, mid Key) (int, error)
+
+	// Subscribe register inbox as a subscriber of topic,
+	// subscribing twice has no effect.
+	Subscribe(topic, inbox string) error
+
+	// Unsubscribe remove inbox from the subscribers of topic
+	Unsubscribe(topic, inbox string) error
+
+	// Subscribers return the name of all inboxes subscribed to topic
+	Subscribers(topic string) ([]string, error)
+
+	// PurgeDeadLetters remove the messages from the dead inbox,
+	// if mid is nil all messages are removed.
+	//
+	// Returns the body key of each message removed
+	PurgeDeadLetters(inbox string, mid Key) ([]Key, error)
+
+	// SaveSchedule create or replace the schedule with the same id
+	SaveSchedule(sch *Schedule) error
+
+	// Schedules return all schedules ordered by id
+	Schedules() ([]Schedule, error)
+
+	// DeleteSchedule remove the schedule with the given id,
+	// ErrScheduleNotFound is returned if it doesn't exist
+	DeleteSchedule(id string) error
+
+	// FetchDueSchedules return the schedules with a NextRun until now, and in the same
+	// transaction, advance their NextRun to the run after now. The returned schedules
+	// hold the NextRun that was due, so each run is returned only once.
+	FetchDueSchedules(now time.Time) ([]Schedule, error)
+
+	// PurgeInboxes remove every inbox whose name starts with prefix and that was created
+	// before createdBefore, with all their pending messages and subscriptions.
+	//
+	// Returns the number of inboxes removed and the body key of each message removed
+	PurgeInboxes(prefix string, createdBefore time.Time) (int, []Key, error)
+
+	// InboxStats return the number of messages of every inbox, considering now.
+	// Dead inboxes aren't returned, their messages are counted by the original inbox.
+	InboxStats(now time.Time) ([]InboxStats, error)
+
+	// AppendEvents add the events to the history of their messages, in a single transaction.
+	// The events generated by the store itself (timeout, expired, dead and replayed)
+	// are recorded in the same transaction of the change.
+	AppendEvents(events []Event) error
+
+	// History return the events of mid ordered by At, events with the same At are
+	// returned in the order they were appended
+	History(mid Key) ([]Event, error)
+
+	// Ping check if the store is available
+	Ping() error
+}
+
+// AckRequest holds the information required to change the status of a message
+type AckRequest struct {
+	Mid    Key
+	Lid    Key
+	Status AckStatus
+	// Client is recorded in the history of the message
+	Client string
+}
+
+// Envelope holds the information required to send a message
+type Envelope struct {
+	Sender     string
+	Receiver   string
+	Delay      time.Duration
+	ClientTime time.Time
+	Priority   int
+	Group      string
+	DedupKey   string
+	// TTL and ExpiresAt are optional, when both are informed the
+	// earliest expiration is used
+	TTL       time.Duration
+	ExpiresAt time.Time
+	Body      url.Values
+	// Payload and ContentType are optional, see Message.Payload
+	Payload     []byte
+	ContentType string
+	// Manifest of a payload already saved in chunks, see WritePayload.
+	// When informed Payload is ignored and the manifest is released
+	// once the message is sent.
+	Manifest *Manifest
+	// Client is recorded in the history of the message
+	Client string
+}
+
+// BatchResult holds the result of a single item of a batch operation
+type BatchResult struct {
+	Message *Message
+	Err     error
+}
+
+// GCReport holds the result of a blob collection
+type GCReport struct {
+	// Keys that were collected, or would be collected by a dry-run
+	Keys []Key
+	// Deleted is the number of keys actually removed
+	Deleted int
+	DryRun  bool
+}
+
+// TopicOf return the name of the topic if receiver is a topic (starts with TopicPrefix),
+// otherwise returns an empty string
+func TopicOf(receiver string) string {
+	if strings.HasPrefix(receiver, TopicPrefix) {
+		return receiver[len(TopicPrefix):]
+	}
+	return ""
+}
+
+// DeadInbox return the name of the dead inbox of the given inbox
+func DeadInbox(inbox string) string {
+	return inbox + DeadInboxSuffix
 }
 
 // Server implements the pandora message API
 type Server struct {
 	BlobStore    BlobStore
 	MessageStore MessageStore
+
+	// DedupWindow is how long a DedupKey is remembered,
+	// if 0 DefaultDedupWindow is used
+	DedupWindow time.Duration
+
+	// ReplyInboxTTL is how long a reply inbox is kept,
+	// if 0 DefaultReplyInboxTTL is used
+	ReplyInboxTTL time.Duration
+
+	// Metrics holds the counters updated by this server
+	Metrics Metrics
+
+	waitLock sync.Mutex
+	waiting  map[string]*waiter
+}
+
+// waiter is the channel closed by notify and the number
+// of clients waiting on it
+type waiter struct {
+	ch    chan struct{}
+	count int
 }
 
 // WriteBlob save the body of the message to the blobstore and writes
-// the value back to msg.Mid
+// the key back to msg.Bid
 func (s *Server) WriteBlob(msg *Message) error {
-	buf := &bytes.Buffer{}
-	io.WriteString(buf, msg.Body.Encode())
-	_, err := s.BlobStore.PutData(msg.Mid, buf.Bytes())
+	key, err := s.BlobStore.PutData(msg.Bid, msg.EncodeBlob())
+	if err == nil {
+		msg.Bid = key
+	}
 	return err
 }
 
@@ -466,22 +957,288 @@ func (s *Server) WriteBlob(msg *Message) error {
 //
 // The message body might be changed by the server by adding headers to it
 func (s *Server) Send(sender, receiver string, delay time.Duration, clientTime time.Time, body url.Values) (Message, error) {
+	return s.SendEnvelope(Envelope{
+		Sender:     sender,
+		Receiver:   receiver,
+		Delay:      delay,
+		ClientTime: clientTime,
+		Body:       body,
+	})
+}
+
+// SendEnvelope works like Send but also allow the priority, group and dedup key
+// of the message to be informed.
+//
+// If a message with the same dedup key was sent to the receiver inside the
+// dedup window, no message is sent and the returned message holds the Mid
+// of the first message.
+func (s *Server) SendEnvelope(env Envelope) (Message, error) {
+	defer s.Metrics.SendLatency.ObserveSince(time.Now())
+	// the message holds its own reference to the manifest
+	defer func() { s.ReleasePayload(env.Manifest) }()
 	var msg Message
-	if body == nil {
-		return msg, ErrNilBody
+	if err := checkEnvelope(&env); err != nil {
+		return msg, err
+	}
+	if err := s.chunkPayload(&env); err != nil {
+		return msg, err
+	}
+	s.prepareMessage(&msg, env)
+
+	if topic := TopicOf(env.Receiver); len(topic) > 0 {
+		err := s.publish(&msg, topic, env.Client)
+		return msg, err
+	}
+
+	err := s.doSend(&msg, env.Client)
+	if err == nil {
+		s.Metrics.Sent.Inc()
+		s.notify(env.Receiver)
+	}
+	return msg, err
+}
+
+// publish enqueue one copy of msg for each subscriber of topic, the body is
+// saved only once in the BlobStore and the ref-count is incremented for each copy.
+//
+// After the call msg.Mid and msg.Bid holds the key of the body
+func (s *Server) publish(msg *Message, topic, client string) error {
+	copies, err := s.topicCopies(msg, topic)
+	if err != nil || len(copies) == 0 {
+		return err
+	}
+	errs, err := s.MessageStore.EnqueueBatch(copies)
+	if err != nil {
+		return err
+	}
+	var sent int
+	var events []Event
+	for i, err := range errs {
+		if err == nil {
+			sent++
+			s.notify(copies[i].Receiver())
+			events = append(events, enqueuedEvent(copies[i], client))
+		}
+	}
+	s.record(events...)
+	s.Metrics.Sent.Add(sent)
+	if sent > 0 {
+		return s.retainBlobs(msg, sent)
+	}
+	return nil
+}
+
+// topicCopies save the body of msg and return one copy of it for each
+// subscriber of topic, the copies aren't enqueued.
+//
+// After the call msg.Mid and msg.Bid holds the key of the body
+func (s *Server) topicCopies(msg *Message, topic string) ([]*Message, error) {
+	subscribers, err := s.MessageStore.Subscribers(topic)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.WriteBlob(msg); err != nil {
+		return nil, err
+	}
+	msg.Mid = msg.Bid
+	copies := make([]*Message, len(subscribers))
+	for i, inbox := range subscribers {
+		copies[i] = &Message{
+			Bid:        msg.Bid,
+			ReceivedAt: msg.ReceivedAt,
+			SendWhen:   msg.SendWhen,
+			Priority:   msg.Priority,
+			Group:      msg.Group,
+			DedupKey:   msg.DedupKey,
+			DedupUntil: msg.DedupUntil,
+			ExpiresAt:  msg.ExpiresAt,
+			Payload:    msg.Payload,
+			Body:       make(url.Values),
+		}
+		for k, v := range msg.Body {
+			copies[i].Body[k] = v
+		}
+		// the receiver is changed only to route the message,
+		// the saved body still points to the topic
+		copies[i].SetReceiver(inbox)
+	}
+	return copies, nil
+}
+
+// Subscribe register inbox as a subscriber of topic
+func (s *Server) Subscribe(topic, inbox string) error {
+	if len(topic) == 0 || len(TopicOf(inbox)) > 0 {
+		return ErrInvalidTopic
+	}
+	return s.MessageStore.Subscribe(topic, inbox)
+}
+
+// Unsubscribe remove inbox from the subscribers of topic
+func (s *Server) Unsubscribe(topic, inbox string) error {
+	return s.MessageStore.Unsubscribe(topic, inbox)
+}
+
+// Subscribers return the inboxes subscribed to topic
+func (s *Server) Subscribers(topic string) ([]string, error) {
+	return s.MessageStore.Subscribers(topic)
+}
+
+// SendBatch works like Send for every envelope, the messages are enqueued in a
+// single transaction, including the copies of the messages sent to topics.
+//
+// The error of each message is returned in the result, if the returned error isn't nil,
+// then no message was sent.
+func (s *Server) SendBatch(envs []Envelope) ([]BatchResult, error) {
+	defer s.Metrics.SendLatency.ObserveSince(time.Now())
+	if len(envs) > MaxBatchSize {
+		return nil, ErrBatchTooLarge
 	}
-	msg.Body = body
-	msg.SetSender(sender)
-	msg.SetReceiver(receiver)
+	// the envelopes are copied since chunkPayload changes them,
+	// the messages hold their own references to the manifests
+	envs = append([]Envelope(nil), envs...)
+	defer func() {
+		for _, env := range envs {
+			s.ReleasePayload(env.Manifest)
+		}
+	}()
+	results := make([]BatchResult, len(envs))
+	var msgs []*Message
+	var idx []int
+	// topic copies don't report their own errors, like publish
+	var isCopy []bool
+	for i := range envs {
+		env := &envs[i]
+		if err := checkEnvelope(env); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if err := s.chunkPayload(env); err != nil {
+			results[i].Err = err
+			continue
+		}
+		msg := &Message{}
+		s.prepareMessage(msg, *env)
+		results[i].Message = msg
+		if topic := TopicOf(env.Receiver); len(topic) > 0 {
+			copies, err := s.topicCopies(msg, topic)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			for _, c := range copies {
+				msgs = append(msgs, c)
+				idx = append(idx, i)
+				isCopy = append(isCopy, true)
+			}
+			continue
+		}
+		if err := s.WriteBlob(msg); err != nil {
+			results[i].Err = err
+			continue
+		}
+		msgs = append(msgs, msg)
+		idx = append(idx, i)
+		isCopy = append(isCopy, false)
+	}
+	if len(msgs) == 0 {
+		return results, nil
+	}
+	errs, err := s.MessageStore.EnqueueBatch(msgs)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	var sent []*Message
+	for i, err := range errs {
+		if isRepeated(msgs[i], err) {
+			// the first message was already counted and notified
+			err = nil
+		} else if err == nil {
+			events = append(events, enqueuedEvent(msgs[i], envs[idx[i]].Client))
+			sent = append(sent, msgs[i])
+			err = s.retainBlobs(msgs[i], 1)
+		} else if isCopy[i] {
+			// like publish, a subscriber that didn't get
+			// its copy doesn't fail the message
+			err = nil
+		}
+		if err != nil {
+			results[idx[i]].Err = err
+		}
+	}
+	s.record(events...)
+	for _, msg := range sent {
+		s.Metrics.Sent.Inc()
+		s.notify(msg.Receiver())
+	}
+	return results, nil
+}
+
+// checkEnvelope validate env before anything is saved. The manifest headers
+// are only accepted from env.Manifest, otherwise a client could change the
+// ref-count or read the payload of another message
+func checkEnvelope(env *Envelope) error {
+	if env.Body == nil {
+		return ErrNilBody
+	}
+	if len(env.Payload) > MaxPayloadSize {
+		return ErrPayloadTooBig
+	}
+	if env.Manifest == nil {
+		if _, ok := env.Body[KeyManifest]; ok {
+			return ErrInvalidManifest
+		}
+		if _, ok := env.Body[KeyPayloadSize]; ok {
+			return ErrInvalidManifest
+		}
+	}
+	return nil
+}
+
+func (s *Server) prepareMessage(msg *Message, env Envelope) {
+	msg.Body = env.Body
+	msg.SetSender(env.Sender)
+	msg.SetReceiver(env.Receiver)
 	msg.Body.Add("p-server", "Pandora-Default-Server")
 
 	msg.ReceivedAt = time.Now()
-	msg.SendWhen = msg.ReceivedAt.Add(delay)
-	msg.SetClientTime(clientTime)
+	msg.SendWhen = msg.ReceivedAt.Add(env.Delay)
+	msg.SetClientTime(env.ClientTime)
 	msg.DeliveryCount = 0
+	msg.Priority = env.Priority
+	msg.Group = env.Group
+	msg.ExpiresAt = env.ExpiresAt
+	if env.TTL > 0 {
+		if expires := msg.ReceivedAt.Add(env.TTL); msg.ExpiresAt.IsZero() || expires.Before(msg.ExpiresAt) {
+			msg.ExpiresAt = expires
+		}
+	}
+	if env.Manifest != nil {
+		msg.Set(KeyManifest, PrintKeyString(env.Manifest.Key))
+		msg.Set(KeyPayloadSize, strconv.FormatInt(env.Manifest.Size, 10))
+	} else {
+		msg.Payload = env.Payload
+	}
+	if env.Payload != nil || env.Manifest != nil {
+		ct := env.ContentType
+		if len(ct) == 0 {
+			ct = DefaultContentType
+		}
+		msg.SetContentType(ct)
+	}
+	msg.DedupKey = env.DedupKey
+	if len(msg.DedupKey) > 0 {
+		window := s.DedupWindow
+		if window <= 0 {
+			window = DefaultDedupWindow
+		}
+		msg.DedupUntil = msg.ReceivedAt.Add(window)
+	}
+}
 
-	err := s.doSend(&msg)
-	return msg, err
+// isRepeated check if err means that msg was already sent with the same dedup key
+func isRepeated(msg *Message, err error) bool {
+	return err == ErrDuplicateMessage && len(msg.DedupKey) > 0
 }
 
 // FetchLatest fetch the latest message for the given receiver,
@@ -489,44 +1246,421 @@ func (s *Server) Send(sender, receiver string, delay time.Duration, clientTime t
 // when that happens the client can check if the body is valid by calling
 // Message.ValidBody.
 //
-// If no error is returned, then the body is valid and there is no need to check that
+// If no error is returned, then the body is valid and there is no need to check that.
+//
+// If lease is 0, the LeaseTime of the receiver is used
 func (s *Server) FetchLatest(receiver string, lease time.Duration) (*Message, error) {
-	if lease <= 0 {
-		lease = DefaultLeaseTime
+	return s.FetchLatestBy("", receiver, lease)
+}
+
+// FetchLatestBy works like FetchLatest but records client
+// in the history of the message
+func (s *Server) FetchLatestBy(client, receiver string, lease time.Duration) (*Message, error) {
+	defer s.Metrics.FetchLatency.ObserveSince(time.Now())
+	if lease < 0 {
+		lease = 0
 	}
 	msg, err := s.MessageStore.FetchAndLockLatest(receiver, lease)
 	if err != nil {
 		return nil, err
 	}
+	s.Metrics.countFetch(msg)
+	s.record(leasedEvent(msg, client))
 	return s.doReadMessage(msg)
 }
 
+// FetchLatestBatch works like FetchLatest but locks up to max messages,
+// max is limited to MaxBatchSize.
+//
+// If the body of a message can't be read, the error is returned in the result
+func (s *Server) FetchLatestBatch(receiver string, lease time.Duration, max int) ([]BatchResult, error) {
+	return s.FetchLatestBatchBy("", receiver, lease, max)
+}
+
+// FetchLatestBatchBy works like FetchLatestBatch but records client
+// in the history of the messages
+func (s *Server) FetchLatestBatchBy(client, receiver string, lease time.Duration, max int) ([]BatchResult, error) {
+	defer s.Metrics.FetchLatency.ObserveSince(time.Now())
+	if lease < 0 {
+		lease = 0
+	}
+	if max <= 0 {
+		max = 1
+	} else if max > MaxBatchSize {
+		max = MaxBatchSize
+	}
+	msgs, err := s.MessageStore.FetchAndLockBatch(receiver, lease, max)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]BatchResult, len(msgs))
+	events := make([]Event, len(msgs))
+	for i, msg := range msgs {
+		s.Metrics.countFetch(msg)
+		events[i] = leasedEvent(msg, client)
+	}
+	s.record(events...)
+	for i, msg := range msgs {
+		results[i].Message, results[i].Err = s.doReadMessage(msg)
+	}
+	return results, nil
+}
+
+// FetchLatestWait works like FetchLatest but if no message is available
+// it waits until a message is sent to receiver or wait expires.
+//
+// wait is limited to MaxWaitTime
+func (s *Server) FetchLatestWait(receiver string, lease, wait time.Duration) (*Message, error) {
+	return s.FetchLatestWaitBy("", receiver, lease, wait)
+}
+
+// FetchLatestWaitBy works like FetchLatestWait but records client
+// in the history of the message
+func (s *Server) FetchLatestWaitBy(client, receiver string, lease, wait time.Duration) (*Message, error) {
+	if wait > MaxWaitTime {
+		wait = MaxWaitTime
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		// get the channel before the fetch,
+		// otherwise a message sent between the fetch and the wait is lost
+		notified := s.waitChannel(receiver)
+		msg, err := s.FetchLatestBy(client, receiver, lease)
+		remaining := deadline.Sub(time.Now())
+		if err != ErrNoMessages || remaining <= 0 {
+			s.doneWaiting(receiver, notified)
+			return msg, err
+		}
+		if remaining > WaitRecheckTime {
+			remaining = WaitRecheckTime
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-notified:
+		case <-timer.C:
+		}
+		timer.Stop()
+		s.doneWaiting(receiver, notified)
+	}
+}
+
+// waitChannel return the channel that will be closed when a new message
+// is available to receiver, each call must be followed by doneWaiting
+func (s *Server) waitChannel(receiver string) <-chan struct{} {
+	s.waitLock.Lock()
+	defer s.waitLock.Unlock()
+	if s.waiting == nil {
+		s.waiting = make(map[string]*waiter)
+	}
+	w, ok := s.waiting[receiver]
+	if !ok {
+		w = &waiter{ch: make(chan struct{})}
+		s.waiting[receiver] = w
+	}
+	w.count++
+	return w.ch
+}
+
+// doneWaiting release the channel returned by waitChannel, the entry
+// of receiver is removed when no one else is waiting on it
+func (s *Server) doneWaiting(receiver string, ch <-chan struct{}) {
+	s.waitLock.Lock()
+	defer s.waitLock.Unlock()
+	// after a notify the entry is gone or holds a new channel
+	if w, ok := s.waiting[receiver]; ok && w.ch == ch {
+		w.count--
+		if w.count <= 0 {
+			delete(s.waiting, receiver)
+		}
+	}
+}
+
+// notify wakes up every client waiting for messages sent to receiver
+func (s *Server) notify(receiver string) {
+	s.waitLock.Lock()
+	defer s.waitLock.Unlock()
+	if w, ok := s.waiting[receiver]; ok {
+		close(w.ch)
+		delete(s.waiting, receiver)
+	}
+}
+
 // FetchHeaders output at least len(out) messages headers, no body is returned
 func (s *Server) FetchHeaders(out []Message, receiver string, receivedAt time.Time) (int, error) {
 	return s.MessageStore.FetchHeaders(out, receiver, receivedAt)
 }
 
+// FetchDeadLetters output at least len(out) message headers from the dead inbox
+func (s *Server) FetchDeadLetters(out []Message, inbox string) (int, error) {
+	return s.MessageStore.FetchDeadLetters(out, inbox)
+}
+
+// ReplayDeadLetters move the dead letters of inbox back to it, making them
+// available for delivery. If mid is nil, all messages are replayed.
+func (s *Server) ReplayDeadLetters(inbox string, mid Key) (int, error) {
+	count, err := s.MessageStore.ReplayDeadLetters(inbox, mid)
+	if count > 0 {
+		s.notify(inbox)
+	}
+	return count, err
+}
+
+// PurgeDeadLetters remove the dead letters of inbox. If mid is nil, all messages
+// are removed
+func (s *Server) PurgeDeadLetters(inbox string, mid Key) (int, error) {
+	keys, err := s.MessageStore.PurgeDeadLetters(inbox, mid)
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		if err := s.releaseBlob(k); err != nil {
+			return len(keys), err
+		}
+	}
+	return len(keys), nil
+}
+
+// InboxStats return the number of messages of every inbox
+func (s *Server) InboxStats() ([]InboxStats, error) {
+	return s.MessageStore.InboxStats(time.Now())
+}
+
+// BlobUsage return the storage used by the BlobStore
+func (s *Server) BlobUsage() (BlobUsage, error) {
+	return s.BlobStore.Usage()
+}
+
+// Health check if both stores are available
+func (s *Server) Health() error {
+	if err := s.MessageStore.Ping(); err != nil {
+		return err
+	}
+	return s.BlobStore.Ping()
+}
+
+// ExpireMessages move the messages that expired until now to the dead inbox,
+// or remove them if their inbox drops expired messages.
+//
+// Returns the number of expired messages
+func (s *Server) ExpireMessages(now time.Time) (int, error) {
+	count, keys, err := s.MessageStore.ExpireMessages(now)
+	if err != nil {
+		return count, err
+	}
+	s.Metrics.Expired.Add(count)
+	return count, s.releaseBlobs(keys)
+}
+
+// PurgeReplyInboxes remove the reply inboxes (see ReplyInboxPrefix) created more than
+// ReplyInboxTTL before now, replies that were never fetched are removed too.
+//
+// Returns the number of inboxes removed
+func (s *Server) PurgeReplyInboxes(now time.Time) (int, error) {
+	ttl := s.ReplyInboxTTL
+	if ttl <= 0 {
+		ttl = DefaultReplyInboxTTL
+	}
+	count, keys, err := s.MessageStore.PurgeInboxes(ReplyInboxPrefix, now.Add(-ttl))
+	if err != nil {
+		return count, err
+	}
+	return count, s.releaseBlobs(keys)
+}
+
+// CollectBlobs remove at most max blobs that aren't referenced by any message,
+// if dryRun is true the blobs are only reported.
+//
+// Blobs that changed in the last GCGracePeriod are never collected
+func (s *Server) CollectBlobs(max int, dryRun bool) (GCReport, error) {
+	report := GCReport{DryRun: dryRun}
+	if max <= 0 {
+		max = GCBatchSize
+	}
+	olderThan := time.Now().Add(-GCGracePeriod)
+	keys, err := s.BlobStore.UnreferencedKeys(max, olderThan)
+	if err != nil {
+		return report, err
+	}
+	report.Keys = keys
+	if dryRun || len(keys) == 0 {
+		return report, nil
+	}
+	report.Deleted, err = s.BlobStore.DeleteData(keys, olderThan)
+	return report, err
+}
+
+// releaseBlob decrement the ref-count of the given body key, and of the
+// chunks of its payload. A body that was already removed is ignored
+func (s *Server) releaseBlob(key Key) error {
+	msg := &Message{Bid: key}
+	if _, err := s.doReadMessage(msg); err == ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	m, err := s.manifestOf(msg)
+	if err == ErrKeyNotFound {
+		m, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		if err := s.updateManifestRefs(m, -1); err != nil {
+			return err
+		}
+	}
+	err = s.BlobStore.UpdateRefCount(key, -1)
+	if err == ErrKeyNotFound {
+		err = nil
+	}
+	return err
+}
+
+// releaseBlobs release the body of every message removed from the MessageStore
+func (s *Server) releaseBlobs(keys []Key) error {
+	for _, k := range keys {
+		if err := s.releaseBlob(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MessageBody return the message mid with only its Body and Payload filled,
+// ErrKeyNotFound is returned if the message doesn't exist
+func (s *Server) MessageBody(mid Key) (*Message, error) {
+	body, err := s.MessageStore.BodyKey(mid)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, ErrKeyNotFound
+	}
+	return s.doReadMessage(&Message{Mid: mid, Bid: body})
+}
+
+// MessageReceiver return the inbox that holds the message mid,
+// ErrKeyNotFound is returned if the message doesn't exist
+func (s *Server) MessageReceiver(mid Key) (string, error) {
+	receiver, err := s.MessageStore.Receiver(mid)
+	if err != nil {
+		return "", err
+	}
+	if len(receiver) == 0 {
+		return "", ErrKeyNotFound
+	}
+	return receiver, nil
+}
+
 func (s *Server) doReadMessage(msg *Message) (*Message, error) {
-	data, err := s.BlobStore.GetData(nil, msg.Mid)
+	data, err := s.BlobStore.GetData(nil, msg.BodyKey())
 	if err != nil {
 		msg.invalidBody = true
 		return msg, err
 	}
-	msg.Body, err = url.ParseQuery(string(data))
-	if err != nil {
+	if err = msg.DecodeBlob(data); err != nil {
 		msg.invalidBody = true
 	}
 	return msg, err
 }
 
-func (s *Server) doSend(msg *Message) error {
+func (s *Server) doSend(msg *Message, client string) error {
 	if err := s.WriteBlob(msg); err != nil {
 		return err
 	}
-	return s.MessageStore.Enqueue(msg)
+	if err := s.MessageStore.Enqueue(msg); isRepeated(msg, err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.record(enqueuedEvent(msg, client))
+	return s.retainBlobs(msg, 1)
+}
+
+// ExtendLease keeps the message mid locked by lockId for more lease time,
+// the returned message holds the new LeasedUntil and Lid.
+func (s *Server) ExtendLease(mid, lockId Key, lease time.Duration, rotate bool) (*Message, error) {
+	if lease <= 0 {
+		lease = DefaultLeaseTime
+	}
+	return s.MessageStore.ExtendLease(mid, lockId, lease, rotate)
 }
 
 // Ack is used to confirm that a message mid was processed o rejected by the client.
+//
+// Confirmed messages release the reference to their body
 func (s *Server) Ack(mid, lockId Key, ack AckStatus) error {
-	return s.MessageStore.Ack(mid, lockId, ack)
+	return s.AckBy("", mid, lockId, ack)
+}
+
+// AckBy works like Ack but records client in the history of the message
+func (s *Server) AckBy(client string, mid, lockId Key, ack AckStatus) error {
+	defer s.Metrics.AckLatency.ObserveSince(time.Now())
+	// taken before the ack, so the event comes before the ones
+	// recorded by the store, like moving to the dead inbox
+	event := ackEvent(AckRequest{Mid: mid, Lid: lockId, Status: ack, Client: client}, time.Now())
+	if ack != StatusConfirmed {
+		err := s.MessageStore.Ack(mid, lockId, ack)
+		if err == nil {
+			s.Metrics.countAck(ack)
+			s.record(event)
+		}
+		return err
+	}
+	body, err := s.MessageStore.BodyKey(mid)
+	if err != nil {
+		return err
+	}
+	if err := s.MessageStore.Ack(mid, lockId, ack); err != nil {
+		return err
+	}
+	s.Metrics.countAck(ack)
+	s.record(event)
+	if body == nil {
+		return nil
+	}
+	return s.releaseBlob(body)
+}
+
+// AckBatch works like Ack for every item of acks, the error of each item is
+// returned in the slice.
+func (s *Server) AckBatch(acks []AckRequest) ([]error, error) {
+	defer s.Metrics.AckLatency.ObserveSince(time.Now())
+	if len(acks) > MaxBatchSize {
+		return nil, ErrBatchTooLarge
+	}
+	bodies := make([]Key, len(acks))
+	for i, a := range acks {
+		if a.Status != StatusConfirmed {
+			continue
+		}
+		var err error
+		if bodies[i], err = s.MessageStore.BodyKey(a.Mid); err != nil {
+			return nil, err
+		}
+	}
+	at := time.Now()
+	errs, err := s.MessageStore.AckBatch(acks)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	for i, err := range errs {
+		if err != nil {
+			continue
+		}
+		s.Metrics.countAck(acks[i].Status)
+		events = append(events, ackEvent(acks[i], at))
+	}
+	s.record(events...)
+	for i, err := range errs {
+		if err != nil {
+			continue
+		}
+		if bodies[i] != nil {
+			errs[i] = s.releaseBlob(bodies[i])
+		}
+	}
+	return errs, nil
 }
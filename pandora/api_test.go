@@ -77,3 +77,66 @@ func TestKeyPrinterRead(t *testing.T) {
 		t.Errorf("error reading key. expected value is %v got %v", buf, key.Bytes())
 	}
 }
+
+func TestMessageBlob(t *testing.T) {
+	var msg Message
+	msg.Empty(nil)
+	msg.SetSender("a@local")
+	msg.SetContentType("application/octet-stream")
+	msg.Payload = []byte("binary\n\x00data")
+
+	var decoded Message
+	if err := decoded.DecodeBlob(msg.EncodeBlob()); err != nil {
+		t.Fatalf("error decoding blob: %v", err)
+	}
+	if decoded.Sender() != "a@local" || decoded.ContentType() != "application/octet-stream" {
+		t.Errorf("invalid headers: %v", decoded.Body)
+	}
+	if !bytes.Equal(decoded.Payload, msg.Payload) {
+		t.Errorf("expecting payload %q got %q", msg.Payload, decoded.Payload)
+	}
+
+	// blobs without payload
+	msg.Payload = nil
+	if err := decoded.DecodeBlob(msg.EncodeBlob()); err != nil {
+		t.Fatalf("error decoding blob: %v", err)
+	}
+	if decoded.Payload != nil {
+		t.Errorf("expecting no payload got %q", decoded.Payload)
+	}
+}
+
+func TestWaitChannel(t *testing.T) {
+	s := &Server{}
+	first := s.waitChannel("a@local")
+	second := s.waitChannel("a@local")
+	if first != second {
+		t.Fatalf("waiters of the same receiver should share the channel")
+	}
+	s.doneWaiting("a@local", first)
+	if len(s.waiting) != 1 {
+		t.Fatalf("expecting 1 entry got %v", len(s.waiting))
+	}
+	s.doneWaiting("a@local", second)
+	if len(s.waiting) != 0 {
+		t.Fatalf("expecting 0 entries got %v", len(s.waiting))
+	}
+
+	notified := s.waitChannel("a@local")
+	s.notify("a@local")
+	select {
+	case <-notified:
+	default:
+		t.Fatalf("notify should close the channel")
+	}
+	// a new waiter isn't released by the waiters of the closed channel
+	next := s.waitChannel("a@local")
+	s.doneWaiting("a@local", notified)
+	if len(s.waiting) != 1 {
+		t.Fatalf("expecting 1 entry got %v", len(s.waiting))
+	}
+	s.doneWaiting("a@local", next)
+	if len(s.waiting) != 0 {
+		t.Fatalf("expecting 0 entries got %v", len(s.waiting))
+	}
+}
@@ -0,0 +1,281 @@
+package pandora
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+)
+
+const (
+	// ChunkSize is the size of each chunk of a large payload. Payloads larger
+	// than ChunkSize aren't saved with the message, instead they are split
+	// in chunks and a manifest is saved in the BlobStore.
+	ChunkSize = 256 << 10
+
+	// MaxStreamSize define the max size of a payload streamed to the server
+	MaxStreamSize = 1 << 30
+
+	// Body field used to store the key of the manifest of a chunked payload
+	KeyManifest = "manifest"
+
+	// Body field used to store the size of a chunked payload
+	KeyPayloadSize = "payloadSize"
+
+	// ErrInvalidManifest the blob isn't a valid manifest
+	ErrInvalidManifest = ApiError("invalid manifest")
+
+	// first line of every manifest
+	manifestHeader = "pandora-manifest"
+)
+
+// Manifest describe a payload saved in chunks. Chunks are content addressed,
+// so identical chunks of different payloads are saved only once.
+type Manifest struct {
+	// Key of the manifest inside the BlobStore
+	Key Key
+	// Size of the payload
+	Size int64
+	// Chunks holds the key of each chunk, in order
+	Chunks []Key
+}
+
+// Encode return the data saved in the BlobStore: a header line,
+// followed by the size and the hex key of each chunk, one per line.
+func (m *Manifest) Encode() []byte {
+	var kp KeyPrinter
+	buf := bytes.Buffer{}
+	io.WriteString(&buf, manifestHeader)
+	buf.WriteByte('\n')
+	io.WriteString(&buf, strconv.FormatInt(m.Size, 10))
+	buf.WriteByte('\n')
+	for _, k := range m.Chunks {
+		io.WriteString(&buf, kp.PrintString(k))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// Decode read the manifest from data, see Encode
+func (m *Manifest) Decode(data []byte) error {
+	var kp KeyPrinter
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	if len(lines) < 2 || string(lines[0]) != manifestHeader {
+		return ErrInvalidManifest
+	}
+	size, err := strconv.ParseInt(string(lines[1]), 10, 64)
+	if err != nil || size < 0 {
+		return ErrInvalidManifest
+	}
+	m.Size = size
+	m.Chunks = make([]Key, 0, len(lines)-2)
+	for _, l := range lines[2:] {
+		k := &SHA1Key{}
+		if err := kp.Read(k, l); err != nil {
+			return ErrInvalidManifest
+		}
+		m.Chunks = append(m.Chunks, k)
+	}
+	return nil
+}
+
+// WritePayload save the contents of in to the BlobStore, splitting it in chunks
+// of ChunkSize, and return the saved manifest.
+//
+// Each chunk is retained as soon as it is written, so the GC doesn't collect
+// the chunks of a slow stream, and the manifest is retained when it is saved.
+// The caller must call ReleasePayload once the manifest is referenced by
+// a message, SendEnvelope and SendBatch release the manifest of the envelope.
+//
+// ErrPayloadTooBig is returned if in holds more than MaxStreamSize bytes,
+// the chunks already written are released when an error is returned.
+func (s *Server) WritePayload(in io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+	if err := s.writeChunks(m, in); err != nil {
+		s.releaseChunks(m.Chunks)
+		return nil, err
+	}
+	var err error
+	m.Key, err = s.BlobStore.PutData(nil, m.Encode())
+	if err == nil {
+		err = s.BlobStore.UpdateRefCount(m.Key, 1)
+	}
+	if err != nil {
+		s.releaseChunks(m.Chunks)
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeChunks save and retain the chunks of in, the keys of the
+// retained chunks are appended to m.Chunks even if an error happens
+func (s *Server) writeChunks(m *Manifest, in io.Reader) error {
+	buf := make([]byte, ChunkSize)
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			m.Size += int64(n)
+			if m.Size > MaxStreamSize {
+				return ErrPayloadTooBig
+			}
+			key, err := s.BlobStore.PutData(nil, buf[:n])
+			if err != nil {
+				return err
+			}
+			if err := s.BlobStore.UpdateRefCount(key, 1); err != nil {
+				return err
+			}
+			m.Chunks = append(m.Chunks, key)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) releaseChunks(chunks []Key) {
+	for _, k := range chunks {
+		s.BlobStore.UpdateRefCount(k, -1)
+	}
+}
+
+// ReleasePayload release the references taken by WritePayload,
+// a nil manifest is ignored
+func (s *Server) ReleasePayload(m *Manifest) error {
+	if m == nil {
+		return nil
+	}
+	return s.updateManifestRefs(m, -1)
+}
+
+// ReadManifest read the manifest saved under key
+func (s *Server) ReadManifest(key Key) (*Manifest, error) {
+	data, err := s.BlobStore.GetData(nil, key)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, ErrKeyNotFound
+	}
+	m := &Manifest{Key: key}
+	if err := m.Decode(data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OpenPayload return a reader of the payload described by the manifest saved
+// under key, chunks are read from the BlobStore only when required.
+func (s *Server) OpenPayload(key Key) (io.Reader, *Manifest, error) {
+	m, err := s.ReadManifest(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &chunkReader{bs: s.BlobStore, chunks: m.Chunks}, m, nil
+}
+
+// chunkReader read each chunk from the BlobStore, one at a time
+type chunkReader struct {
+	bs     BlobStore
+	chunks []Key
+	buf    []byte
+}
+
+func (c *chunkReader) Read(out []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if len(c.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := c.bs.GetData(nil, c.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		if data == nil {
+			return 0, ErrKeyNotFound
+		}
+		c.buf = data
+		c.chunks = c.chunks[1:]
+	}
+	n := copy(out, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// chunkPayload save payloads larger than ChunkSize in chunks,
+// the envelope is changed to point to the manifest, which must be
+// released by the caller, see WritePayload
+func (s *Server) chunkPayload(env *Envelope) error {
+	if env.Manifest != nil || len(env.Payload) <= ChunkSize {
+		return nil
+	}
+	m, err := s.WritePayload(bytes.NewReader(env.Payload))
+	if err != nil {
+		return err
+	}
+	env.Manifest = m
+	env.Payload = nil
+	return nil
+}
+
+// manifestOf return the manifest referenced by the body of msg,
+// nil is returned if the message doesn't have a chunked payload
+func (s *Server) manifestOf(msg *Message) (*Manifest, error) {
+	hexKey := msg.Get(KeyManifest)
+	if len(hexKey) == 0 {
+		return nil, nil
+	}
+	key := &SHA1Key{}
+	if err := (KeyPrinter{}).ReadString(key, hexKey); err != nil {
+		return nil, ErrInvalidManifest
+	}
+	return s.ReadManifest(key)
+}
+
+// retainBlobs add delta to the ref-count of the body of msg, and if the
+// payload is chunked, to the manifest and to each of its chunks.
+func (s *Server) retainBlobs(msg *Message, delta int) error {
+	m, err := s.manifestOf(msg)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		if err := s.updateManifestRefs(m, delta); err != nil {
+			return err
+		}
+	}
+	return s.BlobStore.UpdateRefCount(msg.BodyKey(), delta)
+}
+
+func (s *Server) updateManifestRefs(m *Manifest, delta int) error {
+	for _, k := range m.Chunks {
+		if err := s.BlobStore.UpdateRefCount(k, delta); err != nil && (delta > 0 || err != ErrKeyNotFound) {
+			return err
+		}
+	}
+	err := s.BlobStore.UpdateRefCount(m.Key, delta)
+	if delta < 0 && err == ErrKeyNotFound {
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package pandora
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestManifestEncoding(t *testing.T) {
+	var kw SHA1KeyWriter
+	kw.Write([]byte("chunk"))
+	m := Manifest{Size: 5, Chunks: []Key{kw.Key(), kw.Key()}}
+
+	var decoded Manifest
+	if err := decoded.Decode(m.Encode()); err != nil {
+		t.Fatalf("error decoding manifest: %v", err)
+	}
+	if decoded.Size != m.Size || len(decoded.Chunks) != 2 {
+		t.Fatalf("expecting %v got %v", m, decoded)
+	}
+	for i := range m.Chunks {
+		if !bytes.Equal(decoded.Chunks[i].Bytes(), m.Chunks[i].Bytes()) {
+			t.Errorf("chunk %v: expecting %v got %v", i, m.Chunks[i], decoded.Chunks[i])
+		}
+	}
+
+	if err := decoded.Decode([]byte("a=b&c=d")); err != ErrInvalidManifest {
+		t.Errorf("expecting %v got %v", ErrInvalidManifest, err)
+	}
+}
@@ -0,0 +1,99 @@
+package pandora
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// The message was accepted by the server
+	EventEnqueued = "enqueued"
+	// The message was leased by a client, Lid holds the lease
+	EventLeased = "leased"
+	// The lease expired before the client sent an ack, At is when the lease expired
+	EventTimeout = "timeout"
+	// The client confirmed the message
+	EventConfirmed = "confirmed"
+	// The client rejected the message
+	EventRejected = "rejected"
+	// The message expired before it was delivered, At is when the message expired
+	EventExpired = "expired"
+	// The message was moved to the dead inbox, Detail holds the reason
+	EventDead = "dead"
+	// The message was moved back from the dead inbox
+	EventReplayed = "replayed"
+
+	// Detail of the expired event when the inbox drops its expired messages
+	DetailDropped = "dropped"
+)
+
+// Event is a single entry of the history of a message
+type Event struct {
+	Mid  Key
+	Type string
+	At   time.Time
+	// Client that caused the event, empty for the events caused by the server
+	Client string
+	// Lid is the lease related to the event, if any
+	Lid    Key
+	Detail string
+}
+
+// History return every event of mid ordered by the time they happened,
+// ErrKeyNotFound is returned if mid doesn't have any event
+func (s *Server) History(mid Key) ([]Event, error) {
+	events, err := s.MessageStore.History(mid)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return events, nil
+}
+
+// record append events to the history of their messages. Errors are only
+// logged since the operation that generated the events already happened.
+func (s *Server) record(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+	if err := s.MessageStore.AppendEvents(events); err != nil {
+		log.Printf("[PANDORA-HISTORY] unable to record %v events: %v", len(events), err)
+	}
+}
+
+// enqueuedEvent return the event of msg being accepted by the server
+func enqueuedEvent(msg *Message, client string) Event {
+	return Event{Mid: msg.Mid, Type: EventEnqueued, At: msg.ReceivedAt, Client: client}
+}
+
+// leasedEvent return the event of msg being leased by client
+func leasedEvent(msg *Message, client string) Event {
+	return Event{Mid: msg.Mid, Type: EventLeased, At: time.Now(), Client: client, Lid: msg.Lid}
+}
+
+// ackEvent return the event of the ack a, the type of the event is the name of the status
+func ackEvent(a AckRequest, at time.Time) Event {
+	return Event{Mid: a.Mid, Type: a.Status.String(), At: at, Client: a.Client, Lid: a.Lid}
+}
@@ -21,6 +21,7 @@ package http
 // THE SOFTWARE.
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -41,6 +42,7 @@ type jsonOutput struct {
 const (
 	ErrNotFound     = pandora.ApiError("not found")
 	ErrPOSTRequired = pandora.ApiError("POST is required")
+	ErrInvalidBatch = pandora.ApiError("batch body should be a json array")
 )
 
 var (
@@ -52,6 +54,9 @@ var (
 type Handler struct {
 	Server     *pandora.Server
 	AllowAdmin bool
+	// Auth is used to identify the principal of each request,
+	// if nil, no authentication or authorization is done
+	Auth Authenticator
 }
 
 func (ph *Handler) respondWith(w http.ResponseWriter, req *http.Request, val interface{}) {
@@ -61,21 +66,22 @@ func (ph *Handler) respondWith(w http.ResponseWriter, req *http.Request, val int
 			w.WriteHeader(http.StatusNotFound)
 		} else if val == ErrPOSTRequired {
 			w.WriteHeader(http.StatusMethodNotAllowed)
+		} else if val == ErrUnauthorized {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+		} else if val == ErrForbidden {
+			w.WriteHeader(http.StatusForbidden)
 		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "error=%v", url.QueryEscape(val.Error()))
+			writeError(w, req, http.StatusBadRequest, val)
 		}
 	case error:
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error=%v", url.QueryEscape(val.Error()))
+		writeError(w, req, http.StatusInternalServerError, val)
 	case int:
 		w.WriteHeader(val)
 	case url.Values:
-		w.WriteHeader(http.StatusOK)
-		io.WriteString(w, val.Encode())
+		writeValues(w, req, val)
 	case map[string][]string:
-		w.WriteHeader(http.StatusOK)
-		io.WriteString(w, url.Values(val).Encode())
+		writeValues(w, req, url.Values(val))
 	case []byte:
 		w.WriteHeader(http.StatusOK)
 		w.Write(val)
@@ -83,6 +89,7 @@ func (ph *Handler) respondWith(w http.ResponseWriter, req *http.Request, val int
 		w.WriteHeader(http.StatusOK)
 		io.Copy(w, val)
 	case jsonOutput:
+		w.Header().Set("Content-Type", contentTypeJSON)
 		w.WriteHeader(http.StatusOK)
 		enc := json.NewEncoder(w)
 		enc.Encode(val.val)
@@ -110,15 +117,46 @@ func (ph *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if ret != nil {
 		return
 	}
+	// health checks don't require authentication
+	if strings.HasSuffix(req.URL.Path, "/healthz") {
+		ret = ph.Health(req)
+		return
+	}
+	if _, err := ph.authenticate(req); err != nil {
+		ret = err
+		return
+	}
 	if strings.HasSuffix(req.URL.Path, "/send") {
 		ret = ph.Enqueue(req)
 	} else if strings.HasSuffix(req.URL.Path, "/fetch") {
 		ret = ph.FetchAndLockLatest(req)
 	} else if strings.HasSuffix(req.URL.Path, "/ack") {
 		ret = ph.Ack(req)
+	} else if strings.HasSuffix(req.URL.Path, "/send/batch") {
+		ret = ph.EnqueueBatch(req)
+	} else if strings.HasSuffix(req.URL.Path, "/fetch/batch") {
+		ret = ph.FetchAndLockBatch(req)
+	} else if strings.HasSuffix(req.URL.Path, "/ack/batch") {
+		ret = ph.AckBatch(req)
+	} else if strings.HasSuffix(req.URL.Path, "/extend") {
+		ret = ph.ExtendLease(req)
+	} else if strings.HasSuffix(req.URL.Path, "/subscribe") {
+		ret = ph.Subscribe(req)
+	} else if strings.HasSuffix(req.URL.Path, "/unsubscribe") {
+		ret = ph.Unsubscribe(req)
+	} else if strings.HasSuffix(req.URL.Path, "/subscribers") {
+		ret = ph.Subscribers(req)
+	} else if strings.HasSuffix(req.URL.Path, "/payload") {
+		ret = ph.FetchPayload(req)
+	} else if strings.HasSuffix(req.URL.Path, "/metrics") {
+		ret = ph.Metrics(req)
+	} else if strings.HasSuffix(req.URL.Path, "/schedule") {
+		ret = ph.AddSchedule(req)
 	} else {
 		if ph.AllowAdmin {
-			ret = ph.ServeAdmin(req)
+			if ret = ph.checkAdmin(req); ret == nil {
+				ret = ph.ServeAdmin(req)
+			}
 		} else {
 			ret = ErrNotFound
 		}
@@ -167,49 +205,176 @@ func (ph *Handler) ServeAdmin(req *http.Request) interface{} {
 		}
 		return data
 	} else if strings.HasSuffix(req.URL.Path, "/admin/reenqueue") {
-		err := ph.Server.MessageStore.Reenqueue(time.Now())
+		now := time.Now()
+		err := ph.Server.MessageStore.Reenqueue(now)
+		if err != nil {
+			return err
+		}
+		if _, err := ph.Server.ExpireMessages(now); err != nil {
+			return err
+		}
+		return "OK"
+	} else if strings.HasSuffix(req.URL.Path, "/admin/maxDelivery") {
+		max, err := strconv.Atoi(req.Form.Get(pandora.KeyMaxDelivery))
+		if err != nil {
+			return err
+		}
+		err = ph.Server.MessageStore.SetMaxDelivery(req.Form.Get(pandora.KeyReceiver), max)
+		if err != nil {
+			return err
+		}
+		return "OK"
+	} else if strings.HasSuffix(req.URL.Path, "/admin/fifo") {
+		fifo, err := strconv.ParseBool(req.Form.Get(pandora.KeyFifo))
+		if err != nil {
+			return err
+		}
+		err = ph.Server.MessageStore.SetFifo(req.Form.Get(pandora.KeyReceiver), fifo)
 		if err != nil {
 			return err
 		}
 		return "OK"
+	} else if strings.HasSuffix(req.URL.Path, "/admin/dropExpired") {
+		drop, err := strconv.ParseBool(req.Form.Get(pandora.KeyDropExpired))
+		if err != nil {
+			return err
+		}
+		err = ph.Server.MessageStore.SetDropExpired(req.Form.Get(pandora.KeyReceiver), drop)
+		if err != nil {
+			return err
+		}
+		return "OK"
+	} else if strings.HasSuffix(req.URL.Path, "/admin/dead") {
+		var out [10]pandora.Message
+		sz, err := ph.Server.FetchDeadLetters(out[:], req.Form.Get(pandora.KeyReceiver))
+		if err != nil {
+			return err
+		}
+		if sz == 0 {
+			return http.StatusNoContent
+		}
+		final := make([]url.Values, sz)
+		for i, _ := range final {
+			output := make(url.Values)
+			out[i].WriteTo(output)
+			final[i] = output
+		}
+		return jsonOutput{final}
+	} else if strings.HasSuffix(req.URL.Path, "/admin/dead/replay") {
+		return ph.changeDeadLetters(req, ph.Server.ReplayDeadLetters)
+	} else if strings.HasSuffix(req.URL.Path, "/admin/dead/purge") {
+		return ph.changeDeadLetters(req, ph.Server.PurgeDeadLetters)
+	} else if strings.HasSuffix(req.URL.Path, "/admin/gc") {
+		return ph.CollectBlobs(req)
+	} else if strings.HasSuffix(req.URL.Path, "/admin/schedules") {
+		return ph.Schedules(req)
+	} else if strings.HasSuffix(req.URL.Path, "/admin/schedule/cancel") {
+		return ph.CancelSchedule(req)
+	} else if strings.HasSuffix(req.URL.Path, "/admin/inboxes") {
+		return ph.Inboxes(req)
+	} else if strings.HasSuffix(req.URL.Path, "/admin/inbox/pause") {
+		return ph.PauseInbox(req)
+	} else if strings.HasSuffix(req.URL.Path, "/admin/inbox/resume") {
+		return ph.ResumeInbox(req)
+	} else if strings.HasSuffix(req.URL.Path, "/admin/inbox/leaseTime") {
+		return ph.SetInboxLeaseTime(req)
+	} else if strings.HasSuffix(req.URL.Path, "/admin/inbox/maxSize") {
+		return ph.SetInboxMaxSize(req)
+	} else if strings.HasSuffix(req.URL.Path, "/admin/inbox/purge") {
+		return ph.PurgeInbox(req)
+	} else if strings.HasSuffix(req.URL.Path, "/admin/inbox/delete") {
+		return ph.DeleteInbox(req)
+	} else if strings.HasSuffix(req.URL.Path, "/admin/history") {
+		return ph.History(req)
 	}
 	return ErrNotFound
 }
 
+// CollectBlobs remove the unreferenced blobs, if "dryRun" is true
+// the blobs are only reported.
+//
+// The key of each blob is returned under "key"
+func (ph *Handler) CollectBlobs(req *http.Request) interface{} {
+	dryRun, _ := strconv.ParseBool(req.Form.Get(pandora.KeyDryRun))
+	if !dryRun && req.Method != "POST" {
+		return ErrPOSTRequired
+	}
+	max, _ := strconv.Atoi(req.Form.Get(pandora.KeyMax))
+	report, err := ph.Server.CollectBlobs(max, dryRun)
+	if err != nil {
+		return err
+	}
+	resp := make(url.Values)
+	resp.Set(pandora.KeyDryRun, strconv.FormatBool(report.DryRun))
+	resp.Set("count", strconv.Itoa(len(report.Keys)))
+	resp.Set("deleted", strconv.Itoa(report.Deleted))
+	for _, k := range report.Keys {
+		resp.Add("key", pandora.PrintKeyString(k))
+	}
+	return resp
+}
+
+// changeDeadLetters apply fn to the dead letters of the receiver,
+// if no mid is informed, all dead letters are changed.
+func (ph *Handler) changeDeadLetters(req *http.Request, fn func(string, pandora.Key) (int, error)) interface{} {
+	if req.Method != "POST" {
+		return ErrPOSTRequired
+	}
+	var mid pandora.Key
+	if len(req.Form.Get("mid")) > 0 {
+		var key pandora.SHA1Key
+		if err := (pandora.KeyPrinter{}).ReadString(&key, req.Form.Get("mid")); err != nil {
+			return err
+		}
+		mid = &key
+	}
+	count, err := fn(req.Form.Get(pandora.KeyReceiver), mid)
+	if err != nil {
+		return err
+	}
+	resp := make(url.Values)
+	resp.Set("count", strconv.Itoa(count))
+	return resp
+}
+
 func (ph *Handler) FetchAndLockLatest(req *http.Request) interface{} {
 	if req.Method != "POST" {
 		return ErrPOSTRequired
 	}
 	receiver := req.Form.Get(pandora.KeyReceiver)
+	if err := ph.checkMailbox(req, receiver); err != nil {
+		return err
+	}
 	duration, _ := time.ParseDuration(req.Form.Get(pandora.KeyLeaseTime))
-	msg, err := ph.Server.FetchLatest(receiver, duration)
+	wait, _ := time.ParseDuration(req.Form.Get(pandora.KeyWait))
+	msg, err := ph.Server.FetchLatestWaitBy(ph.client(req), receiver, duration, wait)
 	if err == pandora.ErrNoMessages {
 		return http.StatusNoContent
 	}
 	if err != nil {
 		return err
 	}
-	msg.WriteTo(msg.Body)
-	return msg.Body
+	return messageOutput(req, msg)
 }
 
 func (ph *Handler) Enqueue(req *http.Request) interface{} {
 	if req.Method != "POST" {
 		return ErrPOSTRequired
 	}
-	delay, err := time.ParseDuration(req.Form.Get("delay"))
+	env, err := readSendRequest(req)
 	if err != nil {
-		delay = 0
+		return err
 	}
-	req.Form.Del("delay")
-
-	ctime, err := time.Parse(time.RFC3339Nano, req.Form.Get(pandora.KeyClientTime))
-	if err != nil {
-		ctime = time.Now()
+	if err := ph.checkSend(req, env.Sender, env.Receiver); err != nil {
+		return err
 	}
-	req.Form.Del(pandora.KeyClientTime)
-
-	msg, err := ph.Server.Send(req.Form.Get(pandora.KeySender), req.Form.Get(pandora.KeyReceiver), delay, ctime, req.Form)
+	if hasRawPayload(req) {
+		if err := ph.readRawPayload(&env, req.Body); err != nil {
+			return err
+		}
+	}
+	env.Client = ph.client(req)
+	msg, err := ph.Server.SendEnvelope(env)
 	if err != nil {
 		return err
 	}
@@ -218,7 +383,226 @@ func (ph *Handler) Enqueue(req *http.Request) interface{} {
 	return resp
 }
 
+// EnqueueBatch expects a json array where each item holds the
+// same values expected by Enqueue
+func (ph *Handler) EnqueueBatch(req *http.Request) interface{} {
+	if req.Method != "POST" {
+		return ErrPOSTRequired
+	}
+	var items []url.Values
+	if err := readBatch(req, &items); err != nil {
+		return err
+	}
+	final := make([]url.Values, len(items))
+	var envs []pandora.Envelope
+	var idx []int
+	client := ph.client(req)
+	for i, item := range items {
+		final[i] = make(url.Values)
+		env, err := readEnvelope(item)
+		if err == nil {
+			err = ph.checkSend(req, env.Sender, env.Receiver)
+		}
+		if err != nil {
+			final[i].Set("error", err.Error())
+			continue
+		}
+		env.Client = client
+		envs = append(envs, env)
+		idx = append(idx, i)
+	}
+	results, err := ph.Server.SendBatch(envs)
+	if err != nil {
+		return err
+	}
+	for i, r := range results {
+		if r.Err != nil {
+			final[idx[i]].Set("error", r.Err.Error())
+		} else {
+			final[idx[i]].Set("mid", pandora.KeyPrinter{}.PrintString(r.Message.Mid))
+		}
+	}
+	return jsonOutput{final}
+}
+
 func (ph *Handler) Ack(req *http.Request) interface{} {
+	ack, err := readAckRequest(req.Form)
+	if err != nil {
+		return err
+	}
+	if _, err := ph.checkMessage(req, ack.Mid); err != nil {
+		return err
+	}
+	err = ph.Server.AckBy(ph.client(req), ack.Mid, ack.Lid, ack.Status)
+	if err != nil {
+		return err
+	}
+	return http.StatusOK
+}
+
+// AckBatch expects a json array where each item holds the
+// same values expected by Ack
+func (ph *Handler) AckBatch(req *http.Request) interface{} {
+	if req.Method != "POST" {
+		return ErrPOSTRequired
+	}
+	var items []url.Values
+	if err := readBatch(req, &items); err != nil {
+		return err
+	}
+	final := make([]url.Values, len(items))
+	var acks []pandora.AckRequest
+	var idx []int
+	client := ph.client(req)
+	for i, item := range items {
+		final[i] = make(url.Values)
+		ack, err := readAckRequest(item)
+		if err == nil {
+			_, err = ph.checkMessage(req, ack.Mid)
+		}
+		if err != nil {
+			final[i].Set("error", err.Error())
+			continue
+		}
+		ack.Client = client
+		acks = append(acks, ack)
+		idx = append(idx, i)
+	}
+	errs, err := ph.Server.AckBatch(acks)
+	if err != nil {
+		return err
+	}
+	for i, err := range errs {
+		if err != nil {
+			final[idx[i]].Set("error", err.Error())
+		} else {
+			final[idx[i]].Set("status", "OK")
+		}
+	}
+	return jsonOutput{final}
+}
+
+// FetchAndLockBatch works like FetchAndLockLatest but returns a
+// json array with up to "max" messages
+func (ph *Handler) FetchAndLockBatch(req *http.Request) interface{} {
+	if req.Method != "POST" {
+		return ErrPOSTRequired
+	}
+	receiver := req.Form.Get(pandora.KeyReceiver)
+	if err := ph.checkMailbox(req, receiver); err != nil {
+		return err
+	}
+	duration, _ := time.ParseDuration(req.Form.Get(pandora.KeyLeaseTime))
+	max, _ := strconv.Atoi(req.Form.Get(pandora.KeyMax))
+	results, err := ph.Server.FetchLatestBatchBy(ph.client(req), receiver, duration, max)
+	if err == pandora.ErrNoMessages {
+		return http.StatusNoContent
+	}
+	if err != nil {
+		return err
+	}
+	final := make([]url.Values, len(results))
+	for i, r := range results {
+		msg := r.Message
+		if msg.Body == nil {
+			msg.Body = make(url.Values)
+		}
+		msg.WriteTo(msg.Body)
+		writePayload(msg.Body, msg)
+		if r.Err != nil {
+			msg.Body.Set("error", r.Err.Error())
+		}
+		final[i] = msg.Body
+	}
+	return jsonOutput{final}
+}
+
+// readEnvelope extract the information required to send a message from form,
+// the values used only by the server are removed from form.
+//
+// The payload can be informed encoded as base64
+func readEnvelope(form url.Values) (pandora.Envelope, error) {
+	delay, err := time.ParseDuration(form.Get("delay"))
+	if err != nil {
+		delay = 0
+	}
+	form.Del("delay")
+
+	ctime, err := time.Parse(time.RFC3339Nano, form.Get(pandora.KeyClientTime))
+	if err != nil {
+		ctime = time.Now()
+	}
+	form.Del(pandora.KeyClientTime)
+
+	priority, _ := strconv.Atoi(form.Get(pandora.KeyPriority))
+	form.Del(pandora.KeyPriority)
+	group := form.Get(pandora.KeyGroup)
+	form.Del(pandora.KeyGroup)
+	dedupKey := form.Get(pandora.KeyDedupKey)
+	form.Del(pandora.KeyDedupKey)
+	ttl, _ := time.ParseDuration(form.Get(pandora.KeyTTL))
+	form.Del(pandora.KeyTTL)
+	expiresAt, _ := time.Parse(time.RFC3339Nano, form.Get(pandora.KeyExpiresAt))
+	form.Del(pandora.KeyExpiresAt)
+
+	var payload []byte
+	var payloadErr error
+	if _, ok := form[pandora.KeyPayload]; ok {
+		payload, payloadErr = base64.StdEncoding.DecodeString(form.Get(pandora.KeyPayload))
+		if payloadErr != nil {
+			payloadErr = ErrInvalidPayload
+		}
+		form.Del(pandora.KeyPayload)
+	}
+	contentType := form.Get(pandora.KeyContentType)
+	form.Del(pandora.KeyContentType)
+	// set by the server when the payload is chunked
+	form.Del(pandora.KeyManifest)
+	form.Del(pandora.KeyPayloadSize)
+
+	return pandora.Envelope{
+		Sender:      form.Get(pandora.KeySender),
+		Receiver:    form.Get(pandora.KeyReceiver),
+		Delay:       delay,
+		ClientTime:  ctime,
+		Priority:    priority,
+		Group:       group,
+		DedupKey:    dedupKey,
+		TTL:         ttl,
+		ExpiresAt:   expiresAt,
+		Body:        form,
+		Payload:     payload,
+		ContentType: contentType,
+	}, payloadErr
+}
+
+// readAckRequest extract the mid, lid and statusCode from form
+func readAckRequest(form url.Values) (pandora.AckRequest, error) {
+	var kp pandora.KeyPrinter
+	midK := &pandora.SHA1Key{}
+	lidK := &pandora.SHA1Key{}
+	ack := pandora.AckRequest{Mid: midK, Lid: lidK}
+	err := kp.ReadString(midK, form.Get("mid"))
+	if err != nil {
+		return ack, err
+	}
+	err = kp.ReadString(lidK, form.Get("lid"))
+	if err != nil {
+		return ack, err
+	}
+
+	status, err := strconv.ParseInt(form.Get("statusCode"), 10, 8)
+	if err != nil {
+		return ack, err
+	}
+	ack.Status = pandora.AckStatus(status)
+	return ack, nil
+}
+
+func (ph *Handler) ExtendLease(req *http.Request) interface{} {
+	if req.Method != "POST" {
+		return ErrPOSTRequired
+	}
 	var kp pandora.KeyPrinter
 	var midK pandora.SHA1Key
 	var lidK pandora.SHA1Key
@@ -230,19 +614,106 @@ func (ph *Handler) Ack(req *http.Request) interface{} {
 	if err != nil {
 		return err
 	}
+	if _, err := ph.checkMessage(req, &midK); err != nil {
+		return err
+	}
+	duration, _ := time.ParseDuration(req.Form.Get(pandora.KeyLeaseTime))
+	rotate, _ := strconv.ParseBool(req.Form.Get(pandora.KeyRotate))
 
-	status, err := strconv.ParseInt(req.Form.Get("statusCode"), 32, 10)
+	msg, err := ph.Server.ExtendLease(&midK, &lidK, duration, rotate)
 	if err != nil {
 		return err
 	}
+	resp := make(url.Values)
+	msg.WriteTo(resp)
+	return resp
+}
 
-	err = ph.Server.Ack(&midK, &lidK, pandora.AckStatus(status))
+// Subscribe register the receiver as a subscriber of topic,
+// the principal must own both the receiver and the topic
+func (ph *Handler) Subscribe(req *http.Request) interface{} {
+	if req.Method != "POST" {
+		return ErrPOSTRequired
+	}
+	if err := ph.checkMailbox(req, req.Form.Get(pandora.KeyReceiver)); err != nil {
+		return err
+	}
+	if err := ph.checkMailbox(req, pandora.TopicPrefix+req.Form.Get(pandora.KeyTopic)); err != nil {
+		return err
+	}
+	err := ph.Server.Subscribe(req.Form.Get(pandora.KeyTopic), req.Form.Get(pandora.KeyReceiver))
 	if err != nil {
 		return err
 	}
 	return http.StatusOK
 }
 
+// Unsubscribe remove the receiver from the subscribers of topic
+func (ph *Handler) Unsubscribe(req *http.Request) interface{} {
+	if req.Method != "POST" {
+		return ErrPOSTRequired
+	}
+	if err := ph.checkMailbox(req, req.Form.Get(pandora.KeyReceiver)); err != nil {
+		return err
+	}
+	err := ph.Server.Unsubscribe(req.Form.Get(pandora.KeyTopic), req.Form.Get(pandora.KeyReceiver))
+	if err != nil {
+		return err
+	}
+	return http.StatusOK
+}
+
+// Subscribers return a json array with the inboxes subscribed to topic,
+// only principals that can send to topic can list its subscribers
+func (ph *Handler) Subscribers(req *http.Request) interface{} {
+	if err := ph.checkSendTo(req, pandora.TopicPrefix+req.Form.Get(pandora.KeyTopic)); err != nil {
+		return err
+	}
+	inboxes, err := ph.Server.Subscribers(req.Form.Get(pandora.KeyTopic))
+	if err != nil {
+		return err
+	}
+	if inboxes == nil {
+		inboxes = []string{}
+	}
+	return jsonOutput{inboxes}
+}
+
+// FetchPayload stream the chunked payload described by the manifest key,
+// available from the manifest header of the message.
+//
+// When authentication is enabled the mid of the message is required
+// and the principal must own its receiver.
+func (ph *Handler) FetchPayload(req *http.Request) interface{} {
+	var kp pandora.KeyPrinter
+	var key pandora.SHA1Key
+	if err := kp.ReadString(&key, req.Form.Get(pandora.KeyManifest)); err != nil {
+		return err
+	}
+	var mid pandora.Key
+	if len(req.Form.Get("mid")) > 0 {
+		midK := &pandora.SHA1Key{}
+		if err := kp.ReadString(midK, req.Form.Get("mid")); err != nil {
+			return err
+		}
+		mid = midK
+	}
+	msg, err := ph.checkMessage(req, mid)
+	if err != nil {
+		return err
+	}
+	if msg != nil && msg.Get(pandora.KeyManifest) != kp.PrintString(&key) {
+		return ErrForbidden
+	}
+	in, _, err := ph.Server.OpenPayload(&key)
+	if err == pandora.ErrKeyNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return in
+}
+
 func (ph *Handler) parseFormIfNeed(req *http.Request) error {
 	if len(req.Form) <= 0 {
 		return req.ParseForm()
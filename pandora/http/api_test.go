@@ -21,33 +21,27 @@ package http
 // THE SOFTWARE.
 
 import (
+	"encoding/json"
 	"github.com/andrebq/exp/pandora"
-	"github.com/andrebq/exp/pandora/pgstore"
+	"github.com/andrebq/exp/pandora/kvstore"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
 func mustCreateServer() *pandora.Server {
-	bs, err := pgstore.OpenBlobStore("pandora", "pandora", "localhost", "pandora")
+	store, err := kvstore.Open("")
 	if err != nil {
 		panic(err)
 	}
-
-	ms, err := pgstore.OpenMessageStore("pandora", "pandora", "localhost", "pandora")
-	if err != nil {
-		panic(err)
-	}
-	if err := ms.DeleteMessages(); err != nil {
-		panic(err)
-	}
 	return &pandora.Server{
-		BlobStore:    bs,
-		MessageStore: ms,
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
 	}
 }
 func TestPandoraAPIEmptyMessages(t *testing.T) {
@@ -206,3 +200,321 @@ func TestPandoraAPI(t *testing.T) {
 	}
 	t.Logf("buf: %v", string(buf))
 }
+
+func TestPandoraAPIDeadLetters(t *testing.T) {
+	server := mustCreateServer()
+	handler := &Handler{
+		Server:     server,
+		AllowAdmin: true,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	msg, err := server.Send("a@local", "b@local", 0, time.Now(), make(url.Values))
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+
+	config := make(url.Values)
+	config.Set(pandora.KeyReceiver, "b@local")
+	config.Set(pandora.KeyMaxDelivery, "1")
+	res, err := http.PostForm(ts.URL+"/admin/maxDelivery", config)
+	if err != nil {
+		t.Fatalf("error setting max delivery: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status code. should be 200 got %v", res.StatusCode)
+	}
+	fetched, err := server.FetchLatest("b@local", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	if err := server.Ack(fetched.Mid, fetched.Lid, pandora.StatusRejected); err != nil {
+		t.Fatalf("error rejecting message: %v", err)
+	}
+
+	res, err = http.Get(ts.URL + "/admin/dead?receiver=b%40local")
+	if err != nil {
+		t.Fatalf("error listing dead letters: %v", err)
+	}
+	buf, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status code. should be 200 got %v", res.StatusCode)
+	}
+	t.Logf("buf: %v", string(buf))
+
+	replay := make(url.Values)
+	replay.Set(pandora.KeyReceiver, "b@local")
+	replay.Set("mid", pandora.PrintKeyString(msg.Mid))
+	res, err = http.PostForm(ts.URL+"/admin/dead/replay", replay)
+	if err != nil {
+		t.Fatalf("error replaying dead letters: %v", err)
+	}
+	buf, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	values, _ := url.ParseQuery(string(buf))
+	if values.Get("count") != "1" {
+		t.Errorf("expecting count 1 got %v", string(buf))
+	}
+
+	res, err = http.PostForm(ts.URL+"/admin/dead/purge", replay)
+	if err != nil {
+		t.Fatalf("error purging dead letters: %v", err)
+	}
+	buf, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	values, _ = url.ParseQuery(string(buf))
+	if values.Get("count") != "0" {
+		t.Errorf("expecting count 0 got %v", string(buf))
+	}
+}
+
+func TestPandoraAPIWaitFetch(t *testing.T) {
+	server := mustCreateServer()
+	handler := &Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// create both inboxes
+	_, err := server.Send("b@local", "a@local", 0, time.Now(), make(url.Values))
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		body := make(url.Values)
+		body.Set("info", "late message")
+		server.Send("a@local", "b@local", 0, time.Now(), body)
+	}()
+
+	msgToFetch := make(url.Values)
+	msgToFetch.Set(pandora.KeyReceiver, "b@local")
+	msgToFetch.Set(pandora.KeyLeaseTime, "5m")
+	msgToFetch.Set(pandora.KeyWait, "5s")
+
+	start := time.Now()
+	res, err := http.PostForm(ts.URL+"/fetch", msgToFetch)
+	if err != nil {
+		t.Fatalf("error fetching the message: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status code. should be 200 got %v", res.StatusCode)
+	}
+	if time.Since(start) > time.Second*4 {
+		t.Errorf("fetch should return as soon as the message is sent. took %v", time.Since(start))
+	}
+	buf, _ := ioutil.ReadAll(res.Body)
+	values, _ := url.ParseQuery(string(buf))
+	if values.Get("info") != "late message" {
+		t.Errorf("unexpected message: %v", string(buf))
+	}
+
+	// nothing else to receive
+	msgToFetch.Set(pandora.KeyWait, "100ms")
+	res, err = http.PostForm(ts.URL+"/fetch", msgToFetch)
+	if err != nil {
+		t.Fatalf("error fetching the message: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("invalid status code. should be 204 got %v", res.StatusCode)
+	}
+}
+
+func TestPandoraAPIBlobCollector(t *testing.T) {
+	server := mustCreateServer()
+	handler := &Handler{
+		Server:     server,
+		AllowAdmin: true,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/admin/gc")
+	if err != nil {
+		t.Fatalf("error collecting blobs: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("collecting without dry-run requires POST. got %v", res.StatusCode)
+	}
+
+	res, err = http.Get(ts.URL + "/admin/gc?dryRun=true")
+	if err != nil {
+		t.Fatalf("error collecting blobs: %v", err)
+	}
+	buf, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status code. should be 200 got %v", res.StatusCode)
+	}
+	values, _ := url.ParseQuery(string(buf))
+	if values.Get(pandora.KeyDryRun) != "true" || values.Get("deleted") != "0" {
+		t.Errorf("unexpected report: %v", string(buf))
+	}
+}
+
+func TestPandoraAPIPriority(t *testing.T) {
+	server := mustCreateServer()
+	handler := &Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	for i, priority := range []string{"", "5"} {
+		msg := make(url.Values)
+		msg.Set(pandora.KeySender, "a@local")
+		msg.Set(pandora.KeyReceiver, "b@local")
+		msg.Set(pandora.KeyPriority, priority)
+		msg.Set("id", strconv.Itoa(i))
+		res, err := http.PostForm(ts.URL+"/send", msg)
+		if err != nil {
+			t.Fatalf("error sending message: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("invalid status code. should be 200 got %v", res.StatusCode)
+		}
+	}
+
+	msgToFetch := make(url.Values)
+	msgToFetch.Set(pandora.KeyReceiver, "b@local")
+	res, err := http.PostForm(ts.URL+"/fetch", msgToFetch)
+	if err != nil {
+		t.Fatalf("error fetching the message: %v", err)
+	}
+	buf, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	values, _ := url.ParseQuery(string(buf))
+	if values.Get("id") != "1" || values.Get(pandora.KeyPriority) != "5" {
+		t.Errorf("expecting the message with higher priority got %v", string(buf))
+	}
+}
+
+func TestPandoraAPIDedupKey(t *testing.T) {
+	server := mustCreateServer()
+	handler := &Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	var mids []string
+	for i := 0; i < 2; i++ {
+		msg := make(url.Values)
+		msg.Set(pandora.KeySender, "a@local")
+		msg.Set(pandora.KeyReceiver, "b@local")
+		msg.Set(pandora.KeyClientTime, time.Now().Add(time.Duration(i)*time.Second).Format(time.RFC3339Nano))
+		msg.Set(pandora.KeyDedupKey, "order-1")
+		res, err := http.PostForm(ts.URL+"/send", msg)
+		if err != nil {
+			t.Fatalf("error sending message: %v", err)
+		}
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("invalid status code. should be 200 got %v", res.StatusCode)
+		}
+		values, _ := url.ParseQuery(string(buf))
+		mids = append(mids, values.Get("mid"))
+	}
+	if mids[0] != mids[1] || len(mids[0]) == 0 {
+		t.Errorf("expecting the same mid got %v", mids)
+	}
+}
+
+func TestPandoraAPIManifestHeader(t *testing.T) {
+	server := mustCreateServer()
+	handler := &Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// the manifest headers are set only by the server
+	msg := make(url.Values)
+	msg.Set(pandora.KeySender, "a@local")
+	msg.Set(pandora.KeyReceiver, "b@local")
+	msg.Set(pandora.KeyManifest, "0123456789012345678901234567890123456789")
+	msg.Set(pandora.KeyPayloadSize, "10")
+	res, err := http.PostForm(ts.URL+"/send", msg)
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status code. should be 200 got %v", res.StatusCode)
+	}
+
+	fetched, err := server.FetchLatest("b@local", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	if len(fetched.Get(pandora.KeyManifest)) > 0 || len(fetched.Get(pandora.KeyPayloadSize)) > 0 {
+		t.Errorf("the manifest headers should be removed: %v", fetched.Body)
+	}
+}
+
+func TestPandoraAPIJSON(t *testing.T) {
+	handler := &Handler{
+		Server: mustCreateServer(),
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	msg := `{"headers": {"sender": ["a@local"], "receiver": ["b@local"]}, "body": {"order": 1, "items": ["a", "b"]}}`
+	req, _ := http.NewRequest("POST", ts.URL+"/send", strings.NewReader(msg))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	var sent url.Values
+	err = json.NewDecoder(res.Body).Decode(&sent)
+	res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("invalid response %v / %v", res.StatusCode, err)
+	}
+
+	fetch := make(url.Values)
+	fetch.Set(pandora.KeyReceiver, "b@local")
+	req, _ = http.NewRequest("POST", ts.URL+"/fetch", strings.NewReader(fetch.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	var fetched JSONMessage
+	err = json.NewDecoder(res.Body).Decode(&fetched)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("error decoding message: %v", err)
+	}
+	if fetched.Headers.Get("mid") != sent.Get("mid") || fetched.ContentType != "application/json" {
+		t.Errorf("unexpected message %v", fetched)
+	}
+	var body struct {
+		Order int
+		Items []string
+	}
+	if err := json.Unmarshal(fetched.Body, &body); err != nil || body.Order != 1 || len(body.Items) != 2 {
+		t.Errorf("unexpected body %v / %v", string(fetched.Body), err)
+	}
+}
@@ -0,0 +1,232 @@
+package http
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/andrebq/exp/pandora"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	// The request don't have valid credentials
+	ErrUnauthorized = pandora.ApiError("unauthorized")
+
+	// The principal isn't allowed to perform the request
+	ErrForbidden = pandora.ApiError("forbidden")
+)
+
+// Principal is the identity associated with a set of credentials.
+//
+// Mailboxes and SendTo hold patterns in the format used by path.Match,
+// ie, "*@local" matches every mailbox of the local domain.
+type Principal struct {
+	Name string `json:"name"`
+	// Admin principals can access the /admin/* endpoints
+	Admin bool `json:"admin"`
+	// Mailboxes the principal owns, it can send messages as those mailboxes
+	// and fetch messages from them
+	Mailboxes []string `json:"mailboxes"`
+	// SendTo are the mailboxes (and topics) that can receive messages
+	// from the principal
+	SendTo []string `json:"sendTo"`
+}
+
+// CanUse check if the principal owns mailbox
+func (p *Principal) CanUse(mailbox string) bool {
+	return matchAny(p.Mailboxes, mailbox)
+}
+
+// CanSend check if the principal can send a message from sender to receiver
+func (p *Principal) CanSend(sender, receiver string) bool {
+	return p.CanUse(sender) && p.CanSendTo(receiver)
+}
+
+// CanSendTo check if receiver can receive messages from the principal
+func (p *Principal) CanSendTo(receiver string) bool {
+	return matchAny(p.SendTo, receiver)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator returns the principal associated with the credentials of the request,
+// if the credentials are invalid or missing ErrUnauthorized is returned.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Principal, error)
+}
+
+// TokenAuth is an Authenticator that uses bearer tokens,
+// ie, "Authorization: Bearer <token>".
+//
+// Only the hash of the tokens is kept in memory
+type TokenAuth struct {
+	principals map[[sha256.Size]byte]*Principal
+}
+
+// AddToken associate token with principal, a previous association
+// of the same token is replaced.
+func (ta *TokenAuth) AddToken(token string, principal *Principal) {
+	if ta.principals == nil {
+		ta.principals = make(map[[sha256.Size]byte]*Principal)
+	}
+	ta.principals[sha256.Sum256([]byte(token))] = principal
+}
+
+// Authenticate implements the Authenticator interface
+func (ta *TokenAuth) Authenticate(req *http.Request) (*Principal, error) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, ErrUnauthorized
+	}
+	token := strings.TrimSpace(auth[len("Bearer "):])
+	if len(token) == 0 {
+		return nil, ErrUnauthorized
+	}
+	p, ok := ta.principals[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+	return p, nil
+}
+
+// LoadTokens reads a json array where each item is a Principal with
+// an extra "token" field.
+//
+//	[{"token": "secret", "name": "billing", "mailboxes": ["*@billing"], "sendTo": ["*"]}]
+func LoadTokens(in io.Reader) (*TokenAuth, error) {
+	var items []struct {
+		Token string `json:"token"`
+		Principal
+	}
+	if err := json.NewDecoder(in).Decode(&items); err != nil {
+		return nil, err
+	}
+	ta := &TokenAuth{}
+	for i := range items {
+		if len(items[i].Token) == 0 {
+			continue
+		}
+		p := items[i].Principal
+		ta.AddToken(items[i].Token, &p)
+	}
+	return ta, nil
+}
+
+// authenticate return the principal of the request, nil is returned
+// when no Authenticator is configured
+func (ph *Handler) authenticate(req *http.Request) (*Principal, error) {
+	if ph.Auth == nil {
+		return nil, nil
+	}
+	return ph.Auth.Authenticate(req)
+}
+
+// client return the name used to identify the client of req in the history of the
+// messages, the principal when authentication is enabled or the remote address otherwise
+func (ph *Handler) client(req *http.Request) string {
+	if p, err := ph.authenticate(req); err == nil && p != nil {
+		return p.Name
+	}
+	return req.RemoteAddr
+}
+
+// checkMailbox ensure that the principal of the request owns mailbox
+func (ph *Handler) checkMailbox(req *http.Request, mailbox string) error {
+	p, err := ph.authenticate(req)
+	if err != nil || p == nil {
+		return err
+	}
+	if !p.CanUse(mailbox) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// checkSend ensure that the principal of the request can send from sender to receiver
+func (ph *Handler) checkSend(req *http.Request, sender, receiver string) error {
+	p, err := ph.authenticate(req)
+	if err != nil || p == nil {
+		return err
+	}
+	if !p.CanSend(sender, receiver) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// checkSendTo ensure that the principal of the request can send to receiver
+func (ph *Handler) checkSendTo(req *http.Request, receiver string) error {
+	p, err := ph.authenticate(req)
+	if err != nil || p == nil {
+		return err
+	}
+	if !p.CanSendTo(receiver) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// checkMessage ensure that the principal of the request owns the inbox that holds mid,
+// which isn't the receiver in the body for the copies of a topic.
+// When authentication is enabled the body of the message is returned.
+func (ph *Handler) checkMessage(req *http.Request, mid pandora.Key) (*pandora.Message, error) {
+	p, err := ph.authenticate(req)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	if mid == nil {
+		return nil, ErrForbidden
+	}
+	receiver, err := ph.Server.MessageReceiver(mid)
+	if err == pandora.ErrKeyNotFound {
+		// don't tell if the message exists
+		return nil, ErrForbidden
+	} else if err != nil {
+		return nil, err
+	}
+	if !p.CanUse(receiver) {
+		return nil, ErrForbidden
+	}
+	return ph.Server.MessageBody(mid)
+}
+
+// checkAdmin ensure that the principal of the request is an admin
+func (ph *Handler) checkAdmin(req *http.Request) error {
+	p, err := ph.authenticate(req)
+	if err != nil || p == nil {
+		return err
+	}
+	if !p.Admin {
+		return ErrForbidden
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package http
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/andrebq/exp/pandora"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadTokens(t *testing.T) {
+	auth, err := LoadTokens(strings.NewReader(`[
+		{"token": "s1", "name": "billing", "mailboxes": ["*@billing"], "sendTo": ["*"]},
+		{"token": "s2", "name": "ops", "admin": true}
+	]`))
+	if err != nil {
+		t.Fatalf("error loading tokens: %v", err)
+	}
+
+	req, _ := http.NewRequest("POST", "/send", nil)
+	if _, err := auth.Authenticate(req); err != ErrUnauthorized {
+		t.Errorf("expecting %v got %v", ErrUnauthorized, err)
+	}
+	req.Header.Set("Authorization", "Bearer invalid")
+	if _, err := auth.Authenticate(req); err != ErrUnauthorized {
+		t.Errorf("expecting %v got %v", ErrUnauthorized, err)
+	}
+
+	req.Header.Set("Authorization", "Bearer s1")
+	p, err := auth.Authenticate(req)
+	if err != nil {
+		t.Fatalf("error authenticating: %v", err)
+	}
+	if p.Name != "billing" || p.Admin {
+		t.Errorf("unexpected principal %v", p)
+	}
+	if !p.CanSend("invoices@billing", "a@local") || p.CanUse("a@local") {
+		t.Errorf("invalid permissions for %v", p)
+	}
+
+	req.Header.Set("Authorization", "Bearer s2")
+	if p, err = auth.Authenticate(req); err != nil || !p.Admin {
+		t.Errorf("expecting an admin got %v / %v", p, err)
+	}
+}
+
+func TestPandoraAPIAuth(t *testing.T) {
+	auth := &TokenAuth{}
+	auth.AddToken("user", &Principal{
+		Name:      "user",
+		Mailboxes: []string{"*@local"},
+		SendTo:    []string{"*@local"},
+	})
+	auth.AddToken("admin", &Principal{Name: "admin", Admin: true})
+	handler := &Handler{
+		Server:     mustCreateServer(),
+		AllowAdmin: true,
+		Auth:       auth,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	post := func(path, token string, form url.Values) int {
+		req, _ := http.NewRequest("POST", ts.URL+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error calling %v: %v", path, err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	msg := make(url.Values)
+	msg.Set(pandora.KeySender, "a@local")
+	msg.Set(pandora.KeyReceiver, "b@local")
+	msg.Set(pandora.KeyClientTime, time.Now().Format(time.RFC3339Nano))
+
+	if code := post("/send", "", msg); code != http.StatusUnauthorized {
+		t.Errorf("expecting %v got %v", http.StatusUnauthorized, code)
+	}
+	if code := post("/send", "user", msg); code != http.StatusOK {
+		t.Errorf("expecting %v got %v", http.StatusOK, code)
+	}
+
+	msg.Set(pandora.KeySender, "a@remote")
+	if code := post("/send", "user", msg); code != http.StatusForbidden {
+		t.Errorf("sending as a@remote: expecting %v got %v", http.StatusForbidden, code)
+	}
+
+	fetch := make(url.Values)
+	fetch.Set(pandora.KeyReceiver, "b@remote")
+	if code := post("/fetch", "user", fetch); code != http.StatusForbidden {
+		t.Errorf("fetching from b@remote: expecting %v got %v", http.StatusForbidden, code)
+	}
+	fetch.Set(pandora.KeyReceiver, "b@local")
+	if code := post("/fetch", "user", fetch); code != http.StatusOK {
+		t.Errorf("fetching from b@local: expecting %v got %v", http.StatusOK, code)
+	}
+
+	reenqueue := make(url.Values)
+	if code := post("/admin/reenqueue", "user", reenqueue); code != http.StatusForbidden {
+		t.Errorf("admin as user: expecting %v got %v", http.StatusForbidden, code)
+	}
+	if code := post("/admin/reenqueue", "admin", reenqueue); code != http.StatusOK {
+		t.Errorf("admin as admin: expecting %v got %v", http.StatusOK, code)
+	}
+}
+
+func TestPandoraAPIAuthMessage(t *testing.T) {
+	auth := &TokenAuth{}
+	auth.AddToken("user", &Principal{
+		Name:      "user",
+		Mailboxes: []string{"*@local"},
+		SendTo:    []string{"*@local"},
+	})
+	auth.AddToken("remote", &Principal{
+		Name:      "remote",
+		Mailboxes: []string{"*@remote"},
+		SendTo:    []string{"*@remote"},
+	})
+	auth.AddToken("topics", &Principal{
+		Name:      "topics",
+		Mailboxes: []string{pandora.TopicPrefix + "*"},
+	})
+	handler := &Handler{
+		Server: mustCreateServer(),
+		Auth:   auth,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	post := func(path, token string, body io.Reader, ctype string) (int, url.Values) {
+		req, _ := http.NewRequest("POST", ts.URL+path, body)
+		req.Header.Set("Content-Type", ctype)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error calling %v: %v", path, err)
+		}
+		defer res.Body.Close()
+		buf, _ := ioutil.ReadAll(res.Body)
+		values, _ := url.ParseQuery(string(buf))
+		return res.StatusCode, values
+	}
+	postForm := func(path, token string, form url.Values) (int, url.Values) {
+		return post(path, token, strings.NewReader(form.Encode()), "application/x-www-form-urlencoded")
+	}
+
+	msg := make(url.Values)
+	msg.Set(pandora.KeySender, "a@remote")
+	msg.Set(pandora.KeyReceiver, "b@remote")
+	msg.Set(pandora.KeyClientTime, time.Now().Format(time.RFC3339Nano))
+	if code, _ := postForm("/send", "remote", msg); code != http.StatusOK {
+		t.Fatalf("error sending message: status %v", code)
+	}
+	fetch := make(url.Values)
+	fetch.Set(pandora.KeyReceiver, "b@remote")
+	code, fetched := postForm("/fetch", "remote", fetch)
+	if code != http.StatusOK {
+		t.Fatalf("error fetching message: status %v", code)
+	}
+
+	ack := make(url.Values)
+	ack.Set("mid", fetched.Get("mid"))
+	ack.Set("lid", fetched.Get("lid"))
+	ack.Set("statusCode", strconv.FormatInt(int64(pandora.StatusConfirmed), 10))
+	if code, _ := postForm("/ack", "user", ack); code != http.StatusForbidden {
+		t.Errorf("ack of b@remote: expecting %v got %v", http.StatusForbidden, code)
+	}
+	if code, _ := postForm("/extend", "user", ack); code != http.StatusForbidden {
+		t.Errorf("extend of b@remote: expecting %v got %v", http.StatusForbidden, code)
+	}
+
+	batch, _ := json.Marshal([]url.Values{ack})
+	req, _ := http.NewRequest("POST", ts.URL+"/ack/batch", bytes.NewReader(batch))
+	req.Header.Set("Authorization", "Bearer user")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error calling /ack/batch: %v", err)
+	}
+	var results []url.Values
+	err = json.NewDecoder(res.Body).Decode(&results)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("error reading /ack/batch: %v", err)
+	}
+	if len(results) != 1 || results[0].Get("error") != ErrForbidden.Error() {
+		t.Errorf("ack batch of b@remote: expecting %v got %v", ErrForbidden, results)
+	}
+
+	subscribers := make(url.Values)
+	subscribers.Set(pandora.KeyTopic, "news@remote")
+	if code, _ := postForm("/subscribers", "user", subscribers); code != http.StatusForbidden {
+		t.Errorf("subscribers of news@remote: expecting %v got %v", http.StatusForbidden, code)
+	}
+	if code, _ := postForm("/subscribers", "remote", subscribers); code != http.StatusOK {
+		t.Errorf("subscribers of news@remote: expecting %v got %v", http.StatusOK, code)
+	}
+
+	payload := make(url.Values)
+	payload.Set(pandora.KeyManifest, fetched.Get("mid"))
+	if code, _ := postForm("/payload", "user", payload); code != http.StatusForbidden {
+		t.Errorf("payload without mid: expecting %v got %v", http.StatusForbidden, code)
+	}
+	payload.Set("mid", fetched.Get("mid"))
+	if code, _ := postForm("/payload", "user", payload); code != http.StatusForbidden {
+		t.Errorf("payload of b@remote: expecting %v got %v", http.StatusForbidden, code)
+	}
+
+	// the owner can still ack the message
+	if code, _ := postForm("/ack", "remote", ack); code != http.StatusOK {
+		t.Errorf("ack by the owner: expecting %v got %v", http.StatusOK, code)
+	}
+
+	subscribe := make(url.Values)
+	subscribe.Set(pandora.KeyTopic, "news@remote")
+	subscribe.Set(pandora.KeyReceiver, "c@local")
+	if code, _ := postForm("/subscribe", "user", subscribe); code != http.StatusForbidden {
+		t.Errorf("subscribe to news@remote: expecting %v got %v", http.StatusForbidden, code)
+	}
+	subscribe.Set(pandora.KeyReceiver, "c@remote")
+	if code, _ := postForm("/subscribe", "remote", subscribe); code != http.StatusOK {
+		t.Fatalf("error subscribing to news@remote: status %v", code)
+	}
+	msg.Set(pandora.KeyReceiver, pandora.TopicPrefix+"news@remote")
+	if code, _ := postForm("/send", "remote", msg); code != http.StatusOK {
+		t.Fatalf("error publishing to news@remote: status %v", code)
+	}
+	fetch.Set(pandora.KeyReceiver, "c@remote")
+	if code, fetched = postForm("/fetch", "remote", fetch); code != http.StatusOK {
+		t.Fatalf("error fetching the copy of news@remote: status %v", code)
+	}
+	ack.Set("mid", fetched.Get("mid"))
+	ack.Set("lid", fetched.Get("lid"))
+	if code, _ := postForm("/ack", "topics", ack); code != http.StatusForbidden {
+		t.Errorf("ack of c@remote by the owner of the topic: expecting %v got %v", http.StatusForbidden, code)
+	}
+	if code, _ := postForm("/ack", "remote", ack); code != http.StatusOK {
+		t.Errorf("ack by the subscriber: expecting %v got %v", http.StatusOK, code)
+	}
+}
@@ -0,0 +1,215 @@
+package http
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/andrebq/exp/pandora"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	contentTypeJSON      = "application/json"
+	contentTypeForm      = "application/x-www-form-urlencoded"
+	contentTypeMultipart = "multipart/form-data"
+
+	// The payload sent by the client isn't valid base64
+	ErrInvalidPayload = pandora.ApiError("payload should be encoded as base64")
+
+	// The body of a json request isn't a valid JSONMessage
+	ErrInvalidJSONMessage = pandora.ApiError("invalid json message")
+)
+
+// JSONMessage is the representation of a message used by requests and
+// responses with the application/json content type.
+//
+// Headers holds the same values used by the form encoding (sender, receiver, delay, ...)
+type JSONMessage struct {
+	Headers     url.Values `json:"headers"`
+	ContentType string     `json:"contentType,omitempty"`
+	// Body holds payloads with a json content type
+	Body json.RawMessage `json:"body,omitempty"`
+	// Data holds payloads of any other content type
+	Data []byte `json:"data,omitempty"`
+}
+
+// mediaType return the media type of a Content-Type header without the parameters
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// isJSON check if contentType is json, ie, application/json or application/*+json
+func isJSON(contentType string) bool {
+	mt := mediaType(contentType)
+	return mt == contentTypeJSON || (strings.HasPrefix(mt, "application/") && strings.HasSuffix(mt, "+json"))
+}
+
+// acceptsJSON check if the client prefers json responses
+func acceptsJSON(req *http.Request) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		if mediaType(accept) == contentTypeJSON {
+			return true
+		}
+	}
+	return false
+}
+
+// readBatch decode the json array sent as the body of a batch request,
+// the body is limited like the json messages of readSendRequest
+func readBatch(req *http.Request, items *[]url.Values) error {
+	in := io.LimitReader(req.Body, pandora.MaxPayloadSize*2)
+	if err := json.NewDecoder(in).Decode(items); err != nil {
+		return ErrInvalidBatch
+	}
+	return nil
+}
+
+// readSendRequest extract the envelope from req considering its content type:
+//
+// Form requests use the form values, json requests use a JSONMessage and any other
+// content type is used as the payload, with the headers in the query string.
+// The payload of those requests isn't read, see hasRawPayload.
+func readSendRequest(req *http.Request) (pandora.Envelope, error) {
+	switch mt := mediaType(req.Header.Get("Content-Type")); mt {
+	case "", contentTypeForm, contentTypeMultipart:
+		return readEnvelope(req.Form)
+	case contentTypeJSON:
+		var msg JSONMessage
+		// base64 data is 4/3 larger than the payload
+		in := io.LimitReader(req.Body, pandora.MaxPayloadSize*2)
+		if err := json.NewDecoder(in).Decode(&msg); err != nil {
+			return pandora.Envelope{}, ErrInvalidJSONMessage
+		}
+		if msg.Headers == nil {
+			msg.Headers = make(url.Values)
+		}
+		env, err := readEnvelope(msg.Headers)
+		if err != nil {
+			return env, err
+		}
+		if msg.Body != nil {
+			env.Payload = []byte(msg.Body)
+			env.ContentType = contentTypeJSON
+		} else if msg.Data != nil {
+			env.Payload = msg.Data
+		}
+		if len(msg.ContentType) > 0 {
+			env.ContentType = msg.ContentType
+		}
+		return env, nil
+	default:
+		env, err := readEnvelope(req.URL.Query())
+		env.ContentType = req.Header.Get("Content-Type")
+		return env, err
+	}
+}
+
+// hasRawPayload check if the body of req is the payload itself
+func hasRawPayload(req *http.Request) bool {
+	switch mediaType(req.Header.Get("Content-Type")) {
+	case "", contentTypeForm, contentTypeMultipart, contentTypeJSON:
+		return false
+	}
+	return true
+}
+
+// readRawPayload read the payload of env from body. Payloads up to ChunkSize
+// are kept in memory, larger ones are streamed to the BlobStore in chunks.
+func (ph *Handler) readRawPayload(env *pandora.Envelope, body io.Reader) error {
+	head, err := ioutil.ReadAll(io.LimitReader(body, pandora.ChunkSize+1))
+	if err != nil {
+		return err
+	}
+	if len(head) <= pandora.ChunkSize {
+		env.Payload = head
+		return nil
+	}
+	env.Manifest, err = ph.Server.WritePayload(io.MultiReader(bytes.NewReader(head), body))
+	return err
+}
+
+// writePayload add the payload of msg to values, encoded as base64
+func writePayload(values url.Values, msg *pandora.Message) {
+	if msg.Payload != nil {
+		values.Set(pandora.KeyPayload, base64.StdEncoding.EncodeToString(msg.Payload))
+	}
+}
+
+// messageOutput return the representation of msg negotiated with the client,
+// headers are always written to msg.Body
+func messageOutput(req *http.Request, msg *pandora.Message) interface{} {
+	if msg.Body == nil {
+		msg.Body = make(url.Values)
+	}
+	msg.WriteTo(msg.Body)
+	if !acceptsJSON(req) {
+		writePayload(msg.Body, msg)
+		return msg.Body
+	}
+	out := JSONMessage{
+		Headers:     msg.Body,
+		ContentType: msg.ContentType(),
+	}
+	var body json.RawMessage
+	if isJSON(out.ContentType) && json.Unmarshal(msg.Payload, &body) == nil {
+		out.Body = body
+	} else {
+		out.Data = msg.Payload
+	}
+	return jsonOutput{out}
+}
+
+// writeValues write val as json or form, depending on what the client accepts
+func writeValues(w http.ResponseWriter, req *http.Request, val url.Values) {
+	if acceptsJSON(req) {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(val)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeForm)
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, val.Encode())
+}
+
+// writeError write err as json or form, depending on what the client accepts
+func writeError(w http.ResponseWriter, req *http.Request, status int, err error) {
+	if acceptsJSON(req) {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "error=%v", url.QueryEscape(err.Error()))
+}
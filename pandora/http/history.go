@@ -0,0 +1,65 @@
+package http
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"github.com/andrebq/exp/pandora"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// History return the events of the message "mid" as a json array, ordered by the time they happened
+func (ph *Handler) History(req *http.Request) interface{} {
+	var mid pandora.SHA1Key
+	if err := (pandora.KeyPrinter{}).ReadString(&mid, req.Form.Get("mid")); err != nil {
+		return err
+	}
+	events, err := ph.Server.History(&mid)
+	if err == pandora.ErrKeyNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	final := make([]url.Values, len(events))
+	for i := range events {
+		final[i] = eventValues(&events[i])
+	}
+	return jsonOutput{final}
+}
+
+// eventValues return the representation of ev used by the responses
+func eventValues(ev *pandora.Event) url.Values {
+	out := make(url.Values)
+	out.Set("mid", pandora.PrintKeyString(ev.Mid))
+	out.Set("event", ev.Type)
+	out.Set("at", ev.At.Format(time.RFC3339Nano))
+	if len(ev.Client) > 0 {
+		out.Set("client", ev.Client)
+	}
+	if ev.Lid != nil {
+		out.Set("lid", pandora.PrintKeyString(ev.Lid))
+	}
+	if len(ev.Detail) > 0 {
+		out.Set("detail", ev.Detail)
+	}
+	return out
+}
@@ -0,0 +1,109 @@
+package http
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/json"
+	"github.com/andrebq/exp/pandora"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestPandoraAPIHistory(t *testing.T) {
+	server := mustCreateServer()
+	handler := &Handler{
+		Server:     server,
+		AllowAdmin: true,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	post := func(path string, form url.Values) (int, url.Values) {
+		res, err := http.PostForm(ts.URL+path, form)
+		if err != nil {
+			t.Fatalf("error posting to %v: %v", path, err)
+		}
+		defer res.Body.Close()
+		buf, _ := ioutil.ReadAll(res.Body)
+		values, _ := url.ParseQuery(string(buf))
+		return res.StatusCode, values
+	}
+
+	form := make(url.Values)
+	form.Set(pandora.KeySender, "a@local")
+	form.Set(pandora.KeyReceiver, "history@local")
+	code, sent := post("/send", form)
+	if code != http.StatusOK {
+		t.Fatalf("invalid status code. should be 200 got %v", code)
+	}
+	code, fetched := post("/fetch", url.Values{pandora.KeyReceiver: {"history@local"}})
+	if code != http.StatusOK {
+		t.Fatalf("invalid status code. should be 200 got %v", code)
+	}
+	ack := url.Values{
+		"mid":        {fetched.Get("mid")},
+		"lid":        {fetched.Get("lid")},
+		"statusCode": {strconv.Itoa(int(pandora.StatusConfirmed))},
+	}
+	if code, _ := post("/ack", ack); code != http.StatusOK {
+		t.Fatalf("error confirming: %v", code)
+	}
+
+	res, err := http.Get(ts.URL + "/admin/history?mid=" + sent.Get("mid"))
+	if err != nil {
+		t.Fatalf("error reading the history: %v", err)
+	}
+	var events []url.Values
+	err = json.NewDecoder(res.Body).Decode(&events)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("error decoding the history: %v", err)
+	}
+	expected := []string{pandora.EventEnqueued, pandora.EventLeased, pandora.EventConfirmed}
+	if len(events) != len(expected) {
+		t.Fatalf("expecting %v events got %v", len(expected), events)
+	}
+	for i, ev := range events {
+		if ev.Get("event") != expected[i] || ev.Get("mid") != sent.Get("mid") {
+			t.Errorf("event %v: expecting %v got %v", i, expected[i], ev)
+		}
+		if len(ev.Get("client")) == 0 {
+			t.Errorf("event %v: the client should be recorded", i)
+		}
+	}
+	if events[1].Get("lid") != fetched.Get("lid") {
+		t.Errorf("expecting lid %v got %v", fetched.Get("lid"), events[1].Get("lid"))
+	}
+
+	res, err = http.Get(ts.URL + "/admin/history?mid=" + pandora.PrintKeyString(&pandora.SHA1Key{}))
+	if err != nil {
+		t.Fatalf("error reading the history: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown messages should return 404 got %v", res.StatusCode)
+	}
+}
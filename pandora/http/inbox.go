@@ -0,0 +1,141 @@
+package http
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"github.com/andrebq/exp/pandora"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Inboxes list every inbox, with its policies and number of messages, as a json array
+func (ph *Handler) Inboxes(req *http.Request) interface{} {
+	inboxes, err := ph.Server.Inboxes(time.Now())
+	if err != nil {
+		return err
+	}
+	final := make([]url.Values, len(inboxes))
+	for i := range inboxes {
+		final[i] = inboxValues(&inboxes[i])
+	}
+	return jsonOutput{final}
+}
+
+// PauseInbox stop the delivery of the messages sent to receiver
+func (ph *Handler) PauseInbox(req *http.Request) interface{} {
+	return ph.changeInbox(req, func(inbox string) error {
+		return ph.Server.MessageStore.SetPaused(inbox, true)
+	})
+}
+
+// ResumeInbox restart the delivery of the messages sent to receiver
+func (ph *Handler) ResumeInbox(req *http.Request) interface{} {
+	return ph.changeInbox(req, func(inbox string) error {
+		return ph.Server.MessageStore.SetPaused(inbox, false)
+	})
+}
+
+// SetInboxLeaseTime change the lease used when the client doesn't inform one
+func (ph *Handler) SetInboxLeaseTime(req *http.Request) interface{} {
+	lease, err := time.ParseDuration(req.Form.Get(pandora.KeyLeaseTime))
+	if err != nil {
+		return err
+	}
+	return ph.changeInbox(req, func(inbox string) error {
+		return ph.Server.MessageStore.SetLeaseTime(inbox, lease)
+	})
+}
+
+// SetInboxMaxSize change the max number of pending messages of receiver
+func (ph *Handler) SetInboxMaxSize(req *http.Request) interface{} {
+	max, err := strconv.Atoi(req.Form.Get(pandora.KeyMaxSize))
+	if err != nil {
+		return err
+	}
+	return ph.changeInbox(req, func(inbox string) error {
+		return ph.Server.MessageStore.SetMaxSize(inbox, max)
+	})
+}
+
+// PurgeInbox remove every pending message of receiver,
+// the number of messages removed is returned under "count"
+func (ph *Handler) PurgeInbox(req *http.Request) interface{} {
+	return ph.removeMessages(req, ph.Server.PurgeInbox)
+}
+
+// DeleteInbox remove receiver and its dead inbox,
+// the number of messages removed is returned under "count"
+func (ph *Handler) DeleteInbox(req *http.Request) interface{} {
+	return ph.removeMessages(req, ph.Server.DeleteInbox)
+}
+
+// changeInbox apply fn to the receiver informed by the request
+func (ph *Handler) changeInbox(req *http.Request, fn func(string) error) interface{} {
+	if req.Method != "POST" {
+		return ErrPOSTRequired
+	}
+	err := fn(req.Form.Get(pandora.KeyReceiver))
+	if err == pandora.ErrInboxNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return http.StatusOK
+}
+
+// removeMessages apply fn to the receiver informed by the request
+func (ph *Handler) removeMessages(req *http.Request, fn func(string) (int, error)) interface{} {
+	if req.Method != "POST" {
+		return ErrPOSTRequired
+	}
+	count, err := fn(req.Form.Get(pandora.KeyReceiver))
+	if err == pandora.ErrInboxNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	resp := make(url.Values)
+	resp.Set("count", strconv.Itoa(count))
+	return resp
+}
+
+// inboxValues return the representation of box used by the responses
+func inboxValues(box *pandora.Inbox) url.Values {
+	out := make(url.Values)
+	out.Set(pandora.KeyReceiver, box.Name)
+	out.Set("createdAt", box.CreatedAt.Format(time.RFC3339Nano))
+	out.Set("paused", strconv.FormatBool(box.Paused))
+	if box.LeaseTime > 0 {
+		out.Set(pandora.KeyLeaseTime, box.LeaseTime.String())
+	}
+	out.Set(pandora.KeyMaxSize, strconv.Itoa(box.MaxSize))
+	out.Set(pandora.KeyMaxDelivery, strconv.Itoa(box.MaxDelivery))
+	out.Set(pandora.KeyFifo, strconv.FormatBool(box.Fifo))
+	out.Set(pandora.KeyDropExpired, strconv.FormatBool(box.DropExpired))
+	out.Set("ready", strconv.Itoa(box.Stats.Ready))
+	out.Set("leased", strconv.Itoa(box.Stats.Leased))
+	out.Set("delayed", strconv.Itoa(box.Stats.Delayed))
+	out.Set("dead", strconv.Itoa(box.Stats.Dead))
+	out.Set("timeouts", strconv.FormatInt(box.Stats.Timeouts, 10))
+	return out
+}
@@ -0,0 +1,144 @@
+package http
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/json"
+	"github.com/andrebq/exp/pandora"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPandoraAPIInboxes(t *testing.T) {
+	server := mustCreateServer()
+	handler := &Handler{
+		Server:     server,
+		AllowAdmin: true,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	post := func(path string, form url.Values) (int, url.Values) {
+		res, err := http.PostForm(ts.URL+path, form)
+		if err != nil {
+			t.Fatalf("error posting to %v: %v", path, err)
+		}
+		defer res.Body.Close()
+		buf, _ := ioutil.ReadAll(res.Body)
+		values, _ := url.ParseQuery(string(buf))
+		return res.StatusCode, values
+	}
+	send := func(i int) int {
+		form := make(url.Values)
+		form.Set(pandora.KeySender, "a@local")
+		form.Set(pandora.KeyReceiver, "b@local")
+		form.Set("n", strconv.Itoa(i))
+		code, _ := post("/send", form)
+		return code
+	}
+	receiver := url.Values{pandora.KeyReceiver: {"b@local"}}
+
+	// the policies of unknown inboxes can't be changed
+	if code, _ := post("/admin/inbox/maxSize", url.Values{pandora.KeyReceiver: {"b@local"}, pandora.KeyMaxSize: {"2"}}); code != http.StatusNotFound {
+		t.Fatalf("expecting %v got %v", http.StatusNotFound, code)
+	}
+	if code := send(0); code != http.StatusOK {
+		t.Fatalf("invalid status code. should be 200 got %v", code)
+	}
+	if code, _ := post("/admin/inbox/maxSize", url.Values{pandora.KeyReceiver: {"b@local"}, pandora.KeyMaxSize: {"2"}}); code != http.StatusOK {
+		t.Fatalf("error changing the max size: %v", code)
+	}
+	for i := 1; i < 2; i++ {
+		if code := send(i); code != http.StatusOK {
+			t.Fatalf("invalid status code. should be 200 got %v", code)
+		}
+	}
+	if code := send(2); code != http.StatusBadRequest {
+		t.Errorf("a full inbox should return 400 got %v", code)
+	}
+
+	res, err := http.Get(ts.URL + "/admin/inboxes")
+	if err != nil {
+		t.Fatalf("error listing inboxes: %v", err)
+	}
+	var inboxes []url.Values
+	err = json.NewDecoder(res.Body).Decode(&inboxes)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("error decoding inboxes: %v", err)
+	}
+	var found url.Values
+	for _, box := range inboxes {
+		if box.Get(pandora.KeyReceiver) == "b@local" {
+			found = box
+		}
+	}
+	if found.Get("ready") != "2" || found.Get(pandora.KeyMaxSize) != "2" || found.Get("paused") != "false" {
+		t.Errorf("unexpected inbox %v", found)
+	}
+
+	if code, _ := post("/admin/inbox/pause", receiver); code != http.StatusOK {
+		t.Fatalf("error pausing: %v", code)
+	}
+	if code, _ := post("/fetch", receiver); code != http.StatusNoContent {
+		t.Errorf("a paused inbox shouldn't deliver messages, got %v", code)
+	}
+	if code, _ := post("/admin/inbox/resume", receiver); code != http.StatusOK {
+		t.Fatalf("error resuming: %v", code)
+	}
+
+	if code, _ := post("/admin/inbox/leaseTime", url.Values{pandora.KeyReceiver: {"b@local"}, pandora.KeyLeaseTime: {"1m"}}); code != http.StatusOK {
+		t.Fatalf("error changing the lease time: %v", code)
+	}
+	code, fetched := post("/fetch", receiver)
+	if code != http.StatusOK {
+		t.Fatalf("invalid status code. should be 200 got %v", code)
+	}
+	leasedUntil, _ := time.Parse(time.RFC3339Nano, fetched.Get("leasedUntil"))
+	if lease := leasedUntil.Sub(time.Now()); lease > time.Minute || lease < time.Second*50 {
+		t.Errorf("expecting the lease time of the inbox got %v", lease)
+	}
+
+	code, purged := post("/admin/inbox/purge", receiver)
+	if code != http.StatusOK || purged.Get("count") != "2" {
+		t.Errorf("expecting 2 messages purged got %v / %v", code, purged)
+	}
+	if code := send(3); code != http.StatusOK {
+		t.Errorf("a purged inbox should accept messages, got %v", code)
+	}
+
+	code, deleted := post("/admin/inbox/delete", receiver)
+	if code != http.StatusOK || deleted.Get("count") != "1" {
+		t.Errorf("expecting 1 message deleted got %v / %v", code, deleted)
+	}
+	if code, _ := post("/admin/inbox/delete", receiver); code != http.StatusNotFound {
+		t.Errorf("deleting twice should return 404 got %v", code)
+	}
+	if code, _ := post("/admin/inbox/purge", receiver); code != http.StatusNotFound {
+		t.Errorf("purging a deleted inbox should return 404 got %v", code)
+	}
+}
@@ -0,0 +1,111 @@
+package http
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+import (
+	"bytes"
+	"fmt"
+	"github.com/andrebq/exp/pandora"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Metrics output the metrics of the server using the prometheus text format
+func (ph *Handler) Metrics(req *http.Request) interface{} {
+	inboxes, err := ph.Server.InboxStats()
+	if err != nil {
+		return err
+	}
+	usage, err := ph.Server.BlobUsage()
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	writeMetrics(buf, &ph.Server.Metrics, inboxes, usage)
+	return buf.String()
+}
+
+// Health check if the stores used by the server are available,
+// 503 is returned if any of them isn't
+func (ph *Handler) Health(req *http.Request) interface{} {
+	if err := ph.Server.Health(); err != nil {
+		log.Printf("[PANDORA-HANDLER-health] %v", err)
+		return http.StatusServiceUnavailable
+	}
+	return "ok"
+}
+
+func writeMetrics(w io.Writer, m *pandora.Metrics, inboxes []pandora.InboxStats, usage pandora.BlobUsage) {
+	writeCounter(w, "pandora_messages_sent_total", "Messages sent.", m.Sent.Value())
+	writeCounter(w, "pandora_messages_fetched_total", "Messages fetched.", m.Fetched.Value())
+	writeCounter(w, "pandora_messages_redelivered_total", "Messages fetched more than once.", m.Redelivered.Value())
+	writeCounter(w, "pandora_messages_expired_total", "Messages expired before being delivered.", m.Expired.Value())
+
+	writeHelp(w, "pandora_messages_acked_total", "counter", "Messages acked, by status.")
+	fmt.Fprintf(w, "pandora_messages_acked_total{status=\"confirmed\"} %d\n", m.Confirmed.Value())
+	fmt.Fprintf(w, "pandora_messages_acked_total{status=\"rejected\"} %d\n", m.Rejected.Value())
+
+	writeHelp(w, "pandora_request_duration_seconds", "histogram", "Latency of the server operations.")
+	writeHistogram(w, "pandora_request_duration_seconds", "send", &m.SendLatency)
+	writeHistogram(w, "pandora_request_duration_seconds", "fetch", &m.FetchLatency)
+	writeHistogram(w, "pandora_request_duration_seconds", "ack", &m.AckLatency)
+
+	writeHelp(w, "pandora_inbox_messages", "gauge", "Messages of each inbox, by state.")
+	for _, st := range inboxes {
+		inbox := labelEscaper.Replace(st.Inbox)
+		fmt.Fprintf(w, "pandora_inbox_messages{inbox=\"%s\",state=\"ready\"} %d\n", inbox, st.Ready)
+		fmt.Fprintf(w, "pandora_inbox_messages{inbox=\"%s\",state=\"leased\"} %d\n", inbox, st.Leased)
+		fmt.Fprintf(w, "pandora_inbox_messages{inbox=\"%s\",state=\"delayed\"} %d\n", inbox, st.Delayed)
+		fmt.Fprintf(w, "pandora_inbox_messages{inbox=\"%s\",state=\"dead\"} %d\n", inbox, st.Dead)
+	}
+	writeHelp(w, "pandora_lease_timeouts_total", "counter", "Leases that expired before an ack.")
+	for _, st := range inboxes {
+		fmt.Fprintf(w, "pandora_lease_timeouts_total{inbox=\"%s\"} %d\n", labelEscaper.Replace(st.Inbox), st.Timeouts)
+	}
+
+	writeHelp(w, "pandora_blobs", "gauge", "Blobs saved in the blob store.")
+	fmt.Fprintf(w, "pandora_blobs %d\n", usage.Count)
+	writeHelp(w, "pandora_blob_bytes", "gauge", "Size of the blobs saved in the blob store.")
+	fmt.Fprintf(w, "pandora_blob_bytes %d\n", usage.Bytes)
+}
+
+func writeHelp(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounter(w io.Writer, name, help string, value int64) {
+	writeHelp(w, name, "counter", help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func writeHistogram(w io.Writer, name, op string, h *pandora.Histogram) {
+	counts, sum, count := h.Snapshot()
+	for i, bound := range pandora.LatencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{op=\"%s\",le=\"%s\"} %d\n", name, op, strconv.FormatFloat(bound, 'g', -1, 64), counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{op=\"%s\",le=\"+Inf\"} %d\n", name, op, count)
+	fmt.Fprintf(w, "%s_sum{op=\"%s\"} %s\n", name, op, strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{op=\"%s\"} %d\n", name, op, count)
+}
@@ -0,0 +1,111 @@
+package http
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+import (
+	"github.com/andrebq/exp/pandora"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPandoraAPIMetrics(t *testing.T) {
+	server := mustCreateServer()
+	handler := &Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	for i, delay := range []string{"0s", "0s", "1h"} {
+		msg := make(url.Values)
+		msg.Set("id", strconv.Itoa(i))
+		msg.Set(pandora.KeySender, "a@local")
+		msg.Set(pandora.KeyReceiver, "b@local")
+		msg.Set("delay", delay)
+		res, err := http.PostForm(ts.URL+"/send", msg)
+		if err != nil {
+			t.Fatalf("error sending: %v", err)
+		}
+		res.Body.Close()
+	}
+	if _, err := server.FetchLatest("b@local", time.Minute); err != nil {
+		t.Fatalf("error fetching: %v", err)
+	}
+
+	res, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("error reading metrics: %v", err)
+	}
+	buf, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status code. should be 200 got %v", res.StatusCode)
+	}
+	for _, line := range []string{
+		"pandora_messages_sent_total 3",
+		"pandora_messages_fetched_total 1",
+		`pandora_inbox_messages{inbox="b@local",state="ready"} 1`,
+		`pandora_inbox_messages{inbox="b@local",state="leased"} 1`,
+		`pandora_inbox_messages{inbox="b@local",state="delayed"} 1`,
+		`pandora_inbox_messages{inbox="b@local",state="dead"} 0`,
+		`pandora_request_duration_seconds_count{op="send"} 3`,
+		"pandora_blobs 3",
+	} {
+		if !strings.Contains(string(buf), line+"\n") {
+			t.Errorf("metrics should contain %q:\n%s", line, buf)
+		}
+	}
+}
+
+func TestPandoraAPIHealth(t *testing.T) {
+	handler := &Handler{
+		Server: mustCreateServer(),
+		Auth:   &TokenAuth{},
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// health checks are allowed without a token
+	res, err := http.Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("error checking health: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("invalid status code. should be 200 got %v", res.StatusCode)
+	}
+
+	res, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("error reading metrics: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("metrics require a token. got %v", res.StatusCode)
+	}
+}
@@ -0,0 +1,122 @@
+package http
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+import (
+	"encoding/base64"
+	"github.com/andrebq/exp/pandora"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// AddSchedule register a recurring message, the form holds the same values
+// used by Enqueue plus the spec and an optional scheduleId.
+//
+// An existing schedule is replaced only if the principal can also send
+// its messages.
+func (ph *Handler) AddSchedule(req *http.Request) interface{} {
+	if req.Method != "POST" {
+		return ErrPOSTRequired
+	}
+	sch := pandora.Schedule{
+		Id:   req.Form.Get(pandora.KeyScheduleId),
+		Spec: req.Form.Get(pandora.KeySpec),
+	}
+	req.Form.Del(pandora.KeyScheduleId)
+	req.Form.Del(pandora.KeySpec)
+	env, err := readEnvelope(req.Form)
+	if err != nil {
+		return err
+	}
+	if err := ph.checkSend(req, env.Sender, env.Receiver); err != nil {
+		return err
+	}
+	if len(sch.Id) > 0 {
+		old, err := ph.Server.Schedule(sch.Id)
+		if err == nil {
+			err = ph.checkSend(req, old.Envelope.Sender, old.Envelope.Receiver)
+		} else if err == pandora.ErrScheduleNotFound {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	sch.Envelope = env
+	sch, err = ph.Server.AddSchedule(sch)
+	if err != nil {
+		return err
+	}
+	return scheduleValues(&sch)
+}
+
+// Schedules list every schedule as a json array
+func (ph *Handler) Schedules(req *http.Request) interface{} {
+	schedules, err := ph.Server.Schedules()
+	if err != nil {
+		return err
+	}
+	final := make([]url.Values, len(schedules))
+	for i := range schedules {
+		final[i] = scheduleValues(&schedules[i])
+	}
+	return jsonOutput{final}
+}
+
+// CancelSchedule remove the schedule informed by scheduleId
+func (ph *Handler) CancelSchedule(req *http.Request) interface{} {
+	if req.Method != "POST" {
+		return ErrPOSTRequired
+	}
+	if err := ph.Server.CancelSchedule(req.Form.Get(pandora.KeyScheduleId)); err == pandora.ErrScheduleNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return http.StatusOK
+}
+
+// scheduleValues return the representation of sch used by the responses,
+// the body of the message is included with the routing headers
+func scheduleValues(sch *pandora.Schedule) url.Values {
+	out := make(url.Values)
+	for k, v := range sch.Envelope.Body {
+		out[k] = v
+	}
+	out.Set(pandora.KeyScheduleId, sch.Id)
+	out.Set(pandora.KeySpec, sch.Spec)
+	out.Set(pandora.KeySender, sch.Envelope.Sender)
+	out.Set(pandora.KeyReceiver, sch.Envelope.Receiver)
+	out.Set("nextRun", sch.NextRun.Format(time.RFC3339Nano))
+	out.Set("createdAt", sch.CreatedAt.Format(time.RFC3339Nano))
+	if sch.Envelope.Priority != 0 {
+		out.Set(pandora.KeyPriority, strconv.Itoa(sch.Envelope.Priority))
+	}
+	if len(sch.Envelope.Group) > 0 {
+		out.Set(pandora.KeyGroup, sch.Envelope.Group)
+	}
+	if sch.Envelope.Payload != nil {
+		out.Set(pandora.KeyPayload, base64.StdEncoding.EncodeToString(sch.Envelope.Payload))
+		out.Set(pandora.KeyContentType, sch.Envelope.ContentType)
+	}
+	return out
+}
@@ -0,0 +1,153 @@
+package http
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+import (
+	"encoding/json"
+	"github.com/andrebq/exp/pandora"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPandoraAPISchedules(t *testing.T) {
+	server := mustCreateServer()
+	handler := &Handler{
+		Server:     server,
+		AllowAdmin: true,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	form := make(url.Values)
+	form.Set(pandora.KeySender, "a@local")
+	form.Set(pandora.KeyReceiver, "b@local")
+	form.Set(pandora.KeySpec, "not a spec")
+	res, err := http.PostForm(ts.URL+"/schedule", form)
+	if err != nil {
+		t.Fatalf("error scheduling: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid spec should return 400 got %v", res.StatusCode)
+	}
+
+	form.Set(pandora.KeySpec, "0 8 * * 1-5")
+	form.Set(pandora.KeyScheduleId, "standup")
+	form.Set("info", "meeting")
+	res, err = http.PostForm(ts.URL+"/schedule", form)
+	if err != nil {
+		t.Fatalf("error scheduling: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status code. should be 200 got %v", res.StatusCode)
+	}
+
+	res, err = http.Get(ts.URL + "/admin/schedules")
+	if err != nil {
+		t.Fatalf("error listing schedules: %v", err)
+	}
+	var schedules []url.Values
+	err = json.NewDecoder(res.Body).Decode(&schedules)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("error decoding schedules: %v", err)
+	}
+	if len(schedules) != 1 || schedules[0].Get(pandora.KeyScheduleId) != "standup" || schedules[0].Get("info") != "meeting" {
+		t.Fatalf("unexpected schedules %v", schedules)
+	}
+
+	cancel := url.Values{pandora.KeyScheduleId: {"standup"}}
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		res, err = http.PostForm(ts.URL+"/admin/schedule/cancel", cancel)
+		if err != nil {
+			t.Fatalf("error canceling schedule: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != expected {
+			t.Errorf("expecting %v got %v", expected, res.StatusCode)
+		}
+	}
+}
+
+func TestPandoraAPIScheduleAuth(t *testing.T) {
+	auth := &TokenAuth{}
+	auth.AddToken("user", &Principal{
+		Name:      "user",
+		Mailboxes: []string{"*@local"},
+		SendTo:    []string{"*@local"},
+	})
+	auth.AddToken("remote", &Principal{
+		Name:      "remote",
+		Mailboxes: []string{"*@remote"},
+		SendTo:    []string{"*@remote"},
+	})
+	handler := &Handler{
+		Server: mustCreateServer(),
+		Auth:   auth,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	post := func(token string, form url.Values) int {
+		req, _ := http.NewRequest("POST", ts.URL+"/schedule", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error scheduling: %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	form := make(url.Values)
+	form.Set(pandora.KeySender, "a@remote")
+	form.Set(pandora.KeyReceiver, "b@remote")
+	form.Set(pandora.KeySpec, "@every 5m")
+	form.Set(pandora.KeyScheduleId, "report")
+	if code := post("remote", form); code != http.StatusOK {
+		t.Fatalf("error scheduling: status %v", code)
+	}
+
+	form.Set(pandora.KeySender, "a@local")
+	form.Set(pandora.KeyReceiver, "b@local")
+	if code := post("user", form); code != http.StatusForbidden {
+		t.Errorf("replacing the schedule of a@remote: expecting %v got %v", http.StatusForbidden, code)
+	}
+	sch, err := handler.Server.Schedule("report")
+	if err != nil {
+		t.Fatalf("error reading schedule: %v", err)
+	}
+	if sch.Envelope.Sender != "a@remote" {
+		t.Errorf("expecting %v got %v", "a@remote", sch.Envelope.Sender)
+	}
+
+	form.Set(pandora.KeySender, "c@remote")
+	form.Set(pandora.KeyReceiver, "b@remote")
+	if code := post("remote", form); code != http.StatusOK {
+		t.Errorf("replacing by the owner: expecting %v got %v", http.StatusOK, code)
+	}
+}
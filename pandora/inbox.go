@@ -0,0 +1,99 @@
+package pandora
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"time"
+)
+
+const (
+	// The inbox doesn't exist
+	ErrInboxNotFound = ApiError("inbox not found")
+
+	// The inbox reached its max size and can't receive more messages
+	ErrInboxFull = ApiError("inbox is full")
+
+	// Key used to inform the max number of pending messages of a inbox
+	KeyMaxSize = "maxSize"
+)
+
+// Inbox holds the policies of a inbox
+type Inbox struct {
+	Name      string
+	CreatedAt time.Time
+	// Paused inboxes accept messages but don't deliver them
+	Paused bool
+	// LeaseTime is used when the client doesn't inform one,
+	// if 0 DefaultLeaseTime is used
+	LeaseTime time.Duration
+	// MaxSize is the max number of pending messages, if 0 there is no limit
+	MaxSize     int
+	MaxDelivery int
+	Fifo        bool
+	DropExpired bool
+	// Stats holds the number of messages of the inbox, filled only by Server.Inboxes
+	Stats InboxStats
+}
+
+// Inboxes return every inbox with the number of its messages, ordered by name.
+// Dead inboxes aren't returned, their messages are counted by the original inbox.
+func (s *Server) Inboxes(now time.Time) ([]Inbox, error) {
+	inboxes, err := s.MessageStore.Inboxes()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := s.MessageStore.InboxStats(now)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]InboxStats, len(stats))
+	for _, st := range stats {
+		byName[st.Inbox] = st
+	}
+	for i := range inboxes {
+		inboxes[i].Stats = byName[inboxes[i].Name]
+		inboxes[i].Stats.Inbox = inboxes[i].Name
+	}
+	return inboxes, nil
+}
+
+// PurgeInbox remove every pending message of inbox, the messages in the
+// dead inbox are kept.
+//
+// Returns the number of messages removed
+func (s *Server) PurgeInbox(inbox string) (int, error) {
+	keys, err := s.MessageStore.PurgeMessages(inbox)
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), s.releaseBlobs(keys)
+}
+
+// DeleteInbox remove inbox, its dead inbox, their messages and subscriptions.
+//
+// Returns the number of messages removed
+func (s *Server) DeleteInbox(inbox string) (int, error) {
+	keys, err := s.MessageStore.DeleteInbox(inbox)
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), s.releaseBlobs(keys)
+}
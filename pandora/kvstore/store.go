@@ -0,0 +1,1816 @@
+package kvstore
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/andrebq/exp/pandora"
+	"github.com/cznic/kv"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrKeyNotFound = pandora.ErrKeyNotFound
+
+	prefixBlob     = []byte("b/")
+	prefixBlobRef  = []byte("r/")
+	prefixBlobTime = []byte("u/")
+	prefixInbox    = []byte("i/")
+	prefixInboxId  = []byte("n/")
+	prefixMessage  = []byte("m/")
+	prefixQueue    = []byte("q/")
+	prefixLease    = []byte("l/")
+	prefixTopic    = []byte("t/")
+	prefixDedup    = []byte("d/")
+	prefixSchedule = []byte("s/")
+	prefixExpire   = []byte("e/")
+	prefixHistory  = []byte("h/")
+	keySeq         = []byte("seq/messages")
+	keyHistorySeq  = []byte("seq/history")
+	keyRefsCounted = []byte("meta/refs")
+)
+
+// messageRecord is the value stored under the message key
+type messageRecord struct {
+	Id            int64
+	Mid           []byte
+	Bid           []byte
+	Lid           []byte
+	LeasedUntil   time.Time
+	Status        pandora.AckStatus
+	ReceivedAt    time.Time
+	SendWhen      time.Time
+	DeliveryCount int
+	SenderId      int64
+	ReceiverId    int64
+	Reason        string
+	Priority      int
+	Group         string
+	DedupKey      string
+	DedupUntil    time.Time
+	ExpiresAt     time.Time
+}
+
+// eventRecord is the value stored under the history key
+type eventRecord struct {
+	Type   string
+	At     time.Time
+	Client string
+	Lid    []byte
+	Detail string
+}
+
+// bodyKey return the key of the body in the BlobStore
+func (r *messageRecord) bodyKey() pandora.Key {
+	key := &pandora.SHA1Key{}
+	if r.Bid != nil {
+		copy(key.Bytes(), r.Bid)
+	} else {
+		copy(key.Bytes(), r.Mid)
+	}
+	return key
+}
+
+// inboxRecord is the value stored under the inbox key
+type inboxRecord struct {
+	Id          int64
+	Name        string
+	MaxDelivery int
+	Fifo        bool
+	Timeouts    int64
+	CreatedAt   time.Time
+	DropExpired bool
+	Paused      bool
+	LeaseTime   time.Duration
+	MaxSize     int
+}
+
+func (r *messageRecord) header(msg *pandora.Message) {
+	msg.Mid = &pandora.SHA1Key{}
+	copy(msg.Mid.Bytes(), r.Mid)
+	if r.Bid != nil {
+		msg.Bid = &pandora.SHA1Key{}
+		copy(msg.Bid.Bytes(), r.Bid)
+	}
+	msg.Status = r.Status
+	msg.ReceivedAt = r.ReceivedAt
+	msg.SendWhen = r.SendWhen
+	msg.DeliveryCount = r.DeliveryCount
+	msg.Reason = r.Reason
+	msg.Priority = r.Priority
+	msg.Group = r.Group
+	msg.DedupKey = r.DedupKey
+	msg.DedupUntil = r.DedupUntil
+	msg.ExpiresAt = r.ExpiresAt
+}
+
+// expired check if the record expired at now
+func (r *messageRecord) expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !r.ExpiresAt.After(now)
+}
+
+// Store holds the kv database shared by the MessageStore and the BlobStore.
+//
+// All operations are serialized, the kv transactions aren't isolated between
+// goroutines.
+type Store struct {
+	sync.Mutex
+	db *kv.DB
+}
+
+// Open opens the store saved at filename, if the file doesn't exist
+// it is created.
+//
+// If filename is empty, a memory-only store is returned
+func Open(filename string) (*Store, error) {
+	var db *kv.DB
+	var err error
+	opt := &kv.Options{}
+	if len(filename) == 0 {
+		db, err = kv.CreateMem(opt)
+	} else if _, err = os.Stat(filename); os.IsNotExist(err) {
+		db, err = kv.Create(filename, opt)
+	} else {
+		db, err = kv.Open(filename, opt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{db: db}
+	if err := s.countRefs(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// countRefs add the references of the pending messages to the blobs saved
+// before the ref-count was kept, otherwise the GC would remove their bodies.
+//
+// Only blobs without references are changed and it runs once per store
+func (s *Store) countRefs() error {
+	return s.doInsideTransaction(func(db *kv.DB) error {
+		done, err := db.Get(nil, keyRefsCounted)
+		if err != nil || done != nil {
+			return err
+		}
+		refs := make(map[string]int64)
+		err = scan(db, prefixMessage, func(k, v []byte) (bool, error) {
+			rec := &messageRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return false, err
+			}
+			if rec.Status != pandora.StatusConfirmed {
+				body := rec.Bid
+				if len(body) == 0 {
+					body = rec.Mid
+				}
+				refs[string(body)]++
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+		for body, count := range refs {
+			refKey := append(copyBytes(prefixBlobRef), body...)
+			val, err := db.Get(nil, refKey)
+			if err != nil {
+				return err
+			}
+			if len(val) != 8 || int64(binary.BigEndian.Uint64(val)) > 0 {
+				continue
+			}
+			if _, err := db.Inc(refKey, count); err != nil {
+				return err
+			}
+		}
+		return db.Set(keyRefsCounted, []byte{1})
+	})
+}
+
+// Close the store
+func (s *Store) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.db.Close()
+}
+
+// MessageStore returns the pandora.MessageStore backed by this store
+func (s *Store) MessageStore() *MessageStore {
+	return &MessageStore{s: s}
+}
+
+// BlobStore returns the pandora.BlobStore backed by this store
+func (s *Store) BlobStore() *BlobStore {
+	return &BlobStore{s: s}
+}
+
+// ping read a single key from the database
+func (s *Store) ping() error {
+	return s.doInsideTransaction(func(db *kv.DB) error {
+		_, err := db.Get(nil, keySeq)
+		return err
+	})
+}
+
+func (s *Store) doInsideTransaction(fn func(db *kv.DB) error) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	err = s.db.BeginTransaction()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// if we had a panic
+		// ensure that we rollback
+		// and resend the panic
+		if p := recover(); p != nil {
+			s.db.Rollback()
+			panic(p)
+		}
+		if err == nil {
+			err = s.db.Commit()
+		} else {
+			s.db.Rollback()
+		}
+	}()
+	err = fn(s.db)
+	return
+}
+
+// MessageStore implements pandora.MessageStore using a kv database as backend
+type MessageStore struct {
+	s *Store
+}
+
+// DeleteMessages remove all messages from the store
+func (ms *MessageStore) DeleteMessages() error {
+	return ms.s.doInsideTransaction(func(db *kv.DB) error {
+		for _, prefix := range [][]byte{prefixMessage, prefixQueue, prefixLease, prefixDedup, prefixHistory} {
+			keys, err := scanKeys(db, prefix)
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if err := db.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Enqueue will place the message inside the receiver inbox
+func (ms *MessageStore) Enqueue(msg *pandora.Message) error {
+	return ms.s.doInsideTransaction(func(db *kv.DB) error {
+		return enqueueMessage(db, msg)
+	})
+}
+
+// EnqueueBatch will place every message inside its receiver inbox
+func (ms *MessageStore) EnqueueBatch(msgs []*pandora.Message) ([]error, error) {
+	errs := make([]error, len(msgs))
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		for i, msg := range msgs {
+			errs[i] = enqueueMessage(db, msg)
+			if _, ok := errs[i].(pandora.ApiError); errs[i] != nil && !ok {
+				return errs[i]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// FetchAndLockLatest will read and lock the latest message for the given receiver
+func (ms *MessageStore) FetchAndLockLatest(recv string, dur time.Duration) (*pandora.Message, error) {
+	var msg pandora.Message
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		return fetchLatestMessage(&msg, db, recv, time.Now(), dur)
+	})
+	return &msg, err
+}
+
+// FetchAndLockBatch will read and lock up to max messages for the given receiver
+func (ms *MessageStore) FetchAndLockBatch(recv string, dur time.Duration, max int) ([]*pandora.Message, error) {
+	var msgs []*pandora.Message
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		var err error
+		msgs, err = fetchAndLock(db, recv, time.Now(), dur, max)
+		return err
+	})
+	return msgs, err
+}
+
+// FetchHeaders output at least len(out) messages headers
+func (ms *MessageStore) FetchHeaders(out []pandora.Message, recv string, receivedAt time.Time) (int, error) {
+	var actual []pandora.Message
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		var err error
+		actual, err = fetchHeaders(out, db, recv, time.Now(), receivedAt)
+		return err
+	})
+	return len(actual), err
+}
+
+// Ack will change the status of the message, only if lid is still valid
+func (ms *MessageStore) Ack(mid, lid pandora.Key, status pandora.AckStatus) error {
+	return ms.s.doInsideTransaction(func(db *kv.DB) error {
+		return ackMessage(db, mid, lid, status)
+	})
+}
+
+// AckBatch will change the status of every message, only if the lid is still valid
+func (ms *MessageStore) AckBatch(acks []pandora.AckRequest) ([]error, error) {
+	errs := make([]error, len(acks))
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		for i, ack := range acks {
+			errs[i] = ackMessage(db, ack.Mid, ack.Lid, ack.Status)
+			if _, ok := errs[i].(pandora.ApiError); errs[i] != nil && !ok {
+				return errs[i]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// ExtendLease keeps the message locked for dur, only if lid is still valid
+func (ms *MessageStore) ExtendLease(mid, lid pandora.Key, dur time.Duration, rotate bool) (*pandora.Message, error) {
+	var msg pandora.Message
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		now := time.Now()
+		rec, err := getMessage(db, mid.Bytes())
+		if err != nil {
+			return err
+		}
+		if rec == nil || rec.Lid == nil ||
+			!bytes.Equal(rec.Lid, lid.Bytes()) ||
+			rec.LeasedUntil.Before(now) {
+			return pandora.ErrInvalidLease
+		}
+		if err := db.Delete(leaseKey(rec)); err != nil {
+			return err
+		}
+		rec.header(&msg)
+		msg.CalcualteLeaseFor(now, dur)
+		if rotate {
+			rec.Lid = copyBytes(msg.Lid.Bytes())
+		} else {
+			msg.Lid = &pandora.SHA1Key{}
+			copy(msg.Lid.Bytes(), rec.Lid)
+		}
+		rec.LeasedUntil = msg.LeasedUntil
+		if err := db.Set(leaseKey(rec), rec.Mid); err != nil {
+			return err
+		}
+		return putMessage(db, rec)
+	})
+	return &msg, err
+}
+
+// SetMaxDelivery change how many times a message from inbox can be delivered
+// before being moved to the dead inbox
+func (ms *MessageStore) SetMaxDelivery(inbox string, max int) error {
+	return ms.changeInbox(inbox, func(box *inboxRecord) { box.MaxDelivery = max })
+}
+
+// SetFifo enable or disable the strict fifo mode of inbox
+func (ms *MessageStore) SetFifo(inbox string, fifo bool) error {
+	return ms.changeInbox(inbox, func(box *inboxRecord) { box.Fifo = fifo })
+}
+
+// SetDropExpired change if the expired messages of inbox are removed
+// or moved to the dead inbox
+func (ms *MessageStore) SetDropExpired(inbox string, drop bool) error {
+	return ms.changeInbox(inbox, func(box *inboxRecord) { box.DropExpired = drop })
+}
+
+// SetPaused pause or resume the delivery of the messages of inbox
+func (ms *MessageStore) SetPaused(inbox string, paused bool) error {
+	return ms.changeInbox(inbox, func(box *inboxRecord) { box.Paused = paused })
+}
+
+// SetLeaseTime change the lease used when the client doesn't inform one
+func (ms *MessageStore) SetLeaseTime(inbox string, lease time.Duration) error {
+	return ms.changeInbox(inbox, func(box *inboxRecord) { box.LeaseTime = lease })
+}
+
+// SetMaxSize change the max number of pending messages of inbox
+func (ms *MessageStore) SetMaxSize(inbox string, max int) error {
+	return ms.changeInbox(inbox, func(box *inboxRecord) { box.MaxSize = max })
+}
+
+// changeInbox apply fn to the record of inbox and save it,
+// ErrInboxNotFound is returned if the inbox doesn't exist
+func (ms *MessageStore) changeInbox(inbox string, fn func(box *inboxRecord)) error {
+	return ms.s.doInsideTransaction(func(db *kv.DB) error {
+		box, err := findInbox(db, inbox, false)
+		if err == pandora.ErrSenderNotFound {
+			return pandora.ErrInboxNotFound
+		} else if err != nil {
+			return err
+		}
+		fn(box)
+		return putInbox(db, box)
+	})
+}
+
+// Inboxes return the policies of every inbox that isn't a dead inbox
+func (ms *MessageStore) Inboxes() ([]pandora.Inbox, error) {
+	var inboxes []pandora.Inbox
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		return scan(db, prefixInbox, func(k, v []byte) (bool, error) {
+			box := &inboxRecord{}
+			if err := json.Unmarshal(v, box); err != nil {
+				return false, err
+			}
+			if !strings.HasSuffix(box.Name, pandora.DeadInboxSuffix) {
+				inboxes = append(inboxes, pandora.Inbox{
+					Name:        box.Name,
+					CreatedAt:   box.CreatedAt,
+					Paused:      box.Paused,
+					LeaseTime:   box.LeaseTime,
+					MaxSize:     box.MaxSize,
+					MaxDelivery: box.MaxDelivery,
+					Fifo:        box.Fifo,
+					DropExpired: box.DropExpired,
+				})
+			}
+			return true, nil
+		})
+	})
+	return inboxes, err
+}
+
+// PurgeMessages remove every pending message of inbox
+func (ms *MessageStore) PurgeMessages(inbox string) ([]pandora.Key, error) {
+	var bodies []pandora.Key
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		box, err := findInbox(db, inbox, false)
+		if err == pandora.ErrSenderNotFound {
+			return pandora.ErrInboxNotFound
+		} else if err != nil {
+			return err
+		}
+		bodies, err = purgeQueue(db, box)
+		return err
+	})
+	return bodies, err
+}
+
+// DeleteInbox remove inbox and its dead inbox
+func (ms *MessageStore) DeleteInbox(inbox string) ([]pandora.Key, error) {
+	var bodies []pandora.Key
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		box, err := findInbox(db, inbox, false)
+		if err == pandora.ErrSenderNotFound {
+			return pandora.ErrInboxNotFound
+		} else if err != nil {
+			return err
+		}
+		if bodies, err = deleteInbox(db, box); err != nil {
+			return err
+		}
+		dead, err := findInbox(db, pandora.DeadInbox(inbox), false)
+		if err == pandora.ErrSenderNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		removed, err := deleteInbox(db, dead)
+		bodies = append(bodies, removed...)
+		return err
+	})
+	return bodies, err
+}
+
+// FetchDeadLetters output at least len(out) messages from the dead inbox
+func (ms *MessageStore) FetchDeadLetters(out []pandora.Message, inbox string) (int, error) {
+	var found []*messageRecord
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		var err error
+		found, err = deadLetters(db, inbox, nil)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Sort(byReceivedAt(found))
+	var idx int
+	for idx < len(out) && idx < len(found) {
+		found[idx].header(&out[idx])
+		idx++
+	}
+	return idx, nil
+}
+
+// ReplayDeadLetters move the messages from the dead inbox back to inbox
+func (ms *MessageStore) ReplayDeadLetters(inbox string, mid pandora.Key) (int, error) {
+	var count int
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		found, err := deadLetters(db, inbox, mid)
+		if err != nil || len(found) == 0 {
+			return err
+		}
+		box, err := findInbox(db, inbox, false)
+		if err != nil {
+			return err
+		}
+		for _, rec := range found {
+			if err := db.Delete(queueKey(rec)); err != nil {
+				return err
+			}
+			rec.ReceiverId = box.Id
+			rec.Status = pandora.StatusNotDelivered
+			rec.DeliveryCount = 0
+			rec.Reason = ""
+			if !rec.ExpiresAt.IsZero() {
+				// the message was replayed by hand, it shouldn't expire again
+				if err := db.Delete(expireKey(rec)); err != nil {
+					return err
+				}
+				rec.ExpiresAt = time.Time{}
+			}
+			if err := putMessage(db, rec); err != nil {
+				return err
+			}
+			if err := db.Set(queueKey(rec), rec.Mid); err != nil {
+				return err
+			}
+			if err := appendEvent(db, rec.Mid, &eventRecord{Type: pandora.EventReplayed, At: time.Now()}); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// PurgeDeadLetters remove the messages from the dead inbox
+func (ms *MessageStore) PurgeDeadLetters(inbox string, mid pandora.Key) ([]pandora.Key, error) {
+	var bodies []pandora.Key
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		found, err := deadLetters(db, inbox, mid)
+		if err != nil {
+			return err
+		}
+		for _, rec := range found {
+			if err := deleteMessage(db, rec); err != nil {
+				return err
+			}
+			bodies = append(bodies, rec.bodyKey())
+		}
+		return nil
+	})
+	return bodies, err
+}
+
+// BodyKey return the key of the body of mid
+func (ms *MessageStore) BodyKey(mid pandora.Key) (pandora.Key, error) {
+	var body pandora.Key
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		rec, err := getMessage(db, mid.Bytes())
+		if err != nil || rec == nil {
+			return err
+		}
+		body = rec.bodyKey()
+		return nil
+	})
+	return body, err
+}
+
+// Receiver return the name of the inbox that holds mid
+func (ms *MessageStore) Receiver(mid pandora.Key) (string, error) {
+	var receiver string
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		rec, err := getMessage(db, mid.Bytes())
+		if err != nil || rec == nil {
+			return err
+		}
+		box, err := getInbox(db, rec.ReceiverId)
+		if err != nil || box == nil {
+			return err
+		}
+		receiver = box.Name
+		return nil
+	})
+	return receiver, err
+}
+
+// Subscribe register inbox as a subscriber of topic
+func (ms *MessageStore) Subscribe(topic, inbox string) error {
+	return ms.s.doInsideTransaction(func(db *kv.DB) error {
+		if _, err := findInbox(db, inbox, true); err != nil {
+			return err
+		}
+		return db.Set(subscriptionKey(topic, inbox), []byte(inbox))
+	})
+}
+
+// Unsubscribe remove inbox from the subscribers of topic
+func (ms *MessageStore) Unsubscribe(topic, inbox string) error {
+	return ms.s.doInsideTransaction(func(db *kv.DB) error {
+		return db.Delete(subscriptionKey(topic, inbox))
+	})
+}
+
+// Subscribers return the name of all inboxes subscribed to topic
+func (ms *MessageStore) Subscribers(topic string) ([]string, error) {
+	var inboxes []string
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		values, err := scanValues(db, subscriptionKey(topic, ""))
+		for _, v := range values {
+			inboxes = append(inboxes, string(v))
+		}
+		return err
+	})
+	return inboxes, err
+}
+
+// deadLetters return the unlocked messages from the dead inbox of inbox,
+// if mid isn't nil, only that message is returned
+func deadLetters(db *kv.DB, inbox string, mid pandora.Key) ([]*messageRecord, error) {
+	if len(inbox) == 0 {
+		return nil, pandora.ErrInvalidMailBox
+	}
+	dead, err := findInbox(db, pandora.DeadInbox(inbox), false)
+	if err == pandora.ErrSenderNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var found []*messageRecord
+	err = scanInbox(db, dead.Id, func(rec *messageRecord) (bool, error) {
+		if rec.Lid == nil && (mid == nil || bytes.Equal(mid.Bytes(), rec.Mid)) {
+			found = append(found, rec)
+		}
+		return true, nil
+	})
+	return found, err
+}
+
+// exceededMaxDelivery check if rec was delivered more times than
+// the max allowed by its inbox
+func exceededMaxDelivery(db *kv.DB, rec *messageRecord) (bool, error) {
+	box, err := getInbox(db, rec.ReceiverId)
+	if err != nil || box == nil {
+		return false, err
+	}
+	return box.MaxDelivery > 0 && rec.DeliveryCount >= box.MaxDelivery, nil
+}
+
+// moveToDeadInbox unlock rec and move it to the dead inbox of its receiver
+func moveToDeadInbox(db *kv.DB, rec *messageRecord, status pandora.AckStatus, reason string, now time.Time) error {
+	box, err := getInbox(db, rec.ReceiverId)
+	if err != nil {
+		return err
+	}
+	dead, err := findInbox(db, pandora.DeadInbox(box.Name), true)
+	if err != nil {
+		return err
+	}
+	if err := unlock(db, rec); err != nil {
+		return err
+	}
+	if err := db.Delete(queueKey(rec)); err != nil {
+		return err
+	}
+	rec.ReceiverId = dead.Id
+	rec.Status = status
+	rec.Reason = reason
+	if err := putMessage(db, rec); err != nil {
+		return err
+	}
+	if err := db.Set(queueKey(rec), rec.Mid); err != nil {
+		return err
+	}
+	return appendEvent(db, rec.Mid, &eventRecord{Type: pandora.EventDead, At: now, Detail: reason})
+}
+
+// Reenqueue remove the lock from every message with an expired lease
+func (ms *MessageStore) Reenqueue(now time.Time) error {
+	return ms.s.doInsideTransaction(func(db *kv.DB) error {
+		return reEnqueueMessages(db, now)
+	})
+}
+
+// take all messages that have a lease time expired and
+// remove the lock information.
+//
+// Confirmed messages aren't touched
+func reEnqueueMessages(db *kv.DB, now time.Time) error {
+	var expired [][]byte
+	limit := append(copyBytes(prefixLease), timeKey(now)...)
+	err := scan(db, prefixLease, func(k, v []byte) (bool, error) {
+		if bytes.Compare(k, limit) >= 0 {
+			return false, nil
+		}
+		expired = append(expired, v)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, mid := range expired {
+		rec, err := getMessage(db, mid)
+		if err != nil {
+			return err
+		}
+		if rec == nil || rec.Status == pandora.StatusConfirmed {
+			continue
+		}
+		if err := countTimeout(db, rec.ReceiverId); err != nil {
+			return err
+		}
+		err = appendEvent(db, rec.Mid, &eventRecord{Type: pandora.EventTimeout, At: rec.LeasedUntil, Lid: rec.Lid})
+		if err != nil {
+			return err
+		}
+		dead, err := exceededMaxDelivery(db, rec)
+		if err != nil {
+			return err
+		}
+		if dead {
+			err = moveToDeadInbox(db, rec, pandora.StatusTimeout, "lease expired", now)
+		} else if err = unlock(db, rec); err == nil {
+			err = putMessage(db, rec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpireMessages move the expired messages to the dead inbox or remove them,
+// following the policy of their inbox
+func (ms *MessageStore) ExpireMessages(now time.Time) (int, []pandora.Key, error) {
+	var count int
+	var bodies []pandora.Key
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		var err error
+		count, bodies, err = expireMessages(db, now)
+		return err
+	})
+	return count, bodies, err
+}
+
+// expireMessages handle every message that expired until now and isn't leased.
+//
+// Returns the number of messages expired and the body key of the ones removed
+func expireMessages(db *kv.DB, now time.Time) (int, []pandora.Key, error) {
+	type entry struct {
+		key, mid []byte
+	}
+	var found []entry
+	limit := append(copyBytes(prefixExpire), timeKey(now)...)
+	err := scan(db, prefixExpire, func(k, v []byte) (bool, error) {
+		if bytes.Compare(k, limit) >= 0 {
+			return false, nil
+		}
+		found = append(found, entry{k, v})
+		return true, nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	var count int
+	var bodies []pandora.Key
+	for _, e := range found {
+		rec, err := getMessage(db, e.mid)
+		if err != nil {
+			return 0, nil, err
+		}
+		if rec != nil && rec.Lid != nil && rec.LeasedUntil.After(now) {
+			// a client is processing the message, check it again later
+			continue
+		}
+		if err := db.Delete(e.key); err != nil {
+			return 0, nil, err
+		}
+		if rec == nil || rec.Status == pandora.StatusConfirmed {
+			continue
+		}
+		box, err := getInbox(db, rec.ReceiverId)
+		if err != nil {
+			return 0, nil, err
+		}
+		if box == nil || strings.HasSuffix(box.Name, pandora.DeadInboxSuffix) {
+			continue
+		}
+		event := &eventRecord{Type: pandora.EventExpired, At: rec.ExpiresAt}
+		if box.DropExpired {
+			event.Detail = pandora.DetailDropped
+		}
+		if err := appendEvent(db, rec.Mid, event); err != nil {
+			return 0, nil, err
+		}
+		if box.DropExpired {
+			bodies = append(bodies, rec.bodyKey())
+			err = deleteMessage(db, rec)
+		} else {
+			err = moveToDeadInbox(db, rec, pandora.StatusExpired, "message expired", now)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		count++
+	}
+	return count, bodies, nil
+}
+
+// countTimeout increment the lease timeouts of the inbox
+func countTimeout(db *kv.DB, inboxId int64) error {
+	box, err := getInbox(db, inboxId)
+	if err != nil || box == nil {
+		return err
+	}
+	box.Timeouts++
+	return putInbox(db, box)
+}
+
+// PurgeInboxes remove the inboxes with the given prefix created before createdBefore
+func (ms *MessageStore) PurgeInboxes(prefix string, createdBefore time.Time) (int, []pandora.Key, error) {
+	var count int
+	var bodies []pandora.Key
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		var boxes []*inboxRecord
+		err := scan(db, append(copyBytes(prefixInbox), prefix...), func(k, v []byte) (bool, error) {
+			box := &inboxRecord{}
+			if err := json.Unmarshal(v, box); err != nil {
+				return false, err
+			}
+			if box.CreatedAt.Before(createdBefore) {
+				boxes = append(boxes, box)
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, box := range boxes {
+			removed, err := deleteInbox(db, box)
+			if err != nil {
+				return err
+			}
+			bodies = append(bodies, removed...)
+			count++
+		}
+		return nil
+	})
+	return count, bodies, err
+}
+
+// deleteInbox remove box, its messages, dedup keys and subscriptions.
+//
+// Returns the body key of each message that wasn't confirmed
+func deleteInbox(db *kv.DB, box *inboxRecord) ([]pandora.Key, error) {
+	bodies, err := purgeQueue(db, box)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	err = scan(db, prefixTopic, func(k, v []byte) (bool, error) {
+		if string(v) == box.Name {
+			keys = append(keys, k)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	dedups, err := scanKeys(db, append(copyBytes(prefixDedup), int64Key(box.Id)...))
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, dedups...)
+	keys = append(keys, append(copyBytes(prefixInbox), box.Name...), append(copyBytes(prefixInboxId), int64Key(box.Id)...))
+	for _, k := range keys {
+		if err := db.Delete(k); err != nil {
+			return nil, err
+		}
+	}
+	return bodies, nil
+}
+
+// purgeQueue remove every message from the queue of box.
+//
+// Returns the body key of each message that wasn't confirmed
+func purgeQueue(db *kv.DB, box *inboxRecord) ([]pandora.Key, error) {
+	var bodies []pandora.Key
+	mids, err := scanValues(db, append(copyBytes(prefixQueue), int64Key(box.Id)...))
+	if err != nil {
+		return nil, err
+	}
+	for _, mid := range mids {
+		rec, err := getMessage(db, mid)
+		if err != nil {
+			return nil, err
+		}
+		if rec == nil {
+			continue
+		}
+		if rec.Status != pandora.StatusConfirmed {
+			bodies = append(bodies, rec.bodyKey())
+		}
+		if err := deleteMessage(db, rec); err != nil {
+			return nil, err
+		}
+	}
+	return bodies, nil
+}
+
+// SaveSchedule create or replace the schedule with the same id
+func (ms *MessageStore) SaveSchedule(sch *pandora.Schedule) error {
+	return ms.s.doInsideTransaction(func(db *kv.DB) error {
+		return putSchedule(db, sch)
+	})
+}
+
+// Schedules return all schedules ordered by id
+func (ms *MessageStore) Schedules() ([]pandora.Schedule, error) {
+	var schedules []pandora.Schedule
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		var err error
+		schedules, err = scanSchedules(db)
+		return err
+	})
+	return schedules, err
+}
+
+// DeleteSchedule remove the schedule with the given id
+func (ms *MessageStore) DeleteSchedule(id string) error {
+	return ms.s.doInsideTransaction(func(db *kv.DB) error {
+		key := append(copyBytes(prefixSchedule), id...)
+		val, err := db.Get(nil, key)
+		if err != nil {
+			return err
+		}
+		if val == nil {
+			return pandora.ErrScheduleNotFound
+		}
+		return db.Delete(key)
+	})
+}
+
+// FetchDueSchedules return the schedules due at now and advance their next run
+func (ms *MessageStore) FetchDueSchedules(now time.Time) ([]pandora.Schedule, error) {
+	var due []pandora.Schedule
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		schedules, err := scanSchedules(db)
+		if err != nil {
+			return err
+		}
+		for _, sch := range schedules {
+			if sch.NextRun.After(now) {
+				continue
+			}
+			due = append(due, sch)
+			if sch.NextRun, err = sch.Next(now); err != nil {
+				return err
+			}
+			if err := putSchedule(db, &sch); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return due, err
+}
+
+func scanSchedules(db *kv.DB) ([]pandora.Schedule, error) {
+	var schedules []pandora.Schedule
+	err := scan(db, prefixSchedule, func(k, v []byte) (bool, error) {
+		var sch pandora.Schedule
+		if err := json.Unmarshal(v, &sch); err != nil {
+			return false, err
+		}
+		schedules = append(schedules, sch)
+		return true, nil
+	})
+	return schedules, err
+}
+
+func putSchedule(db *kv.DB, sch *pandora.Schedule) error {
+	val, err := json.Marshal(sch)
+	if err != nil {
+		return err
+	}
+	return db.Set(append(copyBytes(prefixSchedule), sch.Id...), val)
+}
+
+// InboxStats return the number of messages of every inbox
+func (ms *MessageStore) InboxStats(now time.Time) ([]pandora.InboxStats, error) {
+	var stats []pandora.InboxStats
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		var boxes []*inboxRecord
+		err := scan(db, prefixInbox, func(k, v []byte) (bool, error) {
+			box := &inboxRecord{}
+			if err := json.Unmarshal(v, box); err != nil {
+				return false, err
+			}
+			boxes = append(boxes, box)
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, box := range boxes {
+			if strings.HasSuffix(box.Name, pandora.DeadInboxSuffix) {
+				continue
+			}
+			st := pandora.InboxStats{Inbox: box.Name, Timeouts: box.Timeouts}
+			err := scanInbox(db, box.Id, func(rec *messageRecord) (bool, error) {
+				if rec.Lid != nil && rec.LeasedUntil.After(now) {
+					st.Leased++
+				} else if rec.SendWhen.After(now) {
+					st.Delayed++
+				} else {
+					st.Ready++
+				}
+				return true, nil
+			})
+			if err != nil {
+				return err
+			}
+			dead, err := findInbox(db, pandora.DeadInbox(box.Name), false)
+			if err == nil {
+				err = scanInbox(db, dead.Id, func(rec *messageRecord) (bool, error) {
+					st.Dead++
+					return true, nil
+				})
+			} else if err == pandora.ErrSenderNotFound {
+				err = nil
+			}
+			if err != nil {
+				return err
+			}
+			stats = append(stats, st)
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// AppendEvents add the events to the history of their messages
+func (ms *MessageStore) AppendEvents(events []pandora.Event) error {
+	return ms.s.doInsideTransaction(func(db *kv.DB) error {
+		for _, ev := range events {
+			rec := &eventRecord{
+				Type:   ev.Type,
+				At:     ev.At,
+				Client: ev.Client,
+				Detail: ev.Detail,
+			}
+			if ev.Lid != nil {
+				rec.Lid = copyBytes(ev.Lid.Bytes())
+			}
+			if err := appendEvent(db, ev.Mid.Bytes(), rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// History return the events of mid ordered by the time they happened
+func (ms *MessageStore) History(mid pandora.Key) ([]pandora.Event, error) {
+	var events []pandora.Event
+	err := ms.s.doInsideTransaction(func(db *kv.DB) error {
+		values, err := scanValues(db, append(copyBytes(prefixHistory), mid.Bytes()...))
+		if err != nil {
+			return err
+		}
+		events = make([]pandora.Event, len(values))
+		for i, v := range values {
+			var rec eventRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			ev := &events[i]
+			ev.Mid = &pandora.SHA1Key{}
+			copy(ev.Mid.Bytes(), mid.Bytes())
+			ev.Type = rec.Type
+			ev.At = rec.At
+			ev.Client = rec.Client
+			ev.Detail = rec.Detail
+			if rec.Lid != nil {
+				ev.Lid = &pandora.SHA1Key{}
+				copy(ev.Lid.Bytes(), rec.Lid)
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+// Ping check if the database is available
+func (ms *MessageStore) Ping() error {
+	return ms.s.ping()
+}
+
+func fetchHeaders(out []pandora.Message, db *kv.DB, inbox string, now, min time.Time) ([]pandora.Message, error) {
+	err := reEnqueueMessages(db, now)
+	if err != nil {
+		return nil, err
+	}
+	box, err := findInbox(db, inbox, false)
+	if err != nil {
+		return nil, err
+	}
+	var found []*messageRecord
+	err = scanQueue(db, box.Id, now, func(rec *messageRecord) (bool, error) {
+		if rec.Lid == nil && rec.ReceivedAt.After(min) && !rec.expired(now) {
+			found = append(found, rec)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byReceivedAt(found))
+	var idx int
+	for idx < len(out) && idx < len(found) {
+		found[idx].header(&out[idx])
+		idx++
+	}
+	return out[:idx], nil
+}
+
+func fetchLatestMessage(msg *pandora.Message, db *kv.DB, inbox string, now time.Time, dur time.Duration) error {
+	msgs, err := fetchAndLock(db, inbox, now, dur, 1)
+	if err != nil {
+		return err
+	}
+	*msg = *msgs[0]
+	return nil
+}
+
+// fetchAndLock lock up to max messages from inbox
+func fetchAndLock(db *kv.DB, inbox string, now time.Time, dur time.Duration, max int) ([]*pandora.Message, error) {
+	err := reEnqueueMessages(db, now)
+	if err != nil {
+		return nil, err
+	}
+	box, err := findInbox(db, inbox, false)
+	if err != nil {
+		return nil, err
+	}
+	if box.Paused {
+		return nil, pandora.ErrNoMessages
+	}
+	if dur <= 0 {
+		dur = box.LeaseTime
+	}
+	if dur <= 0 {
+		dur = pandora.DefaultLeaseTime
+	}
+	var found []*messageRecord
+	groups := make(map[string]bool)
+	err = scanQueue(db, box.Id, now, func(r *messageRecord) (bool, error) {
+		if r.expired(now) {
+			// expired messages don't block their group
+			return true, nil
+		}
+		if box.Fifo {
+			// only the oldest pending message of each group can be leased
+			if groups[r.Group] {
+				return true, nil
+			}
+			groups[r.Group] = true
+		}
+		if r.Lid == nil {
+			found = append(found, r)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, pandora.ErrNoMessages
+	}
+	// scanQueue returns the messages by SendWhen
+	sort.Stable(byPriority(found))
+	if len(found) > max {
+		found = found[:max]
+	}
+	msgs := make([]*pandora.Message, len(found))
+	for i, rec := range found {
+		msg := &pandora.Message{}
+		rec.header(msg)
+		msg.CalcualteLeaseFor(now, dur)
+
+		rec.Lid = copyBytes(msg.Lid.Bytes())
+		rec.LeasedUntil = msg.LeasedUntil
+		rec.DeliveryCount++
+		if err := db.Set(leaseKey(rec), rec.Mid); err != nil {
+			return nil, err
+		}
+		if err := putMessage(db, rec); err != nil {
+			return nil, err
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
+
+func enqueueMessage(db *kv.DB, msg *pandora.Message) error {
+	msg.Status = pandora.StatusNotDelivered
+	msg.CalculateMid()
+	senderId, receiverId, err := findSenderReceiver(db, msg, true)
+	if err != nil {
+		return err
+	}
+	if len(msg.DedupKey) > 0 {
+		first, err := findDedup(db, receiverId, msg.DedupKey, time.Now())
+		if err != nil {
+			return err
+		}
+		if first != nil {
+			msg.Mid = &pandora.SHA1Key{}
+			copy(msg.Mid.Bytes(), first.Mid)
+			return pandora.ErrDuplicateMessage
+		}
+	}
+	old, err := getMessage(db, msg.Mid.Bytes())
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		return pandora.ErrDuplicateMessage
+	}
+	if full, err := inboxFull(db, receiverId); err != nil {
+		return err
+	} else if full {
+		return pandora.ErrInboxFull
+	}
+	id, err := db.Inc(keySeq, 1)
+	if err != nil {
+		return err
+	}
+	rec := &messageRecord{
+		Id:            id,
+		Mid:           copyBytes(msg.Mid.Bytes()),
+		Status:        msg.Status,
+		ReceivedAt:    msg.ReceivedAt,
+		SendWhen:      msg.SendWhen,
+		DeliveryCount: msg.DeliveryCount,
+		SenderId:      senderId,
+		ReceiverId:    receiverId,
+		Priority:      msg.Priority,
+		Group:         msg.Group,
+		DedupKey:      msg.DedupKey,
+		DedupUntil:    msg.DedupUntil,
+		ExpiresAt:     msg.ExpiresAt,
+	}
+	if msg.Bid != nil {
+		rec.Bid = copyBytes(msg.Bid.Bytes())
+	}
+	if err := putMessage(db, rec); err != nil {
+		return err
+	}
+	if len(rec.DedupKey) > 0 {
+		if err := db.Set(dedupKey(receiverId, rec.DedupKey), rec.Mid); err != nil {
+			return err
+		}
+	}
+	if !rec.ExpiresAt.IsZero() {
+		if err := db.Set(expireKey(rec), rec.Mid); err != nil {
+			return err
+		}
+	}
+	return db.Set(queueKey(rec), rec.Mid)
+}
+
+// inboxFull check if the inbox reached its max size
+func inboxFull(db *kv.DB, inboxId int64) (bool, error) {
+	box, err := getInbox(db, inboxId)
+	if err != nil || box == nil || box.MaxSize <= 0 {
+		return false, err
+	}
+	pending, err := scanKeys(db, append(copyBytes(prefixQueue), int64Key(inboxId)...))
+	return len(pending) >= box.MaxSize, err
+}
+
+// findDedup return the message sent to receiverId with the given dedup key,
+// only if the key is still valid at now
+func findDedup(db *kv.DB, receiverId int64, key string, now time.Time) (*messageRecord, error) {
+	mid, err := db.Get(nil, dedupKey(receiverId, key))
+	if err != nil || mid == nil {
+		return nil, err
+	}
+	rec, err := getMessage(db, mid)
+	if err != nil || rec == nil {
+		return nil, err
+	}
+	if !rec.DedupUntil.After(now) {
+		return nil, nil
+	}
+	return rec, nil
+}
+
+func ackMessage(db *kv.DB, mid, lid pandora.Key, status pandora.AckStatus) error {
+	switch status {
+	case pandora.StatusConfirmed, pandora.StatusRejected:
+	default:
+		return pandora.ErrUnableToChangeStatus
+	}
+	rec, err := getMessage(db, mid.Bytes())
+	if err != nil {
+		return err
+	}
+	if rec == nil || rec.Lid == nil ||
+		!bytes.Equal(rec.Lid, lid.Bytes()) ||
+		rec.LeasedUntil.Before(time.Now()) {
+		return pandora.ErrUnableToChangeStatus
+	}
+	if err := unlock(db, rec); err != nil {
+		return err
+	}
+	rec.Status = status
+	if status == pandora.StatusConfirmed {
+		if err := db.Delete(queueKey(rec)); err != nil {
+			return err
+		}
+	} else {
+		dead, err := exceededMaxDelivery(db, rec)
+		if err != nil {
+			return err
+		}
+		if dead {
+			return moveToDeadInbox(db, rec, pandora.StatusRejected, "rejected by the client", time.Now())
+		}
+	}
+	return putMessage(db, rec)
+}
+
+// scanQueue calls fn for every pending message of the inbox that should be
+// delivered until now, in the order they should be delivered
+func scanQueue(db *kv.DB, inboxId int64, now time.Time, fn func(rec *messageRecord) (bool, error)) error {
+	return scanInbox(db, inboxId, func(rec *messageRecord) (bool, error) {
+		if rec.SendWhen.After(now) {
+			return false, nil
+		}
+		return fn(rec)
+	})
+}
+
+// scanInbox calls fn for every message of the inbox that wasn't confirmed,
+// ordered by SendWhen
+func scanInbox(db *kv.DB, inboxId int64, fn func(rec *messageRecord) (bool, error)) error {
+	mids, err := scanValues(db, append(copyBytes(prefixQueue), int64Key(inboxId)...))
+	if err != nil {
+		return err
+	}
+	for _, mid := range mids {
+		rec, err := getMessage(db, mid)
+		if err != nil {
+			return err
+		}
+		if rec == nil || rec.Status == pandora.StatusConfirmed {
+			continue
+		}
+		more, err := fn(rec)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlock removes the lock information from rec, the record
+// should be saved by the caller
+func unlock(db *kv.DB, rec *messageRecord) error {
+	if rec.Lid != nil {
+		if err := db.Delete(leaseKey(rec)); err != nil {
+			return err
+		}
+	}
+	rec.Lid = nil
+	rec.LeasedUntil = time.Time{}
+	return nil
+}
+
+func findInbox(db *kv.DB, inbox string, create bool) (*inboxRecord, error) {
+	if len(inbox) == 0 {
+		return nil, pandora.ErrInvalidMailBox
+	}
+	val, err := db.Get(nil, append(copyBytes(prefixInbox), inbox...))
+	if err != nil {
+		return nil, err
+	}
+	if val != nil {
+		box := &inboxRecord{}
+		return box, json.Unmarshal(val, box)
+	}
+	if !create {
+		return nil, pandora.ErrSenderNotFound
+	}
+	id, err := db.Inc(keySeq, 1)
+	if err != nil {
+		return nil, err
+	}
+	box := &inboxRecord{Id: id, Name: inbox, CreatedAt: time.Now()}
+	if err := db.Set(append(copyBytes(prefixInboxId), int64Key(id)...), []byte(inbox)); err != nil {
+		return nil, err
+	}
+	return box, putInbox(db, box)
+}
+
+// getInbox return the inbox with the given id
+func getInbox(db *kv.DB, id int64) (*inboxRecord, error) {
+	name, err := db.Get(nil, append(copyBytes(prefixInboxId), int64Key(id)...))
+	if err != nil || name == nil {
+		return nil, err
+	}
+	return findInbox(db, string(name), false)
+}
+
+func putInbox(db *kv.DB, box *inboxRecord) error {
+	val, err := json.Marshal(box)
+	if err != nil {
+		return err
+	}
+	return db.Set(append(copyBytes(prefixInbox), box.Name...), val)
+}
+
+func findSenderReceiver(db *kv.DB, msg *pandora.Message, create bool) (sid int64, rid int64, err error) {
+	sender, err := findInbox(db, msg.Sender(), create)
+	if err != nil {
+		return
+	}
+	receiver, err := findInbox(db, msg.Receiver(), create)
+	if err != nil {
+		return
+	}
+	return sender.Id, receiver.Id, nil
+}
+
+func getMessage(db *kv.DB, mid []byte) (*messageRecord, error) {
+	val, err := db.Get(nil, append(copyBytes(prefixMessage), mid...))
+	if err != nil || val == nil {
+		return nil, err
+	}
+	rec := &messageRecord{}
+	return rec, json.Unmarshal(val, rec)
+}
+
+func putMessage(db *kv.DB, rec *messageRecord) error {
+	val, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return db.Set(append(copyBytes(prefixMessage), rec.Mid...), val)
+}
+
+// deleteMessage remove rec and all its index entries
+func deleteMessage(db *kv.DB, rec *messageRecord) error {
+	if err := unlock(db, rec); err != nil {
+		return err
+	}
+	if err := db.Delete(queueKey(rec)); err != nil {
+		return err
+	}
+	if !rec.ExpiresAt.IsZero() {
+		if err := db.Delete(expireKey(rec)); err != nil {
+			return err
+		}
+	}
+	return db.Delete(append(copyBytes(prefixMessage), rec.Mid...))
+}
+
+// appendEvent add ev to the history of mid, the events are kept in the order they
+// happened and then in the order they were appended
+func appendEvent(db *kv.DB, mid []byte, ev *eventRecord) error {
+	seq, err := db.Inc(keyHistorySeq, 1)
+	if err != nil {
+		return err
+	}
+	val, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return db.Set(historyKey(mid, ev.At, seq), val)
+}
+
+func subscriptionKey(topic, inbox string) []byte {
+	key := append(copyBytes(prefixTopic), topic...)
+	key = append(key, 0)
+	return append(key, inbox...)
+}
+
+func dedupKey(receiverId int64, key string) []byte {
+	return append(append(copyBytes(prefixDedup), int64Key(receiverId)...), key...)
+}
+
+func queueKey(rec *messageRecord) []byte {
+	key := append(copyBytes(prefixQueue), int64Key(rec.ReceiverId)...)
+	key = append(key, timeKey(rec.SendWhen)...)
+	return append(key, int64Key(rec.Id)...)
+}
+
+func leaseKey(rec *messageRecord) []byte {
+	key := append(copyBytes(prefixLease), timeKey(rec.LeasedUntil)...)
+	return append(key, int64Key(rec.Id)...)
+}
+
+func historyKey(mid []byte, at time.Time, seq int64) []byte {
+	key := append(copyBytes(prefixHistory), mid...)
+	key = append(key, timeKey(at)...)
+	return append(key, int64Key(seq)...)
+}
+
+func expireKey(rec *messageRecord) []byte {
+	key := append(copyBytes(prefixExpire), timeKey(rec.ExpiresAt)...)
+	return append(key, int64Key(rec.Id)...)
+}
+
+// BlobStore implements pandora.BlobStore using a kv database as backend
+type BlobStore struct {
+	s *Store
+}
+
+// GetData read the contents stored under the k key
+func (bs *BlobStore) GetData(out []byte, k pandora.Key) ([]byte, error) {
+	var data []byte
+	err := bs.s.doInsideTransaction(func(db *kv.DB) error {
+		var err error
+		data, err = db.Get(nil, append(copyBytes(prefixBlob), k.Bytes()...))
+		if err == nil && data == nil {
+			err = ErrKeyNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	out = sliceOfSize(out, len(data))
+	copy(out, data)
+	return out, nil
+}
+
+// UpdateRefCount change the ref count of k by delta
+func (bs *BlobStore) UpdateRefCount(k pandora.Key, delta int) error {
+	return bs.s.doInsideTransaction(func(db *kv.DB) error {
+		key := append(copyBytes(prefixBlobRef), k.Bytes()...)
+		val, err := db.Get(nil, key)
+		if err != nil {
+			return err
+		}
+		if val == nil {
+			return ErrKeyNotFound
+		}
+		if _, err = db.Inc(key, int64(delta)); err != nil {
+			return err
+		}
+		return touchBlob(db, k.Bytes(), time.Now())
+	})
+}
+
+// UnreferencedKeys return at most max keys with a ref count of 0 or less
+// that didn't change after olderThan
+func (bs *BlobStore) UnreferencedKeys(max int, olderThan time.Time) ([]pandora.Key, error) {
+	var keys []pandora.Key
+	err := bs.s.doInsideTransaction(func(db *kv.DB) error {
+		return scan(db, prefixBlobRef, func(k, v []byte) (bool, error) {
+			blob := k[len(prefixBlobRef):]
+			ok, err := collectable(db, blob, v, olderThan)
+			if err != nil || !ok {
+				return err == nil, err
+			}
+			key := &pandora.SHA1Key{}
+			copy(key.Bytes(), blob)
+			keys = append(keys, key)
+			return len(keys) < max, nil
+		})
+	})
+	return keys, err
+}
+
+// Usage return how many blobs are saved and their total size
+func (bs *BlobStore) Usage() (pandora.BlobUsage, error) {
+	var usage pandora.BlobUsage
+	err := bs.s.doInsideTransaction(func(db *kv.DB) error {
+		return scan(db, prefixBlob, func(k, v []byte) (bool, error) {
+			usage.Count++
+			usage.Bytes += int64(len(v))
+			return true, nil
+		})
+	})
+	return usage, err
+}
+
+// Ping check if the database is available
+func (bs *BlobStore) Ping() error {
+	return bs.s.ping()
+}
+
+// DeleteData remove the data of keys that are still unreferenced
+// and didn't change after olderThan
+func (bs *BlobStore) DeleteData(keys []pandora.Key, olderThan time.Time) (int, error) {
+	var count int
+	err := bs.s.doInsideTransaction(func(db *kv.DB) error {
+		for _, k := range keys {
+			refKey := append(copyBytes(prefixBlobRef), k.Bytes()...)
+			val, err := db.Get(nil, refKey)
+			if err != nil {
+				return err
+			}
+			if val == nil {
+				continue
+			}
+			if ok, err := collectable(db, k.Bytes(), val, olderThan); err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+			for _, prefix := range [][]byte{prefixBlob, prefixBlobRef, prefixBlobTime} {
+				if err := db.Delete(append(copyBytes(prefix), k.Bytes()...)); err != nil {
+					return err
+				}
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// collectable check if the blob with the given ref count value
+// can be removed, ie, isn't referenced and didn't change after olderThan
+func collectable(db *kv.DB, blob, ref []byte, olderThan time.Time) (bool, error) {
+	if len(ref) != 8 || int64(binary.BigEndian.Uint64(ref)) > 0 {
+		return false, nil
+	}
+	changed, err := db.Get(nil, append(copyBytes(prefixBlobTime), blob...))
+	if err != nil {
+		return false, err
+	}
+	return len(changed) != 8 || bytes.Compare(changed, timeKey(olderThan)) < 0, nil
+}
+
+// touchBlob save when the blob was last changed, used to avoid
+// collecting blobs that were just written
+func touchBlob(db *kv.DB, blob []byte, now time.Time) error {
+	return db.Set(append(copyBytes(prefixBlobTime), blob...), timeKey(now))
+}
+
+// PutData write the contents of data and return the key used to store the data
+func (bs *BlobStore) PutData(k pandora.Key, data []byte) (pandora.Key, error) {
+	kw := pandora.SHA1KeyWriter{}
+	kw.Write(data)
+	actual := kw.Key()
+
+	if k != nil && len(k.Bytes()) >= len(actual.Bytes()) {
+		// avoid allocating outside the stack
+		copy(k.Bytes(), actual.Bytes())
+	} else {
+		// use the heap
+		k = actual
+	}
+	err := bs.s.doInsideTransaction(func(db *kv.DB) error {
+		refKey := append(copyBytes(prefixBlobRef), k.Bytes()...)
+		val, err := db.Get(nil, refKey)
+		if err != nil {
+			return err
+		}
+		if val == nil {
+			if err := db.Set(append(copyBytes(prefixBlob), k.Bytes()...), data); err != nil {
+				return err
+			}
+			if _, err := db.Inc(refKey, 0); err != nil {
+				return err
+			}
+		}
+		return touchBlob(db, k.Bytes(), time.Now())
+	})
+	return k, err
+}
+
+// scan calls fn for every key with the given prefix, fn should return
+// false to stop the iteration.
+//
+// fn MUST NOT change the database
+func scan(db *kv.DB, prefix []byte, fn func(k, v []byte) (bool, error)) error {
+	enum, _, err := db.Seek(prefix)
+	if err != nil {
+		return err
+	}
+	for {
+		k, v, err := enum.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(k, prefix) {
+			return nil
+		}
+		more, err := fn(copyBytes(k), copyBytes(v))
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+func scanKeys(db *kv.DB, prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	err := scan(db, prefix, func(k, v []byte) (bool, error) {
+		keys = append(keys, k)
+		return true, nil
+	})
+	return keys, err
+}
+
+func scanValues(db *kv.DB, prefix []byte) ([][]byte, error) {
+	var values [][]byte
+	err := scan(db, prefix, func(k, v []byte) (bool, error) {
+		values = append(values, v)
+		return true, nil
+	})
+	return values, err
+}
+
+// timeKey encode t in a way that preserves the order of the times
+// when compared as bytes
+func timeKey(t time.Time) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(t.UnixNano())^(1<<63))
+	return buf[:]
+}
+
+func int64Key(v int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	return buf[:]
+}
+
+func copyBytes(in []byte) []byte {
+	if in == nil {
+		return nil
+	}
+	out := make([]byte, len(in))
+	copy(out, in)
+	return out
+}
+
+func sliceOfSize(old []byte, sz int) []byte {
+	if cap(old) >= sz {
+		return old[0:sz]
+	}
+	return make([]byte, sz)
+}
+
+type byReceivedAt []*messageRecord
+
+func (b byReceivedAt) Len() int      { return len(b) }
+func (b byReceivedAt) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byReceivedAt) Less(i, j int) bool {
+	if b[i].ReceivedAt.Equal(b[j].ReceivedAt) {
+		return b[i].SendWhen.Before(b[j].SendWhen)
+	}
+	return b[i].ReceivedAt.Before(b[j].ReceivedAt)
+}
+
+type byPriority []*messageRecord
+
+func (b byPriority) Len() int           { return len(b) }
+func (b byPriority) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byPriority) Less(i, j int) bool { return b[i].Priority > b[j].Priority }
@@ -0,0 +1,1174 @@
+package kvstore
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"errors"
+	"github.com/andrebq/exp/pandora"
+	"github.com/cznic/kv"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func mustOpenStore() *Store {
+	store, err := Open("")
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
+
+func TestPandoraServer(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	server := pandora.Server{
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
+	}
+	body := make(url.Values)
+	body.Set("topic", "text")
+	msg, err := server.Send("a@local", "b@remote", time.Minute*-5, time.Now(), body)
+	if err != nil {
+		t.Fatalf("error sending the message: %v", err)
+	}
+
+	var emptyKey pandora.SHA1Key
+	if bytes.Equal(msg.Mid.Bytes(), emptyKey.Bytes()) {
+		t.Errorf("mid cannot be empty or null")
+	}
+
+	var out [10]pandora.Message
+	sz, err := server.FetchHeaders(out[:], "b@remote", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("error fetching headers: %v", err)
+	}
+	if sz != 1 {
+		t.Errorf("error should have found one header. got: %v", sz)
+	}
+
+	newMsg, err := server.FetchLatest("b@remote", time.Minute*5)
+	if err != nil {
+		t.Fatalf("error fetching the message: %v", err)
+	}
+
+	if !bytes.Equal(msg.Mid.Bytes(), newMsg.Mid.Bytes()) {
+		t.Errorf("mid is different: expecting %v got %v", msg.Mid.Bytes(), newMsg.Mid.Bytes())
+	}
+
+	if newMsg.Lid == nil || bytes.Equal(newMsg.Lid.Bytes(), emptyKey.Bytes()) {
+		t.Fatalf("lid is empty...")
+	}
+
+	if newMsg.Get("topic") != msg.Get("topic") {
+		t.Errorf("body is different. expecting %v got %v", msg.Body, newMsg.Body)
+	}
+
+	// locked messages aren't visible
+	_, err = server.FetchLatest("b@remote", time.Minute*5)
+	if err != pandora.ErrNoMessages {
+		t.Errorf("expecting %v got %v", pandora.ErrNoMessages, err)
+	}
+
+	err = server.Ack(newMsg.Mid, newMsg.Lid, pandora.StatusConfirmed)
+	if err != nil {
+		t.Errorf("error doing ack: %v", err)
+	}
+
+	err = server.Ack(newMsg.Mid, newMsg.Lid, pandora.StatusConfirmed)
+	if err != pandora.ErrUnableToChangeStatus {
+		t.Errorf("expecting %v got %v", pandora.ErrUnableToChangeStatus, err)
+	}
+}
+
+func TestMessageStoreLease(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	ms := store.MessageStore()
+
+	msg := &pandora.Message{}
+	msg.Empty(nil)
+	msg.SetReceiver("test@remote")
+	msg.SetSender("test@local")
+	msg.Body.Set("hi", "a body")
+	if err := ms.Enqueue(msg); err != nil {
+		t.Fatalf("error saving the message: %v", err)
+	}
+	if err := ms.Enqueue(msg); err != pandora.ErrDuplicateMessage {
+		t.Errorf("expecting %v got %v", pandora.ErrDuplicateMessage, err)
+	}
+
+	first, err := ms.FetchAndLockLatest("test@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching the message: %v", err)
+	}
+
+	// expire the lease
+	if err := ms.Reenqueue(time.Now().Add(time.Minute * 2)); err != nil {
+		t.Fatalf("error reenqueuing messages: %v", err)
+	}
+
+	second, err := ms.FetchAndLockLatest("test@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching the message again: %v", err)
+	}
+	if !bytes.Equal(first.Mid.Bytes(), second.Mid.Bytes()) {
+		t.Errorf("mid's are different. expecting %v got %v", first.Mid.Bytes(), second.Mid.Bytes())
+	}
+	if second.DeliveryCount != 1 {
+		t.Errorf("expecting delivery count 1 got %v", second.DeliveryCount)
+	}
+
+	if err := ms.Ack(second.Mid, second.Lid, pandora.StatusRejected); err != nil {
+		t.Fatalf("error rejecting message: %v", err)
+	}
+
+	// rejected messages are delivered again
+	third, err := ms.FetchAndLockLatest("test@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching rejected message: %v", err)
+	}
+	if third.Status != pandora.StatusRejected {
+		t.Errorf("expecting status %v got %v", pandora.StatusRejected, third.Status)
+	}
+}
+
+func TestMessageStoreDelay(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	ms := store.MessageStore()
+
+	msg := &pandora.Message{}
+	msg.Empty(nil)
+	msg.SetReceiver("test@remote")
+	msg.SetSender("test@local")
+	msg.SendWhen = msg.ReceivedAt.Add(time.Hour)
+	if err := ms.Enqueue(msg); err != nil {
+		t.Fatalf("error saving the message: %v", err)
+	}
+	_, err := ms.FetchAndLockLatest("test@remote", time.Minute)
+	if err != pandora.ErrNoMessages {
+		t.Errorf("expecting %v got %v", pandora.ErrNoMessages, err)
+	}
+}
+
+func TestBlobStorePandoraAPI(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	var bs pandora.BlobStore
+	var err error
+	bs = store.BlobStore()
+	data := []byte("this is just a dummy text")
+
+	var kw pandora.SHA1KeyWriter
+	kw.Write(data)
+
+	var outKey pandora.Key
+	outKey = &pandora.SHA1Key{}
+	outKey, err = bs.PutData(outKey, data)
+	if err != nil {
+		t.Fatalf("error saving key: %v", err)
+	}
+
+	if !bytes.Equal(outKey.Bytes(), kw.Key().Bytes()) {
+		t.Fatalf("expected key %v got %v", kw.Key().Bytes(), outKey.Bytes())
+	}
+
+	outData, err := bs.GetData(nil, outKey)
+	if err != nil {
+		t.Errorf("error reading data from blobstore: %v", err)
+	}
+
+	if !bytes.Equal(outData, data) {
+		t.Errorf("expected %v got %v for data", data, outData)
+	}
+
+	err = bs.UpdateRefCount(outKey, 1)
+	if err != nil {
+		t.Errorf("unexpected error when incrementing the ref count: %v", err)
+	}
+	err = bs.UpdateRefCount(outKey, -1)
+	if err != nil {
+		t.Errorf("unexpected error when decrementing the ref count: %v", err)
+	}
+
+	var missing pandora.SHA1Key
+	if _, err := bs.GetData(nil, &missing); err != ErrKeyNotFound {
+		t.Errorf("expecting %v got %v", ErrKeyNotFound, err)
+	}
+	if err := bs.UpdateRefCount(&missing, 1); err != ErrKeyNotFound {
+		t.Errorf("expecting %v got %v", ErrKeyNotFound, err)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	ms := store.MessageStore()
+
+	msg := &pandora.Message{}
+	msg.Empty(nil)
+	msg.SetReceiver("test@remote")
+	msg.SetSender("test@local")
+	if err := ms.Enqueue(msg); err != nil {
+		t.Fatalf("error saving the message: %v", err)
+	}
+	if err := ms.SetMaxDelivery("test@remote", 2); err != nil {
+		t.Fatalf("error setting max delivery: %v", err)
+	}
+
+	// first delivery is rejected by the client
+	fetched, err := ms.FetchAndLockLatest("test@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching the message: %v", err)
+	}
+	if err := ms.Ack(fetched.Mid, fetched.Lid, pandora.StatusRejected); err != nil {
+		t.Fatalf("error rejecting the message: %v", err)
+	}
+
+	// second delivery times out
+	if _, err = ms.FetchAndLockLatest("test@remote", time.Minute); err != nil {
+		t.Fatalf("error fetching the message: %v", err)
+	}
+	if err := ms.Reenqueue(time.Now().Add(time.Minute * 2)); err != nil {
+		t.Fatalf("error reenqueuing messages: %v", err)
+	}
+
+	if _, err = ms.FetchAndLockLatest("test@remote", time.Minute); err != pandora.ErrNoMessages {
+		t.Fatalf("expecting %v got %v", pandora.ErrNoMessages, err)
+	}
+
+	var out [10]pandora.Message
+	sz, err := ms.FetchDeadLetters(out[:], "test@remote")
+	if err != nil {
+		t.Fatalf("error fetching dead letters: %v", err)
+	}
+	if sz != 1 {
+		t.Fatalf("expecting 1 dead letter got %v", sz)
+	}
+	if out[0].Status != pandora.StatusTimeout || len(out[0].Reason) == 0 {
+		t.Errorf("invalid dead letter status %v and reason %v", out[0].Status, out[0].Reason)
+	}
+
+	count, err := ms.ReplayDeadLetters("test@remote", out[0].Mid)
+	if err != nil || count != 1 {
+		t.Fatalf("error replaying dead letter: %v / %v", count, err)
+	}
+	replayed, err := ms.FetchAndLockLatest("test@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching replayed message: %v", err)
+	}
+	if replayed.DeliveryCount != 0 {
+		t.Errorf("expecting delivery count 0 got %v", replayed.DeliveryCount)
+	}
+
+	// move it back and purge
+	if err := ms.Reenqueue(time.Now().Add(time.Minute * 2)); err != nil {
+		t.Fatalf("error reenqueuing messages: %v", err)
+	}
+	fetched, err = ms.FetchAndLockLatest("test@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching the message: %v", err)
+	}
+	if err := ms.Ack(fetched.Mid, fetched.Lid, pandora.StatusRejected); err != nil {
+		t.Fatalf("error rejecting the message: %v", err)
+	}
+	purged, err := ms.PurgeDeadLetters("test@remote", nil)
+	if err != nil || len(purged) != 1 {
+		t.Fatalf("error purging dead letters: %v / %v", len(purged), err)
+	}
+	if !bytes.Equal(purged[0].Bytes(), fetched.Mid.Bytes()) {
+		t.Errorf("expecting body key %v got %v", fetched.Mid, purged[0])
+	}
+	if sz, _ := ms.FetchDeadLetters(out[:], "test@remote"); sz != 0 {
+		t.Errorf("expecting no dead letters got %v", sz)
+	}
+}
+
+func TestExtendLease(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	ms := store.MessageStore()
+
+	msg := &pandora.Message{}
+	msg.Empty(nil)
+	msg.SetReceiver("test@remote")
+	msg.SetSender("test@local")
+	if err := ms.Enqueue(msg); err != nil {
+		t.Fatalf("error saving the message: %v", err)
+	}
+	fetched, err := ms.FetchAndLockLatest("test@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching the message: %v", err)
+	}
+
+	extended, err := ms.ExtendLease(fetched.Mid, fetched.Lid, time.Hour, false)
+	if err != nil {
+		t.Fatalf("error extending lease: %v", err)
+	}
+	if !bytes.Equal(extended.Lid.Bytes(), fetched.Lid.Bytes()) {
+		t.Errorf("lid shouldn't change. expecting %v got %v", fetched.Lid.Bytes(), extended.Lid.Bytes())
+	}
+	if !extended.LeasedUntil.After(fetched.LeasedUntil) {
+		t.Errorf("lease should be extended. got %v", extended.LeasedUntil)
+	}
+
+	// the old lease time already passed, but the message is still locked
+	if err := ms.Reenqueue(time.Now().Add(time.Minute * 2)); err != nil {
+		t.Fatalf("error reenqueuing messages: %v", err)
+	}
+	if _, err := ms.FetchAndLockLatest("test@remote", time.Minute); err != pandora.ErrNoMessages {
+		t.Errorf("expecting %v got %v", pandora.ErrNoMessages, err)
+	}
+
+	rotated, err := ms.ExtendLease(fetched.Mid, fetched.Lid, time.Hour, true)
+	if err != nil {
+		t.Fatalf("error extending lease: %v", err)
+	}
+	if bytes.Equal(rotated.Lid.Bytes(), fetched.Lid.Bytes()) {
+		t.Errorf("lid should change")
+	}
+	if _, err := ms.ExtendLease(fetched.Mid, fetched.Lid, time.Hour, false); err != pandora.ErrInvalidLease {
+		t.Errorf("expecting %v got %v", pandora.ErrInvalidLease, err)
+	}
+	if err := ms.Ack(rotated.Mid, rotated.Lid, pandora.StatusConfirmed); err != nil {
+		t.Errorf("error doing ack with the new lid: %v", err)
+	}
+}
+
+func TestBlobCollector(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	server := &pandora.Server{
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
+	}
+
+	body := make(url.Values)
+	body.Set("id", "1")
+	confirmed, err := server.Send("a@local", "b@remote", 0, time.Now(), body)
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	body = make(url.Values)
+	body.Set("id", "2")
+	pending, err := server.Send("a@local", "b@remote", time.Hour, time.Now(), body)
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+
+	fetched, err := server.FetchLatest("b@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	if err := server.Ack(fetched.Mid, fetched.Lid, pandora.StatusConfirmed); err != nil {
+		t.Fatalf("error confirming message: %v", err)
+	}
+
+	// recent blobs are protected by the grace period
+	report, err := server.CollectBlobs(0, true)
+	if err != nil {
+		t.Fatalf("error collecting blobs: %v", err)
+	}
+	if len(report.Keys) != 0 || !report.DryRun {
+		t.Errorf("expecting an empty dry-run report got %v", report)
+	}
+
+	bs := store.BlobStore()
+	future := time.Now().Add(time.Hour)
+	keys, err := bs.UnreferencedKeys(10, future)
+	if err != nil {
+		t.Fatalf("error reading unreferenced keys: %v", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0].Bytes(), confirmed.Bid.Bytes()) {
+		t.Fatalf("expecting only %v got %v", confirmed.Bid, keys)
+	}
+
+	// a blob that is referenced again isn't removed
+	if err := bs.UpdateRefCount(confirmed.Bid, 1); err != nil {
+		t.Fatalf("error updating ref count: %v", err)
+	}
+	if count, err := bs.DeleteData(keys, future); err != nil || count != 0 {
+		t.Fatalf("expecting no blob removed got %v / %v", count, err)
+	}
+	if err := bs.UpdateRefCount(confirmed.Bid, -1); err != nil {
+		t.Fatalf("error updating ref count: %v", err)
+	}
+
+	if count, err := bs.DeleteData(keys, future); err != nil || count != 1 {
+		t.Fatalf("error deleting blobs: %v / %v", count, err)
+	}
+	if _, err := bs.GetData(nil, confirmed.Bid); err != ErrKeyNotFound {
+		t.Errorf("expecting %v got %v", ErrKeyNotFound, err)
+	}
+	if _, err := bs.GetData(nil, pending.Bid); err != nil {
+		t.Errorf("pending blob should be kept: %v", err)
+	}
+}
+
+func TestPriorityAndFifo(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	ms := store.MessageStore()
+
+	send := func(receiver, id string, priority int, group string) {
+		msg := &pandora.Message{}
+		msg.Empty(nil)
+		msg.Set("id", id)
+		msg.SetReceiver(receiver)
+		msg.SetSender("test@local")
+		msg.Priority = priority
+		msg.Group = group
+		if err := ms.Enqueue(msg); err != nil {
+			t.Fatalf("error saving the message: %v", err)
+		}
+	}
+	send("prio@remote", "low", 0, "")
+	send("prio@remote", "high", 10, "")
+	msgs, err := ms.FetchAndLockBatch("prio@remote", time.Minute, 2)
+	if err != nil {
+		t.Fatalf("error fetching messages: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].Priority != 10 || msgs[1].Priority != 0 {
+		t.Fatalf("messages should be ordered by priority: %v", msgs)
+	}
+
+	send("fifo@remote", "a1", 0, "a")
+	send("fifo@remote", "a2", 10, "a")
+	send("fifo@remote", "b1", 0, "b")
+	if err := ms.SetFifo("fifo@remote", true); err != nil {
+		t.Fatalf("error enabling fifo: %v", err)
+	}
+
+	// only the head of each group is available
+	msgs, err = ms.FetchAndLockBatch("fifo@remote", time.Minute, 10)
+	if err != nil {
+		t.Fatalf("error fetching messages: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expecting one message per group got %v", len(msgs))
+	}
+	if _, err := ms.FetchAndLockLatest("fifo@remote", time.Minute); err != pandora.ErrNoMessages {
+		t.Fatalf("expecting %v got %v", pandora.ErrNoMessages, err)
+	}
+
+	var head *pandora.Message
+	for _, m := range msgs {
+		if m.Group == "a" {
+			head = m
+		}
+	}
+	if head == nil {
+		t.Fatalf("head of group a not fetched: %v", msgs)
+	}
+	if err := ms.Ack(head.Mid, head.Lid, pandora.StatusConfirmed); err != nil {
+		t.Fatalf("error confirming message: %v", err)
+	}
+	next, err := ms.FetchAndLockLatest("fifo@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	if next.Group != "a" || next.Priority != 10 {
+		t.Errorf("expecting the second message of group a got %v/%v", next.Group, next.Priority)
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	server := &pandora.Server{
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
+	}
+
+	send := func(dedupKey string, clientTime time.Time) pandora.Message {
+		body := make(url.Values)
+		body.Set("id", "1")
+		msg, err := server.SendEnvelope(pandora.Envelope{
+			Sender:     "a@local",
+			Receiver:   "b@remote",
+			ClientTime: clientTime,
+			DedupKey:   dedupKey,
+			Body:       body,
+		})
+		if err != nil {
+			t.Fatalf("error sending message: %v", err)
+		}
+		return msg
+	}
+
+	// a retry with a new client time returns the first mid
+	first := send("k1", time.Now())
+	retry := send("k1", time.Now().Add(time.Second))
+	if !bytes.Equal(first.Mid.Bytes(), retry.Mid.Bytes()) {
+		t.Errorf("expecting mid %v got %v", first.Mid, retry.Mid)
+	}
+
+	// identical bodies with different keys are different messages
+	clientTime := time.Now()
+	a := send("k2", clientTime)
+	b := send("k3", clientTime)
+	if bytes.Equal(a.Mid.Bytes(), b.Mid.Bytes()) {
+		t.Errorf("messages with different keys should have different mids")
+	}
+
+	var out [10]pandora.Message
+	sz, err := server.FetchHeaders(out[:], "b@remote", time.Time{})
+	if err != nil {
+		t.Fatalf("error fetching headers: %v", err)
+	}
+	if sz != 3 {
+		t.Errorf("expecting 3 messages got %v", sz)
+	}
+
+	// after the window the key can be used again
+	server.DedupWindow = time.Millisecond
+	expiring := send("k4", time.Now())
+	time.Sleep(time.Millisecond * 10)
+	again := send("k4", time.Now().Add(time.Second))
+	if bytes.Equal(expiring.Mid.Bytes(), again.Mid.Bytes()) {
+		t.Errorf("dedup key should expire after the window")
+	}
+}
+
+func TestChunkedPayload(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	server := &pandora.Server{
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
+	}
+
+	// both chunks are equal, so only one is saved
+	payload := bytes.Repeat([]byte{'a'}, pandora.ChunkSize*2)
+	sent, err := server.SendEnvelope(pandora.Envelope{
+		Sender:   "a@local",
+		Receiver: "b@remote",
+		Body:     make(url.Values),
+		Payload:  payload,
+	})
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+
+	fetched, err := server.FetchLatest("b@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	if fetched.Payload != nil || len(fetched.Get(pandora.KeyManifest)) == 0 {
+		t.Fatalf("payload should be chunked: %v", fetched.Body)
+	}
+	var manifestKey pandora.SHA1Key
+	if err := (pandora.KeyPrinter{}).ReadString(&manifestKey, fetched.Get(pandora.KeyManifest)); err != nil {
+		t.Fatalf("invalid manifest key: %v", err)
+	}
+	in, manifest, err := server.OpenPayload(&manifestKey)
+	if err != nil {
+		t.Fatalf("error opening payload: %v", err)
+	}
+	if len(manifest.Chunks) != 2 || !bytes.Equal(manifest.Chunks[0].Bytes(), manifest.Chunks[1].Bytes()) {
+		t.Fatalf("expecting 2 identical chunks got %v", manifest.Chunks)
+	}
+	data, err := ioutil.ReadAll(in)
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("invalid payload: %v bytes / %v", len(data), err)
+	}
+
+	bs := store.BlobStore()
+	future := time.Now().Add(time.Hour)
+	if keys, err := bs.UnreferencedKeys(10, future); err != nil || len(keys) != 0 {
+		t.Fatalf("chunks should be referenced by the message: %v / %v", keys, err)
+	}
+
+	if err := server.Ack(fetched.Mid, fetched.Lid, pandora.StatusConfirmed); err != nil {
+		t.Fatalf("error confirming message: %v", err)
+	}
+	keys, err := bs.UnreferencedKeys(10, future)
+	if err != nil {
+		t.Fatalf("error reading unreferenced keys: %v", err)
+	}
+	// body, manifest and the chunk
+	if len(keys) != 3 {
+		t.Fatalf("expecting 3 unreferenced keys got %v", keys)
+	}
+	if count, err := bs.DeleteData(keys, future); err != nil || count != 3 {
+		t.Fatalf("error deleting blobs: %v / %v", count, err)
+	}
+	if _, err := bs.GetData(nil, sent.Bid); err != ErrKeyNotFound {
+		t.Errorf("expecting %v got %v", ErrKeyNotFound, err)
+	}
+}
+
+func TestCountRefs(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	ms := store.MessageStore()
+	bs := store.BlobStore()
+
+	// a message saved before the ref-count was kept
+	msg := &pandora.Message{}
+	msg.Empty(nil)
+	msg.SetSender("a@local")
+	msg.SetReceiver("b@remote")
+	msg.Set("v", "legacy")
+	key, err := bs.PutData(nil, msg.EncodeBlob())
+	if err != nil {
+		t.Fatalf("error saving the body: %v", err)
+	}
+	msg.Bid = key
+	if err := ms.Enqueue(msg); err != nil {
+		t.Fatalf("error saving the message: %v", err)
+	}
+	err = store.doInsideTransaction(func(db *kv.DB) error {
+		return db.Delete(keyRefsCounted)
+	})
+	if err != nil {
+		t.Fatalf("error removing the marker: %v", err)
+	}
+
+	future := time.Now().Add(time.Hour)
+	if keys, err := bs.UnreferencedKeys(10, future); err != nil || len(keys) != 1 {
+		t.Fatalf("expecting 1 unreferenced key got %v / %v", keys, err)
+	}
+	if err := store.countRefs(); err != nil {
+		t.Fatalf("error counting refs: %v", err)
+	}
+	if keys, err := bs.UnreferencedKeys(10, future); err != nil || len(keys) != 0 {
+		t.Fatalf("the body of the pending message should be referenced: %v / %v", keys, err)
+	}
+	// only once
+	if err := bs.UpdateRefCount(key, -1); err != nil {
+		t.Fatalf("error releasing the body: %v", err)
+	}
+	if err := store.countRefs(); err != nil {
+		t.Fatalf("error counting refs: %v", err)
+	}
+	if keys, err := bs.UnreferencedKeys(10, future); err != nil || len(keys) != 1 {
+		t.Fatalf("expecting 1 unreferenced key got %v / %v", keys, err)
+	}
+}
+
+func TestForgedManifest(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	server := &pandora.Server{
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
+	}
+
+	manifest, err := server.WritePayload(bytes.NewReader(bytes.Repeat([]byte{'a'}, pandora.ChunkSize*2)))
+	if err != nil {
+		t.Fatalf("error writing payload: %v", err)
+	}
+	defer server.ReleasePayload(manifest)
+
+	for _, key := range []string{pandora.KeyManifest, pandora.KeyPayloadSize} {
+		body := make(url.Values)
+		body.Set(key, pandora.PrintKeyString(manifest.Key))
+		env := pandora.Envelope{Sender: "a@local", Receiver: "b@remote", Body: body}
+		if _, err := server.SendEnvelope(env); err != pandora.ErrInvalidManifest {
+			t.Errorf("%v: expecting %v got %v", key, pandora.ErrInvalidManifest, err)
+		}
+		results, err := server.SendBatch([]pandora.Envelope{env})
+		if err != nil || results[0].Err != pandora.ErrInvalidManifest {
+			t.Errorf("%v: expecting %v got %v / %v", key, pandora.ErrInvalidManifest, results, err)
+		}
+	}
+	if _, err := server.FetchLatest("b@remote", time.Minute); err != pandora.ErrSenderNotFound {
+		t.Errorf("no message should be enqueued, got %v", err)
+	}
+}
+
+type failingReader struct {
+	data []byte
+}
+
+func (f *failingReader) Read(out []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, errors.New("broken stream")
+	}
+	n := copy(out, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestWritePayloadRetain(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	server := &pandora.Server{
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
+	}
+	bs := store.BlobStore()
+	future := time.Now().Add(time.Hour)
+
+	payload := append(bytes.Repeat([]byte{'a'}, pandora.ChunkSize), 'b')
+	manifest, err := server.WritePayload(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("error writing payload: %v", err)
+	}
+	if keys, err := bs.UnreferencedKeys(10, future); err != nil || len(keys) != 0 {
+		t.Fatalf("chunks should be retained until released: %v / %v", keys, err)
+	}
+	if err := server.ReleasePayload(manifest); err != nil {
+		t.Fatalf("error releasing payload: %v", err)
+	}
+	// manifest and both chunks
+	keys, err := bs.UnreferencedKeys(10, future)
+	if err != nil || len(keys) != 3 {
+		t.Fatalf("expecting 3 unreferenced keys got %v / %v", keys, err)
+	}
+	if _, err := bs.DeleteData(keys, future); err != nil {
+		t.Fatalf("error deleting blobs: %v", err)
+	}
+
+	// the chunks written before the error are released
+	in := &failingReader{data: bytes.Repeat([]byte{'c'}, pandora.ChunkSize)}
+	if _, err := server.WritePayload(in); err == nil {
+		t.Fatalf("expecting an error from the broken stream")
+	}
+	if keys, err := bs.UnreferencedKeys(10, future); err != nil || len(keys) != 1 {
+		t.Fatalf("expecting 1 unreferenced key got %v / %v", keys, err)
+	}
+}
+
+func TestInboxStats(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	ms := store.MessageStore()
+	server := &pandora.Server{
+		BlobStore:    store.BlobStore(),
+		MessageStore: ms,
+	}
+	for i, delay := range []time.Duration{0, 0, time.Hour} {
+		body := make(url.Values)
+		body.Set("id", strconv.Itoa(i))
+		if _, err := server.Send("a@local", "b@remote", delay, time.Now(), body); err != nil {
+			t.Fatalf("error sending message: %v", err)
+		}
+	}
+	if err := ms.SetMaxDelivery("b@remote", 1); err != nil {
+		t.Fatalf("error setting max delivery: %v", err)
+	}
+	if _, err := server.FetchLatest("b@remote", time.Minute); err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+
+	stats, err := ms.InboxStats(time.Now())
+	if err != nil {
+		t.Fatalf("error reading stats: %v", err)
+	}
+	expected := pandora.InboxStats{Inbox: "b@remote", Ready: 1, Leased: 1, Delayed: 1}
+	if st := findStats(stats, "b@remote"); st != expected {
+		t.Errorf("expecting %v got %v", expected, st)
+	}
+
+	// the expired lease moves the message to the dead inbox
+	if err := ms.Reenqueue(time.Now().Add(time.Minute * 2)); err != nil {
+		t.Fatalf("error reenqueuing: %v", err)
+	}
+	stats, err = ms.InboxStats(time.Now())
+	if err != nil {
+		t.Fatalf("error reading stats: %v", err)
+	}
+	expected = pandora.InboxStats{Inbox: "b@remote", Ready: 1, Delayed: 1, Dead: 1, Timeouts: 1}
+	if st := findStats(stats, "b@remote"); st != expected {
+		t.Errorf("expecting %v got %v", expected, st)
+	}
+	if st := findStats(stats, pandora.DeadInbox("b@remote")); st.Inbox != "" {
+		t.Errorf("dead inboxes shouldn't be listed: %v", stats)
+	}
+}
+
+func findStats(stats []pandora.InboxStats, inbox string) pandora.InboxStats {
+	for _, st := range stats {
+		if st.Inbox == inbox {
+			return st
+		}
+	}
+	return pandora.InboxStats{}
+}
+
+func TestSchedules(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	server := &pandora.Server{
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
+	}
+
+	body := make(url.Values)
+	body.Set("id", "1")
+	sch, err := server.AddSchedule(pandora.Schedule{
+		Spec: "@every 5m",
+		Envelope: pandora.Envelope{
+			Sender:   "a@local",
+			Receiver: "b@remote",
+			Body:     body,
+			// ignored, otherwise every run would be expired
+			ExpiresAt: time.Now().Add(-time.Hour),
+		},
+	})
+	if err != nil {
+		t.Fatalf("error adding schedule: %v", err)
+	}
+	if len(sch.Id) == 0 {
+		t.Fatalf("a id should be generated")
+	}
+	if _, err := server.AddSchedule(pandora.Schedule{Spec: "invalid", Envelope: sch.Envelope}); err != pandora.ErrInvalidSpec {
+		t.Errorf("expecting %v got %v", pandora.ErrInvalidSpec, err)
+	}
+
+	if sent, err := server.RunSchedules(time.Now()); err != nil || sent != 0 {
+		t.Fatalf("the schedule isn't due yet: %v / %v", sent, err)
+	}
+	// runs missed are sent only once
+	later := sch.NextRun.Add(time.Minute * 12)
+	if sent, err := server.RunSchedules(later); err != nil || sent != 1 {
+		t.Fatalf("expecting 1 message sent got %v / %v", sent, err)
+	}
+	if sent, err := server.RunSchedules(later); err != nil || sent != 0 {
+		t.Fatalf("a run should be sent only once got %v / %v", sent, err)
+	}
+
+	schedules, err := server.Schedules()
+	if err != nil || len(schedules) != 1 {
+		t.Fatalf("expecting 1 schedule got %v / %v", schedules, err)
+	}
+	if !schedules[0].NextRun.Equal(later.Add(time.Minute * 5)) {
+		t.Errorf("expecting next run at %v got %v", later.Add(time.Minute*5), schedules[0].NextRun)
+	}
+
+	msg, err := server.FetchLatest("b@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	if msg.Get("id") != "1" || msg.Sender() != "a@local" {
+		t.Errorf("unexpected message %v", msg.Body)
+	}
+
+	if err := server.CancelSchedule(sch.Id); err != nil {
+		t.Fatalf("error canceling schedule: %v", err)
+	}
+	if err := server.CancelSchedule(sch.Id); err != pandora.ErrScheduleNotFound {
+		t.Errorf("expecting %v got %v", pandora.ErrScheduleNotFound, err)
+	}
+}
+
+func TestPurgeReplyInboxes(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	server := &pandora.Server{
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
+	}
+
+	replyTo := pandora.ReplyInboxPrefix + "1"
+	if _, err := server.Send(replyTo, "worker@local", 0, time.Now(), make(url.Values)); err != nil {
+		t.Fatalf("error sending request: %v", err)
+	}
+	reply, err := server.Send("worker@local", replyTo, 0, time.Now(), make(url.Values))
+	if err != nil {
+		t.Fatalf("error sending reply: %v", err)
+	}
+
+	if count, err := server.PurgeReplyInboxes(time.Now()); err != nil || count != 0 {
+		t.Fatalf("recent inboxes should be kept: %v / %v", count, err)
+	}
+	count, err := server.PurgeReplyInboxes(time.Now().Add(pandora.DefaultReplyInboxTTL * 2))
+	if err != nil || count != 1 {
+		t.Fatalf("expecting 1 inbox removed got %v / %v", count, err)
+	}
+
+	if _, err := server.FetchLatest(replyTo, time.Minute); err != pandora.ErrSenderNotFound {
+		t.Errorf("expecting %v got %v", pandora.ErrSenderNotFound, err)
+	}
+	if _, err := server.FetchLatest("worker@local", time.Minute); err != nil {
+		t.Errorf("other inboxes should be kept: %v", err)
+	}
+	keys, err := store.BlobStore().UnreferencedKeys(10, time.Now().Add(time.Hour))
+	if err != nil || len(keys) != 1 || !bytes.Equal(keys[0].Bytes(), reply.Bid.Bytes()) {
+		t.Errorf("expecting the reply body to be released got %v / %v", keys, err)
+	}
+}
+
+func TestMessageExpiry(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	server := &pandora.Server{
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
+	}
+
+	var sent int
+	send := func(to string, env pandora.Envelope) *pandora.Message {
+		sent++
+		env.Sender = "a@local"
+		env.Receiver = to
+		env.Body = make(url.Values)
+		env.Body.Set("n", strconv.Itoa(sent))
+		msg, err := server.SendEnvelope(env)
+		if err != nil {
+			t.Fatalf("error sending: %v", err)
+		}
+		return &msg
+	}
+
+	past := time.Now().Add(-time.Minute)
+	expired := send("b@remote", pandora.Envelope{Group: "g", ExpiresAt: past})
+	valid := send("b@remote", pandora.Envelope{Group: "g", TTL: time.Hour})
+	if valid.ExpiresAt.IsZero() {
+		t.Errorf("the ttl should set the expiration")
+	}
+
+	if err := store.MessageStore().SetFifo("b@remote", true); err != nil {
+		t.Fatalf("error enabling fifo: %v", err)
+	}
+	fetched, err := server.FetchLatest("b@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("expired messages shouldn't block the group: %v", err)
+	}
+	if !bytes.Equal(fetched.Mid.Bytes(), valid.Mid.Bytes()) {
+		t.Errorf("expecting the valid message got %v", pandora.PrintKeyString(fetched.Mid))
+	}
+	if !fetched.ExpiresAt.Equal(valid.ExpiresAt) {
+		t.Errorf("expecting expiration %v got %v", valid.ExpiresAt, fetched.ExpiresAt)
+	}
+	if err := server.Ack(fetched.Mid, fetched.Lid, pandora.StatusConfirmed); err != nil {
+		t.Fatalf("error confirming: %v", err)
+	}
+	if _, err := server.FetchLatest("b@remote", time.Minute); err != pandora.ErrNoMessages {
+		t.Errorf("expecting %v got %v", pandora.ErrNoMessages, err)
+	}
+
+	dropped := send("c@remote", pandora.Envelope{ExpiresAt: past})
+	if err := store.MessageStore().SetDropExpired("c@remote", true); err != nil {
+		t.Fatalf("error changing the expiry policy: %v", err)
+	}
+
+	count, err := server.ExpireMessages(time.Now())
+	if err != nil || count != 2 {
+		t.Fatalf("expecting 2 messages expired got %v / %v", count, err)
+	}
+	if server.Metrics.Expired.Value() != 2 {
+		t.Errorf("expecting 2 expired messages in the metrics got %v", server.Metrics.Expired.Value())
+	}
+
+	var dead [10]pandora.Message
+	sz, err := server.FetchDeadLetters(dead[:], "b@remote")
+	if err != nil || sz != 1 {
+		t.Fatalf("expecting 1 dead letter got %v / %v", sz, err)
+	}
+	if !bytes.Equal(dead[0].Mid.Bytes(), expired.Mid.Bytes()) || dead[0].Status != pandora.StatusExpired {
+		t.Errorf("expecting the expired message got %v with status %v", pandora.PrintKeyString(dead[0].Mid), dead[0].Status)
+	}
+	if sz, err := server.FetchDeadLetters(dead[:], "c@remote"); err != nil || sz != 0 {
+		t.Errorf("dropped messages shouldn't reach the dead inbox: %v / %v", sz, err)
+	}
+	keys, err := store.BlobStore().UnreferencedKeys(10, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("error reading unreferenced keys: %v", err)
+	}
+	var released bool
+	for _, k := range keys {
+		released = released || bytes.Equal(k.Bytes(), dropped.Mid.Bytes())
+	}
+	if !released {
+		t.Errorf("the body of the dropped message should be released")
+	}
+
+	if count, err := server.ExpireMessages(time.Now()); err != nil || count != 0 {
+		t.Errorf("messages should expire only once: %v / %v", count, err)
+	}
+
+	// replayed messages don't expire again
+	if n, err := server.ReplayDeadLetters("b@remote", nil); err != nil || n != 1 {
+		t.Fatalf("error replaying: %v / %v", n, err)
+	}
+	replayed, err := server.FetchLatest("b@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching the replayed message: %v", err)
+	}
+	if !replayed.ExpiresAt.IsZero() {
+		t.Errorf("the replayed message shouldn't expire, got %v", replayed.ExpiresAt)
+	}
+}
+
+func TestInboxes(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	server := &pandora.Server{
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
+	}
+	ms := store.MessageStore()
+
+	// the policies of unknown inboxes can't be changed
+	setters := []func() error{
+		func() error { return ms.SetMaxDelivery("x@remote", 1) },
+		func() error { return ms.SetFifo("x@remote", true) },
+		func() error { return ms.SetDropExpired("x@remote", true) },
+		func() error { return ms.SetPaused("x@remote", true) },
+		func() error { return ms.SetLeaseTime("x@remote", time.Minute) },
+		func() error { return ms.SetMaxSize("x@remote", 1) },
+	}
+	for i, set := range setters {
+		if err := set(); err != pandora.ErrInboxNotFound {
+			t.Errorf("setter %v: expecting %v got %v", i, pandora.ErrInboxNotFound, err)
+		}
+	}
+
+	body := make(url.Values)
+	body.Set("v", "dead")
+	if _, err := server.SendEnvelope(pandora.Envelope{Sender: "a@local", Receiver: "b@remote", ExpiresAt: time.Now().Add(-time.Minute), Body: body}); err != nil {
+		t.Fatalf("error sending: %v", err)
+	}
+	if _, err := server.ExpireMessages(time.Now()); err != nil {
+		t.Fatalf("error expiring: %v", err)
+	}
+	if _, err := server.Send("a@local", "b@remote", 0, time.Now(), make(url.Values)); err != nil {
+		t.Fatalf("error sending: %v", err)
+	}
+	if err := ms.SetPaused("b@remote", true); err != nil {
+		t.Fatalf("error pausing: %v", err)
+	}
+
+	inboxes, err := server.Inboxes(time.Now())
+	if err != nil {
+		t.Fatalf("error listing inboxes: %v", err)
+	}
+	if len(inboxes) != 2 || inboxes[0].Name != "a@local" || inboxes[1].Name != "b@remote" {
+		t.Fatalf("unexpected inboxes %v", inboxes)
+	}
+	if b := inboxes[1]; !b.Paused || b.Stats.Ready != 1 || b.Stats.Dead != 1 {
+		t.Errorf("unexpected inbox %v", b)
+	}
+	if _, err := server.FetchLatest("b@remote", time.Minute); err != pandora.ErrNoMessages {
+		t.Errorf("expecting %v got %v", pandora.ErrNoMessages, err)
+	}
+
+	count, err := server.DeleteInbox("b@remote")
+	if err != nil || count != 2 {
+		t.Fatalf("expecting 2 messages removed got %v / %v", count, err)
+	}
+	if _, err := server.DeleteInbox("b@remote"); err != pandora.ErrInboxNotFound {
+		t.Errorf("expecting %v got %v", pandora.ErrInboxNotFound, err)
+	}
+	if inboxes, err := ms.Inboxes(); err != nil || len(inboxes) != 1 {
+		t.Errorf("expecting only a@local got %v / %v", inboxes, err)
+	}
+	keys, err := store.BlobStore().UnreferencedKeys(10, time.Now().Add(time.Hour))
+	if err != nil || len(keys) != 2 {
+		t.Errorf("expecting 2 bodies released got %v / %v", keys, err)
+	}
+}
+
+func TestMessageHistory(t *testing.T) {
+	store := mustOpenStore()
+	defer store.Close()
+	server := &pandora.Server{
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
+	}
+
+	body := make(url.Values)
+	body.Set("id", "history")
+	msg, err := server.SendEnvelope(pandora.Envelope{
+		Sender:   "a@local",
+		Receiver: "b@remote",
+		Body:     body,
+		Client:   "producer",
+	})
+	if err != nil {
+		t.Fatalf("error sending: %v", err)
+	}
+	if err := store.MessageStore().SetMaxDelivery("b@remote", 2); err != nil {
+		t.Fatalf("error changing the max delivery: %v", err)
+	}
+
+	if _, err := server.FetchLatestBy("worker-1", "b@remote", time.Millisecond*10); err != nil {
+		t.Fatalf("error fetching: %v", err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if err := store.MessageStore().Reenqueue(time.Now()); err != nil {
+		t.Fatalf("error reenqueuing: %v", err)
+	}
+	fetched, err := server.FetchLatestBy("worker-2", "b@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching: %v", err)
+	}
+	if err := server.AckBy("worker-2", fetched.Mid, fetched.Lid, pandora.StatusRejected); err != nil {
+		t.Fatalf("error rejecting: %v", err)
+	}
+	if n, err := server.ReplayDeadLetters("b@remote", nil); err != nil || n != 1 {
+		t.Fatalf("error replaying: %v / %v", n, err)
+	}
+	fetched, err = server.FetchLatestBy("worker-3", "b@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching: %v", err)
+	}
+	if err := server.AckBy("worker-3", fetched.Mid, fetched.Lid, pandora.StatusConfirmed); err != nil {
+		t.Fatalf("error confirming: %v", err)
+	}
+
+	events, err := server.History(msg.Mid)
+	if err != nil {
+		t.Fatalf("error reading the history: %v", err)
+	}
+	expected := []struct {
+		typ, client, detail string
+	}{
+		{pandora.EventEnqueued, "producer", ""},
+		{pandora.EventLeased, "worker-1", ""},
+		{pandora.EventTimeout, "", ""},
+		{pandora.EventLeased, "worker-2", ""},
+		{pandora.EventRejected, "worker-2", ""},
+		{pandora.EventDead, "", "rejected by the client"},
+		{pandora.EventReplayed, "", ""},
+		{pandora.EventLeased, "worker-3", ""},
+		{pandora.EventConfirmed, "worker-3", ""},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expecting %v events got %v", len(expected), events)
+	}
+	for i, ev := range events {
+		e := expected[i]
+		if ev.Type != e.typ || ev.Client != e.client || ev.Detail != e.detail {
+			t.Errorf("event %v: expecting %v got %v", i, e, ev)
+		}
+		if !bytes.Equal(ev.Mid.Bytes(), msg.Mid.Bytes()) {
+			t.Errorf("event %v: invalid mid %v", i, pandora.PrintKeyString(ev.Mid))
+		}
+		if i > 0 && ev.At.Before(events[i-1].At) {
+			t.Errorf("event %v happened before the previous one", i)
+		}
+	}
+	if events[len(events)-1].Lid == nil || !bytes.Equal(events[len(events)-1].Lid.Bytes(), fetched.Lid.Bytes()) {
+		t.Errorf("the confirmation should hold the lease")
+	}
+
+	if _, err := server.History(&pandora.SHA1Key{}); err != pandora.ErrKeyNotFound {
+		t.Errorf("expecting %v got %v", pandora.ErrKeyNotFound, err)
+	}
+}
@@ -0,0 +1,145 @@
+package pandora
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets holds the upper bound, in seconds, of each bucket used by Histogram
+var LatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Counter is a monotonic counter, safe for concurrent use
+type Counter struct {
+	v int64
+}
+
+// Inc add 1 to the counter
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add delta to the counter
+func (c *Counter) Add(delta int) {
+	atomic.AddInt64(&c.v, int64(delta))
+}
+
+// Value return the current value of the counter
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+// Histogram count observed durations using LatencyBuckets, safe for concurrent use
+type Histogram struct {
+	sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Observe add d to the histogram
+func (h *Histogram) Observe(d time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(LatencyBuckets))
+	}
+	secs := d.Seconds()
+	for i, bound := range LatencyBuckets {
+		if secs <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += secs
+	h.count++
+}
+
+// ObserveSince add the time elapsed since start to the histogram
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+// Snapshot return the cumulative count of each bucket of LatencyBuckets,
+// the sum of all observed values (in seconds) and how many values were observed
+func (h *Histogram) Snapshot() ([]uint64, float64, uint64) {
+	h.Lock()
+	defer h.Unlock()
+	counts := make([]uint64, len(LatencyBuckets))
+	copy(counts, h.counts)
+	return counts, h.sum, h.count
+}
+
+// Metrics holds the counters and latencies of a Server since it was started
+type Metrics struct {
+	Sent        Counter
+	Fetched     Counter
+	Redelivered Counter
+	Confirmed   Counter
+	Rejected    Counter
+	Expired     Counter
+
+	SendLatency  Histogram
+	FetchLatency Histogram
+	AckLatency   Histogram
+}
+
+// InboxStats holds the number of messages of a inbox, by state
+type InboxStats struct {
+	Inbox string
+	// Ready messages can be fetched now
+	Ready int
+	// Leased messages are locked by a client
+	Leased int
+	// Delayed messages will be ready in the future
+	Delayed int
+	// Dead messages are in the dead inbox
+	Dead int
+	// Timeouts is how many leases of this inbox expired before an ack,
+	// since the inbox was created
+	Timeouts int64
+}
+
+// BlobUsage holds the storage used by a BlobStore
+type BlobUsage struct {
+	Count int64
+	Bytes int64
+}
+
+// countAck update the ack counters of m
+func (m *Metrics) countAck(status AckStatus) {
+	switch status {
+	case StatusConfirmed:
+		m.Confirmed.Inc()
+	case StatusRejected:
+		m.Rejected.Inc()
+	}
+}
+
+// countFetch update the fetch counters of m
+func (m *Metrics) countFetch(msg *Message) {
+	m.Fetched.Inc()
+	// the fetched message holds the count before this delivery
+	if msg.DeliveryCount > 0 {
+		m.Redelivered.Inc()
+	}
+}
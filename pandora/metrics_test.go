@@ -0,0 +1,52 @@
+package pandora
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	h.Observe(time.Millisecond * 3)
+	h.Observe(time.Second * 2)
+	h.Observe(time.Minute)
+
+	counts, sum, count := h.Snapshot()
+	if count != 3 {
+		t.Errorf("expecting 3 observations got %v", count)
+	}
+	if sum < 62 || sum > 62.01 {
+		t.Errorf("invalid sum %v", sum)
+	}
+	for i, bound := range LatencyBuckets {
+		var expected uint64
+		switch {
+		case bound >= 2:
+			expected = 2
+		case bound >= 0.003:
+			expected = 1
+		}
+		if counts[i] != expected {
+			t.Errorf("bucket %v: expecting %v got %v", bound, expected, counts[i])
+		}
+	}
+}
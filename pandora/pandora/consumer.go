@@ -0,0 +1,232 @@
+package pandora
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"github.com/andrebq/exp/pandora"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultConsumerWait is how long each fetch of a Consumer waits for a message
+	DefaultConsumerWait = time.Second * 5
+
+	// DefaultMinBackoff is the first pause of a Consumer after an empty fetch or an error
+	DefaultMinBackoff = time.Millisecond * 100
+
+	// DefaultMaxBackoff is the longest pause of a Consumer
+	DefaultMaxBackoff = time.Second * 30
+)
+
+// Handler process the messages fetched by a Consumer
+type Handler interface {
+	// Handle process msg, returning an error rejects the message.
+	//
+	// ctx is canceled if the lease of the message is lost
+	Handle(ctx context.Context, msg url.Values) error
+}
+
+// HandlerFunc allow a function to be used as a Handler
+type HandlerFunc func(ctx context.Context, msg url.Values) error
+
+// Handle calls fn(ctx, msg)
+func (fn HandlerFunc) Handle(ctx context.Context, msg url.Values) error {
+	return fn(ctx, msg)
+}
+
+// Consumer fetch messages from Inbox and process them using Handler.
+//
+// Messages are confirmed if the handler returns nil and rejected otherwise,
+// the lease is extended while the handler is running. If the lease can't be
+// extended, the handler context is canceled and the message is still confirmed
+// when the handler returns nil, the server refuses the ack if another consumer
+// already holds the message.
+type Consumer struct {
+	Mailbox *Mailbox
+	Inbox   string
+	Handler Handler
+
+	// Workers is the number of messages processed at the same time, if 0 only one is used
+	Workers int
+
+	// LeaseTime is the lease requested for each message, it is extended every
+	// LeaseTime/2 while the handler runs. If 0 pandora.DefaultLeaseTime is used
+	LeaseTime time.Duration
+
+	// Wait is how long a fetch waits for a message, it also limits how long Run
+	// takes to return after the context is canceled. If 0 DefaultConsumerWait is used
+	Wait time.Duration
+
+	// MinBackoff and MaxBackoff limit the pause after an empty fetch or an error,
+	// the pause doubles until a message is fetched. If 0 DefaultMinBackoff and DefaultMaxBackoff are used
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Run start the workers and blocks until ctx is canceled. Messages being
+// processed are acked before Run returns, messages fetched after ctx is
+// canceled aren't processed and become available again when their lease expires.
+func (c *Consumer) Run(ctx context.Context) error {
+	workers := c.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			c.work(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// work fetch and process messages until ctx is canceled
+func (c *Consumer) work(ctx context.Context) {
+	backoff := time.Duration(0)
+	for ctx.Err() == nil {
+		msg, err := c.Mailbox.FetchWait(c.Inbox, c.leaseTime(), c.wait())
+		if err == nil {
+			backoff = 0
+			c.process(ctx, msg)
+			continue
+		}
+		if err != ErrNoData {
+			log.Printf("[PANDORA-CONSUMER] error fetching from %v: %v", c.Inbox, err)
+		}
+		backoff = c.nextBackoff(backoff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// process calls the handler and ack the message based on its result
+func (c *Consumer) process(ctx context.Context, msg url.Values) {
+	mid, lid := msg.Get("mid"), msg.Get("lid")
+	if ctx.Err() != nil {
+		// the consumer is stopping, a reject would count as a failed
+		// delivery, so the lease expires and another consumer gets the message
+		log.Printf("[PANDORA-CONSUMER] stopping, %v will be available after its lease", mid)
+		return
+	}
+	// the handler isn't canceled by the consumer stop, only when the lease is lost
+	handlerCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go c.extendLease(handlerCtx, cancel, done, mid, lid)
+
+	err := c.handle(handlerCtx, msg)
+	close(done)
+	leaseLost := handlerCtx.Err() != nil
+	cancel()
+	if leaseLost {
+		if err != nil {
+			// the message will be delivered again when the lease expires
+			log.Printf("[PANDORA-CONSUMER] lease of %v lost, handler failed: %v", mid, err)
+			return
+		}
+		// the lease might still be valid, since the extend can fail because of
+		// the network, if not the server refuses the ack
+		log.Printf("[PANDORA-CONSUMER] lease of %v lost, confirming anyway", mid)
+	}
+	if err != nil {
+		log.Printf("[PANDORA-CONSUMER] message %v rejected: %v", mid, err)
+		c.ack(mid, lid, Reject)
+	} else {
+		c.ack(mid, lid, Confirm)
+	}
+}
+
+// handle calls the handler, a panic is returned as an error
+func (c *Consumer) handle(ctx context.Context, msg url.Values) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("handler panic: %v", rec)
+		}
+	}()
+	return c.Handler.Handle(ctx, msg)
+}
+
+// extendLease keeps the message locked until done is closed,
+// cancel is called if the lease can't be extended
+func (c *Consumer) extendLease(ctx context.Context, cancel context.CancelFunc, done <-chan struct{}, mid, lid string) {
+	ticker := time.NewTicker(c.leaseTime() / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, err := c.Mailbox.Extend(mid, lid, c.leaseTime(), false); err != nil {
+				log.Printf("[PANDORA-CONSUMER] error extending the lease of %v: %v", mid, err)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+func (c *Consumer) ack(mid, lid string, status AckStatus) {
+	if err := c.Mailbox.Ack(mid, lid, status); err != nil {
+		log.Printf("[PANDORA-CONSUMER] error acking %v: %v", mid, err)
+	}
+}
+
+func (c *Consumer) leaseTime() time.Duration {
+	if c.LeaseTime <= 0 {
+		return pandora.DefaultLeaseTime
+	}
+	return c.LeaseTime
+}
+
+func (c *Consumer) wait() time.Duration {
+	if c.Wait <= 0 {
+		return DefaultConsumerWait
+	}
+	return c.Wait
+}
+
+// nextBackoff double the current backoff, respecting the min and max
+func (c *Consumer) nextBackoff(current time.Duration) time.Duration {
+	min, max := c.MinBackoff, c.MaxBackoff
+	if min <= 0 {
+		min = DefaultMinBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	next := current * 2
+	if next < min {
+		next = min
+	}
+	if next > max {
+		next = max
+	}
+	return next
+}
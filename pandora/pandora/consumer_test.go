@@ -0,0 +1,292 @@
+package pandora
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"errors"
+	"github.com/andrebq/exp/pandora"
+	pandorahttp "github.com/andrebq/exp/pandora/http"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsumer(t *testing.T) {
+	server := mustCreateServer()
+	handler := &pandorahttp.Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	mb := &Mailbox{
+		Client:  http.DefaultClient,
+		BaseUrl: ts.URL,
+	}
+
+	const total = 10
+	for i := 0; i < total; i++ {
+		body := make(url.Values)
+		body.Set("job", strconv.Itoa(i))
+		if _, err := mb.Send("a@local", "jobs@remote", 0, body); err != nil {
+			t.Fatalf("error sending %v", err)
+		}
+	}
+
+	var lock sync.Mutex
+	done := make(map[string]int)
+	failed := false
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	consumer := &Consumer{
+		Mailbox: mb,
+		Inbox:   "jobs@remote",
+		Workers: 3,
+		Wait:    time.Millisecond * 100,
+		Handler: HandlerFunc(func(_ context.Context, msg url.Values) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if msg.Get("job") == "3" && !failed {
+				failed = true
+				return errors.New("first attempt fails")
+			}
+			done[msg.Get("job")]++
+			if len(done) == total {
+				cancel()
+			}
+			return nil
+		}),
+	}
+
+	finished := make(chan error)
+	go func() { finished <- consumer.Run(ctx) }()
+
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatalf("consumer didn't finish in time")
+	}
+
+	if !failed {
+		t.Errorf("the failing job wasn't processed")
+	}
+	for job, count := range done {
+		if count != 1 {
+			t.Errorf("job %v processed %v times", job, count)
+		}
+	}
+	if _, err := mb.Fetch("jobs@remote", time.Minute); err != ErrNoData {
+		t.Errorf("every message should be confirmed, got %v", err)
+	}
+}
+
+func TestConsumerExtendLease(t *testing.T) {
+	server := mustCreateServer()
+	handler := &pandorahttp.Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	mb := &Mailbox{
+		Client:  http.DefaultClient,
+		BaseUrl: ts.URL,
+	}
+
+	body := make(url.Values)
+	body.Set("job", "slow")
+	if _, err := mb.Send("a@local", "jobs@remote", 0, body); err != nil {
+		t.Fatalf("error sending %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	consumer := &Consumer{
+		Mailbox:   mb,
+		Inbox:     "jobs@remote",
+		LeaseTime: time.Second,
+		Wait:      time.Millisecond * 100,
+		Handler: HandlerFunc(func(hctx context.Context, msg url.Values) error {
+			calls++
+			// outlive the first lease
+			select {
+			case <-time.After(time.Second * 2):
+			case <-hctx.Done():
+				t.Errorf("lease lost: %v", hctx.Err())
+			}
+			// while the lease is held nobody else can fetch the message
+			if _, err := mb.Fetch("jobs@remote", time.Minute); err != ErrNoData {
+				t.Errorf("the message should be locked, got %v", err)
+			}
+			cancel()
+			return nil
+		}),
+	}
+
+	if err := consumer.Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expecting 1 call got %v", calls)
+	}
+	if _, err := mb.Fetch("jobs@remote", time.Minute); err != ErrNoData {
+		t.Errorf("the message should be confirmed, got %v", err)
+	}
+}
+
+// failExtend is a HttpClient that can't extend leases
+type failExtend struct{}
+
+func (failExtend) PostForm(url string, body url.Values) (*http.Response, error) {
+	if strings.HasSuffix(url, "/extend") {
+		return nil, errors.New("extend is down")
+	}
+	return http.PostForm(url, body)
+}
+
+func TestConsumerExtendFails(t *testing.T) {
+	server := mustCreateServer()
+	handler := &pandorahttp.Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	mb := &Mailbox{
+		Client:  failExtend{},
+		BaseUrl: ts.URL,
+	}
+
+	body := make(url.Values)
+	body.Set("job", "slow")
+	if _, err := mb.Send("a@local", "jobs@remote", 0, body); err != nil {
+		t.Fatalf("error sending %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	consumer := &Consumer{
+		Mailbox:   mb,
+		Inbox:     "jobs@remote",
+		LeaseTime: time.Second * 2,
+		Wait:      time.Millisecond * 100,
+		Handler: HandlerFunc(func(hctx context.Context, msg url.Values) error {
+			calls++
+			select {
+			case <-hctx.Done():
+			case <-time.After(time.Second * 5):
+				t.Errorf("the handler should be canceled when the extend fails")
+			}
+			cancel()
+			// the work finished before the lease expired
+			return nil
+		}),
+	}
+
+	if err := consumer.Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expecting 1 call got %v", calls)
+	}
+	// the lease was still valid, so the message was confirmed
+	time.Sleep(time.Second * 2)
+	if _, err := mb.Fetch("jobs@remote", time.Minute); err != ErrNoData {
+		t.Errorf("the message should be confirmed, got %v", err)
+	}
+}
+
+func TestConsumerStopping(t *testing.T) {
+	server := mustCreateServer()
+	handler := &pandorahttp.Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	mb := &Mailbox{
+		Client:  http.DefaultClient,
+		BaseUrl: ts.URL,
+	}
+	if _, err := mb.Send("a@local", "jobs@remote", 0, make(url.Values)); err != nil {
+		t.Fatalf("error sending %v", err)
+	}
+	if err := server.MessageStore.SetMaxDelivery("jobs@remote", 1); err != nil {
+		t.Fatalf("error setting max delivery: %v", err)
+	}
+	msg, err := mb.Fetch("jobs@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	consumer := &Consumer{
+		Mailbox: mb,
+		Inbox:   "jobs@remote",
+		Handler: HandlerFunc(func(context.Context, url.Values) error {
+			t.Errorf("the handler shouldn't be called after the stop")
+			return nil
+		}),
+	}
+	consumer.process(ctx, msg)
+
+	// a reject would move the message to the dead inbox
+	if count, err := server.FetchDeadLetters(make([]pandora.Message, 1), "jobs@remote"); err != nil || count != 0 {
+		t.Errorf("the message shouldn't be rejected, got %v dead letters / %v", count, err)
+	}
+	if _, err := mb.Fetch("jobs@remote", time.Minute); err != ErrNoData {
+		t.Errorf("the message should keep its lease, got %v", err)
+	}
+}
+
+func TestConsumerBackoff(t *testing.T) {
+	consumer := &Consumer{
+		MinBackoff: time.Millisecond * 10,
+		MaxBackoff: time.Millisecond * 50,
+	}
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	var current time.Duration
+	for _, e := range expected {
+		current = consumer.nextBackoff(current)
+		if current != e*time.Millisecond {
+			t.Errorf("expecting %v got %v", e*time.Millisecond, current)
+		}
+	}
+}
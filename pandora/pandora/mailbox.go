@@ -20,13 +20,20 @@ package pandora
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/andrebq/exp/pandora"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -41,6 +48,15 @@ const (
 
 var (
 	ErrNoData = errors.New("no data available")
+
+	// ErrRequestTimeout no reply arrived before the timeout of a Request
+	ErrRequestTimeout = errors.New("request timeout")
+
+	// ErrNoReplyTo the message informed to Reply doesn't have a replyTo header
+	ErrNoReplyTo = errors.New("message without replyTo")
+
+	// ErrPostRequired the Client of the Mailbox doesn't implement HttpPoster
+	ErrPostRequired = errors.New("the http client must implement HttpPoster")
 )
 
 // HttpClient defines the interface required to enable a Mailbox object
@@ -50,12 +66,76 @@ type HttpClient interface {
 	PostForm(url string, body url.Values) (*http.Response, error)
 }
 
+// HttpPoster is implemented by the HttpClient objects that can send
+// raw bodies, it is required by the batch operations and SendStream.
+//
+// Both *http.Client and TokenClient implement it
+type HttpPoster interface {
+	// Post is used to send the given body to the url
+	Post(url string, bodyType string, body io.Reader) (*http.Response, error)
+}
+
+// Outgoing is a message sent by SendBatch
+type Outgoing struct {
+	To    string
+	Delay time.Duration
+	// Priority, Group and DedupKey are optional, see pandora.Message
+	Priority int
+	Group    string
+	DedupKey string
+	// TTL is optional, a message that isn't delivered in time expires
+	TTL  time.Duration
+	Body url.Values
+}
+
+// AckItem is a message confirmed by AckBatch
+type AckItem struct {
+	Mid    string
+	Lid    string
+	Status AckStatus
+}
+
+// Result holds the outcome of a single item from a batch operation
+type Result struct {
+	Mid string
+	Err error
+}
+
 // Mailbox is the most basic form o interaction with a pandora server.
+//
+// Use a TokenClient as Client to talk with servers that require authentication
 type Mailbox struct {
 	BaseUrl string
 	Client  HttpClient
 }
 
+// TokenClient is a HttpClient that sends Token as a bearer token with every request
+type TokenClient struct {
+	// Client used to send the requests, if nil http.DefaultClient is used
+	Client *http.Client
+	Token  string
+}
+
+// PostForm implements the HttpClient interface
+func (tc *TokenClient) PostForm(url string, body url.Values) (*http.Response, error) {
+	return tc.Post(url, "application/x-www-form-urlencoded", strings.NewReader(body.Encode()))
+}
+
+// Post implements the HttpPoster interface
+func (tc *TokenClient) Post(url string, bodyType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", bodyType)
+	req.Header.Set("Authorization", "Bearer "+tc.Token)
+	client := tc.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
 // Ack marks the message as processed or rejected
 func (mb *Mailbox) Ack(mid, lid string, status AckStatus) error {
 	msgToAck := make(url.Values)
@@ -75,12 +155,54 @@ func (mb *Mailbox) Ack(mid, lid string, status AckStatus) error {
 	return nil
 }
 
+// Extend keeps the message locked for more lockFor time and return the lid that
+// should be used from now on. If rotate is true, the server will generate a new lid
+// and the old one will become invalid.
+func (mb *Mailbox) Extend(mid, lid string, lockFor time.Duration, rotate bool) (string, error) {
+	msgToExtend := make(url.Values)
+	msgToExtend.Set("mid", mid)
+	msgToExtend.Set("lid", lid)
+	msgToExtend.Set(pandora.KeyLeaseTime, lockFor.String())
+	msgToExtend.Set(pandora.KeyRotate, strconv.FormatBool(rotate))
+
+	res, err := mb.Client.PostForm(mb.BaseUrl+"/extend", msgToExtend)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("invalid status code: %v", res.StatusCode)
+	}
+
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	values, err := url.ParseQuery(string(buf))
+	if err != nil {
+		return "", err
+	}
+	return values.Get("lid"), nil
+}
+
 // Fetch asks for the server for a message
 func (mb *Mailbox) Fetch(from string, lockFor time.Duration) (url.Values, error) {
+	return mb.FetchWait(from, lockFor, 0)
+}
+
+// FetchWait asks the server for a message, if the mailbox is empty
+// the server holds the request until a message arrives or wait expires.
+//
+// ErrNoData is returned if no message arrived in time.
+func (mb *Mailbox) FetchWait(from string, lockFor, wait time.Duration) (url.Values, error) {
 	// now, try to consume the message
 	msgToFetch := make(url.Values)
 	msgToFetch.Set(pandora.KeyReceiver, from)
 	msgToFetch.Set(pandora.KeyLeaseTime, lockFor.String())
+	if wait > 0 {
+		msgToFetch.Set(pandora.KeyWait, wait.String())
+	}
 
 	res, err := mb.Client.PostForm(mb.BaseUrl+"/fetch", msgToFetch)
 	if err != nil {
@@ -112,6 +234,9 @@ func (mb *Mailbox) Fetch(from string, lockFor time.Duration) (url.Values, error)
 
 // Send will update the given body with the paramters expected by a Pandora server
 // and return the Mid generated by the server or an error.
+//
+// The priority, group, dedup key and expiration of the message can be informed in the body using
+// pandora.KeyPriority, pandora.KeyGroup, pandora.KeyDedupKey, pandora.KeyTTL and pandora.KeyExpiresAt.
 func (mb *Mailbox) Send(from, to string, delay time.Duration, body url.Values) (string, error) {
 	var msg pandora.Message
 	msg.Empty(body)
@@ -124,6 +249,75 @@ func (mb *Mailbox) Send(from, to string, delay time.Duration, body url.Values) (
 	if err != nil {
 		return "", err
 	}
+	return readMid(res)
+}
+
+// SendPayload sends payload as the opaque body of the message, the receiver can read
+// it using Payload. contentType is used by the receiver to decode the payload.
+func (mb *Mailbox) SendPayload(from, to string, delay time.Duration, contentType string, payload []byte) (string, error) {
+	return mb.SendStream(from, to, delay, contentType, bytes.NewReader(payload))
+}
+
+// SendStream works like SendPayload but the payload is read from in while it is sent,
+// payloads larger than pandora.ChunkSize are saved in chunks by the server and
+// the receiver should read them using OpenPayload.
+func (mb *Mailbox) SendStream(from, to string, delay time.Duration, contentType string, in io.Reader) (string, error) {
+	if len(contentType) == 0 {
+		contentType = pandora.DefaultContentType
+	}
+	var msg pandora.Message
+	msg.Empty(nil)
+	msg.SetSender(from)
+	msg.SetReceiver(to)
+	msg.SetClientTime(time.Now())
+	msg.Set("delay", delay.String())
+
+	res, err := mb.post(mb.BaseUrl+"/send?"+msg.Body.Encode(), contentType, in)
+	if err != nil {
+		return "", err
+	}
+	return readMid(res)
+}
+
+// Payload return the content type and the payload of a message returned by Fetch,
+// if the message don't have a payload, nil is returned.
+func Payload(msg url.Values) (string, []byte, error) {
+	if _, ok := msg[pandora.KeyPayload]; !ok {
+		return "", nil, nil
+	}
+	payload, err := base64.StdEncoding.DecodeString(msg.Get(pandora.KeyPayload))
+	return msg.Get(pandora.KeyContentType), payload, err
+}
+
+// OpenPayload return a reader of the payload of a message returned by Fetch,
+// chunked payloads are streamed from the server. The caller should close the reader.
+//
+// If the message don't have a payload, nil is returned.
+func (mb *Mailbox) OpenPayload(msg url.Values) (io.ReadCloser, error) {
+	if len(msg.Get(pandora.KeyManifest)) == 0 {
+		_, payload, err := Payload(msg)
+		if payload == nil || err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(payload)), nil
+	}
+	values := make(url.Values)
+	values.Set(pandora.KeyManifest, msg.Get(pandora.KeyManifest))
+	// required when the server uses authentication
+	values.Set("mid", msg.Get("mid"))
+	res, err := mb.Client.PostForm(mb.BaseUrl+"/payload", values)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("invalid status code: %v", res.StatusCode)
+	}
+	return res.Body, nil
+}
+
+// readMid read the mid from the response of a send request
+func readMid(res *http.Response) (string, error) {
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
@@ -146,3 +340,276 @@ func (mb *Mailbox) Send(from, to string, delay time.Duration, body url.Values) (
 
 	return values.Get("mid"), nil
 }
+
+// Request sends body to to and waits until the reply arrives or timeout expires.
+//
+// The request is sent from an ephemeral reply inbox (see pandora.ReplyInboxPrefix), informed in
+// the replyTo header, together with a random correlationId. The worker should answer using Reply.
+// Replies with another correlationId are confirmed and ignored.
+//
+// ErrRequestTimeout is returned if no reply arrived in time, the reply inbox is
+// removed by the server after its ttl.
+func (mb *Mailbox) Request(to string, body url.Values, timeout time.Duration) (url.Values, error) {
+	replyTo := pandora.ReplyInboxPrefix + randomId()
+	correlationId := randomId()
+	if body == nil {
+		body = make(url.Values)
+	}
+	body.Set(pandora.KeyReplyTo, replyTo)
+	body.Set(pandora.KeyCorrelationId, correlationId)
+	if _, err := mb.Send(replyTo, to, 0, body); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return nil, ErrRequestTimeout
+		}
+		if wait > pandora.MaxWaitTime {
+			wait = pandora.MaxWaitTime
+		}
+		reply, err := mb.FetchWait(replyTo, pandora.DefaultLeaseTime, wait)
+		if err == ErrNoData {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := mb.Ack(reply.Get("mid"), reply.Get("lid"), Confirm); err != nil {
+			return nil, err
+		}
+		if reply.Get(pandora.KeyCorrelationId) == correlationId {
+			return reply, nil
+		}
+	}
+}
+
+// Reply sends body as the reply of request, a message returned by Fetch. The reply is sent
+// from the receiver of request to its replyTo inbox, with the same correlationId.
+//
+// ErrNoReplyTo is returned if request isn't expecting a reply
+func (mb *Mailbox) Reply(request url.Values, body url.Values) (string, error) {
+	replyTo := request.Get(pandora.KeyReplyTo)
+	if len(replyTo) == 0 {
+		return "", ErrNoReplyTo
+	}
+	if body == nil {
+		body = make(url.Values)
+	}
+	body.Set(pandora.KeyCorrelationId, request.Get(pandora.KeyCorrelationId))
+	return mb.Send(request.Get(pandora.KeyReceiver), replyTo, 0, body)
+}
+
+// randomId return 16 random bytes encoded as hex
+func randomId() string {
+	var buf [16]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// Schedule register a recurring message from from to to, sent every time spec is due
+// (see pandora.ParseSpec). If id is empty, the server generates one.
+//
+// Returns the id of the schedule
+func (mb *Mailbox) Schedule(id, spec, from, to string, body url.Values) (string, error) {
+	if body == nil {
+		body = make(url.Values)
+	}
+	body.Set(pandora.KeyScheduleId, id)
+	body.Set(pandora.KeySpec, spec)
+	body.Set(pandora.KeySender, from)
+	body.Set(pandora.KeyReceiver, to)
+
+	res, err := mb.Client.PostForm(mb.BaseUrl+"/schedule", body)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("invalid status code: %v", res.StatusCode)
+	}
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	values, err := url.ParseQuery(string(buf))
+	if err != nil {
+		return "", err
+	}
+	return values.Get(pandora.KeyScheduleId), nil
+}
+
+// Publish sends body to every inbox subscribed to topic and return the key of the body
+func (mb *Mailbox) Publish(from, topic string, delay time.Duration, body url.Values) (string, error) {
+	return mb.Send(from, pandora.TopicPrefix+topic, delay, body)
+}
+
+// Subscribe register inbox to receive the messages published to topic
+func (mb *Mailbox) Subscribe(topic, inbox string) error {
+	return mb.postSubscription("/subscribe", topic, inbox)
+}
+
+// Unsubscribe stops the delivery of messages from topic to inbox
+func (mb *Mailbox) Unsubscribe(topic, inbox string) error {
+	return mb.postSubscription("/unsubscribe", topic, inbox)
+}
+
+// Subscribers return the name of the inboxes subscribed to topic
+func (mb *Mailbox) Subscribers(topic string) ([]string, error) {
+	values := make(url.Values)
+	values.Set(pandora.KeyTopic, topic)
+	res, err := mb.Client.PostForm(mb.BaseUrl+"/subscribers", values)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid status code: %v", res.StatusCode)
+	}
+	var inboxes []string
+	err = json.NewDecoder(res.Body).Decode(&inboxes)
+	return inboxes, err
+}
+
+func (mb *Mailbox) postSubscription(path, topic, inbox string) error {
+	values := make(url.Values)
+	values.Set(pandora.KeyTopic, topic)
+	values.Set(pandora.KeyReceiver, inbox)
+	res, err := mb.Client.PostForm(mb.BaseUrl+path, values)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid status code: %v", res.StatusCode)
+	}
+	return nil
+}
+
+// SendBatch works like Send for every message, all messages are sent in a single request.
+//
+// The result of each message is returned in the same order of msgs.
+func (mb *Mailbox) SendBatch(from string, msgs []Outgoing) ([]Result, error) {
+	items := make([]url.Values, len(msgs))
+	for i, out := range msgs {
+		var msg pandora.Message
+		msg.Empty(out.Body)
+		msg.SetSender(from)
+		msg.SetReceiver(out.To)
+		msg.SetClientTime(time.Now())
+		msg.Set("delay", out.Delay.String())
+		if out.Priority != 0 {
+			msg.Set(pandora.KeyPriority, strconv.Itoa(out.Priority))
+		}
+		if len(out.Group) > 0 {
+			msg.Set(pandora.KeyGroup, out.Group)
+		}
+		if len(out.DedupKey) > 0 {
+			msg.Set(pandora.KeyDedupKey, out.DedupKey)
+		}
+		if out.TTL > 0 {
+			msg.Set(pandora.KeyTTL, out.TTL.String())
+		}
+		items[i] = msg.Body
+	}
+	var values []url.Values
+	if err := mb.postBatch("/send/batch", items, &values); err != nil {
+		return nil, err
+	}
+	return readResults(values, "mid"), nil
+}
+
+// FetchBatch works like Fetch but asks the server for up to max messages.
+//
+// ErrNoData is returned if the mailbox is empty
+func (mb *Mailbox) FetchBatch(from string, lockFor time.Duration, max int) ([]url.Values, error) {
+	msgToFetch := make(url.Values)
+	msgToFetch.Set(pandora.KeyReceiver, from)
+	msgToFetch.Set(pandora.KeyLeaseTime, lockFor.String())
+	msgToFetch.Set(pandora.KeyMax, strconv.Itoa(max))
+
+	res, err := mb.Client.PostForm(mb.BaseUrl+"/fetch/batch", msgToFetch)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent {
+		return nil, ErrNoData
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid status code: %v", res.StatusCode)
+	}
+
+	var values []url.Values
+	if err := json.NewDecoder(res.Body).Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// AckBatch works like Ack for every item, all items are sent in a single request.
+//
+// The result of each item is returned in the same order of acks.
+func (mb *Mailbox) AckBatch(acks []AckItem) ([]Result, error) {
+	items := make([]url.Values, len(acks))
+	for i, ack := range acks {
+		items[i] = make(url.Values)
+		items[i].Set("mid", ack.Mid)
+		items[i].Set("lid", ack.Lid)
+		items[i].Set("statusCode", strconv.FormatInt(int64(ack.Status), 10))
+	}
+	var values []url.Values
+	if err := mb.postBatch("/ack/batch", items, &values); err != nil {
+		return nil, err
+	}
+	results := readResults(values, "mid")
+	for i := range results {
+		results[i].Mid = acks[i].Mid
+	}
+	return results, nil
+}
+
+// post sends body using the Client, which must implement HttpPoster
+func (mb *Mailbox) post(url string, bodyType string, body io.Reader) (*http.Response, error) {
+	poster, ok := mb.Client.(HttpPoster)
+	if !ok {
+		return nil, ErrPostRequired
+	}
+	return poster.Post(url, bodyType, body)
+}
+
+func (mb *Mailbox) postBatch(path string, items []url.Values, out interface{}) error {
+	buf, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	res, err := mb.post(mb.BaseUrl+path, "application/json", bytes.NewBuffer(buf))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid status code: %v", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func readResults(values []url.Values, key string) []Result {
+	results := make([]Result, len(values))
+	for i, v := range values {
+		if len(v.Get("error")) > 0 {
+			results[i].Err = errors.New(v.Get("error"))
+		}
+		results[i].Mid = v.Get(key)
+	}
+	return results
+}
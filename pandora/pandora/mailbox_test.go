@@ -1,32 +1,27 @@
 package pandora
 
 import (
+	"bytes"
 	"github.com/andrebq/exp/pandora"
 	pandorahttp "github.com/andrebq/exp/pandora/http"
-	"github.com/andrebq/exp/pandora/pgstore"
+	"github.com/andrebq/exp/pandora/kvstore"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"testing"
 	"time"
 )
 
 func mustCreateServer() *pandora.Server {
-	bs, err := pgstore.OpenBlobStore("pandora", "pandora", "localhost", "pandora")
+	store, err := kvstore.Open("")
 	if err != nil {
 		panic(err)
 	}
-
-	ms, err := pgstore.OpenMessageStore("pandora", "pandora", "localhost", "pandora")
-	if err != nil {
-		panic(err)
-	}
-	if err := ms.DeleteMessages(); err != nil {
-		panic(err)
-	}
 	return &pandora.Server{
-		BlobStore:    bs,
-		MessageStore: ms,
+		BlobStore:    store.BlobStore(),
+		MessageStore: store.MessageStore(),
 	}
 }
 
@@ -80,3 +75,458 @@ func TestMailbox(t *testing.T) {
 		t.Fatalf("should have received error %v but got %v", ErrNoData, err)
 	}
 }
+
+func TestMailboxExtend(t *testing.T) {
+	server := mustCreateServer()
+	handler := &pandorahttp.Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	mb := Mailbox{
+		Client:  http.DefaultClient,
+		BaseUrl: ts.URL,
+	}
+
+	body := make(url.Values)
+	body.Set("topic", "long job")
+	if _, err := mb.Send("a@local", "b@remote", 0, body); err != nil {
+		t.Fatalf("error sending %v", err)
+	}
+
+	fetched, err := mb.Fetch("b@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching object: %v", err)
+	}
+
+	lid, err := mb.Extend(fetched.Get("mid"), fetched.Get("lid"), time.Minute*10, true)
+	if err != nil {
+		t.Fatalf("error extending the lease: %v", err)
+	}
+	if len(lid) == 0 || lid == fetched.Get("lid") {
+		t.Errorf("expecting a new lid got %v", lid)
+	}
+
+	if _, err := mb.Extend(fetched.Get("mid"), fetched.Get("lid"), time.Minute, false); err == nil {
+		t.Errorf("the old lid shouldn't be valid")
+	}
+
+	if err := mb.Ack(fetched.Get("mid"), lid, Confirm); err != nil {
+		t.Errorf("error doing ACK. %v", err)
+	}
+}
+
+func TestMailboxBatch(t *testing.T) {
+	server := mustCreateServer()
+	handler := &pandorahttp.Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	mb := Mailbox{
+		Client:  http.DefaultClient,
+		BaseUrl: ts.URL,
+	}
+
+	var msgs []Outgoing
+	for i := 0; i < 5; i++ {
+		body := make(url.Values)
+		body.Set("idx", strconv.Itoa(i))
+		msgs = append(msgs, Outgoing{To: "b@remote", Body: body})
+	}
+	msgs = append(msgs, Outgoing{To: "", Body: make(url.Values)})
+
+	results, err := mb.SendBatch("a@local", msgs)
+	if err != nil {
+		t.Fatalf("error sending batch: %v", err)
+	}
+	if len(results) != len(msgs) {
+		t.Fatalf("expecting %v results got %v", len(msgs), len(results))
+	}
+	for i, r := range results[:5] {
+		if r.Err != nil || len(r.Mid) == 0 {
+			t.Errorf("item %v should be sent. got %v", i, r)
+		}
+	}
+	if results[5].Err == nil {
+		t.Errorf("a message without receiver shouldn't be sent")
+	}
+
+	fetched, err := mb.FetchBatch("b@remote", time.Minute, 3)
+	if err != nil {
+		t.Fatalf("error fetching batch: %v", err)
+	}
+	if len(fetched) != 3 {
+		t.Fatalf("expecting 3 messages got %v", len(fetched))
+	}
+
+	var acks []AckItem
+	for _, f := range fetched {
+		acks = append(acks, AckItem{Mid: f.Get("mid"), Lid: f.Get("lid"), Status: Confirm})
+	}
+	acks = append(acks, AckItem{Mid: fetched[0].Get("mid"), Lid: fetched[0].Get("lid"), Status: Confirm})
+	ackResults, err := mb.AckBatch(acks)
+	if err != nil {
+		t.Fatalf("error doing batch ack: %v", err)
+	}
+	for i, r := range ackResults[:3] {
+		if r.Err != nil {
+			t.Errorf("ack %v failed: %v", i, r.Err)
+		}
+	}
+	if ackResults[3].Err == nil {
+		t.Errorf("the same message shouldn't be confirmed twice")
+	}
+
+	fetched, err = mb.FetchBatch("b@remote", time.Minute, 10)
+	if err != nil {
+		t.Fatalf("error fetching batch: %v", err)
+	}
+	if len(fetched) != 2 {
+		t.Errorf("expecting 2 messages got %v", len(fetched))
+	}
+}
+
+// formClient only implements HttpClient
+type formClient struct{}
+
+func (formClient) PostForm(url string, body url.Values) (*http.Response, error) {
+	return http.PostForm(url, body)
+}
+
+func TestMailboxFormClient(t *testing.T) {
+	server := mustCreateServer()
+	handler := &pandorahttp.Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	mb := Mailbox{
+		Client:  formClient{},
+		BaseUrl: ts.URL,
+	}
+	if _, err := mb.Send("a@local", "b@remote", 0, make(url.Values)); err != nil {
+		t.Fatalf("error sending %v", err)
+	}
+	_, err := mb.SendBatch("a@local", []Outgoing{{To: "b@remote", Body: make(url.Values)}})
+	if err != ErrPostRequired {
+		t.Errorf("expecting %v got %v", ErrPostRequired, err)
+	}
+}
+
+func TestMailboxTopics(t *testing.T) {
+	server := mustCreateServer()
+	handler := &pandorahttp.Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	mb := Mailbox{
+		Client:  http.DefaultClient,
+		BaseUrl: ts.URL,
+	}
+
+	for _, inbox := range []string{"a@remote", "b@remote", "c@remote"} {
+		if err := mb.Subscribe("news", inbox); err != nil {
+			t.Fatalf("error subscribing %v: %v", inbox, err)
+		}
+	}
+	if err := mb.Unsubscribe("news", "c@remote"); err != nil {
+		t.Fatalf("error unsubscribing: %v", err)
+	}
+	subscribers, err := mb.Subscribers("news")
+	if err != nil {
+		t.Fatalf("error listing subscribers: %v", err)
+	}
+	if len(subscribers) != 2 {
+		t.Fatalf("expecting 2 subscribers got %v", subscribers)
+	}
+
+	body := make(url.Values)
+	body.Set("headline", "hello")
+	bid, err := mb.Publish("a@local", "news", 0, body)
+	if err != nil {
+		t.Fatalf("error publishing: %v", err)
+	}
+
+	var mids []string
+	for _, inbox := range subscribers {
+		fetched, err := mb.Fetch(inbox, time.Minute)
+		if err != nil {
+			t.Fatalf("error fetching from %v: %v", inbox, err)
+		}
+		if fetched.Get("headline") != "hello" {
+			t.Errorf("unexpected body: %v", fetched)
+		}
+		mids = append(mids, fetched.Get("mid"))
+	}
+	if mids[0] == mids[1] {
+		t.Errorf("each subscriber should receive a different message")
+	}
+
+	if _, err := mb.Fetch("c@remote", time.Minute); err != ErrNoData {
+		t.Errorf("expecting %v got %v", ErrNoData, err)
+	}
+
+	var key pandora.SHA1Key
+	if err := (pandora.KeyPrinter{}).ReadString(&key, bid); err != nil {
+		t.Fatalf("invalid body key %v: %v", bid, err)
+	}
+	if _, err := server.BlobStore.GetData(nil, &key); err != nil {
+		t.Errorf("body should be stored under %v: %v", bid, err)
+	}
+
+	// the copies of a batch are enqueued with the other messages
+	// and the repeated messages aren't counted again
+	sent := server.Metrics.Sent.Value()
+	results, err := mb.SendBatch("a@local", []Outgoing{
+		{To: pandora.TopicPrefix + "news", Body: url.Values{"headline": {"batch"}}},
+		{To: "d@remote", DedupKey: "once", Body: url.Values{"n": {"1"}}},
+		{To: "d@remote", DedupKey: "once", Body: url.Values{"n": {"1"}}},
+	})
+	if err != nil {
+		t.Fatalf("error sending batch: %v", err)
+	}
+	for i, r := range results {
+		if r.Err != nil {
+			t.Errorf("error sending item %v: %v", i, r.Err)
+		}
+	}
+	if results[1].Mid != results[2].Mid {
+		t.Errorf("expecting %v got %v", results[1].Mid, results[2].Mid)
+	}
+	if delta := server.Metrics.Sent.Value() - sent; delta != 3 {
+		t.Errorf("expecting 3 messages sent got %v", delta)
+	}
+	for _, inbox := range append(subscribers, "d@remote") {
+		if _, err := mb.Fetch(inbox, time.Minute); err != nil {
+			t.Errorf("error fetching from %v: %v", inbox, err)
+		}
+	}
+	if _, err := mb.Fetch("d@remote", time.Minute); err != ErrNoData {
+		t.Errorf("expecting %v got %v", ErrNoData, err)
+	}
+}
+
+func TestMailboxToken(t *testing.T) {
+	server := mustCreateServer()
+	auth := &pandorahttp.TokenAuth{}
+	auth.AddToken("secret", &pandorahttp.Principal{
+		Name:      "local",
+		Mailboxes: []string{"*@local"},
+		SendTo:    []string{"*@local"},
+	})
+	handler := &pandorahttp.Handler{
+		Server: server,
+		Auth:   auth,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	anonymous := Mailbox{
+		Client:  http.DefaultClient,
+		BaseUrl: ts.URL,
+	}
+	if _, err := anonymous.Send("a@local", "b@local", 0, make(url.Values)); err == nil {
+		t.Fatalf("sending without a token should fail")
+	}
+
+	mb := Mailbox{
+		Client:  &TokenClient{Token: "secret"},
+		BaseUrl: ts.URL,
+	}
+	mid, err := mb.Send("a@local", "b@local", 0, make(url.Values))
+	if err != nil {
+		t.Fatalf("error sending %v", err)
+	}
+	fetched, err := mb.Fetch("b@local", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching %v", err)
+	}
+	if fetched.Get("mid") != mid {
+		t.Errorf("expected mid %v got %v", mid, fetched.Get("mid"))
+	}
+	if err := mb.Ack(fetched.Get("mid"), fetched.Get("lid"), Confirm); err != nil {
+		t.Errorf("error doing ACK. %v", err)
+	}
+
+	if _, err := mb.Send("a@local", "b@remote", 0, make(url.Values)); err == nil {
+		t.Errorf("sending to b@remote should be forbidden")
+	}
+}
+
+func TestMailboxPayload(t *testing.T) {
+	server := mustCreateServer()
+	handler := &pandorahttp.Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	mb := Mailbox{
+		Client:  http.DefaultClient,
+		BaseUrl: ts.URL,
+	}
+
+	payload := []byte{0, 1, 2, '\n', 255}
+	mid, err := mb.SendPayload("a@local", "b@remote", 0, "application/x-protobuf", payload)
+	if err != nil {
+		t.Fatalf("error sending %v", err)
+	}
+
+	fetched, err := mb.Fetch("b@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching %v", err)
+	}
+	if fetched.Get("mid") != mid {
+		t.Errorf("expected mid %v got %v", mid, fetched.Get("mid"))
+	}
+	ct, data, err := Payload(fetched)
+	if err != nil {
+		t.Fatalf("error reading payload: %v", err)
+	}
+	if ct != "application/x-protobuf" || !bytes.Equal(data, payload) {
+		t.Errorf("unexpected payload %v %v", ct, data)
+	}
+}
+
+func TestMailboxStream(t *testing.T) {
+	server := mustCreateServer()
+	handler := &pandorahttp.Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	mb := Mailbox{
+		Client:  http.DefaultClient,
+		BaseUrl: ts.URL,
+	}
+
+	payload := bytes.Repeat([]byte("0123456789"), pandora.ChunkSize/4)
+	_, err := mb.SendStream("a@local", "b@remote", 0, "text/plain", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("error sending %v", err)
+	}
+
+	fetched, err := mb.Fetch("b@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching %v", err)
+	}
+	if len(fetched.Get(pandora.KeyManifest)) == 0 || len(fetched.Get(pandora.KeyPayload)) > 0 {
+		t.Fatalf("payload should be chunked: %v", fetched)
+	}
+	if fetched.Get(pandora.KeyPayloadSize) != strconv.Itoa(len(payload)) {
+		t.Errorf("expecting size %v got %v", len(payload), fetched.Get(pandora.KeyPayloadSize))
+	}
+	in, err := mb.OpenPayload(fetched)
+	if err != nil {
+		t.Fatalf("error opening payload: %v", err)
+	}
+	defer in.Close()
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatalf("error reading payload: %v", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Errorf("expecting %v bytes got %v", len(payload), len(data))
+	}
+}
+
+func TestMailboxSchedule(t *testing.T) {
+	server := mustCreateServer()
+	handler := &pandorahttp.Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	mb := Mailbox{
+		Client:  http.DefaultClient,
+		BaseUrl: ts.URL,
+	}
+
+	body := make(url.Values)
+	body.Set("report", "daily")
+	id, err := mb.Schedule("reports", "@every 1h", "a@local", "b@remote", body)
+	if err != nil {
+		t.Fatalf("error scheduling %v", err)
+	}
+	if id != "reports" {
+		t.Errorf("expecting id reports got %v", id)
+	}
+	if sent, err := server.RunSchedules(time.Now().Add(time.Hour)); err != nil || sent != 1 {
+		t.Fatalf("expecting 1 message sent got %v / %v", sent, err)
+	}
+
+	fetched, err := mb.Fetch("b@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching %v", err)
+	}
+	if fetched.Get("report") != "daily" || fetched.Get(pandora.KeySpec) != "" {
+		t.Errorf("unexpected message %v", fetched)
+	}
+}
+
+func TestMailboxRequest(t *testing.T) {
+	server := mustCreateServer()
+	handler := &pandorahttp.Handler{
+		Server: server,
+	}
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	mb := Mailbox{
+		Client:  http.DefaultClient,
+		BaseUrl: ts.URL,
+	}
+
+	// create the worker inbox, the fetch fails if it doesn't exist
+	if _, err := server.Send("worker@local", "other@local", 0, time.Now(), make(url.Values)); err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+
+	go func() {
+		request, err := mb.FetchWait("worker@local", time.Minute, time.Second*10)
+		if err != nil {
+			t.Errorf("error fetching request %v", err)
+			return
+		}
+		body := make(url.Values)
+		body.Set("answer", request.Get("question")+"!")
+		if _, err := mb.Reply(request, body); err != nil {
+			t.Errorf("error sending reply %v", err)
+		}
+		mb.Ack(request.Get("mid"), request.Get("lid"), Confirm)
+	}()
+
+	body := make(url.Values)
+	body.Set("question", "ping")
+	reply, err := mb.Request("worker@local", body, time.Second*10)
+	if err != nil {
+		t.Fatalf("error sending request %v", err)
+	}
+	if reply.Get("answer") != "ping!" {
+		t.Errorf("unexpected reply %v", reply)
+	}
+
+	if _, err := mb.Request("nobody@local", nil, time.Millisecond*100); err != ErrRequestTimeout {
+		t.Errorf("expecting %v got %v", ErrRequestTimeout, err)
+	}
+	if _, err := mb.Reply(reply, nil); err != ErrNoReplyTo {
+		t.Errorf("expecting %v got %v", ErrNoReplyTo, err)
+	}
+}
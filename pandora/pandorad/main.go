@@ -4,10 +4,13 @@ import (
 	"flag"
 	"github.com/andrebq/exp/pandora"
 	pandorahttp "github.com/andrebq/exp/pandora/http"
+	"github.com/andrebq/exp/pandora/kvstore"
 	"github.com/andrebq/exp/pandora/pgstore"
 	"github.com/andrebq/exp/pandora/webui"
 	"log"
 	"net/http"
+	"os"
+	"time"
 )
 
 var (
@@ -19,6 +22,14 @@ var (
 	dbName = flag.String("dbName", "pandpra", "Name of the database to connect")
 
 	initPgStore = flag.Bool("initPgStore", false, "Initialize the tables on the database")
+	store       = flag.String("store", "pg", "Storage backend: pg (postgresql) or kv (embedded)")
+	storeFile   = flag.String("storeFile", "", "File used by the kv store. If empty, messages are kept in memory")
+	gcInterval  = flag.Duration("gcInterval", time.Minute*10, "How often unreferenced blobs are collected. Use 0 to disable")
+	dedupWindow = flag.Duration("dedupWindow", pandora.DefaultDedupWindow, "How long a dedupKey is remembered by the server")
+	tokens      = flag.String("tokens", "", "Json file with the api tokens and their permissions. If empty, no authentication is required")
+	scheduler   = flag.Bool("scheduler", true, "Send the messages of the recurring schedules")
+	replyTTL    = flag.Duration("replyInboxTTL", pandora.DefaultReplyInboxTTL, "How long the reply inboxes used by request/reply are kept")
+	reaper      = flag.Duration("reaperInterval", pandora.ExpireInterval, "How often expired leases and messages are processed. Use 0 to disable")
 	h      = flag.Bool("h", false, "Help")
 )
 
@@ -29,6 +40,53 @@ func main() {
 		return
 	}
 
+	var server *pandora.Server
+	switch *store {
+	case "pg":
+		server = openPgStore()
+	case "kv":
+		server = openKvStore()
+	default:
+		log.Fatalf("invalid store: %v", *store)
+	}
+
+	server.DedupWindow = *dedupWindow
+	server.ReplyInboxTTL = *replyTTL
+
+	if *gcInterval > 0 {
+		go collectBlobs(server, *gcInterval)
+	}
+	if *scheduler {
+		go runSchedules(server)
+	}
+	go purgeReplyInboxes(server)
+	if *reaper > 0 {
+		go reapMessages(server, *reaper)
+	}
+
+	handler := &webui.Handler{
+		Api: pandorahttp.Handler{
+			Server:     server,
+			AllowAdmin: true,
+		},
+	}
+	if len(*tokens) > 0 {
+		handler.Api.Auth = loadTokens(*tokens)
+	}
+
+	if *static == "!usegas" {
+		handler.DefaultStatic()
+	} else {
+		handler.Static = http.FileServer(http.Dir(*static))
+	}
+
+	log.Printf("starting server at %v", *addr)
+	if err := http.ListenAndServe(*addr, handler); err != nil {
+		log.Fatalf("error starting server: %v", err)
+	}
+}
+
+func openPgStore() *pandora.Server {
 	messageStore, err := pgstore.OpenMessageStore(*dbUser, *dbPasswd, *dbHost, *dbName)
 	if err != nil {
 		log.Fatalf("error opening message store: %v", err)
@@ -48,29 +106,102 @@ func main() {
 		}
 
 		log.Printf("Tables initialized")
-		return
+		os.Exit(0)
 	}
 
-	server := pandora.Server{
+	return &pandora.Server{
 		BlobStore:    blobStore,
 		MessageStore: messageStore,
 	}
+}
 
-	handler := &webui.Handler{
-		Api: pandorahttp.Handler{
-			Server:     &server,
-			AllowAdmin: true,
-		},
+func openKvStore() *pandora.Server {
+	kvStore, err := kvstore.Open(*storeFile)
+	if err != nil {
+		log.Fatalf("error opening kv store: %v", err)
+	}
+	if len(*storeFile) == 0 {
+		log.Printf("using a memory store, messages will be lost on exit")
 	}
+	return &pandora.Server{
+		BlobStore:    kvStore.BlobStore(),
+		MessageStore: kvStore.MessageStore(),
+	}
+}
 
-	if *static == "!usegas" {
-		handler.DefaultStatic()
-	} else {
-		handler.Static = http.FileServer(http.Dir(*static))
+// collectBlobs remove the unreferenced blobs every interval,
+// batches are removed until no more blobs are found
+func collectBlobs(server *pandora.Server, interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		for {
+			report, err := server.CollectBlobs(pandora.GCBatchSize, false)
+			if err != nil {
+				log.Printf("error collecting blobs: %v", err)
+				break
+			}
+			if report.Deleted > 0 {
+				log.Printf("%v blobs collected", report.Deleted)
+			}
+			if len(report.Keys) < pandora.GCBatchSize || report.Deleted == 0 {
+				break
+			}
+		}
 	}
+}
 
-	log.Printf("starting server at %v", *addr)
-	if err = http.ListenAndServe(*addr, handler); err != nil {
-		log.Fatalf("error starting server: %v", err)
+// runSchedules send the messages of the due schedules every pandora.SchedulerInterval
+func runSchedules(server *pandora.Server) {
+	for now := range time.Tick(pandora.SchedulerInterval) {
+		sent, err := server.RunSchedules(now)
+		if err != nil {
+			log.Printf("error running schedules: %v", err)
+		}
+		if sent > 0 {
+			log.Printf("%v scheduled messages sent", sent)
+		}
+	}
+}
+
+// purgeReplyInboxes remove the expired reply inboxes every pandora.ReplyPurgeInterval
+func purgeReplyInboxes(server *pandora.Server) {
+	for now := range time.Tick(pandora.ReplyPurgeInterval) {
+		count, err := server.PurgeReplyInboxes(now)
+		if err != nil {
+			log.Printf("error removing reply inboxes: %v", err)
+		}
+		if count > 0 {
+			log.Printf("%v reply inboxes removed", count)
+		}
+	}
+}
+
+// reapMessages reenqueue the messages with an expired lease and then
+// handle the expired messages, every interval
+func reapMessages(server *pandora.Server, interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := server.MessageStore.Reenqueue(now); err != nil {
+			log.Printf("error reenqueuing messages: %v", err)
+			continue
+		}
+		count, err := server.ExpireMessages(now)
+		if err != nil {
+			log.Printf("error expiring messages: %v", err)
+		}
+		if count > 0 {
+			log.Printf("%v messages expired", count)
+		}
+	}
+}
+
+func loadTokens(filename string) pandorahttp.Authenticator {
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Fatalf("error opening tokens file: %v", err)
+	}
+	defer file.Close()
+	auth, err := pandorahttp.LoadTokens(file)
+	if err != nil {
+		log.Fatalf("error reading tokens file: %v", err)
 	}
+	return auth
 }
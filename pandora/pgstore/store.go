@@ -24,9 +24,11 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/andrebq/exp/pandora"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"io"
 	"io/ioutil"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
@@ -48,6 +50,25 @@ var (
 		$$ language plpgsql;`,
 		`create table if not exists pgstore_blobs(id integer not null default nextval('pgstore_seq_blobs'), blobid bytea, data bytea)`,
 		`create table if not exists pgstore_blobs_ref(id integer not null, blobid bytea, delta integer not null)`,
+		// the blobs saved before the ref-count was kept have a sum of 0,
+		// so the references of the pending messages are added when the
+		// column is created, otherwise the GC would remove their bodies.
+		// 1 is pandora.StatusConfirmed
+		`do
+		$$
+		begin
+			alter table pgstore_blobs_ref add column changedat timestamp not null default now();
+			if to_regclass('pgstore_messages') is not null then
+				insert into pgstore_blobs_ref(id, blobid, delta)
+					select b.id, b.blobid, count(*)
+					from pgstore_blobs b
+					join pgstore_messages m on m.mid = b.blobid
+					where m.status <> 1
+					group by b.id, b.blobid;
+			end if;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
 	}
 
 	messageStoreDef = []string{
@@ -79,9 +100,195 @@ var (
 		end
 		$$ language plpgsql;`,
 		`create table if not exists pgstore_messageboxes (id integer not null default nextval('pgstore_seq_messages'), name text not null)`,
+		`do
+		$$
+		begin
+			alter table pgstore_messages add column reason text;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			alter table pgstore_messageboxes add column maxdelivery int not null default 0;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			alter table pgstore_messages add column blobid bytea;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`create table if not exists pgstore_subscriptions(topic text not null, inboxid int not null, unique(topic, inboxid))`,
+		`do
+		$$
+		begin
+			alter table pgstore_messages add column priority int not null default 0;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			alter table pgstore_messages add column msggroup text not null default '';
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			alter table pgstore_messageboxes add column fifo boolean not null default false;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			alter table pgstore_messages add column dedupkey text;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			alter table pgstore_messages add column dedupuntil timestamp;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			alter table pgstore_messageboxes add column timeouts bigint not null default 0;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			alter table pgstore_messageboxes add column createdat timestamp not null default now();
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			alter table pgstore_messages add column expiresat timestamp;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			alter table pgstore_messageboxes add column dropexpired boolean not null default false;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			alter table pgstore_messageboxes add column paused boolean not null default false;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		// leasetime is a time.Duration, ie, nanoseconds
+		`do
+		$$
+		begin
+			alter table pgstore_messageboxes add column leasetime bigint not null default 0;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			alter table pgstore_messageboxes add column maxsize int not null default 0;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			create index pgstore_idx_messages_queue on pgstore_messages(receiverid, status, sendwhen);
+		exception when duplicate_table then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			create index pgstore_idx_messages_lease on pgstore_messages(leaseuntil) where lid is not null;
+		exception when duplicate_table then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			create index pgstore_idx_messages_expire on pgstore_messages(expiresat) where expiresat is not null;
+		exception when duplicate_table then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			create index pgstore_idx_messages_dedup on pgstore_messages(receiverid, dedupkey) where dedupkey is not null;
+		exception when duplicate_table then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			create index pgstore_idx_messageboxes_name on pgstore_messageboxes(name);
+		exception when duplicate_table then
+		end
+		$$ language plpgsql;`,
+		`do
+		$$
+		begin
+			create sequence pgstore_seq_history increment 1 minvalue 1 maxvalue 9223372036854775807 start 1 cache 1;
+		exception when duplicate_table then
+		end
+		$$ language plpgsql;`,
+		`create table if not exists pgstore_history(
+			id bigint not null default nextval('pgstore_seq_history'),
+			mid bytea not null,
+			event text not null,
+			at timestamp not null,
+			client text not null default '',
+			lid bytea,
+			detail text not null default ''
+		)`,
+		`do
+		$$
+		begin
+			create index pgstore_idx_history_mid on pgstore_history(mid, at, id);
+		exception when duplicate_table then
+		end
+		$$ language plpgsql;`,
+		`create table if not exists pgstore_schedules(
+			id text not null primary key,
+			spec text not null,
+			sender text not null,
+			receiver text not null,
+			priority int not null default 0,
+			msggroup text not null default '',
+			body text not null,
+			payload bytea,
+			contenttype text not null default '',
+			nextrun timestamp not null,
+			createdat timestamp not null
+		)`,
+		// ttl is the time.Duration of Envelope.TTL, ie, nanoseconds
+		`do
+		$$
+		begin
+			alter table pgstore_schedules add column ttl bigint not null default 0;
+		exception when duplicate_column then
+		end
+		$$ language plpgsql;`,
 	}
 
-	ErrKeyNotFound = pandora.ApiError("key not found")
+	ErrKeyNotFound = pandora.ErrKeyNotFound
 )
 
 type memoryBuffer interface {
@@ -108,6 +315,10 @@ func OpenMessageStore(user, pwd, host, dbname string) (*MessageStore, error) {
 
 func (ms *MessageStore) DeleteMessages() error {
 	_, err := ms.conn.Exec("delete from pgstore_messages")
+	if err != nil {
+		return err
+	}
+	_, err = ms.conn.Exec("delete from pgstore_history")
 	return err
 }
 
@@ -121,28 +332,241 @@ func (ms *MessageStore) InitTables() (err error) {
 	return
 }
 
+// Reenqueue remove the lock of the messages with a lease expired until now.
+//
+// Fetches don't wait for it, messages with an expired lease can be fetched again
+// right away, but it should run periodically to move the messages that reached the
+// max delivery count to the dead inbox and keep the timeouts of the inboxes updated.
 func (ms *MessageStore) Reenqueue(now time.Time) error {
-	return reEnqueueMessages(ms.conn, time.Now())
+	return doInsideTransaction(ms.conn, func(tx querier) error {
+		return reEnqueueMessages(tx, now)
+	})
 }
 
 // take all messages that have a lease time expired and
 // remove the lock information.
 //
-// Confirmed messages aren't touched
+// Messages that reached the max delivery count of the inbox
+// are moved to the dead inbox.
+//
+// Confirmed messages aren't touched.
+//
+// The expired leases are removed first, rows locked by concurrent fetches
+// are skipped, and only the removed leases are counted as timeouts.
 func reEnqueueMessages(db querier, now time.Time) error {
-	_, err := db.Exec(`update pgstore_messages
-		set lid = null, leaseuntil = null
-		where lid is not null and leaseuntil < $1 and status <> $2`,
-		now, pandora.StatusConfirmed)
+	rows, err := db.Query(`with expired as (
+			update pgstore_messages m
+			set lid = null, leaseuntil = null
+			from (select id, lid, leaseuntil
+				from pgstore_messages
+				where lid is not null and leaseuntil < $1 and status <> $2
+				for update skip locked) old
+			where m.id = old.id
+			returning m.id, m.mid, m.receiverid, m.deliverycount, old.lid, old.leaseuntil
+		), counted as (
+			update pgstore_messageboxes b
+			set timeouts = b.timeouts + e.total
+			from (select receiverid, count(*) as total
+				from expired
+				group by receiverid) e
+			where b.id = e.receiverid
+		), recorded as (
+			insert into pgstore_history(mid, event, at, lid)
+			select mid, $3, leaseuntil, lid from expired
+		)
+		select e.id
+		from expired e
+			inner join pgstore_messageboxes b on b.id = e.receiverid
+		where b.maxdelivery > 0 and e.deliverycount >= b.maxdelivery`,
+		now, pandora.StatusConfirmed, pandora.EventTimeout)
+	if err != nil {
+		return err
+	}
+	var dead []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		dead = append(dead, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range dead {
+		if err := moveToDeadInbox(db, id, pandora.StatusTimeout, "lease expired", now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpireMessages move the expired messages to the dead inbox or remove them,
+// following the policy of their inbox
+func (ms *MessageStore) ExpireMessages(now time.Time) (int, []pandora.Key, error) {
+	var count int
+	var bodies []pandora.Key
+	err := doInsideTransaction(ms.conn, func(tx querier) error {
+		var err error
+		count, bodies, err = expireMessages(tx, now)
+		return err
+	})
+	return count, bodies, err
+}
+
+// expireMessages handle every message that expired until now and isn't leased.
+//
+// Returns the number of messages expired and the body key of the ones removed
+func expireMessages(db querier, now time.Time) (int, []pandora.Key, error) {
+	_, err := db.Exec(`insert into pgstore_history(mid, event, at, detail)
+		select m.mid, $4, m.expiresat, case when b.dropexpired then $5 else '' end
+		from pgstore_messages m
+			inner join pgstore_messageboxes b on b.id = m.receiverid
+		where m.expiresat <= $1 and m.status <> $2
+			and (m.lid is null or m.leaseuntil < $1)
+			and right(b.name, length($3)) <> $3`,
+		now, pandora.StatusConfirmed, pandora.DeadInboxSuffix, pandora.EventExpired, pandora.DetailDropped)
+	if err != nil {
+		return 0, nil, err
+	}
+	ids, err := queryIds(db, `select m.id
+		from pgstore_messages m
+			inner join pgstore_messageboxes b on b.id = m.receiverid
+		where m.expiresat <= $1 and m.status <> $2
+			and (m.lid is null or m.leaseuntil < $1)
+			and not b.dropexpired
+			and right(b.name, length($3)) <> $3`,
+		now, pandora.StatusConfirmed, pandora.DeadInboxSuffix)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, id := range ids {
+		if err := moveToDeadInbox(db, id, pandora.StatusExpired, "message expired", now); err != nil {
+			return 0, nil, err
+		}
+	}
+	rows, err := db.Query(`delete from pgstore_messages m
+		using pgstore_messageboxes b
+		where b.id = m.receiverid
+			and m.expiresat <= $1 and m.status <> $2
+			and (m.lid is null or m.leaseuntil < $1)
+			and b.dropexpired
+			and right(b.name, length($3)) <> $3
+		returning coalesce(m.blobid, m.mid)`,
+		now, pandora.StatusConfirmed, pandora.DeadInboxSuffix)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	var bodies []pandora.Key
+	for rows.Next() {
+		var buf []byte
+		if err := rows.Scan(&buf); err != nil {
+			return 0, nil, err
+		}
+		body := &pandora.SHA1Key{}
+		copy(body.Bytes(), buf)
+		bodies = append(bodies, body)
+	}
+	return len(ids) + len(bodies), bodies, rows.Err()
+}
+
+// moveToDeadInbox unlock the message and move it to the dead inbox of its
+// current receiver
+func moveToDeadInbox(db querier, id int64, status pandora.AckStatus, reason string, now time.Time) error {
+	var inbox string
+	err := db.QueryRow(`select b.name
+		from pgstore_messages m
+			inner join pgstore_messageboxes b on b.id = m.receiverid
+		where m.id = $1`, id).Scan(&inbox)
+	if err != nil {
+		return err
+	}
+	deadId, err := findInbox(db, pandora.DeadInbox(inbox), true)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`update pgstore_messages
+		set receiverid = $1, status = $2, reason = $3, lid = null, leaseuntil = null
+		where id = $4`, deadId, status, reason, id)
+	if err != nil {
+		return err
+	}
+	return appendMessageEvent(db, id, pandora.EventDead, now, reason)
+}
+
+// appendMessageEvent add an event, caused by the store, to the history of the message
+func appendMessageEvent(db querier, id int64, event string, at time.Time, detail string) error {
+	_, err := db.Exec(`insert into pgstore_history(mid, event, at, detail)
+		select mid, $2, $3, $4 from pgstore_messages where id = $1`, id, event, at, detail)
 	return err
 }
 
-func fetchHeaders(out []pandora.Message, db querier, inbox string, now, min time.Time) ([]pandora.Message, error) {
-	err := reEnqueueMessages(db, now)
+// appendEvent add ev to the history of its message
+func appendEvent(db querier, ev *pandora.Event) error {
+	var lid []byte
+	if ev.Lid != nil {
+		lid = ev.Lid.Bytes()
+	}
+	_, err := db.Exec(`insert into pgstore_history(mid, event, at, client, lid, detail)
+		values ($1, $2, $3, $4, $5, $6)`, ev.Mid.Bytes(), ev.Type, ev.At, ev.Client, lid, ev.Detail)
+	return err
+}
+
+// exceededMaxDelivery check if the message was delivered more times than the max
+// allowed by its receiver
+func exceededMaxDelivery(db querier, id int64) (bool, error) {
+	var exceeded bool
+	err := db.QueryRow(`select b.maxdelivery > 0 and m.deliverycount >= b.maxdelivery
+		from pgstore_messages m
+			inner join pgstore_messageboxes b on b.id = m.receiverid
+		where m.id = $1`, id).Scan(&exceeded)
+	return exceeded, err
+}
+
+// deadLetters return the ids of unlocked messages in the dead inbox of inbox,
+// if mid isn't nil only that message is returned
+func deadLetters(db querier, inbox string, mid pandora.Key) ([]int64, error) {
+	if len(inbox) == 0 {
+		return nil, pandora.ErrInvalidMailBox
+	}
+	deadId, err := findInbox(db, pandora.DeadInbox(inbox), false)
+	if err == pandora.ErrSenderNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var midBytes []byte
+	if mid != nil {
+		midBytes = mid.Bytes()
+	}
+	return queryIds(db, `select id from pgstore_messages
+		where receiverid = $1 and lid is null and status <> $2
+			and ($3::bytea is null or mid = $3)
+		order by receivedat asc`, deadId, pandora.StatusConfirmed, midBytes)
+}
+
+// queryIds return the ids selected by query
+func queryIds(db querier, query string, args ...interface{}) ([]int64, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
 
+func fetchHeaders(out []pandora.Message, db querier, inbox string, now, min time.Time) ([]pandora.Message, error) {
 	inboxId, err := findInbox(db, inbox, false)
 	if err != nil {
 		return nil, err
@@ -150,10 +574,11 @@ func fetchHeaders(out []pandora.Message, db querier, inbox string, now, min time
 	results, err := db.Query(`select mid, status, receivedat, sendwhen, deliverycount
 		from pgstore_messages
 		where receiverid = $1
-			and lid is null
+			and (lid is null or leaseuntil < $2)
 			and sendwhen <= $2
 			and receivedat > $3
 			and status <> $4
+			and (expiresat is null or expiresat > $2)
 		order by receivedat asc, sendwhen asc
 		limit $5`, inboxId, now, min, pandora.StatusConfirmed, len(out))
 	if err != nil {
@@ -181,36 +606,272 @@ func fetchHeaders(out []pandora.Message, db querier, inbox string, now, min time
 }
 
 func fetchLatestMessage(msg *pandora.Message, db querier, inbox string, now time.Time, dur time.Duration) error {
-	err := reEnqueueMessages(db, now)
+	msgs, err := fetchAndLock(db, inbox, now, dur, 1)
 	if err != nil {
 		return err
 	}
+	*msg = *msgs[0]
+	return nil
+}
+
+// fetchAndLock lock up to max messages from inbox
+func fetchAndLock(db querier, inbox string, now time.Time, dur time.Duration, max int) ([]*pandora.Message, error) {
 	inboxId, err := findInbox(db, inbox, false)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var buf []byte
-	var id int64
-	err = db.QueryRow(`select id, mid, status, receivedat, sendwhen, deliverycount
+	var fifo, paused bool
+	var lease time.Duration
+	var maxDelivery int
+	err = db.QueryRow("select fifo, paused, leasetime, maxdelivery from pgstore_messageboxes where id = $1", inboxId).Scan(&fifo, &paused, &lease, &maxDelivery)
+	if err != nil {
+		return nil, err
+	}
+	if paused {
+		return nil, pandora.ErrNoMessages
+	}
+	if dur <= 0 {
+		dur = lease
+	}
+	if dur <= 0 {
+		dur = pandora.DefaultLeaseTime
+	}
+	// messages with an expired lease are available, unless they reached the max
+	// delivery count, those are moved to the dead inbox by reEnqueueMessages.
+	//
+	// rows locked by concurrent fetches are skipped instead of waited
+	query := `select id, mid, blobid, status, receivedat, sendwhen, deliverycount, priority, msggroup, expiresat
 		from pgstore_messages
 		where receiverid = $1
-			and lid is null
-			and sendwhen <= $2
 			and status <> $3
-		order by sendwhen asc
-		limit 1`, inboxId, now, pandora.StatusConfirmed).Scan(&id, &buf, &msg.Status, &msg.ReceivedAt, &msg.SendWhen, &msg.DeliveryCount)
+			and sendwhen <= $2
+			and (lid is null or (leaseuntil < $2 and ($5 = 0 or deliverycount < $5)))
+			and (expiresat is null or expiresat > $2)
+		order by priority desc, sendwhen asc
+		limit $4
+		for update skip locked`
+	if fifo {
+		// the heads of the groups can't be skipped, concurrent fetches
+		// of a fifo inbox wait for each other
+		if _, err := db.Exec("select id from pgstore_messageboxes where id = $1 for update", inboxId); err != nil {
+			return nil, err
+		}
+		// only the oldest pending message of each group can be leased,
+		// expired messages don't block their group
+		query = `select id, mid, blobid, status, receivedat, sendwhen, deliverycount, priority, msggroup, expiresat
+		from (select distinct on (msggroup) *
+			from pgstore_messages
+			where receiverid = $1
+				and status <> $3
+				and sendwhen <= $2
+				and (expiresat is null or expiresat > $2)
+				and (lid is null or leaseuntil >= $2 or $5 = 0 or deliverycount < $5)
+			order by msggroup, sendwhen asc, id asc) heads
+		where lid is null or leaseuntil < $2
+		order by priority desc, sendwhen asc
+		limit $4`
+	}
+	rows, err := db.Query(query, inboxId, now, pandora.StatusConfirmed, max, maxDelivery)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*pandora.Message
+	var ids []int64
+	for rows.Next() {
+		var buf, bid []byte
+		var id int64
+		var expiresAt sql.NullTime
+		msg := &pandora.Message{}
+		if err := rows.Scan(&id, &buf, &bid, &msg.Status, &msg.ReceivedAt, &msg.SendWhen, &msg.DeliveryCount, &msg.Priority, &msg.Group, &expiresAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		msg.ExpiresAt = expiresAt.Time
+		msg.Mid = &pandora.SHA1Key{}
+		copy(msg.Mid.Bytes(), buf)
+		if bid != nil {
+			msg.Bid = &pandora.SHA1Key{}
+			copy(msg.Bid.Bytes(), bid)
+		}
+		msgs = append(msgs, msg)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, pandora.ErrNoMessages
+	}
+	var timeouts []pandora.Event
+	for i, msg := range msgs {
+		msg.CalcualteLeaseFor(now, dur)
+		// the previous lease is read from the locked row, if reEnqueueMessages
+		// removed it first the timeout was already counted there
+		var lid []byte
+		var leaseUntil sql.NullTime
+		err = db.QueryRow(`update pgstore_messages m
+			set lid = $1, deliverycount = m.deliverycount + 1, leaseuntil = $2
+			from (select id, lid, leaseuntil
+				from pgstore_messages
+				where id = $3
+				for update) old
+			where m.id = old.id
+			returning old.lid, old.leaseuntil`, msg.Lid.Bytes(), msg.LeasedUntil, ids[i]).Scan(&lid, &leaseUntil)
+		if err != nil {
+			return nil, err
+		}
+		if lid != nil {
+			old := pandora.Event{Mid: msg.Mid, Type: pandora.EventTimeout, At: leaseUntil.Time, Lid: &pandora.SHA1Key{}}
+			copy(old.Lid.Bytes(), lid)
+			timeouts = append(timeouts, old)
+		}
+	}
+	if len(timeouts) > 0 {
+		// the expired leases weren't counted by reEnqueueMessages yet
+		if _, err := db.Exec("update pgstore_messageboxes set timeouts = timeouts + $1 where id = $2", len(timeouts), inboxId); err != nil {
+			return nil, err
+		}
+	}
+	for i := range timeouts {
+		if err := appendEvent(db, &timeouts[i]); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+func enqueueMessage(db querier, msg *pandora.Message) error {
+	msg.Status = pandora.StatusNotDelivered
+	msg.CalculateMid()
+	senderId, receiverId, err := findSenderReceiver(db, msg, true)
+	if err != nil {
+		return err
+	}
+	var dedupKey, dedupUntil interface{}
+	if len(msg.DedupKey) > 0 {
+		dedupKey, dedupUntil = msg.DedupKey, msg.DedupUntil
+		first, err := findDedup(db, receiverId, msg.DedupKey, time.Now())
+		if err != nil {
+			return err
+		}
+		if first != nil {
+			msg.Mid = &pandora.SHA1Key{}
+			copy(msg.Mid.Bytes(), first)
+			return pandora.ErrDuplicateMessage
+		}
+	}
+	var id int64
+	err = db.QueryRow("select id from pgstore_messages where mid = $1", msg.Mid.Bytes()).Scan(&id)
+	if err == nil {
+		return pandora.ErrDuplicateMessage
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	var full bool
+	err = db.QueryRow(`select b.maxsize > 0 and b.maxsize <= (select count(*)
+			from pgstore_messages m
+			where m.receiverid = b.id and m.status <> $2)
+		from pgstore_messageboxes b
+		where b.id = $1`, receiverId, pandora.StatusConfirmed).Scan(&full)
+	if err != nil {
+		return err
+	}
+	if full {
+		return pandora.ErrInboxFull
+	}
+	var bid []byte
+	if msg.Bid != nil {
+		bid = msg.Bid.Bytes()
+	}
+	var expiresAt interface{}
+	if !msg.ExpiresAt.IsZero() {
+		expiresAt = msg.ExpiresAt
+	}
+	err = withSavepoint(db, func() error {
+		return db.QueryRow("insert into pgstore_messages(mid, blobid, status, receivedat, sendwhen, deliverycount, senderid, receiverid, priority, msggroup, dedupkey, dedupuntil, expiresat) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) returning id",
+			msg.Mid.Bytes(), bid, msg.Status, msg.ReceivedAt, msg.SendWhen, msg.DeliveryCount, senderId, receiverId, msg.Priority, msg.Group, dedupKey, dedupUntil, expiresAt).Scan(&id)
+	})
+	if isUniqueViolation(err) {
+		// another transaction saved the same mid after our check
+		return pandora.ErrDuplicateMessage
+	}
+	return err
+}
+
+// findDedup return the mid of the message sent to receiverId with the given dedup key,
+// only if the key is still valid at now.
+//
+// Concurrent calls with the same key wait until the transaction ends
+func findDedup(db querier, receiverId int64, key string, now time.Time) ([]byte, error) {
+	_, err := db.Exec("select pg_advisory_xact_lock($1::int, hashtext($2))", receiverId, key)
+	if err != nil {
+		return nil, err
+	}
+	var mid []byte
+	err = db.QueryRow(`select mid from pgstore_messages
+		where receiverid = $1 and dedupkey = $2 and dedupuntil > $3
+		order by id desc
+		limit 1`, receiverId, key, now).Scan(&mid)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return mid, err
+}
+
+// withSavepoint call fn inside a savepoint, if fn fails the changes made by it
+// are rolled back and the transaction can still be used.
+func withSavepoint(db querier, fn func() error) error {
+	if _, err := db.Exec("savepoint pgstore_savepoint"); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		if _, rbErr := db.Exec("rollback to savepoint pgstore_savepoint"); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+	_, err := db.Exec("release savepoint pgstore_savepoint")
+	return err
+}
+
+// isUniqueViolation check if err was caused by a unique constraint
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+func ackMessage(db querier, mid, lid pandora.Key, status pandora.AckStatus) error {
+	var id int64
+	switch status {
+	case pandora.StatusConfirmed, pandora.StatusRejected:
+	default:
+		return pandora.ErrUnableToChangeStatus
+	}
+
+	err := db.QueryRow(`update pgstore_messages
+		set status = $1, lid = null, leaseuntil = null
+		where mid = $2 and lid = $3 and leaseuntil >= $4
+		returning id`, status, mid.Bytes(), lid.Bytes(), time.Now()).Scan(&id)
 	if err == sql.ErrNoRows {
-		return pandora.ErrNoMessages
+		return pandora.ErrUnableToChangeStatus
 	}
 	if err != nil {
 		return err
 	}
-	msg.Mid = &pandora.SHA1Key{}
-	copy(msg.Mid.Bytes(), buf)
-	msg.CalcualteLeaseFor(now, dur)
-
-	_, err = db.Exec("update pgstore_messages set lid = $1, deliverycount = deliverycount + 1, leaseuntil = $2 where id = $3", msg.Lid.Bytes(), msg.LeasedUntil, id)
-	return err
+	if id == 0 {
+		return pandora.ErrUnableToChangeStatus
+	}
+	if status == pandora.StatusRejected {
+		dead, err := exceededMaxDelivery(db, id)
+		if err != nil {
+			return err
+		}
+		if dead {
+			return moveToDeadInbox(db, id, pandora.StatusRejected, "rejected by the client", time.Now())
+		}
+	}
+	return nil
 }
 
 func findInbox(db querier, inbox string, create bool) (id int64, err error) {
@@ -246,18 +907,31 @@ func findSenderReceiver(db querier, msg *pandora.Message, create bool) (sid int6
 
 // Enqueue will place the message inside the receiver inbox
 func (ms *MessageStore) Enqueue(msg *pandora.Message) error {
-	msg.Status = pandora.StatusNotDelivered
-	msg.CalculateMid()
 	return doInsideTransaction(ms.conn, func(tx querier) error {
-		senderId, receiverId, err := findSenderReceiver(tx, msg, true)
-		if err != nil {
-			return err
+		return enqueueMessage(tx, msg)
+	})
+}
+
+// EnqueueBatch will place every message inside its receiver inbox,
+// each message uses its own savepoint so a failed one is rolled back
+// without aborting the others.
+func (ms *MessageStore) EnqueueBatch(msgs []*pandora.Message) ([]error, error) {
+	errs := make([]error, len(msgs))
+	err := doInsideTransaction(ms.conn, func(tx querier) error {
+		for i, msg := range msgs {
+			errs[i] = withSavepoint(tx, func() error {
+				return enqueueMessage(tx, msg)
+			})
+			if _, ok := errs[i].(pandora.ApiError); errs[i] != nil && !ok {
+				return errs[i]
+			}
 		}
-		var id int64
-		err = tx.QueryRow("insert into pgstore_messages(mid, status, receivedat, sendwhen, deliverycount, senderid, receiverid) values ($1, $2, $3, $4, $5, $6, $7) returning id",
-			msg.Mid.Bytes(), msg.Status, msg.ReceivedAt, msg.SendWhen, msg.DeliveryCount, senderId, receiverId).Scan(&id)
-		return err
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
 }
 
 // FetchAndLockLatest will read and lock the latest message for the given receiver
@@ -269,6 +943,17 @@ func (ms *MessageStore) FetchAndLockLatest(recv string, dur time.Duration) (*pan
 	return &msg, err
 }
 
+// FetchAndLockBatch will read and lock up to max messages for the given receiver
+func (ms *MessageStore) FetchAndLockBatch(recv string, dur time.Duration, max int) ([]*pandora.Message, error) {
+	var msgs []*pandora.Message
+	err := doInsideTransaction(ms.conn, func(tx querier) error {
+		var err error
+		msgs, err = fetchAndLock(tx, recv, time.Now(), dur, max)
+		return err
+	})
+	return msgs, err
+}
+
 func (ms *MessageStore) FetchHeaders(out []pandora.Message, recv string, receivedAt time.Time) (int, error) {
 	var actual []pandora.Message
 	err := doInsideTransaction(ms.conn, func(tx querier) error {
@@ -281,25 +966,550 @@ func (ms *MessageStore) FetchHeaders(out []pandora.Message, recv string, receive
 
 func (ms *MessageStore) Ack(mid, lid pandora.Key, status pandora.AckStatus) error {
 	return doInsideTransaction(ms.conn, func(tx querier) error {
-		var id int64
-		switch status {
-		case pandora.StatusConfirmed, pandora.StatusRejected:
-		default:
-			return pandora.ErrUnableToChangeStatus
+		return ackMessage(tx, mid, lid, status)
+	})
+}
+
+// AckBatch will change the status of every message, only if the lid is still valid
+func (ms *MessageStore) AckBatch(acks []pandora.AckRequest) ([]error, error) {
+	errs := make([]error, len(acks))
+	err := doInsideTransaction(ms.conn, func(tx querier) error {
+		for i, ack := range acks {
+			errs[i] = ackMessage(tx, ack.Mid, ack.Lid, ack.Status)
+			if _, ok := errs[i].(pandora.ApiError); errs[i] != nil && !ok {
+				return errs[i]
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
 
+// ExtendLease keeps the message locked for dur, only if lid is still valid
+func (ms *MessageStore) ExtendLease(mid, lid pandora.Key, dur time.Duration, rotate bool) (*pandora.Message, error) {
+	var msg pandora.Message
+	err := doInsideTransaction(ms.conn, func(tx querier) error {
+		now := time.Now()
+		msg.Mid = mid
+		msg.CalcualteLeaseFor(now, dur)
+		if !rotate {
+			msg.Lid = &pandora.SHA1Key{}
+			copy(msg.Lid.Bytes(), lid.Bytes())
+		}
+		var buf []byte
 		err := tx.QueryRow(`update pgstore_messages
-			set status = $1, lid = null, leaseuntil = null
-			where mid = $2 and lid = $3 and leaseuntil >= $4
-			returning id`, status, mid.Bytes(), lid.Bytes(), time.Now()).Scan(&id)
+			set lid = $1, leaseuntil = $2
+			where mid = $3 and lid = $4 and leaseuntil >= $5
+			returning mid, status, receivedat, sendwhen, deliverycount`,
+			msg.Lid.Bytes(), msg.LeasedUntil, mid.Bytes(), lid.Bytes(), now).Scan(&buf, &msg.Status, &msg.ReceivedAt, &msg.SendWhen, &msg.DeliveryCount)
+		if err == sql.ErrNoRows {
+			return pandora.ErrInvalidLease
+		}
+		if err != nil {
+			return err
+		}
+		msg.Mid = &pandora.SHA1Key{}
+		copy(msg.Mid.Bytes(), buf)
+		return nil
+	})
+	return &msg, err
+}
+
+// SetMaxDelivery change how many times a message from inbox can be delivered
+// before being moved to the dead inbox
+func (ms *MessageStore) SetMaxDelivery(inbox string, max int) error {
+	return ms.updateInbox(inbox, "maxdelivery", max)
+}
+
+// SetFifo enable or disable the strict fifo mode of inbox
+func (ms *MessageStore) SetFifo(inbox string, fifo bool) error {
+	return ms.updateInbox(inbox, "fifo", fifo)
+}
+
+// SetDropExpired change if the expired messages of inbox are removed
+// or moved to the dead inbox
+func (ms *MessageStore) SetDropExpired(inbox string, drop bool) error {
+	return ms.updateInbox(inbox, "dropexpired", drop)
+}
+
+// SetPaused pause or resume the delivery of the messages of inbox
+func (ms *MessageStore) SetPaused(inbox string, paused bool) error {
+	return ms.updateInbox(inbox, "paused", paused)
+}
+
+// SetLeaseTime change the lease used when the client doesn't inform one
+func (ms *MessageStore) SetLeaseTime(inbox string, lease time.Duration) error {
+	return ms.updateInbox(inbox, "leasetime", int64(lease))
+}
+
+// SetMaxSize change the max number of pending messages of inbox
+func (ms *MessageStore) SetMaxSize(inbox string, max int) error {
+	return ms.updateInbox(inbox, "maxsize", max)
+}
+
+// updateInbox set the column of inbox to value,
+// ErrInboxNotFound is returned if the inbox doesn't exist
+func (ms *MessageStore) updateInbox(inbox, column string, value interface{}) error {
+	return doInsideTransaction(ms.conn, func(tx querier) error {
+		id, err := findInbox(tx, inbox, false)
+		if err == pandora.ErrSenderNotFound {
+			return pandora.ErrInboxNotFound
+		} else if err != nil {
+			return err
+		}
+		_, err = tx.Exec("update pgstore_messageboxes set "+column+" = $1 where id = $2", value, id)
+		return err
+	})
+}
+
+// Inboxes return the policies of every inbox that isn't a dead inbox
+func (ms *MessageStore) Inboxes() ([]pandora.Inbox, error) {
+	rows, err := ms.conn.Query(`select name, createdat, paused, leasetime, maxsize, maxdelivery, fifo, dropexpired
+		from pgstore_messageboxes
+		where right(name, length($1)) <> $1
+		order by name`, pandora.DeadInboxSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var inboxes []pandora.Inbox
+	for rows.Next() {
+		var box pandora.Inbox
+		err := rows.Scan(&box.Name, &box.CreatedAt, &box.Paused, &box.LeaseTime, &box.MaxSize, &box.MaxDelivery, &box.Fifo, &box.DropExpired)
+		if err != nil {
+			return nil, err
+		}
+		inboxes = append(inboxes, box)
+	}
+	return inboxes, rows.Err()
+}
+
+// PurgeMessages remove every pending message of inbox
+func (ms *MessageStore) PurgeMessages(inbox string) ([]pandora.Key, error) {
+	var bodies []pandora.Key
+	err := doInsideTransaction(ms.conn, func(tx querier) error {
+		id, err := findInbox(tx, inbox, false)
+		if err == pandora.ErrSenderNotFound {
+			return pandora.ErrInboxNotFound
+		} else if err != nil {
+			return err
+		}
+		bodies, err = purgeMessages(tx, id)
+		return err
+	})
+	return bodies, err
+}
+
+// DeleteInbox remove inbox and its dead inbox
+func (ms *MessageStore) DeleteInbox(inbox string) ([]pandora.Key, error) {
+	var bodies []pandora.Key
+	err := doInsideTransaction(ms.conn, func(tx querier) error {
+		id, err := findInbox(tx, inbox, false)
+		if err == pandora.ErrSenderNotFound {
+			return pandora.ErrInboxNotFound
+		} else if err != nil {
+			return err
+		}
+		if bodies, err = deleteInbox(tx, id); err != nil {
+			return err
+		}
+		deadId, err := findInbox(tx, pandora.DeadInbox(inbox), false)
+		if err == pandora.ErrSenderNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		removed, err := deleteInbox(tx, deadId)
+		bodies = append(bodies, removed...)
+		return err
+	})
+	return bodies, err
+}
+
+// FetchDeadLetters output at least len(out) messages from the dead inbox
+func (ms *MessageStore) FetchDeadLetters(out []pandora.Message, inbox string) (int, error) {
+	var idx int
+	err := doInsideTransaction(ms.conn, func(tx querier) error {
+		ids, err := deadLetters(tx, inbox, nil)
+		if err != nil {
+			return err
+		}
+		var buf []byte
+		var reason sql.NullString
+		for _, id := range ids {
+			if idx >= len(out) {
+				break
+			}
+			msg := &out[idx]
+			err := tx.QueryRow(`select mid, status, receivedat, sendwhen, deliverycount, reason
+				from pgstore_messages where id = $1`, id).Scan(&buf, &msg.Status, &msg.ReceivedAt, &msg.SendWhen, &msg.DeliveryCount, &reason)
+			if err != nil {
+				return err
+			}
+			msg.Mid = &pandora.SHA1Key{}
+			copy(msg.Mid.Bytes(), buf)
+			msg.Reason = reason.String
+			idx++
+		}
+		return nil
+	})
+	return idx, err
+}
+
+// ReplayDeadLetters move the messages from the dead inbox back to inbox
+func (ms *MessageStore) ReplayDeadLetters(inbox string, mid pandora.Key) (int, error) {
+	var count int
+	err := doInsideTransaction(ms.conn, func(tx querier) error {
+		ids, err := deadLetters(tx, inbox, mid)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		inboxId, err := findInbox(tx, inbox, false)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			_, err := tx.Exec(`update pgstore_messages
+				set receiverid = $1, status = $2, deliverycount = 0, reason = null, expiresat = null
+				where id = $3`, inboxId, pandora.StatusNotDelivered, id)
+			if err != nil {
+				return err
+			}
+			if err := appendMessageEvent(tx, id, pandora.EventReplayed, time.Now(), ""); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Subscribe register inbox as a subscriber of topic
+func (ms *MessageStore) Subscribe(topic, inbox string) error {
+	return doInsideTransaction(ms.conn, func(tx querier) error {
+		inboxId, err := findInbox(tx, inbox, true)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`insert into pgstore_subscriptions(topic, inboxid)
+			select $1, $2
+			where not exists (select 1 from pgstore_subscriptions where topic = $1 and inboxid = $2)`, topic, inboxId)
+		return err
+	})
+}
+
+// Unsubscribe remove inbox from the subscribers of topic
+func (ms *MessageStore) Unsubscribe(topic, inbox string) error {
+	_, err := ms.conn.Exec(`delete from pgstore_subscriptions
+		where topic = $1 and inboxid in (select id from pgstore_messageboxes where name = $2)`, topic, inbox)
+	return err
+}
+
+// Subscribers return the name of all inboxes subscribed to topic
+func (ms *MessageStore) Subscribers(topic string) ([]string, error) {
+	rows, err := ms.conn.Query(`select b.name
+		from pgstore_subscriptions s
+			inner join pgstore_messageboxes b on b.id = s.inboxid
+		where s.topic = $1
+		order by b.name`, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var inboxes []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		inboxes = append(inboxes, name)
+	}
+	return inboxes, rows.Err()
+}
+
+// PurgeInboxes remove the inboxes with the given prefix created before createdBefore
+func (ms *MessageStore) PurgeInboxes(prefix string, createdBefore time.Time) (int, []pandora.Key, error) {
+	var count int
+	var bodies []pandora.Key
+	err := doInsideTransaction(ms.conn, func(tx querier) error {
+		ids, err := queryIds(tx, `select id from pgstore_messageboxes
+			where substr(name, 1, length($1)) = $1 and createdat < $2`, prefix, createdBefore)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			removed, err := deleteInbox(tx, id)
+			if err != nil {
+				return err
+			}
+			bodies = append(bodies, removed...)
+			count++
+		}
+		return nil
+	})
+	return count, bodies, err
+}
+
+// deleteInbox remove the inbox, its messages and subscriptions.
+//
+// Returns the body key of each message that wasn't confirmed
+func deleteInbox(db querier, id int64) ([]pandora.Key, error) {
+	bodies, err := purgeMessages(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("delete from pgstore_subscriptions where inboxid = $1", id); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("delete from pgstore_messageboxes where id = $1", id)
+	return bodies, err
+}
+
+// purgeMessages remove every message received by the inbox id.
+//
+// Returns the body key of each message that wasn't confirmed
+func purgeMessages(db querier, id int64) ([]pandora.Key, error) {
+	rows, err := db.Query(`delete from pgstore_messages
+		where receiverid = $1
+		returning status, coalesce(blobid, mid)`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var bodies []pandora.Key
+	for rows.Next() {
+		var status pandora.AckStatus
+		var buf []byte
+		if err := rows.Scan(&status, &buf); err != nil {
+			return nil, err
+		}
+		if status != pandora.StatusConfirmed {
+			body := &pandora.SHA1Key{}
+			copy(body.Bytes(), buf)
+			bodies = append(bodies, body)
+		}
+	}
+	return bodies, rows.Err()
+}
+
+// SaveSchedule create or replace the schedule with the same id
+func (ms *MessageStore) SaveSchedule(sch *pandora.Schedule) error {
+	return doInsideTransaction(ms.conn, func(tx querier) error {
+		if _, err := tx.Exec("delete from pgstore_schedules where id = $1", sch.Id); err != nil {
+			return err
+		}
+		env := sch.Envelope
+		_, err := tx.Exec(`insert into pgstore_schedules(id, spec, sender, receiver, priority, msggroup, body, payload, contenttype, ttl, nextrun, createdat)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+			sch.Id, sch.Spec, env.Sender, env.Receiver, env.Priority, env.Group, env.Body.Encode(), env.Payload, env.ContentType, env.TTL, sch.NextRun, sch.CreatedAt)
+		return err
+	})
+}
+
+// Schedules return all schedules ordered by id
+func (ms *MessageStore) Schedules() ([]pandora.Schedule, error) {
+	return querySchedules(ms.conn, `select id, spec, sender, receiver, priority, msggroup, body, payload, contenttype, ttl, nextrun, createdat
+		from pgstore_schedules
+		order by id`)
+}
+
+// DeleteSchedule remove the schedule with the given id
+func (ms *MessageStore) DeleteSchedule(id string) error {
+	res, err := ms.conn.Exec("delete from pgstore_schedules where id = $1", id)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return pandora.ErrScheduleNotFound
+	}
+	return nil
+}
+
+// FetchDueSchedules return the schedules due at now and advance their next run
+func (ms *MessageStore) FetchDueSchedules(now time.Time) ([]pandora.Schedule, error) {
+	var due []pandora.Schedule
+	err := doInsideTransaction(ms.conn, func(tx querier) error {
+		var err error
+		// the lock prevents two schedulers from sending the same run
+		due, err = querySchedules(tx, `select id, spec, sender, receiver, priority, msggroup, body, payload, contenttype, ttl, nextrun, createdat
+			from pgstore_schedules
+			where nextrun <= $1
+			order by id
+			for update`, now)
+		if err != nil {
+			return err
+		}
+		for _, sch := range due {
+			next, err := sch.Next(now)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec("update pgstore_schedules set nextrun = $1 where id = $2", next, sch.Id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return due, err
+}
+
+func querySchedules(db querier, query string, args ...interface{}) ([]pandora.Schedule, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var schedules []pandora.Schedule
+	for rows.Next() {
+		var sch pandora.Schedule
+		var body string
+		env := &sch.Envelope
+		err := rows.Scan(&sch.Id, &sch.Spec, &env.Sender, &env.Receiver, &env.Priority, &env.Group,
+			&body, &env.Payload, &env.ContentType, &env.TTL, &sch.NextRun, &sch.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if env.Body, err = url.ParseQuery(body); err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, sch)
+	}
+	return schedules, rows.Err()
+}
+
+// InboxStats return the number of messages of every inbox
+func (ms *MessageStore) InboxStats(now time.Time) ([]pandora.InboxStats, error) {
+	rows, err := ms.conn.Query(`select b.name, b.timeouts,
+			coalesce(sum(case when m.lid is not null and m.leaseuntil >= $1 then 1 else 0 end), 0),
+			coalesce(sum(case when (m.lid is null or m.leaseuntil < $1) and m.sendwhen > $1 then 1 else 0 end), 0),
+			coalesce(sum(case when (m.lid is null or m.leaseuntil < $1) and m.sendwhen <= $1 then 1 else 0 end), 0)
+		from pgstore_messageboxes b
+			left join pgstore_messages m on m.receiverid = b.id and m.status <> $2
+		group by b.id, b.name, b.timeouts
+		order by b.name`, now, pandora.StatusConfirmed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stats []pandora.InboxStats
+	dead := make(map[string]int)
+	for rows.Next() {
+		var st pandora.InboxStats
+		if err := rows.Scan(&st.Inbox, &st.Timeouts, &st.Leased, &st.Delayed, &st.Ready); err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(st.Inbox, pandora.DeadInboxSuffix) {
+			dead[strings.TrimSuffix(st.Inbox, pandora.DeadInboxSuffix)] = st.Leased + st.Delayed + st.Ready
+			continue
+		}
+		stats = append(stats, st)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range stats {
+		stats[i].Dead = dead[stats[i].Inbox]
+	}
+	return stats, nil
+}
+
+// AppendEvents add the events to the history of their messages
+func (ms *MessageStore) AppendEvents(events []pandora.Event) error {
+	return doInsideTransaction(ms.conn, func(tx querier) error {
+		for i := range events {
+			if err := appendEvent(tx, &events[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// History return the events of mid ordered by the time they happened
+func (ms *MessageStore) History(mid pandora.Key) ([]pandora.Event, error) {
+	rows, err := ms.conn.Query(`select event, at, client, lid, detail
+		from pgstore_history
+		where mid = $1
+		order by at, id`, mid.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []pandora.Event
+	for rows.Next() {
+		var lid []byte
+		ev := pandora.Event{Mid: &pandora.SHA1Key{}}
+		copy(ev.Mid.Bytes(), mid.Bytes())
+		if err := rows.Scan(&ev.Type, &ev.At, &ev.Client, &lid, &ev.Detail); err != nil {
+			return nil, err
+		}
+		if lid != nil {
+			ev.Lid = &pandora.SHA1Key{}
+			copy(ev.Lid.Bytes(), lid)
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// Ping check if the database is available
+func (ms *MessageStore) Ping() error {
+	return ms.conn.Ping()
+}
+
+// PurgeDeadLetters remove the messages from the dead inbox
+func (ms *MessageStore) PurgeDeadLetters(inbox string, mid pandora.Key) ([]pandora.Key, error) {
+	var bodies []pandora.Key
+	err := doInsideTransaction(ms.conn, func(tx querier) error {
+		ids, err := deadLetters(tx, inbox, mid)
 		if err != nil {
 			return err
 		}
-		if id == 0 {
-			return pandora.ErrUnableToChangeStatus
+		for _, id := range ids {
+			body := &pandora.SHA1Key{}
+			var buf []byte
+			err := tx.QueryRow("delete from pgstore_messages where id = $1 returning coalesce(blobid, mid)", id).Scan(&buf)
+			if err != nil {
+				return err
+			}
+			copy(body.Bytes(), buf)
+			bodies = append(bodies, body)
 		}
 		return nil
 	})
+	return bodies, err
+}
+
+// BodyKey return the key of the body of mid
+func (ms *MessageStore) BodyKey(mid pandora.Key) (pandora.Key, error) {
+	var buf []byte
+	err := ms.conn.QueryRow("select coalesce(blobid, mid) from pgstore_messages where mid = $1", mid.Bytes()).Scan(&buf)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	body := &pandora.SHA1Key{}
+	copy(body.Bytes(), buf)
+	return body, nil
+}
+
+// Receiver return the name of the inbox that holds mid
+func (ms *MessageStore) Receiver(mid pandora.Key) (string, error) {
+	var receiver string
+	err := ms.conn.QueryRow(`select b.name from pgstore_messages m
+		inner join pgstore_messageboxes b on b.id = m.receiverid
+		where m.mid = $1`, mid.Bytes()).Scan(&receiver)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return receiver, err
 }
 
 // BlobStore implements pandora.BlobStore using postgresql as backend
@@ -319,6 +1529,18 @@ func (bs *BlobStore) InitTables() (err error) {
 	return
 }
 
+// Usage return how many blobs are saved and their total size
+func (bs *BlobStore) Usage() (pandora.BlobUsage, error) {
+	var usage pandora.BlobUsage
+	err := bs.conn.QueryRow(`select count(*), coalesce(sum(octet_length(data)), 0) from pgstore_blobs`).Scan(&usage.Count, &usage.Bytes)
+	return usage, err
+}
+
+// Ping check if the database is available
+func (bs *BlobStore) Ping() error {
+	return bs.conn.Ping()
+}
+
 // Close the store
 func (bs *BlobStore) Close() error {
 	return bs.conn.Close()
@@ -349,10 +1571,62 @@ func (bs *BlobStore) UpdateRefCount(k pandora.Key, delta int) error {
 	if !exists {
 		return ErrKeyNotFound
 	}
-	_, err = bs.conn.Exec(`insert into pgstore_blobs_ref(id, blobid, delta) values ($1, $2, $3)`, id, k.Bytes(), delta)
+	_, err = bs.conn.Exec(`insert into pgstore_blobs_ref(id, blobid, delta, changedat) values ($1, $2, $3, $4)`, id, k.Bytes(), delta, time.Now())
 	return err
 }
 
+// UnreferencedKeys return at most max keys with a ref count of 0 or less
+// that didn't change after olderThan
+func (bs *BlobStore) UnreferencedKeys(max int, olderThan time.Time) ([]pandora.Key, error) {
+	rows, err := bs.conn.Query(`select blobid from pgstore_blobs_ref
+		group by blobid
+		having sum(delta) <= 0 and max(changedat) < $1
+		limit $2`, olderThan, max)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []pandora.Key
+	for rows.Next() {
+		var buf []byte
+		if err := rows.Scan(&buf); err != nil {
+			return nil, err
+		}
+		key := &pandora.SHA1Key{}
+		copy(key.Bytes(), buf)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// DeleteData remove the data of keys that are still unreferenced
+// and didn't change after olderThan
+func (bs *BlobStore) DeleteData(keys []pandora.Key, olderThan time.Time) (int, error) {
+	var count int
+	err := doInsideTransaction(bs.conn, func(tx querier) error {
+		for _, k := range keys {
+			var collectable bool
+			err := tx.QueryRow(`select sum(delta) <= 0 and max(changedat) < $2
+				from pgstore_blobs_ref where blobid = $1
+				having count(*) > 0`, k.Bytes(), olderThan).Scan(&collectable)
+			if err == sql.ErrNoRows || (err == nil && !collectable) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if _, err := tx.Exec("delete from pgstore_blobs where blobid = $1", k.Bytes()); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("delete from pgstore_blobs_ref where blobid = $1", k.Bytes()); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
 // PutData write the contents of data and return the key used to store the data
 func (bs *BlobStore) PutData(k pandora.Key, data []byte) (pandora.Key, error) {
 	kw := pandora.SHA1KeyWriter{}
@@ -416,14 +1690,16 @@ func (bs *BlobStore) insert(out pandora.Key, data []byte) error {
 		return err
 	}
 	if exists {
-		return nil
+		// keep the blob safe from the collector until it is referenced
+		_, err = bs.conn.Exec(`insert into pgstore_blobs_ref(id, blobid, delta, changedat) values ($1, $2, 0, $3)`, id, out.Bytes(), time.Now())
+		return err
 	}
 	return doInsideTransaction(bs.conn, func(tx querier) error {
 		err := tx.QueryRow(`insert into pgstore_blobs(blobid, data) values ($1, $2) returning id`, out.Bytes(), data).Scan(&id)
 		if err != nil {
 			return err
 		}
-		_, err = tx.Exec(`insert into pgstore_blobs_ref(id, blobid, delta) values ($1, $2, $3)`, id, out.Bytes(), 0)
+		_, err = tx.Exec(`insert into pgstore_blobs_ref(id, blobid, delta, changedat) values ($1, $2, $3, $4)`, id, out.Bytes(), 0, time.Now())
 		if err != nil {
 			return err
 		}
@@ -24,6 +24,9 @@ import (
 	"bytes"
 	"github.com/andrebq/exp/pandora"
 	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -167,6 +170,45 @@ func TestMessageStorePandoraAPI(t *testing.T) {
 	}
 }
 
+func TestMessageStoreExpiredLease(t *testing.T) {
+	store := mustCreateMessageStore(OpenMessageStore("pandora", "pandora", "localhost", "pandora"))
+	defer store.DeleteMessages()
+
+	msg := &pandora.Message{}
+	msg.Empty(nil)
+	msg.SetReceiver("lease@remote")
+	msg.SetSender("lease@local")
+	if err := store.Enqueue(msg); err != nil {
+		t.Fatalf("error saving the message: %v", err)
+	}
+
+	first, err := store.FetchAndLockLatest("lease@remote", time.Millisecond)
+	if err != nil {
+		t.Fatalf("error fetching the message: %v", err)
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	// the expired lease is available without a call to Reenqueue
+	second, err := store.FetchAndLockLatest("lease@remote", time.Minute)
+	if err != nil {
+		t.Fatalf("error fetching the message again: %v", err)
+	}
+	if !bytes.Equal(first.Mid.Bytes(), second.Mid.Bytes()) || second.DeliveryCount != 1 {
+		t.Errorf("expecting the same message delivered twice got %v", second)
+	}
+	if err := store.Ack(first.Mid, first.Lid, pandora.StatusConfirmed); err != pandora.ErrUnableToChangeStatus {
+		t.Errorf("the old lid shouldn't be valid: %v", err)
+	}
+	if err := store.Ack(second.Mid, second.Lid, pandora.StatusConfirmed); err != nil {
+		t.Errorf("error doing ack: %v", err)
+	}
+	// the fetch records the timeout of the first lease
+	events, err := store.History(first.Mid)
+	if err != nil || len(events) != 1 || events[0].Type != pandora.EventTimeout || !bytes.Equal(events[0].Lid.Bytes(), first.Lid.Bytes()) {
+		t.Errorf("expecting the timeout of the first lease got %v / %v", events, err)
+	}
+}
+
 func TestBlobStorePandoraAPI(t *testing.T) {
 	var bs pandora.BlobStore
 	var err error
@@ -206,3 +248,72 @@ func TestBlobStorePandoraAPI(t *testing.T) {
 		t.Errorf("unexpected error when decrementing the ref count: %v", err)
 	}
 }
+
+func BenchmarkEnqueue(b *testing.B) {
+	store := mustCreateMessageStore(OpenMessageStore("pandora", "pandora", "localhost", "pandora"))
+	defer store.DeleteMessages()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := &pandora.Message{}
+		msg.Empty(nil)
+		msg.SetSender("bench@local")
+		msg.SetReceiver("bench@remote")
+		msg.Body.Set("n", strconv.Itoa(i))
+		if err := store.Enqueue(msg); err != nil {
+			b.Fatalf("error saving the message: %v", err)
+		}
+	}
+}
+
+func BenchmarkFetchAndAck1(b *testing.B)  { benchmarkFetchAndAck(b, 1) }
+func BenchmarkFetchAndAck4(b *testing.B)  { benchmarkFetchAndAck(b, 4) }
+func BenchmarkFetchAndAck16(b *testing.B) { benchmarkFetchAndAck(b, 16) }
+
+// benchmarkFetchAndAck enqueue b.N messages and measure how long
+// the given number of concurrent consumers take to fetch and confirm them all
+func benchmarkFetchAndAck(b *testing.B, consumers int) {
+	store := mustCreateMessageStore(OpenMessageStore("pandora", "pandora", "localhost", "pandora"))
+	defer store.DeleteMessages()
+	store.DeleteMessages()
+
+	for i := 0; i < b.N; i++ {
+		msg := &pandora.Message{}
+		msg.Empty(nil)
+		msg.SetSender("bench@local")
+		msg.SetReceiver("bench@remote")
+		msg.Body.Set("n", strconv.Itoa(i))
+		if err := store.Enqueue(msg); err != nil {
+			b.Fatalf("error saving the message: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var acked int64
+	b.ResetTimer()
+	for c := 0; c < consumers; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				msg, err := store.FetchAndLockLatest("bench@remote", time.Minute)
+				if err == pandora.ErrNoMessages {
+					return
+				} else if err != nil {
+					b.Errorf("error fetching: %v", err)
+					return
+				}
+				if err := store.Ack(msg.Mid, msg.Lid, pandora.StatusConfirmed); err != nil {
+					b.Errorf("error doing ack: %v", err)
+					return
+				}
+				atomic.AddInt64(&acked, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+	if acked != int64(b.N) {
+		b.Errorf("expecting %v messages acked got %v", b.N, acked)
+	}
+}
@@ -0,0 +1,308 @@
+package pandora
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ErrInvalidSpec the schedule spec can't be parsed
+	ErrInvalidSpec = ApiError("invalid schedule spec")
+
+	// ErrScheduleNotFound there is no schedule with the given id
+	ErrScheduleNotFound = ApiError("schedule not found")
+
+	// Key used to inform the spec of a schedule
+	KeySpec = "spec"
+
+	// Key used to inform the id of a schedule
+	KeyScheduleId = "scheduleId"
+
+	// MinScheduleInterval is the shortest interval accepted by "@every"
+	MinScheduleInterval = time.Second
+
+	// SchedulerInterval is how often the scheduler of pandorad checks for due schedules
+	SchedulerInterval = time.Second
+)
+
+// Spec calculates when a schedule should run
+type Spec interface {
+	// Next return the first run strictly after t
+	Next(t time.Time) time.Time
+}
+
+// ParseSpec parse a schedule spec. Two formats are accepted:
+//
+// "@every <duration>", ie, "@every 5m", runs at a fixed interval.
+//
+// A cron expression with 5 fields: minute, hour, day of month, month and day of week.
+// Each field accept "*", a number, a range "a-b", a step "*/n" or "a-b/n" and lists of them
+// separated by ",". Day of week accepts 0 to 7, both 0 and 7 are sunday.
+//
+// Like cron, if both day fields are restricted, a day matching any of them runs. A field
+// is unrestricted when its ranges cover every value, even with a step, like "*" and "*/2".
+func ParseSpec(spec string) (Spec, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil || d < MinScheduleInterval {
+			return nil, ErrInvalidSpec
+		}
+		return everySpec(d), nil
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, ErrInvalidSpec
+	}
+	var cs cronSpec
+	var err error
+	if cs.minute, _, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if cs.hour, _, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if cs.dom, cs.anyDom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if cs.month, _, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if cs.dow, cs.anyDow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if hasBit(cs.dow, 7) {
+		// 7 is also sunday
+		cs.dow = cs.dow&^(1<<7) | 1
+	}
+	// "0-6" covers the week even without 7
+	cs.anyDow = cs.anyDow || cs.dow == 1<<7-1
+	return &cs, nil
+}
+
+type everySpec time.Duration
+
+func (e everySpec) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// cronSpec holds one bit for each accepted value of the field
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+func (c *cronSpec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// every valid expression matches at least once in a few years
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !hasBit(c.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !hasBit(c.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !hasBit(c.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (c *cronSpec) matchDay(t time.Time) bool {
+	dom := hasBit(c.dom, t.Day())
+	dow := hasBit(c.dow, int(t.Weekday()))
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func hasBit(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+// parseCronField return the bits of every value accepted by field,
+// any is true if the range of every part of field goes from min to max
+func parseCronField(field string, min, max int) (bits uint64, any bool, err error) {
+	any = true
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			if step, err = strconv.Atoi(part[idx+1:]); err != nil || step <= 0 {
+				return 0, false, ErrInvalidSpec
+			}
+			part = part[:idx]
+		}
+		first, last := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			if first, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, false, ErrInvalidSpec
+			}
+			last = first
+			if len(bounds) == 2 {
+				if last, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, false, ErrInvalidSpec
+				}
+			} else if step > 1 {
+				// "a/n" means from a until max
+				last = max
+			}
+		}
+		if first < min || last > max || first > last {
+			return 0, false, ErrInvalidSpec
+		}
+		any = any && first == min && last == max
+		for v := first; v <= last; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, any, nil
+}
+
+// Schedule sends a copy of Envelope every time its Spec is due
+type Schedule struct {
+	Id   string
+	Spec string
+	// Envelope used to build each message, Delay, ClientTime, DedupKey, ExpiresAt and Client
+	// are ignored, use TTL to expire the messages.
+	Envelope Envelope
+	// NextRun holds when the schedule should run again
+	NextRun   time.Time
+	CreatedAt time.Time
+}
+
+// Next calculates the run that follows t
+func (s *Schedule) Next(t time.Time) (time.Time, error) {
+	spec, err := ParseSpec(s.Spec)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return spec.Next(t), nil
+}
+
+// AddSchedule validate and save sch, the first run is calculated from now.
+//
+// If sch.Id is empty, a new id is generated. A schedule with the same id is replaced.
+func (s *Server) AddSchedule(sch Schedule) (Schedule, error) {
+	env := sch.Envelope
+	if env.Body == nil {
+		return sch, ErrNilBody
+	}
+	if len(env.Sender) == 0 || len(env.Receiver) == 0 {
+		return sch, ErrInvalidMailBox
+	}
+	if len(env.Payload) > MaxPayloadSize {
+		return sch, ErrPayloadTooBig
+	}
+	now := time.Now()
+	next, err := sch.Next(now)
+	if err != nil {
+		return sch, err
+	}
+	if next.IsZero() {
+		return sch, ErrInvalidSpec
+	}
+	sch.NextRun = next
+	sch.CreatedAt = now
+	if len(sch.Id) == 0 {
+		var kw SHA1KeyWriter
+		io.WriteString(&kw, sch.Spec+"\x00"+env.Receiver+"\x00"+now.Format(time.RFC3339Nano))
+		sch.Id = PrintKeyString(kw.Key())
+	}
+	return sch, s.MessageStore.SaveSchedule(&sch)
+}
+
+// Schedules return all registered schedules
+func (s *Server) Schedules() ([]Schedule, error) {
+	return s.MessageStore.Schedules()
+}
+
+// Schedule return the schedule with the given id,
+// ErrScheduleNotFound is returned if it doesn't exist
+func (s *Server) Schedule(id string) (Schedule, error) {
+	schedules, err := s.MessageStore.Schedules()
+	if err != nil {
+		return Schedule{}, err
+	}
+	for _, sch := range schedules {
+		if sch.Id == id {
+			return sch, nil
+		}
+	}
+	return Schedule{}, ErrScheduleNotFound
+}
+
+// CancelSchedule remove the schedule with the given id,
+// messages already sent by it aren't changed
+func (s *Server) CancelSchedule(id string) error {
+	return s.MessageStore.DeleteSchedule(id)
+}
+
+// RunSchedules send one message for each schedule that is due at now.
+// Runs missed while the scheduler wasn't running are sent only once.
+//
+// Returns the number of messages sent, errors of a schedule don't stop the others.
+func (s *Server) RunSchedules(now time.Time) (int, error) {
+	due, err := s.MessageStore.FetchDueSchedules(now)
+	if err != nil {
+		return 0, err
+	}
+	var sent int
+	var firstErr error
+	for _, sch := range due {
+		env := sch.Envelope
+		body := make(url.Values)
+		for k, v := range env.Body {
+			body[k] = v
+		}
+		env.Body = body
+		env.Delay = 0
+		env.ExpiresAt = time.Time{}
+		env.ClientTime = sch.NextRun
+		// a run is sent at most once, even if the store returns it again
+		env.DedupKey = sch.Id + "@" + sch.NextRun.Format(time.RFC3339Nano)
+		env.Client = "schedule " + sch.Id
+		if _, err := s.SendEnvelope(env); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, firstErr
+}
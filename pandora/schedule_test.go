@@ -0,0 +1,64 @@
+package pandora
+
+// Copyright (c) 2014 André Luiz Alves Moraes
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSpec(t *testing.T) {
+	base := time.Date(2014, time.March, 14, 10, 7, 30, 0, time.UTC)
+	for _, c := range []struct {
+		spec string
+		next time.Time
+	}{
+		{"@every 5m", base.Add(time.Minute * 5)},
+		{"* * * * *", time.Date(2014, time.March, 14, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2014, time.March, 14, 10, 15, 0, 0, time.UTC)},
+		{"0 9-17 * * *", time.Date(2014, time.March, 14, 11, 0, 0, 0, time.UTC)},
+		{"30 8 * * 1", time.Date(2014, time.March, 17, 8, 30, 0, 0, time.UTC)},
+		{"0 0 1 1,7 *", time.Date(2014, time.July, 1, 0, 0, 0, 0, time.UTC)},
+		// restricted day of month and day of week, either matches
+		{"0 0 20 * 6", time.Date(2014, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// 7 is sunday
+		{"0 0 * * 7", time.Date(2014, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 6-7", time.Date(2014, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		// a step over the whole range doesn't restrict the field, both must match
+		{"0 0 */2 * 1", time.Date(2014, time.March, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 0-6", time.Date(2014, time.April, 13, 0, 0, 0, 0, time.UTC)},
+	} {
+		spec, err := ParseSpec(c.spec)
+		if err != nil {
+			t.Errorf("error parsing %q: %v", c.spec, err)
+			continue
+		}
+		if next := spec.Next(base); !next.Equal(c.next) {
+			t.Errorf("%q: expecting %v got %v", c.spec, c.next, next)
+		}
+	}
+
+	for _, invalid := range []string{"", "@every 1ms", "@every x", "* * * *", "60 * * * *", "5-1 * * * *", "*/0 * * * *", "a * * * *", "* * * * 8"} {
+		if _, err := ParseSpec(invalid); err != ErrInvalidSpec {
+			t.Errorf("%q: expecting %v got %v", invalid, ErrInvalidSpec, err)
+		}
+	}
+}
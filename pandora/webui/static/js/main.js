@@ -53,6 +53,12 @@ function PandoraCtrl($scope) {
 
 	$scope.reEnqueueError = "OK";
 
+	$scope.history = {
+		mid: "",
+		events: [],
+		error: ""
+	};
+
 	$scope.message = {
 		fields: [
 			{ caption:"To", name: "receiver", initialValue: "" },
@@ -97,6 +103,20 @@ function PandoraCtrl($scope) {
 		$scope.fetchMessages();
 	};
 
+	$scope.fetchHistory = function(mid) {
+		$scope.history.mid = mid;
+		$scope.history.error = "pending";
+		$.getJSON("/api/admin/history", $.param({mid: mid})).then(function(result) {
+			$scope.$apply(function(){
+				$scope.history.events = _.map(result, mergeKeys);
+				$scope.history.error = ""; });
+		}, function(err) {
+			$scope.$apply(function(){
+				$scope.history.events = [];
+				$scope.history.error = err.statusText; });
+		});
+	};
+
 	$scope.reEnqueue = function() {
 		$scope.reEnqueueError = "pending";
 		$.get("/api/admin/reenqueue").then(function(result) {
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// MaxAggregateEntries is how many entries a query of /buckets/aggregate can read,
+	// every value is kept in memory to compute the percentiles
+	MaxAggregateEntries = 100000
+)
+
+var (
+	DefaultPercentiles = []float64{50, 90, 99}
+
+	ErrTooManyEntries = errors.New("too many entries to aggregate, use a shorter time range")
+)
+
+// AggregateQuery select the bucket entries and the Info fields that are aggregated
+type AggregateQuery struct {
+	Filter *BucketFilter
+	// Fields restrict the Info fields, if empty every numeric field is used
+	Fields []string
+	// Group is the size of the time window, if zero the whole range is a single window
+	Group       time.Duration
+	Percentiles []float64
+	// MaxEntries is how many entries can be read before failing with
+	// ErrTooManyEntries, zero means no limit
+	MaxEntries int
+	// Aggregated, if not nil, is called with the id of every entry
+	// that had at least one value aggregated
+	Aggregated func(id int)
+}
+
+// AggregateSeries holds the aggregates of one field of a bucket, sorted by time
+type AggregateSeries struct {
+	Bucket string
+	Field  string
+	Points []*Aggregate
+}
+
+// Aggregate summarize the values of a field inside a time window
+type Aggregate struct {
+	// Time is the start of the window, or the time of the oldest entry
+	// when the query isn't grouped
+	Time        string
+	TimeMillis  int64
+	Count       int
+	Sum         float64
+	Min         float64
+	Max         float64
+	Avg         float64
+	Percentiles map[string]float64
+}
+
+// ParseAggregateQuery read the query from the same args used by the bucket
+// queries plus group, field and percentile
+func ParseAggregateQuery(args url.Values) (*AggregateQuery, error) {
+	filter, err := ParseBucketFilter(args, 500)
+	if err != nil {
+		return nil, err
+	}
+	// the pages are read by id, see Aggregate
+	filter.Desc = false
+	filter.ById = true
+
+	q := &AggregateQuery{
+		Filter:     filter,
+		Fields:     args["field"],
+		MaxEntries: MaxAggregateEntries,
+	}
+	if len(args.Get("group")) > 0 {
+		if q.Group, err = time.ParseDuration(args.Get("group")); err != nil || q.Group < 0 {
+			return nil, fmt.Errorf("%v isn't a valid group", args.Get("group"))
+		}
+	}
+	for _, v := range args["percentile"] {
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("%v isn't a valid percentile", v)
+		}
+		q.Percentiles = append(q.Percentiles, p)
+	}
+	if len(args["percentile"]) == 0 {
+		q.Percentiles = DefaultPercentiles
+	}
+	return q, nil
+}
+
+func (q *AggregateQuery) selectField(name string) bool {
+	if len(q.Fields) == 0 {
+		return true
+	}
+	for _, f := range q.Fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+type seriesKey struct {
+	bucket, field string
+}
+
+type aggregateWindow struct {
+	start  time.Time
+	values []float64
+}
+
+// Aggregate compute the aggregates of every entry selected by the query,
+// the entries are read from the storage in pages of q.Filter.Limit.
+//
+// The pages are read by id, so no entry is skipped even when the
+// server time doesn't follow the ids (ie, rollups)
+func (db *StatsDB) Aggregate(q *AggregateQuery) ([]*AggregateSeries, error) {
+	series := make(map[seriesKey]map[int64]*aggregateWindow)
+	filter := *q.Filter
+	filter.Desc = false
+	filter.ById = true
+	read := 0
+	for {
+		data, err := db.store.FetchBucket(&filter)
+		if err != nil {
+			return nil, err
+		}
+		newData := false
+		for b := range data {
+			newData = true
+			read++
+			if q.MaxEntries > 0 && read > q.MaxEntries {
+				// release the storage goroutine
+				for _ = range data {
+				}
+				return nil, ErrTooManyEntries
+			}
+			if b.Id > filter.IdStart {
+				filter.IdStart = b.Id
+			}
+			at, err := time.ParseInLocation(DateTimeFormatFromServer, b.ServerTime, time.Local)
+			if err != nil {
+				printf("invalid server time %v on entry %v", b.ServerTime, b.Id)
+				continue
+			}
+			var slot int64
+			if q.Group > 0 {
+				at = at.Truncate(q.Group)
+				slot = at.UnixNano()
+			}
+			used := false
+			for field, v := range b.Info {
+				if !q.selectField(field) {
+					continue
+				}
+				values := numbers(nil, v)
+				if len(values) == 0 {
+					continue
+				}
+				key := seriesKey{bucket: b.Bucket, field: field}
+				windows := series[key]
+				if windows == nil {
+					windows = make(map[int64]*aggregateWindow)
+					series[key] = windows
+				}
+				window := windows[slot]
+				if window == nil {
+					window = &aggregateWindow{start: at}
+					windows[slot] = window
+				} else if at.Before(window.start) {
+					window.start = at
+				}
+				window.values = append(window.values, values...)
+				used = true
+			}
+			if used && q.Aggregated != nil {
+				q.Aggregated(b.Id)
+			}
+		}
+		if !newData {
+			break
+		}
+	}
+
+	out := make([]*AggregateSeries, 0, len(series))
+	for key, windows := range series {
+		s := &AggregateSeries{Bucket: key.bucket, Field: key.field}
+		for _, w := range windows {
+			s.Points = append(s.Points, w.aggregate(q.Percentiles))
+		}
+		sort.Sort(aggregatesByTime(s.Points))
+		out = append(out, s)
+	}
+	sort.Sort(seriesByName(out))
+	return out, nil
+}
+
+func (w *aggregateWindow) aggregate(percentiles []float64) *Aggregate {
+	sort.Float64s(w.values)
+	a := &Aggregate{
+		Time:        w.start.Format(DateTimeFormatFromServer),
+		TimeMillis:  w.start.UnixNano() / int64(time.Millisecond),
+		Count:       len(w.values),
+		Min:         w.values[0],
+		Max:         w.values[len(w.values)-1],
+		Percentiles: make(map[string]float64),
+	}
+	for _, v := range w.values {
+		a.Sum += v
+	}
+	a.Avg = a.Sum / float64(a.Count)
+	for _, p := range percentiles {
+		// nearest rank
+		rank := int(math.Ceil(p/100*float64(len(w.values)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		a.Percentiles[strconv.FormatFloat(p, 'f', -1, 64)] = w.values[rank]
+	}
+	return a
+}
+
+// numbers append to out the numeric values of v, strings are parsed and
+// lists (produced by merges) are flattened
+func numbers(out []float64, v interface{}) []float64 {
+	switch v := v.(type) {
+	case float64:
+		out = append(out, v)
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			out = append(out, f)
+		}
+	case []interface{}:
+		for _, item := range v {
+			out = numbers(out, item)
+		}
+	}
+	return out
+}
+
+type aggregatesByTime []*Aggregate
+
+func (a aggregatesByTime) Len() int           { return len(a) }
+func (a aggregatesByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a aggregatesByTime) Less(i, j int) bool { return a[i].TimeMillis < a[j].TimeMillis }
+
+type seriesByName []*AggregateSeries
+
+func (s seriesByName) Len() int      { return len(s) }
+func (s seriesByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s seriesByName) Less(i, j int) bool {
+	if s[i].Bucket == s[j].Bucket {
+		return s[i].Field < s[j].Field
+	}
+	return s[i].Bucket < s[j].Bucket
+}
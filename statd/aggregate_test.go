@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAggregateWindow(t *testing.T) {
+	for i, c := range []struct {
+		values      []float64
+		percentiles []float64
+		expected    Aggregate
+	}{
+		{[]float64{1}, []float64{50, 99}, Aggregate{
+			Count: 1, Sum: 1, Min: 1, Max: 1, Avg: 1,
+			Percentiles: map[string]float64{"50": 1, "99": 1},
+		}},
+		{[]float64{5, 1, 3}, []float64{50}, Aggregate{
+			Count: 3, Sum: 9, Min: 1, Max: 5, Avg: 3,
+			Percentiles: map[string]float64{"50": 3},
+		}},
+		// nearest rank: ceil(p/100 * n)
+		{[]float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, []float64{1, 50, 90, 95, 99.9, 100}, Aggregate{
+			Count: 10, Sum: 55, Min: 1, Max: 10, Avg: 5.5,
+			Percentiles: map[string]float64{"1": 1, "50": 5, "90": 9, "95": 10, "99.9": 10, "100": 10},
+		}},
+		{[]float64{-2, 2}, nil, Aggregate{
+			Count: 2, Sum: 0, Min: -2, Max: 2, Avg: 0,
+			Percentiles: map[string]float64{},
+		}},
+	} {
+		start := time.Date(2014, 1, 1, 10, 0, 0, 0, time.Local)
+		w := &aggregateWindow{start: start, values: c.values}
+		got := w.aggregate(c.percentiles)
+		c.expected.Time = "2014-01-01 10:00:00.000"
+		c.expected.TimeMillis = start.UnixNano() / int64(time.Millisecond)
+		if !reflect.DeepEqual(*got, c.expected) {
+			t.Errorf("case %v: expecting %v got %v", i, c.expected, *got)
+		}
+	}
+}
+
+func TestAggregateNumbers(t *testing.T) {
+	for i, c := range []struct {
+		value    interface{}
+		expected []float64
+	}{
+		{1.5, []float64{1.5}},
+		{"2.5", []float64{2.5}},
+		{"abc", nil},
+		{true, nil},
+		{nil, nil},
+		{map[string]interface{}{"a": 1.0}, nil},
+		// merged lists
+		{[]interface{}{1.0, "2", []interface{}{3.0, "x"}, false}, []float64{1, 2, 3}},
+	} {
+		if got := numbers(nil, c.value); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("case %v: expecting %v got %v", i, c.expected, got)
+		}
+	}
+}
+
+func TestParseAggregateQuery(t *testing.T) {
+	q, err := ParseAggregateQuery(url.Values{"prefix": {"app."}, "sort": {"desc"}})
+	if err != nil {
+		t.Fatalf("error parsing the query: %v", err)
+	}
+	if q.Group != 0 || len(q.Fields) != 0 || !reflect.DeepEqual(q.Percentiles, DefaultPercentiles) {
+		t.Errorf("invalid defaults: %v", q)
+	}
+	if q.Filter.Desc || !q.Filter.ById || q.MaxEntries != MaxAggregateEntries {
+		t.Errorf("the pages must be read by id and bounded: %v", q.Filter)
+	}
+
+	q, err = ParseAggregateQuery(url.Values{"bucket": {"a"}, "group": {"5m"}, "field": {"x", "y"}, "percentile": {"99.9"}})
+	if err != nil {
+		t.Fatalf("error parsing the query: %v", err)
+	}
+	if q.Group != time.Minute*5 || !reflect.DeepEqual(q.Fields, []string{"x", "y"}) || !reflect.DeepEqual(q.Percentiles, []float64{99.9}) {
+		t.Errorf("invalid query: %v", q)
+	}
+
+	for _, args := range []url.Values{
+		{"group": {"5m"}},
+		{"bucket": {"a"}, "group": {"abc"}},
+		{"bucket": {"a"}, "group": {"-5m"}},
+		{"bucket": {"a"}, "percentile": {"0"}},
+		{"bucket": {"a"}, "percentile": {"101"}},
+		{"bucket": {"a"}, "percentile": {"x"}},
+	} {
+		if _, err := ParseAggregateQuery(args); err == nil {
+			t.Errorf("%v should be invalid", args)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	store := mustOpenKv()
+	db := NewStatsDB(store)
+	defer db.Done()
+
+	base := time.Date(2014, 1, 1, 10, 0, 0, 0, time.Local)
+	push := func(name string, at time.Time, info map[string]interface{}) {
+		if err := store.PushBucketAt(&Bucket{Bucket: name, Info: info}, at); err != nil {
+			t.Fatalf("error pushing bucket: %v", err)
+		}
+	}
+	push("app.a", base.Add(time.Minute), map[string]interface{}{"v": 1.0, "w": 10.0, "s": "text"})
+	push("app.a", base.Add(time.Minute*4), map[string]interface{}{"v": 2.0})
+	push("app.a", base.Add(time.Minute*6), map[string]interface{}{"v": []interface{}{3.0, 4.0}})
+	push("app.b", base.Add(time.Minute*2), map[string]interface{}{"v": "5"})
+	// older than the other entries but with a higher id
+	push("app.a", base.Add(-time.Minute*3), map[string]interface{}{"v": 6.0})
+
+	filter := &BucketFilter{Prefix: []string{"app."}, Limit: 2}
+	series, err := db.Aggregate(&AggregateQuery{Filter: filter, Fields: []string{"v"}, Group: time.Minute * 5})
+	if err != nil {
+		t.Fatalf("error aggregating: %v", err)
+	}
+	type point struct {
+		bucket string
+		at     time.Time
+		count  int
+		sum    float64
+	}
+	var got []point
+	for _, s := range series {
+		if s.Field != "v" {
+			t.Errorf("only v should be aggregated. got %v", s.Field)
+		}
+		for _, p := range s.Points {
+			got = append(got, point{s.Bucket, time.Unix(0, p.TimeMillis*int64(time.Millisecond)), p.Count, p.Sum})
+		}
+	}
+	expected := []point{
+		{"app.a", base.Add(-time.Minute * 5), 1, 6},
+		{"app.a", base, 2, 3},
+		{"app.a", base.Add(time.Minute * 5), 2, 7},
+		{"app.b", base, 1, 5},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("invalid windows.\nexpecting %v\ngot       %v", expected, got)
+	}
+
+	// without a group the time is the oldest entry
+	series, err = db.Aggregate(&AggregateQuery{Filter: &BucketFilter{Bucket: []string{"app.a"}}})
+	if err != nil {
+		t.Fatalf("error aggregating: %v", err)
+	}
+	if len(series) != 2 || series[0].Field != "v" || series[1].Field != "w" {
+		t.Fatalf("should have the numeric fields v and w. got %v", series)
+	}
+	if p := series[0].Points; len(p) != 1 || p[0].Count != 5 || p[0].Time != base.Add(-time.Minute*3).Format(DateTimeFormatFromServer) {
+		t.Errorf("invalid single window: %v", p[0])
+	}
+
+	_, err = db.Aggregate(&AggregateQuery{Filter: &BucketFilter{Prefix: []string{"app."}, Limit: 2}, MaxEntries: 4})
+	if err != ErrTooManyEntries {
+		t.Errorf("should fail after reading MaxEntries. got %v", err)
+	}
+}
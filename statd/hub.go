@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	// HubBufferSize is how many entries a subscriber can have pending,
+	// slower subscribers are dropped and should catch up from the database
+	HubBufferSize = 100
+)
+
+// Hub publish the stats and buckets saved by the StatsDB to the live streams
+type Hub struct {
+	sync.Mutex
+	stats   map[chan Stats]bool
+	buckets map[chan Bucket]*BucketFilter
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		stats:   make(map[chan Stats]bool),
+		buckets: make(map[chan Bucket]*BucketFilter),
+	}
+}
+
+// SubscribeStats return a channel that receives every new stat,
+// the channel is closed if the subscriber can't keep up.
+func (h *Hub) SubscribeStats() chan Stats {
+	h.Lock()
+	defer h.Unlock()
+	ch := make(chan Stats, HubBufferSize)
+	h.stats[ch] = true
+	return ch
+}
+
+func (h *Hub) UnsubscribeStats(ch chan Stats) {
+	h.Lock()
+	defer h.Unlock()
+	if h.stats[ch] {
+		delete(h.stats, ch)
+		close(ch)
+	}
+}
+
+// SubscribeBuckets return a channel that receives the new entries
+// selected by filter, the channel is closed if the subscriber can't keep up.
+//
+// Only the bucket names and entry ids of the filter are checked
+func (h *Hub) SubscribeBuckets(filter *BucketFilter) chan Bucket {
+	h.Lock()
+	defer h.Unlock()
+	ch := make(chan Bucket, HubBufferSize)
+	h.buckets[ch] = filter
+	return ch
+}
+
+func (h *Hub) UnsubscribeBuckets(ch chan Bucket) {
+	h.Lock()
+	defer h.Unlock()
+	if _, has := h.buckets[ch]; has {
+		delete(h.buckets, ch)
+		close(ch)
+	}
+}
+
+func (h *Hub) PublishStat(st Stats) {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.stats {
+		select {
+		case ch <- st:
+		default:
+			printf("dropping slow stats subscriber")
+			delete(h.stats, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *Hub) PublishBucket(bucket Bucket) {
+	h.Lock()
+	defer h.Unlock()
+	for ch, filter := range h.buckets {
+		if !filter.Select(bucket.Bucket, bucket.Id) {
+			continue
+		}
+		select {
+		case ch <- bucket:
+		default:
+			printf("dropping slow bucket subscriber")
+			delete(h.buckets, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHubFanOut(t *testing.T) {
+	hub := NewHub()
+	first, second := hub.SubscribeStats(), hub.SubscribeStats()
+	defer hub.UnsubscribeStats(first)
+	defer hub.UnsubscribeStats(second)
+	buckets := hub.SubscribeBuckets(&BucketFilter{Prefix: []string{"app."}})
+	defer hub.UnsubscribeBuckets(buckets)
+
+	hub.PublishStat(Stats{Id: 1})
+	for i, ch := range []chan Stats{first, second} {
+		if st := <-ch; st.Id != 1 {
+			t.Errorf("subscriber %v should receive the stat. got %v", i, st)
+		}
+	}
+
+	hub.PublishBucket(Bucket{Id: 1, Bucket: "other"})
+	hub.PublishBucket(Bucket{Id: 2, Bucket: "app.a"})
+	if b := <-buckets; b.Id != 2 {
+		t.Errorf("only app.a should be sent. got %v", b)
+	}
+	if len(buckets) != 0 {
+		t.Errorf("the subscriber should have no pending entries. got %v", len(buckets))
+	}
+}
+
+func TestHubDropSlowSubscriber(t *testing.T) {
+	hub := NewHub()
+	slow := hub.SubscribeStats()
+	for i := 0; i <= HubBufferSize; i++ {
+		hub.PublishStat(Stats{Id: i + 1})
+	}
+	count := 0
+	for _ = range slow {
+		count++
+	}
+	if count != HubBufferSize {
+		t.Errorf("should receive %v stats before being dropped. got %v", HubBufferSize, count)
+	}
+	// already dropped, must not close the channel again
+	hub.UnsubscribeStats(slow)
+
+	buckets := hub.SubscribeBuckets(&BucketFilter{Bucket: []string{"a"}})
+	for i := 0; i <= HubBufferSize; i++ {
+		hub.PublishBucket(Bucket{Id: i + 1, Bucket: "a"})
+	}
+	count = 0
+	for _ = range buckets {
+		count++
+	}
+	if count != HubBufferSize {
+		t.Errorf("should receive %v entries before being dropped. got %v", HubBufferSize, count)
+	}
+	hub.UnsubscribeBuckets(buckets)
+}
+
+func TestStreamBucketsEnd(t *testing.T) {
+	store := mustOpenKv()
+	db := NewStatsDB(store)
+	defer db.Done()
+
+	for i := 0; i < 3; i++ {
+		if err := store.PushBucket(&Bucket{Bucket: "app.a"}); err != nil {
+			t.Fatalf("error pushing bucket: %v", err)
+		}
+	}
+
+	var ids []int
+	send := func(id int, v interface{}) error {
+		ids = append(ids, id)
+		if id == 3 {
+			// saved after the catch up
+			for i := 0; i < 3; i++ {
+				db.newBucket <- Bucket{Bucket: "app.a"}
+			}
+		}
+		return nil
+	}
+	args := map[string][]string{"bucket": {"app.a"}, "id_end": {"4"}}
+	result := make(chan error, 1)
+	go func() {
+		result <- db.StreamBuckets(args, send, make(chan struct{}))
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("error streaming buckets: %v", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatalf("the stream should stop after id_end. got %v", ids)
+	}
+	if len(ids) != 4 || ids[3] != 4 {
+		t.Errorf("should send the entries up to id_end. got %v", ids)
+	}
+
+	// time_end already passed, the live entries aren't read
+	args = map[string][]string{"bucket": {"app.a"}, "time_end": {"-1h"}}
+	go func() {
+		result <- db.StreamBuckets(args, send, make(chan struct{}))
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("error streaming buckets: %v", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatalf("the stream should stop after time_end")
+	}
+}
+
+func TestStreamStatsCatchUp(t *testing.T) {
+	store := mustOpenKv()
+	db := NewStatsDB(store)
+	defer db.Done()
+
+	// more than one page, with contexts that don't follow the ids
+	for i := 0; i < 250; i++ {
+		if err := store.Push(&Stats{System: "web", Context: fmt.Sprintf("%03d", 250-i)}); err != nil {
+			t.Fatalf("error pushing stat: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+	var ids []int
+	send := func(id int, v interface{}) error {
+		ids = append(ids, id)
+		switch id {
+		case 100:
+			// saved during the catch up
+			for i := 0; i < 5; i++ {
+				db.newStat <- Stats{System: "web"}
+			}
+		case 255:
+			// saved after the catch up
+			for i := 0; i < 5; i++ {
+				db.newStat <- Stats{System: "web"}
+			}
+		case 260:
+			close(done)
+		}
+		return nil
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- db.StreamStats(0, send, done)
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("error streaming stats: %v", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatalf("the stream should have sent 260 stats. got %v", len(ids))
+	}
+
+	if len(ids) != 260 {
+		t.Fatalf("should send 260 stats. got %v", len(ids))
+	}
+	for i, id := range ids {
+		if id != i+1 {
+			t.Fatalf("stats should be sent once and in order. expecting %v got %v", i+1, id)
+		}
+	}
+}
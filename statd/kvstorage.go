@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/cznic/kv"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	prefixStats       = []byte("s/")
+	prefixBuckets     = []byte("b/")
+	prefixBucketNames = []byte("n/")
+	keyStatsSeq       = []byte("seq/stats")
+	keyBucketsSeq     = []byte("seq/buckets")
+
+	// errStopScan is returned by the scan functions to stop before the end
+	errStopScan = errors.New("scan stopped")
+)
+
+// kvStat is the value saved under the stat key
+type kvStat struct {
+	Id         int
+	System     string
+	SubSystem  string
+	Message    string
+	Context    string
+	ServerTime time.Time
+	ClientTime string
+	Error      bool
+	Info       map[string]string
+}
+
+// kvBucket is the value saved under the bucket entry key
+type kvBucket struct {
+	Id         int
+	Bucket     string
+	ServerTime time.Time
+	Deleted    bool
+	Info       map[string]interface{}
+}
+
+// KvStorage save the stats and buckets in an embedded kv database,
+// it doesn't require any server and is useful to run statd locally.
+//
+// Queries are solved by scanning the keys, so it isn't meant for large datasets
+type KvStorage struct {
+	sync.Mutex
+	db *kv.DB
+}
+
+// NewKvStorage opens the database saved at filename, if the file doesn't exist
+// it is created.
+//
+// If filename is empty, a memory-only database is used
+func NewKvStorage(filename string) (*KvStorage, error) {
+	var db *kv.DB
+	var err error
+	opt := &kv.Options{}
+	if len(filename) == 0 {
+		printf("opening memory-only kv database")
+		db, err = kv.CreateMem(opt)
+	} else if _, err = os.Stat(filename); os.IsNotExist(err) {
+		printf("creating kv database at: %v", filename)
+		db, err = kv.Create(filename, opt)
+	} else {
+		printf("opening kv database at: %v", filename)
+		db, err = kv.Open(filename, opt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &KvStorage{db: db}, nil
+}
+
+func (s *KvStorage) PushBucket(bucket *Bucket) error {
+	return s.PushBucketAt(bucket, time.Now())
+}
+
+func (s *KvStorage) PushBucketAt(bucket *Bucket, at time.Time) error {
+	return s.inside(func(db *kv.DB) error {
+		id, err := db.Inc(keyBucketsSeq, 1)
+		if err != nil {
+			return err
+		}
+		rec := &kvBucket{
+			Id:         int(id),
+			Bucket:     bucket.Bucket,
+			ServerTime: at,
+			Info:       bucket.Info,
+		}
+		if err := putJSON(db, bucketKey(rec.Id), rec); err != nil {
+			return err
+		}
+		bucket.Id = rec.Id
+		bucket.ServerTime = rec.ServerTime.Format(DateTimeFormatFromServer)
+		return db.Set(bucketNameKey(rec.Bucket, rec.Id), nil)
+	})
+}
+
+func (s *KvStorage) Push(st *Stats) error {
+	return s.inside(func(db *kv.DB) error {
+		id, err := db.Inc(keyStatsSeq, 1)
+		if err != nil {
+			return err
+		}
+		rec := &kvStat{
+			Id:         int(id),
+			System:     st.System,
+			SubSystem:  st.SubSystem,
+			Message:    st.Message,
+			Context:    st.Context,
+			ServerTime: time.Now(),
+			ClientTime: st.ClientTime,
+			Error:      st.Error,
+			Info:       st.Info,
+		}
+		if err := putJSON(db, statKey(rec.Id), rec); err != nil {
+			return err
+		}
+		st.Id = rec.Id
+		st.ServerTime = rec.ServerTime.Format(DateTimeFormatFromServer)
+		return nil
+	})
+}
+
+func (s *KvStorage) FetchAfterId(lastId, size int) (<-chan Stats, error) {
+	stats, err := s.scanStats(statKey(lastId+1), 0)
+	if err != nil {
+		return nil, err
+	}
+	// same order used by the postgres storage
+	sort.Sort(statsByContext(stats))
+	return streamStats(stats, size), nil
+}
+
+func (s *KvStorage) FetchSince(lastId, size int) (<-chan Stats, error) {
+	// the keys are already sorted by id, so only size keys are read
+	stats, err := s.scanStats(statKey(lastId+1), size)
+	if err != nil {
+		return nil, err
+	}
+	return streamStats(stats, size), nil
+}
+
+func (s *KvStorage) Fetch(size int) (<-chan Stats, error) {
+	stats, err := s.scanStats(prefixStats, 0)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(statsByTime(stats))
+	return streamStats(stats, size), nil
+}
+
+func (s *KvStorage) FetchBucket(filter *BucketFilter) (<-chan Bucket, error) {
+	var found []*kvBucket
+	err := s.inside(func(db *kv.DB) error {
+		ids, err := filterIds(db, filter)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			rec, err := getBucket(db, id)
+			if err != nil {
+				return err
+			}
+			if rec != nil && !rec.Deleted && matchBucket(rec, filter) {
+				found = append(found, rec)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var order sort.Interface = bucketsByTime(found)
+	if filter.ById {
+		order = bucketsById(found)
+	}
+	if filter.Desc {
+		order = sort.Reverse(order)
+	}
+	sort.Sort(order)
+	if filter.Limit > 0 && len(found) > filter.Limit {
+		found = found[:filter.Limit]
+	}
+	out := make(chan Bucket, len(found))
+	for _, rec := range found {
+		out <- Bucket{
+			Id:         rec.Id,
+			Bucket:     rec.Bucket,
+			ServerTime: rec.ServerTime.Format(DateTimeFormatFromServer),
+			Info:       rec.Info,
+		}
+	}
+	close(out)
+	return out, nil
+}
+
+func (s *KvStorage) EntriesInBucket(bucket string) (int, error) {
+	var count int
+	err := s.inside(func(db *kv.DB) error {
+		ids, err := bucketIds(db, bucketNamePrefix(bucket))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			rec, err := getBucket(db, id)
+			if err != nil {
+				return err
+			}
+			if rec != nil && !rec.Deleted {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (s *KvStorage) DeleteBucket(bucket string) error {
+	return s.inside(func(db *kv.DB) error {
+		ids, err := bucketIds(db, bucketNamePrefix(bucket))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			rec, err := getBucket(db, id)
+			if err != nil {
+				return err
+			}
+			if rec == nil || rec.Deleted {
+				continue
+			}
+			rec.Deleted = true
+			if err := putJSON(db, bucketKey(id), rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *KvStorage) PurgeBuckets(filter *BucketFilter) (int, error) {
+	return s.purgeBuckets(func(db *kv.DB) ([]int, error) {
+		return filterIds(db, filter)
+	}, func(rec *kvBucket) bool {
+		return matchBucket(rec, filter)
+	})
+}
+
+func (s *KvStorage) PurgeDeletedBuckets(before time.Time) (int, error) {
+	return s.purgeBuckets(func(db *kv.DB) ([]int, error) {
+		return bucketIds(db, prefixBucketNames)
+	}, func(rec *kvBucket) bool {
+		return rec.Deleted && rec.ServerTime.Before(before)
+	})
+}
+
+// purgeBuckets remove the entries found by ids and selected by fn
+func (s *KvStorage) purgeBuckets(ids func(db *kv.DB) ([]int, error), fn func(rec *kvBucket) bool) (int, error) {
+	var count int
+	err := s.inside(func(db *kv.DB) error {
+		ids, err := ids(db)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			rec, err := getBucket(db, id)
+			if err != nil {
+				return err
+			}
+			if rec == nil || !fn(rec) {
+				continue
+			}
+			if err := db.Delete(bucketKey(id)); err != nil {
+				return err
+			}
+			if err := db.Delete(bucketNameKey(rec.Bucket, id)); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (s *KvStorage) PurgeStats(system string, before time.Time) (int, error) {
+	var count int
+	err := s.inside(func(db *kv.DB) error {
+		// the keys are removed after the scan to keep the enumerator valid
+		var expired [][]byte
+		err := scan(db, prefixStats, prefixStats, func(k, v []byte) error {
+			var rec kvStat
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if (len(system) == 0 || rec.System == system) && rec.ServerTime.Before(before) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := db.Delete(k); err != nil {
+				return err
+			}
+		}
+		count = len(expired)
+		return nil
+	})
+	return count, err
+}
+
+// CreateTables does nothing, the kv storage doesn't have a schema
+func (s *KvStorage) CreateTables() error {
+	return nil
+}
+
+func (s *KvStorage) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.db.Close()
+}
+
+// inside run fn inside a transaction, all operations are serialized
+// since the kv transactions aren't isolated between goroutines
+func (s *KvStorage) inside(fn func(db *kv.DB) error) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	if err = s.db.BeginTransaction(); err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			s.db.Rollback()
+			panic(p)
+		}
+		if err == nil {
+			err = s.db.Commit()
+		} else {
+			s.db.Rollback()
+		}
+	}()
+	err = fn(s.db)
+	return
+}
+
+// scanStats return the stats with a key starting at from,
+// up to max stats are read, zero means no limit
+func (s *KvStorage) scanStats(from []byte, max int) ([]Stats, error) {
+	var stats []Stats
+	err := s.inside(func(db *kv.DB) error {
+		err := scan(db, prefixStats, from, func(k, v []byte) error {
+			if max > 0 && len(stats) >= max {
+				return errStopScan
+			}
+			var rec kvStat
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			stats = append(stats, Stats{
+				Id:         rec.Id,
+				System:     rec.System,
+				SubSystem:  rec.SubSystem,
+				Message:    rec.Message,
+				Context:    rec.Context,
+				ServerTime: rec.ServerTime.Format(DateTimeFormatFromServer),
+				ClientTime: rec.ClientTime,
+				Error:      rec.Error,
+				Info:       rec.Info,
+			})
+			return nil
+		})
+		if err == errStopScan {
+			err = nil
+		}
+		return err
+	})
+	return stats, err
+}
+
+// streamStats send up to size stats to the returned channel
+func streamStats(stats []Stats, size int) <-chan Stats {
+	if size > 0 && len(stats) > size {
+		stats = stats[:size]
+	}
+	out := make(chan Stats, len(stats))
+	for _, st := range stats {
+		out <- st
+	}
+	close(out)
+	return out
+}
+
+// filterIds return the ids of the entries that might be selected by filter
+func filterIds(db *kv.DB, filter *BucketFilter) ([]int, error) {
+	var ids []int
+	if len(filter.Prefix) > 0 {
+		for _, name := range filter.Prefix {
+			found, err := bucketIds(db, append(copyBytes(prefixBucketNames), name...))
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, found...)
+		}
+	} else if len(filter.Bucket) > 0 {
+		for _, name := range filter.Bucket {
+			found, err := bucketIds(db, bucketNamePrefix(name))
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, found...)
+		}
+	} else if len(filter.EntryId) > 0 {
+		ids = append(ids, filter.EntryId...)
+	}
+	// prefixes might overlap
+	sort.Ints(ids)
+	uniq := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			uniq = append(uniq, id)
+		}
+	}
+	return uniq, nil
+}
+
+// matchBucket check the exclusions and the id and time limits of filter
+func matchBucket(rec *kvBucket, filter *BucketFilter) bool {
+	for _, prefix := range filter.Exclude {
+		if strings.HasPrefix(rec.Bucket, prefix) {
+			return false
+		}
+	}
+	if filter.IdStart > 0 && rec.Id <= filter.IdStart {
+		return false
+	}
+	if filter.IdEnd > 0 && rec.Id > filter.IdEnd {
+		return false
+	}
+	if !filter.TimeStart.IsZero() && !rec.ServerTime.After(filter.TimeStart) {
+		return false
+	}
+	if !filter.TimeEnd.IsZero() && rec.ServerTime.After(filter.TimeEnd) {
+		return false
+	}
+	return true
+}
+
+// bucketIds return the ids of the entries whose name key starts with prefix
+func bucketIds(db *kv.DB, prefix []byte) ([]int, error) {
+	var ids []int
+	err := scan(db, prefix, prefix, func(k, v []byte) error {
+		ids = append(ids, int(binary.BigEndian.Uint64(k[len(k)-8:])))
+		return nil
+	})
+	return ids, err
+}
+
+func getBucket(db *kv.DB, id int) (*kvBucket, error) {
+	val, err := db.Get(nil, bucketKey(id))
+	if err != nil || val == nil {
+		return nil, err
+	}
+	rec := &kvBucket{}
+	return rec, json.Unmarshal(val, rec)
+}
+
+func putJSON(db *kv.DB, key []byte, val interface{}) error {
+	buf, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return db.Set(key, buf)
+}
+
+// scan calls fn for every key starting at from while the key has the given prefix
+func scan(db *kv.DB, prefix, from []byte, fn func(k, v []byte) error) error {
+	enum, _, err := db.Seek(from)
+	if err != nil {
+		return err
+	}
+	for {
+		k, v, err := enum.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(k, prefix) {
+			return nil
+		}
+		if err := fn(copyBytes(k), copyBytes(v)); err != nil {
+			return err
+		}
+	}
+}
+
+func statKey(id int) []byte {
+	return append(copyBytes(prefixStats), idKey(id)...)
+}
+
+func bucketKey(id int) []byte {
+	return append(copyBytes(prefixBuckets), idKey(id)...)
+}
+
+// bucketNamePrefix return the prefix of the name keys of the entries of bucket
+func bucketNamePrefix(bucket string) []byte {
+	key := append(copyBytes(prefixBucketNames), bucket...)
+	return append(key, 0)
+}
+
+func bucketNameKey(bucket string, id int) []byte {
+	return append(bucketNamePrefix(bucket), idKey(id)...)
+}
+
+func idKey(id int) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(id))
+	return buf[:]
+}
+
+func copyBytes(in []byte) []byte {
+	out := make([]byte, len(in))
+	copy(out, in)
+	return out
+}
+
+// statsByContext sort by context and then by the newest first,
+// the ids follow the server time
+type statsByContext []Stats
+
+func (s statsByContext) Len() int      { return len(s) }
+func (s statsByContext) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s statsByContext) Less(i, j int) bool {
+	if s[i].Context != s[j].Context {
+		return s[i].Context < s[j].Context
+	}
+	return s[i].Id > s[j].Id
+}
+
+// statsByTime sort by the newest first
+type statsByTime []Stats
+
+func (s statsByTime) Len() int           { return len(s) }
+func (s statsByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s statsByTime) Less(i, j int) bool { return s[i].Id > s[j].Id }
+
+type bucketsById []*kvBucket
+
+func (b bucketsById) Len() int           { return len(b) }
+func (b bucketsById) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bucketsById) Less(i, j int) bool { return b[i].Id < b[j].Id }
+
+type bucketsByTime []*kvBucket
+
+func (b bucketsByTime) Len() int      { return len(b) }
+func (b bucketsByTime) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b bucketsByTime) Less(i, j int) bool {
+	if !b[i].ServerTime.Equal(b[j].ServerTime) {
+		return b[i].ServerTime.Before(b[j].ServerTime)
+	}
+	return b[i].Id < b[j].Id
+}
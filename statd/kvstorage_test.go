@@ -0,0 +1,198 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mustOpenKv() *KvStorage {
+	store, err := NewKvStorage("")
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
+
+// statIds return the ids of the stats, or nil on errors
+func statIds(data <-chan Stats, err error) []int {
+	if err != nil {
+		return nil
+	}
+	ids := []int{}
+	for st := range data {
+		ids = append(ids, st.Id)
+	}
+	return ids
+}
+
+// bucketIdsOf return the ids of the entries, or nil on errors
+func bucketIdsOf(data <-chan Bucket, err error) []int {
+	if err != nil {
+		return nil
+	}
+	ids := []int{}
+	for b := range data {
+		ids = append(ids, b.Id)
+	}
+	return ids
+}
+
+func TestKvStorageStats(t *testing.T) {
+	store := mustOpenKv()
+	defer store.Close()
+
+	for i, ctx := range []string{"b", "a", "b", "c"} {
+		st := &Stats{System: "web", Context: ctx, Info: map[string]string{"n": ctx}}
+		if err := store.Push(st); err != nil {
+			t.Fatalf("error pushing stat: %v", err)
+		}
+		if st.Id != i+1 || len(st.ServerTime) == 0 {
+			t.Errorf("push should set the id and server time. got %v", st)
+		}
+	}
+
+	// by context and then the newest first
+	if ids := statIds(store.FetchAfterId(0, 10)); !reflect.DeepEqual(ids, []int{2, 3, 1, 4}) {
+		t.Errorf("invalid FetchAfterId order: %v", ids)
+	}
+	if ids := statIds(store.FetchAfterId(1, 2)); !reflect.DeepEqual(ids, []int{2, 3}) {
+		t.Errorf("invalid FetchAfterId page: %v", ids)
+	}
+	if ids := statIds(store.FetchSince(1, 2)); !reflect.DeepEqual(ids, []int{2, 3}) {
+		t.Errorf("invalid FetchSince page: %v", ids)
+	}
+	if ids := statIds(store.Fetch(3)); !reflect.DeepEqual(ids, []int{4, 3, 2}) {
+		t.Errorf("invalid Fetch order: %v", ids)
+	}
+
+	data, _ := store.FetchSince(1, 1)
+	if st := <-data; st.Info["n"] != "a" || st.System != "web" {
+		t.Errorf("the fields should be saved. got %v", st)
+	}
+}
+
+func TestKvStorageFetchBucket(t *testing.T) {
+	store := mustOpenKv()
+	defer store.Close()
+
+	base := time.Date(2014, 1, 1, 10, 0, 0, 0, time.Local)
+	// the last entry is saved with an old time, like the rollups
+	entries := []struct {
+		bucket string
+		at     time.Time
+	}{
+		{"app.a", base},
+		{"app.b", base.Add(time.Minute)},
+		{"other", base.Add(time.Minute * 2)},
+		{"app.a", base.Add(time.Minute * 3)},
+		{"app.a", base.Add(time.Minute * 4)},
+		{"app.a", base.Add(-time.Minute)},
+	}
+	for _, e := range entries {
+		if err := store.PushBucketAt(&Bucket{Bucket: e.bucket, Info: map[string]interface{}{}}, e.at); err != nil {
+			t.Fatalf("error pushing bucket: %v", err)
+		}
+	}
+
+	for i, c := range []struct {
+		filter BucketFilter
+		ids    []int
+	}{
+		{BucketFilter{Prefix: []string{"app."}}, []int{6, 1, 2, 4, 5}},
+		{BucketFilter{Prefix: []string{"app.", "oth"}}, []int{6, 1, 2, 3, 4, 5}},
+		{BucketFilter{Prefix: []string{"app", "app."}}, []int{6, 1, 2, 4, 5}},
+		{BucketFilter{Prefix: []string{"app."}, Exclude: []string{"app.b"}}, []int{6, 1, 4, 5}},
+		{BucketFilter{Bucket: []string{"app.a"}}, []int{6, 1, 4, 5}},
+		{BucketFilter{Bucket: []string{"app.a", "other"}}, []int{6, 1, 3, 4, 5}},
+		{BucketFilter{Bucket: []string{"app"}}, []int{}},
+		{BucketFilter{EntryId: []int{5, 3}}, []int{3, 5}},
+		{BucketFilter{Bucket: []string{"app.a"}, IdStart: 1}, []int{6, 4, 5}},
+		{BucketFilter{Bucket: []string{"app.a"}, IdEnd: 4}, []int{1, 4}},
+		{BucketFilter{Bucket: []string{"app.a"}, TimeStart: base}, []int{4, 5}},
+		{BucketFilter{Bucket: []string{"app.a"}, TimeEnd: base.Add(time.Minute * 3)}, []int{6, 1, 4}},
+		{BucketFilter{Bucket: []string{"app.a"}, Desc: true}, []int{5, 4, 1, 6}},
+		{BucketFilter{Bucket: []string{"app.a"}, ById: true}, []int{1, 4, 5, 6}},
+		{BucketFilter{Bucket: []string{"app.a"}, ById: true, Desc: true}, []int{6, 5, 4, 1}},
+		{BucketFilter{Bucket: []string{"app.a"}, Limit: 2}, []int{6, 1}},
+		{BucketFilter{Bucket: []string{"app.a"}, Desc: true, Limit: 2}, []int{5, 4}},
+	} {
+		filter := c.filter
+		if ids := bucketIdsOf(store.FetchBucket(&filter)); !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("case %v: expecting %v got %v", i, c.ids, ids)
+		}
+	}
+}
+
+func TestKvStorageDeleteBucket(t *testing.T) {
+	store := mustOpenKv()
+	defer store.Close()
+
+	for _, name := range []string{"app.a", "app.a", "app.ab"} {
+		if err := store.PushBucket(&Bucket{Bucket: name, Info: map[string]interface{}{}}); err != nil {
+			t.Fatalf("error pushing bucket: %v", err)
+		}
+	}
+	if count, err := store.EntriesInBucket("app.a"); err != nil || count != 2 {
+		t.Errorf("app.a should have 2 entries. got %v %v", count, err)
+	}
+	if err := store.DeleteBucket("app.a"); err != nil {
+		t.Fatalf("error deleting bucket: %v", err)
+	}
+	if count, _ := store.EntriesInBucket("app.a"); count != 0 {
+		t.Errorf("app.a should be empty. got %v", count)
+	}
+	if count, _ := store.EntriesInBucket("app.ab"); count != 1 {
+		t.Errorf("app.ab shouldn't be deleted. got %v", count)
+	}
+	if ids := bucketIdsOf(store.FetchBucket(&BucketFilter{Prefix: []string{"app."}})); !reflect.DeepEqual(ids, []int{3}) {
+		t.Errorf("the deleted entries shouldn't be fetched. got %v", ids)
+	}
+}
+
+func TestKvStoragePurge(t *testing.T) {
+	store := mustOpenKv()
+	defer store.Close()
+
+	base := time.Date(2014, 1, 1, 10, 0, 0, 0, time.Local)
+	push := func(name string, at time.Time) {
+		if err := store.PushBucketAt(&Bucket{Bucket: name, Info: map[string]interface{}{}}, at); err != nil {
+			t.Fatalf("error pushing bucket: %v", err)
+		}
+	}
+	push("app.a", base)
+	push("app.a", base.Add(time.Hour))
+	push(RollupPrefix+"app.a", base)
+	push("deleted", base)
+	push("deleted", base.Add(time.Hour))
+	store.DeleteBucket("deleted")
+
+	// deleted or not, the filter decides
+	count, err := store.PurgeBuckets(&BucketFilter{Prefix: []string{""}, Exclude: []string{RollupPrefix}, TimeEnd: base})
+	if err != nil || count != 2 {
+		t.Errorf("should remove the old app.a and deleted entries. got %v %v", count, err)
+	}
+	if ids := bucketIdsOf(store.FetchBucket(&BucketFilter{Prefix: []string{""}})); !reflect.DeepEqual(ids, []int{3, 2}) {
+		t.Errorf("invalid entries after purge: %v", ids)
+	}
+	if count, err := store.PurgeDeletedBuckets(base.Add(time.Hour * 2)); err != nil || count != 1 {
+		t.Errorf("should remove the last deleted entry. got %v %v", count, err)
+	}
+	// the name keys must be removed too
+	if count, _ := store.PurgeBuckets(&BucketFilter{Bucket: []string{"deleted"}}); count != 0 {
+		t.Errorf("deleted should be empty. got %v", count)
+	}
+
+	for _, system := range []string{"web", "db", "web"} {
+		store.Push(&Stats{System: system})
+	}
+	if count, err := store.PurgeStats("web", time.Now().Add(time.Minute)); err != nil || count != 2 {
+		t.Errorf("should remove the web stats. got %v %v", count, err)
+	}
+	if ids := statIds(store.Fetch(10)); !reflect.DeepEqual(ids, []int{2}) {
+		t.Errorf("only the db stat should be kept. got %v", ids)
+	}
+	if count, _ := store.PurgeStats("", time.Now().Add(time.Minute)); count != 1 {
+		t.Errorf("the empty system should select every stat. got %v", count)
+	}
+}
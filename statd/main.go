@@ -5,11 +5,12 @@ import (
 	"bufio"
 	"bytes"
 	"code.google.com/p/go.net/websocket"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	_ "github.com/lib/pq"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -17,6 +18,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,20 +27,29 @@ const (
 	MaxSize     = 1000
 
 	DateTimeFormatFromServer = "2006-01-02 15:04:05.000"
-	StatsSelect              = `select s.id, s.system, s.subsystem, s.message, s.context, to_char(s.servertime, 'yyyy-mm-dd HH24:MI:SS.MS'), s.clienttime, s.error, si.info from stats s inner join stats_info si on s.id = si.stats_id `
-	BucketSelect             = `select b.id, to_char(b.servertime, 'yyyy-mm-dd HH24:MI:SS.MS'), b.bucket, b.info from buckets b where deleted = 'f' `
-	EntriesInBucketSelect    = `select count(*) from buckets b where deleted = 'f'`
-	DeleteBucketSelect       = `update buckets set deleted = true where bucket = $1`
+
+	// EventsHeartbeat is the interval between the comments sent to idle event streams
+	EventsHeartbeat = time.Second * 30
+)
+
+var (
+	ErrSlowStream = errors.New("the stream can't keep up with the new entries")
 )
 
 var (
-	dbuser   = flag.String("dbuser", "statsd", "Database user")
-	dbpasswd = flag.String("dbpasswd", "statsd", "Database password")
-	dbname   = flag.String("dbname", "statsd", "Database name")
-	dbhost   = flag.String("dbhost", "localhost", "Database host")
-	initdb   = flag.Bool("initdb", false, "Initialize the tables on the database")
-	httpaddr = flag.String("httpaddr", "0.0.0.0:4001", "Address to listen for incoming http requests")
-	help     = flag.Bool("h", false, "Help")
+	dbuser       = flag.String("dbuser", "statsd", "Database user")
+	dbpasswd     = flag.String("dbpasswd", "statsd", "Database password")
+	dbname       = flag.String("dbname", "statsd", "Database name")
+	dbhost       = flag.String("dbhost", "localhost", "Database host")
+	initdb       = flag.Bool("initdb", false, "Initialize the tables on the database")
+	storage      = flag.String("storage", "postgres", "Storage used to save the data: postgres or kv")
+	kvfile       = flag.String("kvfile", "statd.db", "File used by the kv storage, if empty the data is kept only in memory")
+	retention    = flag.String("retention", "", "JSON file with the retention policy, if empty the data is kept forever")
+	httpaddr     = flag.String("httpaddr", "0.0.0.0:4001", "Address to listen for incoming http requests")
+	statsdaddr   = flag.String("statsdaddr", "", "Address to listen for statsd metrics over udp and tcp, if empty statsd is disabled")
+	statsdprefix = flag.String("statsdprefix", "statsd.", "Prefix added to the bucket of the statsd metrics")
+	statsdflush  = flag.Duration("statsdflush", time.Second*10, "Interval between the flushes of the statsd metrics")
+	help         = flag.Bool("h", false, "Help")
 
 	exitStatus int
 )
@@ -113,393 +124,175 @@ type Stats struct {
 	Info           map[string]string
 }
 
+// StatsDB receives the new stats and buckets, save them in the storage
+// and publish them to the live streams
 type StatsDB struct {
-	conn      *sql.DB
+	store     Storage
+	hub       *Hub
 	newStat   chan Stats
 	newBucket chan Bucket
 	done      chan struct{}
 }
 
 func (db *StatsDB) PushBucket(bucket *Bucket) error {
-	var lastid int
-
-	buf := &bytes.Buffer{}
-	enc := json.NewEncoder(buf)
-	err := enc.Encode(bucket.Info)
-	if err != nil {
-		return err
-	}
-
-	err = db.conn.QueryRow("insert into buckets(bucket, servertime, info) values ($1, $2, $3) returning id",
-		bucket.Bucket, time.Now(), string(buf.Bytes())).Scan(&lastid)
-	return err
+	return db.store.PushBucket(bucket)
 }
 
 func (db *StatsDB) Push(st *Stats) error {
-	var lastid int
-
-	err := db.conn.QueryRow("insert into stats(system, subsystem, message, context, servertime, clienttime, error) values ($1, $2, $3, $4, $5, $6, $7) returning id",
-		st.System, st.SubSystem, st.Message, st.Context, time.Now(), st.ClientTime, st.Error).Scan(&lastid)
-	if err != nil {
-		return err
-	}
-
-	buf := &bytes.Buffer{}
-	enc := json.NewEncoder(buf)
-	err = enc.Encode(st.Info)
-	if err != nil {
-		return err
-	}
-
-	_, err = db.conn.Exec("insert into stats_info(stats_id, info) values ($1, $2)",
-		lastid, string(buf.Bytes()))
-	return err
+	return db.store.Push(st)
 }
 
-func (db *StatsDB) streamBuckets(result *sql.Rows, out chan Bucket) {
-	var err error
-	defer result.Close()
-LOOP:
-	for result.Next() && result.Err() == nil {
-		var bucket Bucket
-		var info string
-		bucket.Info = make(map[string]interface{})
-		err = result.Scan(&bucket.Id, &bucket.ServerTime, &bucket.Bucket, &info)
-		if err != nil {
-			printf("error scanning database: %v", err)
-			break LOOP
-		}
-		dec := json.NewDecoder(bytes.NewBufferString(info))
-		err = dec.Decode(&bucket.Info)
-		if err != nil {
-			printf("error decoding info from record: %v", err)
-			break LOOP
-		}
-		select {
-		case out <- bucket:
-		case <-time.After(time.Second * 10):
-			break LOOP
-		}
-	}
-	close(out)
+func (db *StatsDB) FetchAfterId(lastId, size int) (<-chan Stats, error) {
+	return db.store.FetchAfterId(lastId, size)
 }
 
-func (db *StatsDB) streamRows(result *sql.Rows, out chan Stats) {
-	var err error
-	defer result.Close()
-LOOP:
-	for result.Next() && result.Err() == nil {
-		var stat Stats
-		var info string
-		stat.Info = make(map[string]string)
-		err = result.Scan(&stat.Id, &stat.System, &stat.SubSystem, &stat.Message, &stat.Context, &stat.ServerTime, &stat.ClientTime, &stat.Error, &info)
-		if err != nil {
-			printf("error scanning database: %v", err)
-			break
-		}
-		dec := json.NewDecoder(bytes.NewBufferString(info))
-		err = dec.Decode(&stat.Info)
-		if err != nil {
-			printf("error decoding info from record: %v", err)
-			break
-		}
-		select {
-		case out <- stat:
-		case <-time.After(time.Second * 10):
-			break LOOP
-		}
-	}
-	close(out)
+func (db *StatsDB) Fetch(size int) (<-chan Stats, error) {
+	return db.store.Fetch(size)
 }
 
-func (db *StatsDB) FetchAfterId(lastId, size int) (chan Stats, error) {
-	result, err := db.conn.Query(StatsSelect+" where s.id > $1 order by s.context, s.servertime desc limit $2", lastId, size)
+func (db *StatsDB) FetchBucket(args url.Values, maxSize int) (<-chan Bucket, error) {
+	filter, err := ParseBucketFilter(args, maxSize)
 	if err != nil {
-		printf("error running query: %v", err)
 		return nil, err
 	}
-	out := make(chan Stats, 0)
-	go db.streamRows(result, out)
-	return out, err
+	return db.store.FetchBucket(filter)
 }
 
-func (db *StatsDB) Fetch(size int) (<-chan Stats, error) {
-	result, err := db.conn.Query(StatsSelect+" order by s.servertime desc, s.context limit $1", size)
-	if err != nil {
-		printf("error running query: %v", err)
-		return nil, err
-	}
-	out := make(chan Stats, 0)
-	go db.streamRows(result, out)
-	return out, err
+func (db *StatsDB) EntriesInBucket(bucket string) (int, error) {
+	return db.store.EntriesInBucket(bucket)
 }
 
-func (db *StatsDB) FetchBucket(args url.Values, maxSize int) (<-chan Bucket, error) {
-	query := &bytes.Buffer{}
-	var queryArgs []interface{}
-	fmt.Fprintf(query, BucketSelect)
-	if _, has := args["prefix"]; has {
-		fmt.Fprintf(query, " AND ( ")
-		first := true
-		for _, name := range args["prefix"] {
-			if !first {
-				fmt.Fprintf(query, " OR ")
-			}
-			fmt.Fprintf(query, " b.bucket like $%v ", len(queryArgs)+1)
-			queryArgs = append(queryArgs, name+"%")
-		}
-		fmt.Fprintf(query, ") ")
-	} else if _, has := args["bucket"]; has {
-		first := true
-		fmt.Fprintf(query, " and b.bucket in (")
-		for _, v := range args["bucket"] {
-			if !first {
-				fmt.Fprintf(query, " ,")
-			}
-			fmt.Fprintf(query, " $%v", len(queryArgs) + 1)
-			queryArgs = append(queryArgs, v)
-			first = false
-		}
-		fmt.Fprintf(query, " )")
-	} else if _, has := args["entryid"]; has {
-		first := true
-		fmt.Fprintf(query, " and b.id in (")
-		for _, v := range args["entryid"] {
-			if !first {
-				fmt.Fprintf(query, " ,")
-			}
-			fmt.Fprintf(query, " $%v", len(queryArgs) + 1)
-			queryArgs = append(queryArgs, v)
-			first = false
-		}
-		fmt.Fprintf(query, " )")
-	} else {
-		return nil, fmt.Errorf("you must provide at least one of: bucket, entryid, prefix")
-	}
+func (db *StatsDB) DeleteBucket(bucket string) error {
+	return db.store.DeleteBucket(bucket)
+}
 
-	if len(args.Get("id_start")) > 0 {
-		fmt.Fprintf(query, " and b.id > $%v", len(queryArgs)+1)
-		queryArgs = append(queryArgs, args.Get("id_start"))
+func NewStatsDB(store Storage) *StatsDB {
+	db := &StatsDB{
+		store:     store,
+		hub:       NewHub(),
+		newStat:   make(chan Stats, 1),
+		newBucket: make(chan Bucket, 1),
+		done:      make(chan struct{}, 0),
 	}
+	go db.serve()
+	return db
+}
 
-	if len(args.Get("id_end")) > 0 {
-		fmt.Fprintf(query, " and b.id <= $%v", len(queryArgs)+1)
-		queryArgs = append(queryArgs, args.Get("id_end"))
-	}
+func (db *StatsDB) CreateTables() error {
+	return db.store.CreateTables()
+}
 
-	if len(args.Get("time_start")) > 0 {
-		val, err := time.Parse(DateTimeFormatFromServer, args.Get("time_start"))
+// StreamStats send the stats after lastId saved in the database and then, as they
+// are saved, the new ones. It only returns when send fails, done is closed or the
+// stream is too slow, in that case the client should reconnect and catch up.
+func (db *StatsDB) StreamStats(lastId int, send func(id int, v interface{}) error, done <-chan struct{}) error {
+	// subscribe before the catch up, otherwise the stats saved
+	// between the last query and the subscription are lost
+	live := db.hub.SubscribeStats()
+	defer db.hub.UnsubscribeStats(live)
+	for {
+		data, err := db.store.FetchSince(lastId, 100)
 		if err != nil {
-			// not a time, maybe a duration
-			var dur time.Duration
-			dur, err = time.ParseDuration(args.Get("time_start"))
-			if err != nil {
-				return nil, fmt.Errorf("%v isn't a valid date or valid duration", args.Get("time_start"))
-			}
-			val = time.Now()
-			val = val.Add(dur)
+			return err
 		}
-		fmt.Fprintf(query, " and b.servertime > $%v", len(queryArgs)+1)
-		queryArgs = append(queryArgs, val)
-	}
-
-	if len(args.Get("time_end")) > 0 {
-		val, err := time.Parse(DateTimeFormatFromServer, args.Get("time_end"))
-		if err != nil {
-			// not a time, maybe a duration
-			var dur time.Duration
-			dur, err = time.ParseDuration(args.Get("time_end"))
-			if err != nil {
-				return nil, fmt.Errorf("%v isn't a valid date or valid duration", args.Get("time_end"))
+		newData := false
+		for v := range data {
+			newData = true
+			if v.Id > lastId {
+				lastId = v.Id
+			}
+			if err := send(v.Id, &v); err != nil {
+				return err
 			}
-			val = time.Now()
-			val = val.Add(dur)
 		}
-		fmt.Fprintf(query, " and b.servertime <= $%v", len(queryArgs)+1)
-		queryArgs = append(queryArgs, val)
-	}
-
-	if args.Get("sort") == "desc" {
-		fmt.Fprintf(query, " order by b.servertime desc ")
-	} else {
-		fmt.Fprintf(query, " order by b.servertime asc ")
-	}
-
-	if args.Get("pagesize") != "" {
-		var pagesize int64
-		var err error
-		if pagesize, err = strconv.ParseInt(args.Get("pagesize"), 10, 32); err != nil {
-			pagesize = 0
+		if !newData {
+			break
 		}
-		maxSize = int(pagesize)
-	}
-
-	if maxSize > 500 {
-		maxSize = 500
-	} else if maxSize <= 0 {
-		maxSize = 100
-	}
-
-	fmt.Fprintf(query, " limit $%v", len(queryArgs)+1)
-	queryArgs = append(queryArgs, maxSize)
-
-	result, err := db.conn.Query(string(query.Bytes()), queryArgs...)
-
-	if err != nil {
-		printf("error running query: query: [%v] params: [%v] cause: %v", string(query.Bytes()), queryArgs, err)
-		return nil, err
 	}
-	out := make(chan Bucket, 0)
-	go db.streamBuckets(result, out)
-	return out, err
-}
-
-func (db *StatsDB) EntriesInBucket(bucket string) (int, error) {
-	var out int
-	err := db.conn.QueryRow(EntriesInBucketSelect+" and b.bucket = $1", bucket).Scan(&out)
-	if err != nil {
-		printf("error running query: %v", err)
-	}
-	return out, err
-}
-
-func (db *StatsDB) updateBucket(args url.Values) error {
-	query := &bytes.Buffer{}
-	var queryArgs []interface{}
-	fmt.Fprintf(query, BucketSelect)
-	if _, has := args["prefix"]; has {
-		fmt.Fprintf(query, " AND ( ")
-		first := true
-		for _, name := range args["prefix"] {
-			if !first {
-				fmt.Fprintf(query, " OR ")
+	for {
+		select {
+		case v, ok := <-live:
+			if !ok {
+				return ErrSlowStream
 			}
-			fmt.Fprintf(query, " bucket like $%v ", len(queryArgs)+1)
-			queryArgs = append(queryArgs, name+"%")
-		}
-		fmt.Fprintf(query, ") ")
-	} else if _, has := args["bucket"]; has {
-		first := true
-		fmt.Fprintf(query, " and bucket in (")
-		for _, v := range args["bucket"] {
-			if !first {
-				fmt.Fprintf(query, " ,")
+			if v.Id <= lastId {
+				// already sent by the catch up
+				continue
 			}
-			fmt.Fprintf(query, " $%v", len(queryArgs) + 1)
-			queryArgs = append(queryArgs, v)
-			first = false
-		}
-		fmt.Fprintf(query, " )")
-	} else if _, has := args["entryid"]; has {
-		first := true
-		fmt.Fprintf(query, " and id in (")
-		for _, v := range args["entryid"] {
-			if !first {
-				fmt.Fprintf(query, " ,")
+			lastId = v.Id
+			if err := send(v.Id, &v); err != nil {
+				return err
 			}
-			fmt.Fprintf(query, " $%v", len(queryArgs) + 1)
-			queryArgs = append(queryArgs, v)
-			first = false
+		case <-done:
+			return nil
 		}
-		fmt.Fprintf(query, " )")
-	} else {
-		return fmt.Errorf("you must provide at least one of: bucket, entryid, prefix")
-	}
-
-	if len(args.Get("id_start")) > 0 {
-		fmt.Fprintf(query, " and id > $%v", len(queryArgs)+1)
-		queryArgs = append(queryArgs, args.Get("id_start"))
 	}
+}
 
-	if len(args.Get("id_end")) > 0 {
-		fmt.Fprintf(query, " and id <= $%v", len(queryArgs)+1)
-		queryArgs = append(queryArgs, args.Get("id_end"))
+// StreamBuckets works like StreamStats but send the bucket entries selected by args,
+// the entries are always sent by id. The stream also returns once the new entries
+// pass the id_end or time_end of args.
+func (db *StatsDB) StreamBuckets(args url.Values, send func(id int, v interface{}) error, done <-chan struct{}) error {
+	filter, err := ParseBucketFilter(args, 100)
+	if err != nil {
+		return err
 	}
-
-	if len(args.Get("time_start")) > 0 {
-		val, err := time.Parse(DateTimeFormatFromServer, args.Get("time_start"))
+	filter.Desc = false
+	filter.ById = true
+	live := db.hub.SubscribeBuckets(filter)
+	defer db.hub.UnsubscribeBuckets(live)
+	for {
+		data, err := db.store.FetchBucket(filter)
 		if err != nil {
-			// not a time, maybe a duration
-			var dur time.Duration
-			dur, err = time.ParseDuration(args.Get("time_start"))
-			if err != nil {
-				return fmt.Errorf("%v isn't a valid date or valid duration", args.Get("time_start"))
-			}
-			val = time.Now()
-			val = val.Add(dur)
+			return err
 		}
-		fmt.Fprintf(query, " and servertime > $%v", len(queryArgs)+1)
-		queryArgs = append(queryArgs, val)
-	}
-
-	if len(args.Get("time_end")) > 0 {
-		val, err := time.Parse(DateTimeFormatFromServer, args.Get("time_end"))
-		if err != nil {
-			// not a time, maybe a duration
-			var dur time.Duration
-			dur, err = time.ParseDuration(args.Get("time_end"))
-			if err != nil {
-				return fmt.Errorf("%v isn't a valid date or valid duration", args.Get("time_end"))
+		newData := false
+		for v := range data {
+			newData = true
+			filter.IdStart = v.Id
+			if err := send(v.Id, &v); err != nil {
+				return err
 			}
-			val = time.Now()
-			val = val.Add(dur)
 		}
-		fmt.Fprintf(query, " and servertime <= $%v", len(queryArgs)+1)
-		queryArgs = append(queryArgs, val)
-	}
-
-	_, err := db.conn.Exec(string(query.Bytes()), queryArgs...)
-
-	if err != nil {
-		printf("error running query: query: [%v] params: [%v] cause: %v", string(query.Bytes()), queryArgs, err)
-		return err
+		if !newData {
+			break
+		}
 	}
-	return err
-}
-
-func (db *StatsDB) DeleteBucket(bucket string) error {
-	_, err := db.conn.Exec(DeleteBucketSelect, bucket)
-	return err
-}
-
-func NewStatsDB(user, pwd, host, dbname string) (*StatsDB, error) {
-	printf("opening database connection to: %v with user %v database %v", host, user, dbname)
-	sqldb, err := sql.Open("postgres", fmt.Sprintf("user=%v dbname=%v password=%v host=%v sslmode=disable", user, dbname, pwd, host))
-	if err != nil {
-		return nil, err
+	// the new entries are saved with the current time, so
+	// none of them is selected after the time_end
+	if filter.pastEnd(filter.IdStart+1, time.Now()) {
+		return nil
 	}
-	db := &StatsDB{
-		conn:      sqldb,
-		newStat:   make(chan Stats, 1),
-		newBucket: make(chan Bucket, 1),
-		done:      make(chan struct{}, 0),
+	var end <-chan time.Time
+	if !filter.TimeEnd.IsZero() {
+		end = time.After(filter.TimeEnd.Sub(time.Now()))
 	}
-	go db.serve()
-	return db, nil
-}
-
-func (db *StatsDB) CreateTables() error {
-	cmds := []string{
-		`create sequence stats_seq increment 1 minvalue 1 maxvalue 9223372036854775807 start 1 cache 1`,
-		`create sequence stats_info_seq increment 1 minvalue 1 maxvalue 9223372036854775807 start 1 cache 1`,
-		`create sequence buckets_seq increment 1 minvalue 1 maxvalue 9223372036854775807 start 1 cache 1`,
-		`create table stats(id integer not null default nextval('stats_seq'), system char varying(255) not null, subsystem char varying(255), message char varying(255), context char varying(255), servertime timestamp not null, clienttime char varying(100), error boolean)`,
-		`create table stats_info(id integer not null default nextval('stats_info_seq'), stats_id integer, info text)`,
-		`create table buckets(id integer not null default nextval('buckets_seq'), bucket varchar(255), servertime timestamp not null, deleted boolean not null default 'f', info char text)`,
-	}
-	var firsterr error
-	for _, cmd := range cmds {
-		printf("running: %v", cmd)
-		_, err := db.conn.Exec(cmd)
-		if err != nil {
-			printf("error: %v", err)
-			if firsterr != nil {
-				firsterr = err
+	for {
+		select {
+		case v, ok := <-live:
+			if !ok {
+				return ErrSlowStream
+			}
+			if v.Id <= filter.IdStart {
+				continue
+			}
+			at, err := time.ParseInLocation(DateTimeFormatFromServer, v.ServerTime, time.Local)
+			if err != nil {
+				at = time.Now()
+			}
+			if filter.pastEnd(v.Id, at) {
+				return nil
 			}
+			filter.IdStart = v.Id
+			if err := send(v.Id, &v); err != nil {
+				return err
+			}
+		case <-end:
+			return nil
+		case <-done:
+			return nil
 		}
 	}
-	printf("done creating tables")
-	return firsterr
 }
 
 func (db *StatsDB) Done() {
@@ -507,7 +300,7 @@ func (db *StatsDB) Done() {
 }
 
 func (db *StatsDB) serve() {
-	defer db.conn.Close()
+	defer db.store.Close()
 LOOP:
 	for {
 		select {
@@ -515,11 +308,15 @@ LOOP:
 			err := db.Push(&stat)
 			if err != nil {
 				log.Printf("error pushing to database %v", err)
+			} else {
+				db.hub.PublishStat(stat)
 			}
 		case bucket := <-db.newBucket:
 			err := db.PushBucket(&bucket)
 			if err != nil {
 				log.Printf("error pushing to database %v", err)
+			} else {
+				db.hub.PublishBucket(bucket)
 			}
 		case <-db.done:
 			break LOOP
@@ -533,37 +330,15 @@ func MakeBucketStream(db *StatsDB) websocket.Handler {
 		enc := json.NewEncoder(conn)
 		values := conn.Request().URL.Query()
 		printf("bucketstream. url: %v", conn.Request().URL)
-		var backtime int
-		var lastId int64
-		newData := false
-		for {
-			data, err := db.FetchBucket(values, 100)
-			if err != nil {
-				printf("error reading data from database: %v", err)
-				return
+		err := db.StreamBuckets(values, func(id int, v interface{}) error {
+			if err := enc.Encode(v); err != nil {
+				return err
 			}
-			for v := range data {
-				lastId = int64(v.Id)
-				newData = true
-				err = enc.Encode(&v)
-				if err != nil {
-					printf("error encoding data to client: %v", err)
-					return
-				}
-				fmt.Fprintf(conn, "\r\n")
-			}
-			if !newData {
-				backtime = backtime + 10
-				if backtime > 300 {
-					backtime = 300
-				}
-				printf("no more data to stream, wait a few seconds")
-				<-time.After(time.Minute + (time.Second * time.Duration(backtime)))
-			} else {
-				values.Set("id_start", fmt.Sprintf("%v", lastId))
-				backtime = 0
-			}
-			newData = false
+			_, err := fmt.Fprintf(conn, "\r\n")
+			return err
+		}, closedOnEOF(conn))
+		if err != nil {
+			printf("error streaming buckets: %v", err)
 		}
 	}
 	return streamBucket
@@ -586,37 +361,113 @@ func MakeStatsStream(db *StatsDB) websocket.Handler {
 			printf("starting stream to: %v at id: %v", conn.Request().RemoteAddr, lastId)
 		}
 		enc := json.NewEncoder(conn)
-		var backtime int
-		newData := false
+		err = db.StreamStats(int(lastId), func(id int, v interface{}) error {
+			if err := enc.Encode(v); err != nil {
+				return err
+			}
+			_, err := fmt.Fprintf(conn, "\r\n")
+			return err
+		}, closedOnEOF(reader))
+		if err != nil {
+			printf("error streaming stats: %v", err)
+		}
+	})
+}
+
+// closedOnEOF return a channel closed when the client stops sending data,
+// ie, when the connection is closed
+func closedOnEOF(r io.Reader) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, r)
+		close(done)
+	}()
+	return done
+}
+
+// MakeStatsEvents serve the stats stream as Server-Sent Events, the stream starts
+// after the id informed by the Last-Event-ID header or the lastid parameter.
+func MakeStatsEvents(db *StatsDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		lastId := req.Form.Get("lastid")
+		if len(req.Header.Get("Last-Event-ID")) > 0 {
+			lastId = req.Header.Get("Last-Event-ID")
+		}
+		id, _ := strconv.Atoi(lastId)
+		printf("starting events to: %v at id: %v", req.RemoteAddr, id)
+		serveEvents(w, req, func(send func(int, interface{}) error) error {
+			return db.StreamStats(id, send, req.Context().Done())
+		})
+	}
+}
+
+// MakeBucketEvents serve the bucket stream as Server-Sent Events, it accepts the
+// same parameters of the websocket stream. The Last-Event-ID header replaces id_start.
+func MakeBucketEvents(db *StatsDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if len(req.Header.Get("Last-Event-ID")) > 0 {
+			req.Form.Set("id_start", req.Header.Get("Last-Event-ID"))
+		}
+		printf("bucketevents. url: %v", req.URL)
+		serveEvents(w, req, func(send func(int, interface{}) error) error {
+			return db.StreamBuckets(req.Form, send, req.Context().Done())
+		})
+	}
+}
+
+// serveEvents write each value sent by stream as an event,
+// using the entry id as the event id
+func serveEvents(w http.ResponseWriter, req *http.Request, stream func(send func(int, interface{}) error) error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// the heartbeat keeps proxies from closing an idle stream,
+	// so the writes must be serialized
+	var lock sync.Mutex
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(EventsHeartbeat)
+		defer ticker.Stop()
 		for {
-			data, err := db.FetchAfterId(int(lastId), 100)
-			if err != nil {
-				printf("error reading data from database: %v", err)
+			select {
+			case <-ticker.C:
+				lock.Lock()
+				fmt.Fprintf(w, ": heartbeat\n\n")
+				flusher.Flush()
+				lock.Unlock()
+			case <-stop:
 				return
 			}
-			for v := range data {
-				lastId = int64(v.Id)
-				newData = true
-				err = enc.Encode(&v)
-				if err != nil {
-					printf("error encoding data to client: %v", err)
-					return
-				}
-				fmt.Fprintf(conn, "\r\n")
-			}
-			if !newData {
-				backtime = backtime + 10
-				if backtime > 300 {
-					backtime = 300
-				}
-				printf("no more data to stream, wait a few seconds")
-				<-time.After(time.Minute + (time.Second * time.Duration(backtime)))
-			} else {
-				backtime = 0
-			}
-			newData = false
 		}
+	}()
+
+	err := stream(func(id int, v interface{}) error {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if _, err := fmt.Fprintf(w, "id: %v\ndata: %s\n\n", id, buf); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
 	})
+	if err != nil {
+		printf("error streaming events to %v: %v", req.RemoteAddr, err)
+	}
 }
 
 type StatsHandler struct {
@@ -698,6 +549,8 @@ func (bh *BucketHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	} else if req.Method == "GET" {
 		if strings.HasSuffix(req.URL.Path, "/merge") {
 			bh.handleMergeGet(w, req)
+		} else if strings.HasSuffix(req.URL.Path, "/aggregate") {
+			bh.handleAggregate(w, req)
 		} else if strings.HasSuffix(req.URL.Path, "/count") {
 			bh.handleCount(w, req)
 		} else {
@@ -789,6 +642,33 @@ func (bh *BucketHandler) handleMergeGet(w http.ResponseWriter, req *http.Request
 	}
 }
 
+func (bh *BucketHandler) handleAggregate(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	query, err := ParseAggregateQuery(req.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	series, err := bh.db.Aggregate(query)
+	if err == ErrTooManyEntries {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "error fetching data from database", http.StatusInternalServerError)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	err = enc.Encode(series)
+	if err != nil {
+		printf("error encoding response: %v", err)
+	}
+}
+
 func (bh *BucketHandler) handleGet(w http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
 
@@ -835,10 +715,11 @@ func abort() bool {
 }
 
 func setupDatabase() (*StatsDB, error) {
-	if statsdb, err := NewStatsDB(*dbuser, *dbpasswd, *dbhost, *dbname); err != nil {
+	if store, err := OpenStorage(*storage); err != nil {
 		fatalf("error connecting to database. %v", 1, err)
 		return nil, err
 	} else {
+		statsdb := NewStatsDB(store)
 		if err := statsdb.CreateTables(); err != nil {
 			fatalf("error creating tables. %v", 1, err)
 			return statsdb, err
@@ -864,18 +745,35 @@ func allowAnyOriginHandshake(cfg *websocket.Config, req *http.Request) error {
 }
 
 func setupHttp() error {
-	if statsdb, err := NewStatsDB(*dbuser, *dbpasswd, *dbhost, *dbname); err != nil {
+	if store, err := OpenStorage(*storage); err != nil {
 		return err
 	} else {
+		statsdb := NewStatsDB(store)
+		if len(*retention) > 0 {
+			policy, err := LoadRetentionPolicy(*retention)
+			if err != nil {
+				return err
+			}
+			go statsdb.KeepRetention(policy)
+		}
+		if len(*statsdaddr) > 0 {
+			statsd := NewStatsdServer(statsdb.newBucket, *statsdprefix, *statsdflush)
+			if err := statsd.Listen(*statsdaddr); err != nil {
+				return err
+			}
+		}
 		handler := NewStatsHandler(statsdb)
 		http.Handle("/stats/stream", AllowAnyOrigin(MakeStatsStream(statsdb)))
+		http.Handle("/stats/events", MakeStatsEvents(statsdb))
 		http.Handle("/stats/new", handler)
 		http.Handle("/stats", handler)
 
 		bucketHandler := NewBucketHandler(statsdb)
 		http.Handle("/buckets/stream", AllowAnyOrigin(MakeBucketStream(statsdb)))
+		http.Handle("/buckets/events", MakeBucketEvents(statsdb))
 		http.Handle("/buckets/new", bucketHandler)
 		http.Handle("/buckets/merge", bucketHandler)
+		http.Handle("/buckets/aggregate", bucketHandler)
 		http.Handle("/buckets/count", bucketHandler)
 		http.Handle("/buckets", bucketHandler)
 		return nil
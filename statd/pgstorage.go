@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "github.com/lib/pq"
+	"time"
+)
+
+const (
+	StatsSelect           = `select s.id, s.system, s.subsystem, s.message, s.context, to_char(s.servertime, 'yyyy-mm-dd HH24:MI:SS.MS'), s.clienttime, s.error, si.info from stats s inner join stats_info si on s.id = si.stats_id `
+	BucketSelect          = `select b.id, to_char(b.servertime, 'yyyy-mm-dd HH24:MI:SS.MS'), b.bucket, b.info from buckets b where deleted = 'f' `
+	EntriesInBucketSelect = `select count(*) from buckets b where deleted = 'f'`
+	DeleteBucketSelect    = `update buckets set deleted = true where bucket = $1`
+)
+
+// PgStorage save the stats and buckets in a postgres database
+type PgStorage struct {
+	conn *sql.DB
+}
+
+func NewPgStorage(user, pwd, host, dbname string) (*PgStorage, error) {
+	printf("opening database connection to: %v with user %v database %v", host, user, dbname)
+	sqldb, err := sql.Open("postgres", fmt.Sprintf("user=%v dbname=%v password=%v host=%v sslmode=disable", user, dbname, pwd, host))
+	if err != nil {
+		return nil, err
+	}
+	return &PgStorage{conn: sqldb}, nil
+}
+
+func (db *PgStorage) PushBucket(bucket *Bucket) error {
+	return db.PushBucketAt(bucket, time.Now())
+}
+
+func (db *PgStorage) PushBucketAt(bucket *Bucket, at time.Time) error {
+	var lastid int
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	err := enc.Encode(bucket.Info)
+	if err != nil {
+		return err
+	}
+
+	err = db.conn.QueryRow("insert into buckets(bucket, servertime, info) values ($1, $2, $3) returning id",
+		bucket.Bucket, at, string(buf.Bytes())).Scan(&lastid)
+	if err != nil {
+		return err
+	}
+	bucket.Id = lastid
+	bucket.ServerTime = at.Format(DateTimeFormatFromServer)
+	return nil
+}
+
+func (db *PgStorage) Push(st *Stats) error {
+	var lastid int
+
+	now := time.Now()
+	err := db.conn.QueryRow("insert into stats(system, subsystem, message, context, servertime, clienttime, error) values ($1, $2, $3, $4, $5, $6, $7) returning id",
+		st.System, st.SubSystem, st.Message, st.Context, now, st.ClientTime, st.Error).Scan(&lastid)
+	if err != nil {
+		return err
+	}
+	st.Id = lastid
+	st.ServerTime = now.Format(DateTimeFormatFromServer)
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	err = enc.Encode(st.Info)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec("insert into stats_info(stats_id, info) values ($1, $2)",
+		lastid, string(buf.Bytes()))
+	return err
+}
+
+func (db *PgStorage) streamBuckets(result *sql.Rows, out chan Bucket) {
+	var err error
+	defer result.Close()
+LOOP:
+	for result.Next() && result.Err() == nil {
+		var bucket Bucket
+		var info string
+		bucket.Info = make(map[string]interface{})
+		err = result.Scan(&bucket.Id, &bucket.ServerTime, &bucket.Bucket, &info)
+		if err != nil {
+			printf("error scanning database: %v", err)
+			break LOOP
+		}
+		dec := json.NewDecoder(bytes.NewBufferString(info))
+		err = dec.Decode(&bucket.Info)
+		if err != nil {
+			printf("error decoding info from record: %v", err)
+			break LOOP
+		}
+		select {
+		case out <- bucket:
+		case <-time.After(time.Second * 10):
+			break LOOP
+		}
+	}
+	close(out)
+}
+
+func (db *PgStorage) streamRows(result *sql.Rows, out chan Stats) {
+	var err error
+	defer result.Close()
+LOOP:
+	for result.Next() && result.Err() == nil {
+		var stat Stats
+		var info string
+		stat.Info = make(map[string]string)
+		err = result.Scan(&stat.Id, &stat.System, &stat.SubSystem, &stat.Message, &stat.Context, &stat.ServerTime, &stat.ClientTime, &stat.Error, &info)
+		if err != nil {
+			printf("error scanning database: %v", err)
+			break
+		}
+		dec := json.NewDecoder(bytes.NewBufferString(info))
+		err = dec.Decode(&stat.Info)
+		if err != nil {
+			printf("error decoding info from record: %v", err)
+			break
+		}
+		select {
+		case out <- stat:
+		case <-time.After(time.Second * 10):
+			break LOOP
+		}
+	}
+	close(out)
+}
+
+func (db *PgStorage) FetchAfterId(lastId, size int) (<-chan Stats, error) {
+	result, err := db.conn.Query(StatsSelect+" where s.id > $1 order by s.context, s.servertime desc limit $2", lastId, size)
+	if err != nil {
+		printf("error running query: %v", err)
+		return nil, err
+	}
+	out := make(chan Stats, 0)
+	go db.streamRows(result, out)
+	return out, err
+}
+
+func (db *PgStorage) FetchSince(lastId, size int) (<-chan Stats, error) {
+	result, err := db.conn.Query(StatsSelect+" where s.id > $1 order by s.id asc limit $2", lastId, size)
+	if err != nil {
+		printf("error running query: %v", err)
+		return nil, err
+	}
+	out := make(chan Stats, 0)
+	go db.streamRows(result, out)
+	return out, err
+}
+
+func (db *PgStorage) Fetch(size int) (<-chan Stats, error) {
+	result, err := db.conn.Query(StatsSelect+" order by s.servertime desc, s.context limit $1", size)
+	if err != nil {
+		printf("error running query: %v", err)
+		return nil, err
+	}
+	out := make(chan Stats, 0)
+	go db.streamRows(result, out)
+	return out, err
+}
+
+func (db *PgStorage) FetchBucket(filter *BucketFilter) (<-chan Bucket, error) {
+	query := &bytes.Buffer{}
+	fmt.Fprintf(query, BucketSelect)
+	queryArgs, err := bucketWhere(query, filter, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.ById && filter.Desc {
+		fmt.Fprintf(query, " order by b.id desc ")
+	} else if filter.ById {
+		fmt.Fprintf(query, " order by b.id asc ")
+	} else if filter.Desc {
+		fmt.Fprintf(query, " order by b.servertime desc ")
+	} else {
+		fmt.Fprintf(query, " order by b.servertime asc ")
+	}
+
+	if filter.Limit > 0 {
+		fmt.Fprintf(query, " limit $%v", len(queryArgs)+1)
+		queryArgs = append(queryArgs, filter.Limit)
+	}
+
+	result, err := db.conn.Query(string(query.Bytes()), queryArgs...)
+
+	if err != nil {
+		printf("error running query: query: [%v] params: [%v] cause: %v", string(query.Bytes()), queryArgs, err)
+		return nil, err
+	}
+	out := make(chan Bucket, 0)
+	go db.streamBuckets(result, out)
+	return out, err
+}
+
+// bucketWhere write to query the conditions of filter, the query must already
+// have a where clause
+func bucketWhere(query *bytes.Buffer, filter *BucketFilter, queryArgs []interface{}) ([]interface{}, error) {
+	if len(filter.Prefix) > 0 {
+		fmt.Fprintf(query, " AND ( ")
+		first := true
+		for _, name := range filter.Prefix {
+			if !first {
+				fmt.Fprintf(query, " OR ")
+			}
+			fmt.Fprintf(query, " b.bucket like $%v ", len(queryArgs)+1)
+			queryArgs = append(queryArgs, name+"%")
+			first = false
+		}
+		fmt.Fprintf(query, ") ")
+	} else if len(filter.Bucket) > 0 {
+		first := true
+		fmt.Fprintf(query, " and b.bucket in (")
+		for _, v := range filter.Bucket {
+			if !first {
+				fmt.Fprintf(query, " ,")
+			}
+			fmt.Fprintf(query, " $%v", len(queryArgs)+1)
+			queryArgs = append(queryArgs, v)
+			first = false
+		}
+		fmt.Fprintf(query, " )")
+	} else if len(filter.EntryId) > 0 {
+		first := true
+		fmt.Fprintf(query, " and b.id in (")
+		for _, v := range filter.EntryId {
+			if !first {
+				fmt.Fprintf(query, " ,")
+			}
+			fmt.Fprintf(query, " $%v", len(queryArgs)+1)
+			queryArgs = append(queryArgs, v)
+			first = false
+		}
+		fmt.Fprintf(query, " )")
+	} else {
+		return nil, fmt.Errorf("you must provide at least one of: bucket, entryid, prefix")
+	}
+
+	for _, prefix := range filter.Exclude {
+		fmt.Fprintf(query, " and b.bucket not like $%v", len(queryArgs)+1)
+		queryArgs = append(queryArgs, prefix+"%")
+	}
+
+	if filter.IdStart > 0 {
+		fmt.Fprintf(query, " and b.id > $%v", len(queryArgs)+1)
+		queryArgs = append(queryArgs, filter.IdStart)
+	}
+
+	if filter.IdEnd > 0 {
+		fmt.Fprintf(query, " and b.id <= $%v", len(queryArgs)+1)
+		queryArgs = append(queryArgs, filter.IdEnd)
+	}
+
+	if !filter.TimeStart.IsZero() {
+		fmt.Fprintf(query, " and b.servertime > $%v", len(queryArgs)+1)
+		queryArgs = append(queryArgs, filter.TimeStart)
+	}
+
+	if !filter.TimeEnd.IsZero() {
+		fmt.Fprintf(query, " and b.servertime <= $%v", len(queryArgs)+1)
+		queryArgs = append(queryArgs, filter.TimeEnd)
+	}
+	return queryArgs, nil
+}
+
+func (db *PgStorage) EntriesInBucket(bucket string) (int, error) {
+	var out int
+	err := db.conn.QueryRow(EntriesInBucketSelect+" and b.bucket = $1", bucket).Scan(&out)
+	if err != nil {
+		printf("error running query: %v", err)
+	}
+	return out, err
+}
+
+func (db *PgStorage) DeleteBucket(bucket string) error {
+	_, err := db.conn.Exec(DeleteBucketSelect, bucket)
+	return err
+}
+
+func (db *PgStorage) PurgeBuckets(filter *BucketFilter) (int, error) {
+	query := &bytes.Buffer{}
+	fmt.Fprintf(query, "delete from buckets b where true ")
+	queryArgs, err := bucketWhere(query, filter, nil)
+	if err != nil {
+		return 0, err
+	}
+	return rowsAffected(db.conn.Exec(string(query.Bytes()), queryArgs...))
+}
+
+func (db *PgStorage) PurgeDeletedBuckets(before time.Time) (int, error) {
+	return rowsAffected(db.conn.Exec("delete from buckets where deleted = 't' and servertime < $1", before))
+}
+
+func (db *PgStorage) PurgeStats(system string, before time.Time) (int, error) {
+	where := " where servertime < $1"
+	args := []interface{}{before}
+	if len(system) > 0 {
+		where += " and system = $2"
+		args = append(args, system)
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("delete from stats_info where stats_id in (select id from stats"+where+")", args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	count, err := rowsAffected(tx.Exec("delete from stats"+where, args...))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+func rowsAffected(res sql.Result, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	return int(count), err
+}
+
+func (db *PgStorage) CreateTables() error {
+	cmds := []string{
+		`create sequence stats_seq increment 1 minvalue 1 maxvalue 9223372036854775807 start 1 cache 1`,
+		`create sequence stats_info_seq increment 1 minvalue 1 maxvalue 9223372036854775807 start 1 cache 1`,
+		`create sequence buckets_seq increment 1 minvalue 1 maxvalue 9223372036854775807 start 1 cache 1`,
+		`create table stats(id integer not null default nextval('stats_seq'), system char varying(255) not null, subsystem char varying(255), message char varying(255), context char varying(255), servertime timestamp not null, clienttime char varying(100), error boolean)`,
+		`create table stats_info(id integer not null default nextval('stats_info_seq'), stats_id integer, info text)`,
+		`create table buckets(id integer not null default nextval('buckets_seq'), bucket varchar(255), servertime timestamp not null, deleted boolean not null default 'f', info char text)`,
+	}
+	var firsterr error
+	for _, cmd := range cmds {
+		printf("running: %v", cmd)
+		_, err := db.conn.Exec(cmd)
+		if err != nil {
+			printf("error: %v", err)
+			if firsterr != nil {
+				firsterr = err
+			}
+		}
+	}
+	printf("done creating tables")
+	return firsterr
+}
+
+func (db *PgStorage) Close() error {
+	return db.conn.Close()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RollupPrefix is added to the name of the bucket that keeps the hourly
+	// aggregates of a rolled up bucket.
+	//
+	// The rollup entries are saved with the time of their hour, so their ids
+	// don't follow the server time and the pages read with IdStart
+	// must be sorted by id
+	RollupPrefix = "hourly/"
+
+	DefaultRetentionInterval = time.Hour
+)
+
+// RetentionPolicy configure how long the stats and the bucket entries are kept,
+// it is read from the json file informed by the -retention flag:
+//
+//	{
+//		"Every": "1h",
+//		"Buckets": [{"Prefix": "app.", "MaxAge": "720h", "RollupAfter": "48h"}],
+//		"Stats": [{"System": "", "MaxAge": "168h"}],
+//		"Deleted": "24h"
+//	}
+//
+// When the policies overlap, the shorter retention wins
+type RetentionPolicy struct {
+	// Every is the interval between the runs
+	Every   Duration
+	Buckets []BucketRetention
+	Stats   []StatsRetention
+	// Deleted is how long the deleted bucket entries are kept,
+	// zero keeps them until a bucket policy removes them
+	Deleted Duration
+}
+
+// BucketRetention applies to every bucket starting with Prefix, the rollups of
+// those buckets are only removed by a policy with a prefix starting with RollupPrefix
+type BucketRetention struct {
+	Prefix string
+	// MaxAge is how long the entries are kept, zero keeps them forever
+	MaxAge Duration
+	// RollupAfter replaces the entries older than it by their hourly aggregates,
+	// zero disables the rollup
+	RollupAfter Duration
+}
+
+// StatsRetention applies to the stats of System, an empty System selects every system
+type StatsRetention struct {
+	System string
+	MaxAge Duration
+}
+
+// Duration is a time.Duration read from json strings like "720h"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(buf []byte) error {
+	str, err := strconv.Unquote(string(buf))
+	if err != nil {
+		return fmt.Errorf("%v isn't a valid duration", string(buf))
+	}
+	d.Duration, err = time.ParseDuration(str)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+// LoadRetentionPolicy read the policy saved at filename
+func LoadRetentionPolicy(filename string) (*RetentionPolicy, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	policy := &RetentionPolicy{}
+	if err := json.NewDecoder(file).Decode(policy); err != nil {
+		return nil, fmt.Errorf("invalid retention policy %v. %v", filename, err)
+	}
+	if policy.Every.Duration <= 0 {
+		policy.Every.Duration = DefaultRetentionInterval
+	}
+	for _, b := range policy.Buckets {
+		if b.MaxAge.Duration > 0 && b.RollupAfter.Duration >= b.MaxAge.Duration {
+			return nil, fmt.Errorf("the rollup of %v must happen before the entries expire", b.Prefix)
+		}
+	}
+	return policy, nil
+}
+
+// KeepRetention apply the policy at every interval, it never returns
+func (db *StatsDB) KeepRetention(policy *RetentionPolicy) {
+	for {
+		if err := db.ApplyRetention(policy, time.Now()); err != nil {
+			printf("error applying retention policy: %v", err)
+		}
+		time.Sleep(policy.Every.Duration)
+	}
+}
+
+// ApplyRetention rollup and remove the data that expired at now
+func (db *StatsDB) ApplyRetention(policy *RetentionPolicy, now time.Time) error {
+	for _, b := range policy.Buckets {
+		if b.RollupAfter.Duration > 0 {
+			if err := db.Rollup(b.Prefix, now.Add(-b.RollupAfter.Duration)); err != nil {
+				return err
+			}
+		}
+		if b.MaxAge.Duration > 0 {
+			count, err := db.store.PurgeBuckets(retentionFilter(b.Prefix, now.Add(-b.MaxAge.Duration)))
+			if err != nil {
+				return err
+			}
+			printf("retention removed %v entries from buckets %v*", count, b.Prefix)
+		}
+	}
+	if policy.Deleted.Duration > 0 {
+		count, err := db.store.PurgeDeletedBuckets(now.Add(-policy.Deleted.Duration))
+		if err != nil {
+			return err
+		}
+		printf("retention removed %v deleted entries", count)
+	}
+	for _, s := range policy.Stats {
+		if s.MaxAge.Duration <= 0 {
+			continue
+		}
+		count, err := db.store.PurgeStats(s.System, now.Add(-s.MaxAge.Duration))
+		if err != nil {
+			return err
+		}
+		printf("retention removed %v stats from system [%v]", count, s.System)
+	}
+	return nil
+}
+
+// retentionFilter select the entries of the buckets starting with prefix saved
+// until the given time, the rollups are only selected when prefix starts with RollupPrefix
+func retentionFilter(prefix string, until time.Time) *BucketFilter {
+	filter := &BucketFilter{
+		Prefix:  []string{prefix},
+		TimeEnd: until,
+	}
+	if !strings.HasPrefix(prefix, RollupPrefix) {
+		filter.Exclude = []string{RollupPrefix}
+	}
+	return filter
+}
+
+// Rollup replace the entries of the buckets starting with prefix saved before
+// the hour of until by one entry per bucket and hour. The entry is saved in the
+// bucket RollupPrefix + name and each numeric field of Info is replaced by its
+// Count, Sum, Min, Max and Avg.
+//
+// The hours are rolled up one at a time and only the entries with a numeric
+// field are removed, the others are kept until the MaxAge of their policy.
+// Hours with more than MaxAggregateEntries entries are skipped.
+func (db *StatsDB) Rollup(prefix string, until time.Time) error {
+	// only complete hours are rolled up, otherwise the same hour
+	// would have many rollup entries
+	until = until.Truncate(time.Hour)
+	var after time.Time
+	for {
+		hour, ok, err := db.nextRollupHour(prefix, after, until)
+		if err != nil || !ok {
+			return err
+		}
+		err = db.rollupHour(prefix, hour)
+		if err == ErrTooManyEntries {
+			printf("retention skipped the rollup of buckets %v* at %v. %v", prefix, hour.Format(DateTimeFormatFromServer), err)
+		} else if err != nil {
+			return err
+		}
+		// TimeStart is exclusive
+		after = hour.Add(time.Hour - time.Microsecond)
+	}
+}
+
+// nextRollupHour return the hour of the oldest entry of the buckets starting with
+// prefix saved after the given time and before until
+func (db *StatsDB) nextRollupHour(prefix string, after, until time.Time) (time.Time, bool, error) {
+	// TimeEnd is inclusive and the entries at until belong to the next hour
+	filter := retentionFilter(prefix, until.Add(-time.Microsecond))
+	// the rollups are never rolled up again
+	filter.Exclude = []string{RollupPrefix}
+	filter.TimeStart = after
+	filter.Limit = 1
+	data, err := db.store.FetchBucket(filter)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	var oldest Bucket
+	found := false
+	for b := range data {
+		if !found {
+			oldest, found = b, true
+		}
+	}
+	if !found {
+		return time.Time{}, false, nil
+	}
+	at, err := time.ParseInLocation(DateTimeFormatFromServer, oldest.ServerTime, time.Local)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid server time %v on entry %v", oldest.ServerTime, oldest.Id)
+	}
+	return at.Truncate(time.Hour), true, nil
+}
+
+// rollupHour replace the entries of the buckets starting with prefix saved
+// inside the hour starting at hour
+func (db *StatsDB) rollupHour(prefix string, hour time.Time) error {
+	filter := retentionFilter(prefix, hour.Add(time.Hour-time.Microsecond))
+	filter.Exclude = []string{RollupPrefix}
+	filter.TimeStart = hour.Add(-time.Microsecond)
+	filter.Limit = 500
+	var ids []int
+	series, err := db.Aggregate(&AggregateQuery{
+		Filter:     filter,
+		Group:      time.Hour,
+		MaxEntries: MaxAggregateEntries,
+		Aggregated: func(id int) {
+			ids = append(ids, id)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]*Bucket)
+	for _, s := range series {
+		for _, p := range s.Points {
+			entry := entries[s.Bucket]
+			if entry == nil {
+				entry = &Bucket{
+					Bucket: RollupPrefix + s.Bucket,
+					Info:   make(map[string]interface{}),
+				}
+				entries[s.Bucket] = entry
+			}
+			entry.Info[s.Field] = map[string]interface{}{
+				"Count": p.Count,
+				"Sum":   p.Sum,
+				"Min":   p.Min,
+				"Max":   p.Max,
+				"Avg":   p.Avg,
+			}
+		}
+	}
+	for _, entry := range entries {
+		if err := db.store.PushBucketAt(entry, hour); err != nil {
+			return err
+		}
+	}
+
+	// only the entries that were aggregated are removed
+	count := 0
+	for len(ids) > 0 {
+		page := ids
+		if len(page) > filter.Limit {
+			page = page[:filter.Limit]
+		}
+		ids = ids[len(page):]
+		removed, err := db.store.PurgeBuckets(&BucketFilter{EntryId: page})
+		if err != nil {
+			return err
+		}
+		count += removed
+	}
+	printf("retention rolled up %v entries from buckets %v* into %v", count, prefix, len(entries))
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRollupAcrossRuns(t *testing.T) {
+	store := mustOpenKv()
+	db := NewStatsDB(store)
+	defer db.Done()
+
+	base := time.Date(2014, 1, 1, 10, 0, 0, 0, time.Local)
+	// more than one page per hour
+	for hour := 0; hour < 2; hour++ {
+		for i := 0; i < 600; i++ {
+			at := base.Add(time.Duration(hour)*time.Hour + time.Duration(i)*time.Second*5)
+			err := store.PushBucketAt(&Bucket{Bucket: "app.a", Info: map[string]interface{}{"v": float64(i)}}, at)
+			if err != nil {
+				t.Fatalf("error pushing bucket: %v", err)
+			}
+		}
+	}
+
+	// the empty prefix also selects the rollups
+	policy := &RetentionPolicy{
+		Buckets: []BucketRetention{{Prefix: "", RollupAfter: Duration{time.Hour}}},
+	}
+	if err := db.ApplyRetention(policy, base.Add(time.Hour*2)); err != nil {
+		t.Fatalf("error on the first run: %v", err)
+	}
+	if count, _ := store.EntriesInBucket("app.a"); count != 600 {
+		t.Errorf("the first run should rollup only the first hour. got %v entries left", count)
+	}
+	if err := db.ApplyRetention(policy, base.Add(time.Hour*3)); err != nil {
+		t.Fatalf("error on the second run: %v", err)
+	}
+	if count, _ := store.EntriesInBucket("app.a"); count != 0 {
+		t.Errorf("every entry should be rolled up. got %v entries left", count)
+	}
+
+	data, err := db.FetchBucket(url.Values{"bucket": {RollupPrefix + "app.a"}}, 0)
+	if err != nil {
+		t.Fatalf("error fetching rollups: %v", err)
+	}
+	var rollups []Bucket
+	for b := range data {
+		rollups = append(rollups, b)
+	}
+	if len(rollups) != 2 {
+		t.Fatalf("should have one rollup per hour. got %v", rollups)
+	}
+	for i, r := range rollups {
+		v := r.Info["v"].(map[string]interface{})
+		if v["Count"] != float64(600) || v["Sum"] != float64(599*600/2) {
+			t.Errorf("invalid rollup %v: %v", i, v)
+		}
+		if expected := base.Add(time.Duration(i) * time.Hour).Format(DateTimeFormatFromServer); r.ServerTime != expected {
+			t.Errorf("rollup %v should be at %v got %v", i, expected, r.ServerTime)
+		}
+	}
+}
+
+func TestRollupKeepsText(t *testing.T) {
+	store := mustOpenKv()
+	db := NewStatsDB(store)
+	defer db.Done()
+
+	base := time.Date(2014, 1, 1, 10, 0, 0, 0, time.Local)
+	store.PushBucketAt(&Bucket{Bucket: "app.a", Info: map[string]interface{}{"v": float64(1)}}, base)
+	store.PushBucketAt(&Bucket{Bucket: "app.a", Info: map[string]interface{}{"msg": "started"}}, base.Add(time.Minute))
+	store.PushBucketAt(&Bucket{Bucket: "app.a", Info: map[string]interface{}{"v": float64(2)}}, base.Add(time.Hour*5))
+
+	if err := db.Rollup("app.", base.Add(time.Hour*6)); err != nil {
+		t.Fatalf("error on rollup: %v", err)
+	}
+	if count, _ := store.EntriesInBucket("app.a"); count != 1 {
+		t.Errorf("only the entry without numbers should be kept. got %v entries", count)
+	}
+	if count, _ := store.EntriesInBucket(RollupPrefix + "app.a"); count != 2 {
+		t.Errorf("expecting 2 rollups got %v", count)
+	}
+}
+
+func TestRetentionPurge(t *testing.T) {
+	store := mustOpenKv()
+	db := NewStatsDB(store)
+	defer db.Done()
+
+	now := time.Now()
+	old := now.Add(-time.Hour * 48)
+	store.PushBucketAt(&Bucket{Bucket: "app.a", Info: map[string]interface{}{}}, old)
+	store.PushBucketAt(&Bucket{Bucket: "app.a", Info: map[string]interface{}{}}, now)
+	store.PushBucketAt(&Bucket{Bucket: RollupPrefix + "app.a", Info: map[string]interface{}{}}, old)
+	store.PushBucketAt(&Bucket{Bucket: "other", Info: map[string]interface{}{}}, old)
+	store.DeleteBucket("other")
+	store.Push(&Stats{System: "web"})
+	store.Push(&Stats{System: "db"})
+
+	policy := &RetentionPolicy{
+		Buckets: []BucketRetention{{Prefix: "app.", MaxAge: Duration{time.Hour}}},
+		Stats:   []StatsRetention{{System: "web", MaxAge: Duration{time.Hour}}},
+		Deleted: Duration{time.Hour},
+	}
+	if err := db.ApplyRetention(policy, now.Add(time.Hour*2)); err != nil {
+		t.Fatalf("error applying retention: %v", err)
+	}
+	if count, _ := store.EntriesInBucket("app.a"); count != 0 {
+		t.Errorf("app.a should be empty. got %v", count)
+	}
+	if count, _ := store.EntriesInBucket(RollupPrefix + "app.a"); count != 1 {
+		t.Errorf("the rollups should be kept. got %v", count)
+	}
+	if count, _ := store.PurgeDeletedBuckets(now); count != 0 {
+		t.Errorf("the deleted entries should be removed. got %v", count)
+	}
+	data, _ := store.Fetch(10)
+	for st := range data {
+		if st.System != "db" {
+			t.Errorf("only the db stats should be kept. got %v", st)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatsdCounter = "c"
+	StatsdTimer   = "ms"
+	StatsdGauge   = "g"
+	StatsdSet     = "s"
+	// StatsdHistogram is accepted as a timer
+	StatsdHistogram = "h"
+
+	// StatsdMaxPacket is the largest udp packet read by the listener
+	StatsdMaxPacket = 65536
+
+	// StatsdGaugeIdleFlushes is how many flushes a gauge is kept without
+	// changes, after that a delta starts again from zero
+	StatsdGaugeIdleFlushes = 60
+)
+
+// StatsdMetric is one value read from a statsd line
+type StatsdMetric struct {
+	Name  string
+	Type  string
+	Value float64
+	// Raw is the value as sent, used by the sets
+	Raw string
+	// Rate is the sample rate of counters and timers
+	Rate float64
+	// Delta is true for gauges sent with a sign, they change the current value
+	Delta bool
+}
+
+// ParseStatsdLine read the metrics of a line in the etsy statsd format:
+//
+//	name:value|type[|@rate][:value|type[|@rate]...]
+func ParseStatsdLine(line string) ([]StatsdMetric, error) {
+	sep := strings.Index(line, ":")
+	if sep <= 0 {
+		return nil, fmt.Errorf("missing the metric name")
+	}
+	name := strings.TrimSpace(line[:sep])
+	var out []StatsdMetric
+	for _, sample := range strings.Split(line[sep+1:], ":") {
+		parts := strings.Split(sample, "|")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("%v isn't a valid sample", sample)
+		}
+		m := StatsdMetric{
+			Name: name,
+			Type: parts[1],
+			Raw:  parts[0],
+			Rate: 1,
+		}
+		if m.Type == StatsdHistogram {
+			m.Type = StatsdTimer
+		}
+		switch m.Type {
+		case StatsdCounter, StatsdTimer, StatsdGauge:
+			var err error
+			if m.Value, err = strconv.ParseFloat(m.Raw, 64); err != nil {
+				return nil, fmt.Errorf("%v isn't a valid value", m.Raw)
+			}
+			m.Delta = m.Type == StatsdGauge && (m.Raw[0] == '+' || m.Raw[0] == '-')
+		case StatsdSet:
+		default:
+			return nil, fmt.Errorf("%v isn't a valid type", m.Type)
+		}
+		if len(parts) == 3 {
+			if !strings.HasPrefix(parts[2], "@") {
+				return nil, fmt.Errorf("%v isn't a valid sample rate", parts[2])
+			}
+			rate, err := strconv.ParseFloat(parts[2][1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("%v isn't a valid sample rate", parts[2])
+			}
+			m.Rate = rate
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// StatsdServer receives the metrics sent by statsd clients and, at every flush,
+// sends one entry per metric to the bucket Prefix + name.
+//
+// The Info of the entry depends on the type of the metric:
+//
+//	counter: Count and Rate (per second)
+//	timer: Count, Sum, Min, Max, Avg and P90
+//	gauge: Value
+//	set: Count of unique values
+type StatsdServer struct {
+	sync.Mutex
+	Prefix   string
+	Interval time.Duration
+
+	out      chan<- Bucket
+	addr     net.Addr
+	counters map[string]float64
+	timers   map[string]*statsdTimer
+	gauges   map[string]float64
+	// only the gauges updated since the last flush are sent
+	changed map[string]bool
+	// flushes since the last change of each gauge
+	idle map[string]int
+	sets map[string]map[string]bool
+}
+
+type statsdTimer struct {
+	count  float64
+	values []float64
+}
+
+func NewStatsdServer(out chan<- Bucket, prefix string, interval time.Duration) *StatsdServer {
+	return &StatsdServer{
+		Prefix:   prefix,
+		Interval: interval,
+		out:      out,
+		counters: make(map[string]float64),
+		timers:   make(map[string]*statsdTimer),
+		gauges:   make(map[string]float64),
+		changed:  make(map[string]bool),
+		idle:     make(map[string]int),
+		sets:     make(map[string]map[string]bool),
+	}
+}
+
+// Listen accept statsd packets over udp and lines over tcp at addr
+// and starts the flush loop. Both use the same port, even when addr
+// doesn't have one (ie, ":0")
+func (s *StatsdServer) Listen(addr string) error {
+	if s.Interval <= 0 {
+		return fmt.Errorf("%v isn't a valid statsd flush interval", s.Interval)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	pconn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	_, port, err := net.SplitHostPort(pconn.LocalAddr().String())
+	if err != nil {
+		pconn.Close()
+		return err
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		pconn.Close()
+		return err
+	}
+	s.addr = pconn.LocalAddr()
+	printf("starting statsd listener at: %v", s.addr)
+	go s.serveUDP(pconn)
+	go s.serveTCP(listener)
+	go s.flushLoop()
+	return nil
+}
+
+// Addr return the address used by Listen, or nil if the server isn't listening
+func (s *StatsdServer) Addr() net.Addr {
+	return s.addr
+}
+
+func (s *StatsdServer) serveUDP(conn net.PacketConn) {
+	defer conn.Close()
+	buf := make([]byte, StatsdMaxPacket)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			printf("error reading statsd packet: %v", err)
+			return
+		}
+		s.HandlePacket(string(buf[:n]))
+	}
+}
+
+func (s *StatsdServer) serveTCP(listener net.Listener) {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			printf("error accepting statsd connection: %v", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				s.HandleLine(scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				printf("error reading statsd connection from %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// HandlePacket process every line of a packet
+func (s *StatsdServer) HandlePacket(packet string) {
+	for _, line := range strings.Split(packet, "\n") {
+		s.HandleLine(line)
+	}
+}
+
+// HandleLine parse the line and add its metrics to the current interval,
+// invalid lines are logged and ignored
+func (s *StatsdServer) HandleLine(line string) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	metrics, err := ParseStatsdLine(line)
+	if err != nil {
+		printf("invalid statsd line %q: %v", line, err)
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, m := range metrics {
+		s.add(m)
+	}
+}
+
+func (s *StatsdServer) add(m StatsdMetric) {
+	switch m.Type {
+	case StatsdCounter:
+		s.counters[m.Name] += m.Value / m.Rate
+	case StatsdTimer:
+		t := s.timers[m.Name]
+		if t == nil {
+			t = &statsdTimer{}
+			s.timers[m.Name] = t
+		}
+		t.count += 1 / m.Rate
+		t.values = append(t.values, m.Value)
+	case StatsdGauge:
+		if m.Delta {
+			s.gauges[m.Name] += m.Value
+		} else {
+			s.gauges[m.Name] = m.Value
+		}
+		s.changed[m.Name] = true
+	case StatsdSet:
+		set := s.sets[m.Name]
+		if set == nil {
+			set = make(map[string]bool)
+			s.sets[m.Name] = set
+		}
+		set[m.Raw] = true
+	}
+}
+
+func (s *StatsdServer) flushLoop() {
+	for {
+		time.Sleep(s.Interval)
+		for _, entry := range s.Flush() {
+			s.out <- entry
+		}
+	}
+}
+
+// Flush return the entries of the current interval and starts a new one
+func (s *StatsdServer) Flush() []Bucket {
+	s.Lock()
+	defer s.Unlock()
+	var out []Bucket
+	entry := func(name string, info map[string]interface{}) {
+		out = append(out, Bucket{Bucket: s.Prefix + name, Info: info})
+	}
+	for name, count := range s.counters {
+		entry(name, map[string]interface{}{
+			"Count": count,
+			"Rate":  count / s.Interval.Seconds(),
+		})
+	}
+	for name, t := range s.timers {
+		w := &aggregateWindow{values: t.values}
+		a := w.aggregate([]float64{90})
+		entry(name, map[string]interface{}{
+			"Count": t.count,
+			"Sum":   a.Sum,
+			"Min":   a.Min,
+			"Max":   a.Max,
+			"Avg":   a.Avg,
+			"P90":   a.Percentiles["90"],
+		})
+	}
+	for name := range s.gauges {
+		if s.changed[name] {
+			entry(name, map[string]interface{}{
+				"Value": s.gauges[name],
+			})
+			s.idle[name] = 0
+			continue
+		}
+		s.idle[name]++
+		if s.idle[name] >= StatsdGaugeIdleFlushes {
+			delete(s.gauges, name)
+			delete(s.idle, name)
+		}
+	}
+	for name, set := range s.sets {
+		entry(name, map[string]interface{}{
+			"Count": len(set),
+		})
+	}
+	s.counters = make(map[string]float64)
+	s.timers = make(map[string]*statsdTimer)
+	s.changed = make(map[string]bool)
+	s.sets = make(map[string]map[string]bool)
+	return out
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	metric := func(name, typ string, value float64, raw string, rate float64, delta bool) StatsdMetric {
+		return StatsdMetric{Name: name, Type: typ, Value: value, Raw: raw, Rate: rate, Delta: delta}
+	}
+	for _, c := range []struct {
+		line     string
+		expected []StatsdMetric
+	}{
+		{"hits:1|c", []StatsdMetric{metric("hits", "c", 1, "1", 1, false)}},
+		{"hits:2|c|@0.5", []StatsdMetric{metric("hits", "c", 2, "2", 0.5, false)}},
+		{"lat:320|ms", []StatsdMetric{metric("lat", "ms", 320, "320", 1, false)}},
+		{"lat:1.5|ms|@0.1", []StatsdMetric{metric("lat", "ms", 1.5, "1.5", 0.1, false)}},
+		{"size:10|h", []StatsdMetric{metric("size", "ms", 10, "10", 1, false)}},
+		{"gau:5|g", []StatsdMetric{metric("gau", "g", 5, "5", 1, false)}},
+		{"gau:+5|g", []StatsdMetric{metric("gau", "g", 5, "+5", 1, true)}},
+		{"gau:-5|g", []StatsdMetric{metric("gau", "g", -5, "-5", 1, true)}},
+		{"users:bob|s", []StatsdMetric{metric("users", "s", 0, "bob", 1, false)}},
+		{"multi:1|c:2|ms|@0.5", []StatsdMetric{
+			metric("multi", "c", 1, "1", 1, false),
+			metric("multi", "ms", 2, "2", 0.5, false),
+		}},
+		{" name :1|c", []StatsdMetric{metric("name", "c", 1, "1", 1, false)}},
+	} {
+		got, err := ParseStatsdLine(c.line)
+		if err != nil {
+			t.Errorf("error parsing %q: %v", c.line, err)
+		} else if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("line %q: expecting %v got %v", c.line, c.expected, got)
+		}
+	}
+
+	for _, line := range []string{
+		"",
+		"hits",
+		":1|c",
+		"hits:1",
+		"hits:1|x",
+		"hits:a|c",
+		"hits:1|c|0.5",
+		"hits:1|c|@0",
+		"hits:1|c|@2",
+		"hits:1|c|@x",
+		"hits:1|c|@0.5|x",
+		"hits:1|c:",
+	} {
+		if _, err := ParseStatsdLine(line); err == nil {
+			t.Errorf("%q should be invalid", line)
+		}
+	}
+}
+
+func flushed(s *StatsdServer) map[string]map[string]interface{} {
+	out := make(map[string]map[string]interface{})
+	for _, b := range s.Flush() {
+		out[b.Bucket] = b.Info
+	}
+	return out
+}
+
+func TestStatsdFlush(t *testing.T) {
+	s := NewStatsdServer(nil, "statsd.", time.Second*10)
+	s.HandlePacket("hits:1|c\nhits:2|c|@0.5\nbad line\n\nlat:10|ms:20|ms|@0.5\nlat:30|ms")
+	s.HandlePacket("gau:5|g\ngau:-2|g\nusers:a|s\nusers:b|s\nusers:a|s")
+
+	expected := map[string]map[string]interface{}{
+		"statsd.hits":  {"Count": 5.0, "Rate": 0.5},
+		"statsd.lat":   {"Count": 4.0, "Sum": 60.0, "Min": 10.0, "Max": 30.0, "Avg": 20.0, "P90": 30.0},
+		"statsd.gau":   {"Value": 3.0},
+		"statsd.users": {"Count": 2},
+	}
+	if got := flushed(s); !reflect.DeepEqual(got, expected) {
+		t.Errorf("invalid flush.\nexpecting %v\ngot       %v", expected, got)
+	}
+
+	// counters, timers and sets start again, gauges keep their value
+	if got := flushed(s); len(got) != 0 {
+		t.Errorf("nothing should be sent without new metrics. got %v", got)
+	}
+	s.HandlePacket("gau:+1|g\nhits:1|c\nusers:c|s")
+	expected = map[string]map[string]interface{}{
+		"statsd.hits":  {"Count": 1.0, "Rate": 0.1},
+		"statsd.gau":   {"Value": 4.0},
+		"statsd.users": {"Count": 1},
+	}
+	if got := flushed(s); !reflect.DeepEqual(got, expected) {
+		t.Errorf("invalid second flush.\nexpecting %v\ngot       %v", expected, got)
+	}
+
+	// idle gauges are forgotten
+	for i := 0; i < StatsdGaugeIdleFlushes; i++ {
+		s.Flush()
+	}
+	s.HandlePacket("gau:+1|g")
+	expected = map[string]map[string]interface{}{
+		"statsd.gau": {"Value": 1.0},
+	}
+	if got := flushed(s); !reflect.DeepEqual(got, expected) {
+		t.Errorf("invalid flush after idle.\nexpecting %v\ngot       %v", expected, got)
+	}
+}
+
+func TestStatsdInvalidInterval(t *testing.T) {
+	s := NewStatsdServer(nil, "statsd.", 0)
+	if err := s.Listen("127.0.0.1:0"); err == nil {
+		t.Errorf("a zero interval should be rejected")
+	}
+}
+
+func TestStatsdListen(t *testing.T) {
+	out := make(chan Bucket, 10)
+	s := NewStatsdServer(out, "statsd.", time.Millisecond*100)
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := s.Addr().String()
+
+	udp, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("error dialing udp: %v", err)
+	}
+	defer udp.Close()
+	fmt.Fprintf(udp, "hits:1|c")
+
+	tcp, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("tcp should use the same port of udp: %v", err)
+	}
+	fmt.Fprintf(tcp, "hits:2|c\n")
+	tcp.Close()
+
+	total := 0.0
+	timeout := time.After(time.Second * 5)
+	for total < 3 {
+		select {
+		case b := <-out:
+			if b.Bucket != "statsd.hits" {
+				t.Fatalf("invalid bucket: %v", b)
+			}
+			total += b.Info["Count"].(float64)
+		case <-timeout:
+			t.Fatalf("should receive 3 hits from udp and tcp. got %v", total)
+		}
+	}
+}
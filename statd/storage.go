@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage is implemented by the backends used to save stats and buckets
+type Storage interface {
+	// Push save a new stat, the id and server time are set by the storage
+	Push(st *Stats) error
+	// PushBucket save a new entry of a bucket, the id and server time are set by the storage
+	PushBucket(bucket *Bucket) error
+	// PushBucketAt works like PushBucket but the entry is saved with the given server time
+	PushBucketAt(bucket *Bucket, at time.Time) error
+	// FetchAfterId return up to size stats with an id greater than lastId
+	FetchAfterId(lastId, size int) (<-chan Stats, error)
+	// FetchSince works like FetchAfterId but the stats are sorted by id,
+	// so it can be used to read the stats in pages
+	FetchSince(lastId, size int) (<-chan Stats, error)
+	// Fetch return the last size stats
+	Fetch(size int) (<-chan Stats, error)
+	// FetchBucket return the bucket entries selected by filter
+	FetchBucket(filter *BucketFilter) (<-chan Bucket, error)
+	// EntriesInBucket count the entries of bucket that weren't deleted
+	EntriesInBucket(bucket string) (int, error)
+	// DeleteBucket remove every entry of bucket
+	DeleteBucket(bucket string) error
+	// PurgeBuckets remove the entries, deleted or not, selected by filter,
+	// the sort and limit of the filter are ignored
+	PurgeBuckets(filter *BucketFilter) (int, error)
+	// PurgeDeletedBuckets remove the deleted entries saved before the given time
+	PurgeDeletedBuckets(before time.Time) (int, error)
+	// PurgeStats remove the stats of system saved before the given time,
+	// an empty system selects every system
+	PurgeStats(system string, before time.Time) (int, error)
+	// CreateTables initialize the storage
+	CreateTables() error
+	Close() error
+}
+
+// BucketFilter select the entries returned by Storage.FetchBucket,
+// only one of Prefix, Bucket or EntryId is used, in that order.
+//
+// Zero values mean no limit
+type BucketFilter struct {
+	Prefix  []string
+	Bucket  []string
+	EntryId []int
+	// Exclude skip the buckets starting with any of the prefixes
+	Exclude []string
+	// IdStart and TimeStart are exclusive, IdEnd and TimeEnd are inclusive
+	IdStart   int
+	IdEnd     int
+	TimeStart time.Time
+	TimeEnd   time.Time
+	// Desc sort the entries by the newest first
+	Desc bool
+	// ById sort the entries by id instead of the server time, it must be used
+	// when the pages are read using IdStart since the rollups are saved
+	// with an old server time
+	ById  bool
+	Limit int
+}
+
+// Select check if the entry id of the bucket name is selected by the
+// Prefix, Bucket, EntryId and Exclude of the filter
+func (f *BucketFilter) Select(name string, id int) bool {
+	for _, prefix := range f.Exclude {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	if len(f.Prefix) > 0 {
+		for _, prefix := range f.Prefix {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+	} else if len(f.Bucket) > 0 {
+		for _, bucket := range f.Bucket {
+			if bucket == name {
+				return true
+			}
+		}
+	} else {
+		for _, entry := range f.EntryId {
+			if entry == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pastEnd check if an entry with the given id and server time comes
+// after the IdEnd or the TimeEnd of the filter
+func (f *BucketFilter) pastEnd(id int, at time.Time) bool {
+	return (f.IdEnd > 0 && id > f.IdEnd) || (!f.TimeEnd.IsZero() && at.After(f.TimeEnd))
+}
+
+// ParseBucketFilter read the filter from the query string args,
+// maxSize is used when args doesn't have a pagesize
+func ParseBucketFilter(args url.Values, maxSize int) (*BucketFilter, error) {
+	filter := &BucketFilter{}
+	if _, has := args["prefix"]; has {
+		filter.Prefix = args["prefix"]
+	} else if _, has := args["bucket"]; has {
+		filter.Bucket = args["bucket"]
+	} else if _, has := args["entryid"]; has {
+		for _, v := range args["entryid"] {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("%v isn't a valid entryid", v)
+			}
+			filter.EntryId = append(filter.EntryId, id)
+		}
+	} else {
+		return nil, fmt.Errorf("you must provide at least one of: bucket, entryid, prefix")
+	}
+
+	var err error
+	if len(args.Get("id_start")) > 0 {
+		if filter.IdStart, err = strconv.Atoi(args.Get("id_start")); err != nil {
+			return nil, fmt.Errorf("%v isn't a valid id", args.Get("id_start"))
+		}
+	}
+	if len(args.Get("id_end")) > 0 {
+		if filter.IdEnd, err = strconv.Atoi(args.Get("id_end")); err != nil {
+			return nil, fmt.Errorf("%v isn't a valid id", args.Get("id_end"))
+		}
+	}
+	if len(args.Get("time_start")) > 0 {
+		if filter.TimeStart, err = parseTime(args.Get("time_start")); err != nil {
+			return nil, err
+		}
+	}
+	if len(args.Get("time_end")) > 0 {
+		if filter.TimeEnd, err = parseTime(args.Get("time_end")); err != nil {
+			return nil, err
+		}
+	}
+
+	filter.Desc = args.Get("sort") == "desc"
+
+	if args.Get("pagesize") != "" {
+		var pagesize int64
+		if pagesize, err = strconv.ParseInt(args.Get("pagesize"), 10, 32); err != nil {
+			pagesize = 0
+		}
+		maxSize = int(pagesize)
+	}
+
+	if maxSize > 500 {
+		maxSize = 500
+	} else if maxSize <= 0 {
+		maxSize = 100
+	}
+	filter.Limit = maxSize
+	return filter, nil
+}
+
+// parseTime read val in the format used by the server or
+// as a duration relative to now
+func parseTime(val string) (time.Time, error) {
+	t, err := time.ParseInLocation(DateTimeFormatFromServer, val, time.Local)
+	if err != nil {
+		// not a time, maybe a duration
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return t, fmt.Errorf("%v isn't a valid date or valid duration", val)
+		}
+		t = time.Now().Add(dur)
+	}
+	return t, nil
+}
+
+// OpenStorage open the backend with the given name
+func OpenStorage(name string) (Storage, error) {
+	switch name {
+	case "postgres":
+		return NewPgStorage(*dbuser, *dbpasswd, *dbhost, *dbname)
+	case "kv":
+		return NewKvStorage(*kvfile)
+	}
+	return nil, fmt.Errorf("unknown storage %v, use postgres or kv", name)
+}